@@ -0,0 +1,344 @@
+//go:build !js
+
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"assette/apiclient"
+	"assette/db"
+	"assette/mail"
+	"assette/models"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	verificationTokenTTL  = 24 * time.Hour
+	passwordResetTokenTTL = time.Hour
+
+	// Verification emails sent to a user per window, since anyone can ask
+	// for one to be sent
+	maxVerificationEmails = 3
+	verificationWindow    = time.Hour
+)
+
+// verificationToken is stored in the verify-tokens namespace. The email is
+// kept so that a link sent before the user changed address cannot verify the
+// new one.
+type verificationToken struct {
+	UserID string `json:"userId"`
+	Email  string `json:"email"`
+}
+
+type passwordResetToken struct {
+	UserID string `json:"userId"`
+}
+
+// credentials are kept apart from models.User so that password hashes never
+// leave the server
+type credentials struct {
+	PasswordHash string `json:"passwordHash"`
+}
+
+// SendVerification emails a verification link to the address of a user.
+// Users are created before anyone signs in, so anyone can ask for a link,
+// but only maxVerificationEmails per user every verificationWindow.
+func SendVerification(client *db.Client, sender mail.Sender, baseURL string) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request apiclient.VerificationRequest
+		if err := decodeBody(r, &request); err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		userData, err := client.Get(r.Context(), "users", request.UserID)
+		if err != nil {
+			if err == db.ErrKeyNotFound {
+				WriteError(w, r, NewProblem(http.StatusNotFound, CodeNotFound, "User not found"))
+				return
+			}
+			WriteError(w, r, err)
+			return
+		}
+
+		var user models.User
+		if err := json.Unmarshal(userData, &user); err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		if user.EmailVerified {
+			WriteError(w, r, NewProblem(http.StatusConflict, CodeConflict, "Email already verified"))
+			return
+		}
+
+		sent, err := client.Incr(r.Context(), "verification-emails", request.UserID, verificationWindow)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		if sent > maxVerificationEmails {
+			w.Header().Set("Retry-After", strconv.Itoa(int(verificationWindow/time.Second)))
+			WriteError(w, r, NewProblem(http.StatusTooManyRequests, CodeRateLimited, "Too many verification emails sent to this user, try again later"))
+			return
+		}
+
+		token, err := newToken()
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		record := verificationToken{UserID: request.UserID, Email: user.Email}
+		if err := client.PutWithTTL(r.Context(), "verify-tokens", hashToken(token), record, verificationTokenTTL); err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		err = sender.Send(r.Context(), mail.Message{
+			To:      user.Email,
+			Subject: "Verify your email address",
+			Body: fmt.Sprintf("Hello %s,\n\nConfirm your email address by opening the link below:\n\n%s\n\nThe link expires in 24 hours.\n",
+				user.Name, link(baseURL, "/verify", token)),
+		})
+		if err != nil {
+			WriteError(w, r, NewProblem(http.StatusBadGateway, CodeMailFailed, "Failed to send verification email").WithCause(err))
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// VerifyEmail marks the email of a user as verified using a token sent by
+// SendVerification
+func VerifyEmail(client *db.Client) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request apiclient.TokenRequest
+		if err := decodeBody(r, &request); err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		tokenData, err := client.Take(r.Context(), "verify-tokens", hashToken(request.Token))
+		if err != nil {
+			if err == db.ErrKeyNotFound {
+				WriteError(w, r, NewProblem(http.StatusBadRequest, CodeInvalidToken, "Invalid or expired token"))
+				return
+			}
+			WriteError(w, r, err)
+			return
+		}
+
+		var record verificationToken
+		if err := json.Unmarshal(tokenData, &record); err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		// Retried on concurrent changes, which must not be overwritten, as long
+		// as the address is still the one the link was sent to
+		var before, user models.User
+		for {
+			stored, err := client.GetRecord(r.Context(), "users", record.UserID)
+			if err != nil {
+				if err == db.ErrKeyNotFound {
+					WriteError(w, r, NewProblem(http.StatusBadRequest, CodeInvalidToken, "Invalid or expired token"))
+					return
+				}
+				WriteError(w, r, err)
+				return
+			}
+
+			user = models.User{}
+			if err := json.Unmarshal(stored.Value, &user); err != nil {
+				WriteError(w, r, err)
+				return
+			}
+
+			if !strings.EqualFold(user.Email, record.Email) {
+				WriteError(w, r, NewProblem(http.StatusBadRequest, CodeInvalidToken, "Invalid or expired token"))
+				return
+			}
+
+			before = user
+			user.EmailVerified = true
+			_, err = client.CompareAndPutIndexed(r.Context(), "users", record.UserID, user, stored.ModRevision, UsersByEmail)
+			if err == nil {
+				break
+			}
+			if err != db.ErrRevisionMismatch {
+				WriteError(w, r, err)
+				return
+			}
+		}
+
+		// Only the owner of the address can follow the link
+		recordAudit(r.WithContext(WithUserID(r.Context(), record.UserID)), client, AuditUpdate, "users", record.UserID, before, user)
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// RequestPasswordReset emails a password reset link to the user owning the
+// given address. It answers the same way whether or not the address is known,
+// so it cannot be used to discover accounts.
+func RequestPasswordReset(client *db.Client, sender mail.Sender, baseURL string) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request apiclient.PasswordResetRequest
+		if err := decodeBody(r, &request); err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		userID, user, err := findUserByEmail(r.Context(), client, request.Email)
+		if err != nil {
+			if err != db.ErrKeyNotFound {
+				WriteError(w, r, err)
+				return
+			}
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+
+		// Anyone can set the address of a new user, so only addresses proven
+		// to belong to the user get a link to set their password
+		if !user.EmailVerified {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+
+		token, err := newToken()
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		record := passwordResetToken{UserID: userID}
+		if err := client.PutWithTTL(r.Context(), "reset-tokens", hashToken(token), record, passwordResetTokenTTL); err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		err = sender.Send(r.Context(), mail.Message{
+			To:      user.Email,
+			Subject: "Reset your password",
+			Body: fmt.Sprintf("Hello %s,\n\nChoose a new password by opening the link below:\n\n%s\n\nThe link expires in 1 hour. If you did not ask for a reset, ignore this email.\n",
+				user.Name, link(baseURL, "/reset", token)),
+		})
+		if err != nil {
+			log.Printf("[ERROR] sending password reset email: %v", err)
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// ResetPassword sets a new password using a token sent by RequestPasswordReset
+func ResetPassword(client *db.Client) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request apiclient.PasswordRequest
+		if err := decodeBody(r, &request); err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		if err := models.ValidatePassword(request.Password); err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		tokenData, err := client.Take(r.Context(), "reset-tokens", hashToken(request.Token))
+		if err != nil {
+			if err == db.ErrKeyNotFound {
+				WriteError(w, r, NewProblem(http.StatusBadRequest, CodeInvalidToken, "Invalid or expired token"))
+				return
+			}
+			WriteError(w, r, err)
+			return
+		}
+
+		var record passwordResetToken
+		if err := json.Unmarshal(tokenData, &record); err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		if err := setPassword(r.Context(), client, record.UserID, request.Password); err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		// Whoever knew the previous password is signed out
+		if err := endSessions(r.Context(), client, record.UserID); err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		// The password hash itself is never recorded
+		recordAudit(r.WithContext(WithUserID(r.Context(), record.UserID)), client, AuditUpdate, "credentials", record.UserID, nil, map[string]string{"password": "changed"})
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func setPassword(ctx context.Context, client *db.Client, userID string, password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	return client.Put(ctx, "credentials", userID, credentials{PasswordHash: string(hash)})
+}
+
+// findUserByEmail returns db.ErrKeyNotFound when no user has the address
+func findUserByEmail(ctx context.Context, client *db.Client, email string) (string, models.User, error) {
+	if email == "" {
+		return "", models.User{}, db.ErrKeyNotFound
+	}
+
+	userID, err := client.Lookup(ctx, UsersByEmail, normalizeEmail(email))
+	if err != nil {
+		return "", models.User{}, err
+	}
+
+	userData, err := client.Get(ctx, "users", userID)
+	if err != nil {
+		return "", models.User{}, err
+	}
+
+	var user models.User
+	err = json.Unmarshal(userData, &user)
+	return userID, user, err
+}
+
+// newToken returns a random URL-safe token. Only its hash is stored, so a
+// leaked etcd snapshot does not expose usable tokens.
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func link(baseURL string, path string, token string) string {
+	return strings.TrimSuffix(baseURL, "/") + path + "?token=" + url.QueryEscape(token)
+}
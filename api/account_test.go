@@ -0,0 +1,243 @@
+//go:build !js
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"assette/db"
+	"assette/mail"
+	"assette/models"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// recordingSender keeps sent messages in memory
+type recordingSender struct {
+	mu       sync.Mutex
+	messages []mail.Message
+}
+
+func (s *recordingSender) Send(ctx context.Context, msg mail.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = append(s.messages, msg)
+	return nil
+}
+
+// tokenFromMessage extracts the token of the link contained in a message
+func tokenFromMessage(t *testing.T, msg mail.Message) string {
+	t.Helper()
+
+	for _, field := range strings.Fields(msg.Body) {
+		if u, err := url.Parse(field); err == nil && u.Query().Get("token") != "" {
+			return u.Query().Get("token")
+		}
+	}
+
+	t.Fatalf("No token link found in message:\n%s", msg.Body)
+	return ""
+}
+
+func postJSON(handler func(w http.ResponseWriter, r *http.Request), path string, body interface{}) *httptest.ResponseRecorder {
+	data, _ := json.Marshal(body)
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewBuffer(data))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	handler(w, req)
+	return w
+}
+
+func TestEmailVerification(t *testing.T) {
+	_, _, client := newTestDB(t)
+	sender := &recordingSender{}
+
+	userID := "user:verify"
+	err := client.Put(context.Background(), "users", userID, models.User{Name: "John", Email: "john@example.com"})
+	if err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+
+	w := postJSON(SendVerification(client, sender, "http://localhost:8000"), "/api/account/verification", map[string]string{"userId": userID})
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Expected status %d, got %d", http.StatusAccepted, w.Code)
+	}
+
+	if len(sender.messages) != 1 || sender.messages[0].To != "john@example.com" {
+		t.Fatalf("Expected one message to john@example.com, got %+v", sender.messages)
+	}
+	token := tokenFromMessage(t, sender.messages[0])
+
+	w = postJSON(VerifyEmail(client), "/api/account/verify", map[string]string{"token": token})
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected status %d, got %d", http.StatusNoContent, w.Code)
+	}
+
+	data, err := client.Get(context.Background(), "users", userID)
+	if err != nil {
+		t.Fatalf("Failed to get user: %v", err)
+	}
+	var user models.User
+	json.Unmarshal(data, &user)
+	if !user.EmailVerified {
+		t.Error("Expected email to be verified")
+	}
+
+	// Tokens are single use
+	w = postJSON(VerifyEmail(client), "/api/account/verify", map[string]string{"token": token})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d when reusing token, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+// TestEmailVerificationLimit checks that no one can have the server send
+// verification emails to a user without bounds
+func TestEmailVerificationLimit(t *testing.T) {
+	_, _, client := newTestDB(t)
+	sender := &recordingSender{}
+
+	client.Put(context.Background(), "users", "user:a", models.User{Name: "John", Email: "john@example.com"})
+	client.Put(context.Background(), "users", "user:b", models.User{Name: "Jane", Email: "jane@example.com"})
+
+	for i := 0; i < maxVerificationEmails; i++ {
+		if w := postJSON(SendVerification(client, sender, "http://localhost:8000"), "/api/account/verification", map[string]string{"userId": "user:a"}); w.Code != http.StatusAccepted {
+			t.Fatalf("Expected status %d, got %d", http.StatusAccepted, w.Code)
+		}
+	}
+	w := postJSON(SendVerification(client, sender, "http://localhost:8000"), "/api/account/verification", map[string]string{"userId": "user:a"})
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected status %d with Retry-After past the limit, got %d", http.StatusTooManyRequests, w.Code)
+	}
+	if len(sender.messages) != maxVerificationEmails {
+		t.Errorf("Expected %d messages, got %d", maxVerificationEmails, len(sender.messages))
+	}
+
+	// Other users have their own limit
+	if w := postJSON(SendVerification(client, sender, "http://localhost:8000"), "/api/account/verification", map[string]string{"userId": "user:b"}); w.Code != http.StatusAccepted {
+		t.Errorf("Expected status %d for another user, got %d", http.StatusAccepted, w.Code)
+	}
+}
+
+func TestEmailVerificationAfterEmailChange(t *testing.T) {
+	_, _, client := newTestDB(t)
+	sender := &recordingSender{}
+
+	userID := "user:changed"
+	client.Put(context.Background(), "users", userID, models.User{Name: "John", Email: "old@example.com"})
+
+	postJSON(SendVerification(client, sender, "http://localhost:8000"), "/api/account/verification", map[string]string{"userId": userID})
+	token := tokenFromMessage(t, sender.messages[0])
+
+	client.Put(context.Background(), "users", userID, models.User{Name: "John", Email: "new@example.com"})
+
+	w := postJSON(VerifyEmail(client), "/api/account/verify", map[string]string{"token": token})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for token issued to old address, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestUpdateUserResetsVerification(t *testing.T) {
+	_, _, client := newTestDB(t)
+
+	userID := "user:reverify"
+	client.Put(context.Background(), "users", userID, models.User{Name: "John", Email: "john@example.com", EmailVerified: true})
+
+	body, _ := json.Marshal(models.User{Name: "John", Email: "other@example.com", EmailVerified: true})
+	req := httptest.NewRequest(http.MethodPut, "/api/users/"+userID, bytes.NewBuffer(body))
+	req.SetPathValue("id", userID)
+	w := httptest.NewRecorder()
+	UpdateUser(client)(w, req)
+
+	var response map[string]interface{}
+	json.NewDecoder(w.Body).Decode(&response)
+	if response["emailVerified"] != false {
+		t.Errorf("Expected changed email to be unverified, got %v", response["emailVerified"])
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	_, _, client := newTestDB(t)
+	sender := &recordingSender{}
+
+	userID := "user:reset"
+	client.PutIndexed(context.Background(), "users", userID, models.User{Name: "Jane", Email: "jane@example.com", EmailVerified: true}, UsersByEmail)
+
+	// Anyone can create a user with an address, so unverified ones get nothing
+	client.PutIndexed(context.Background(), "users", "user:unverified", models.User{Name: "John", Email: "john@example.com"}, UsersByEmail)
+	w := postJSON(RequestPasswordReset(client, sender, "http://localhost:8000"), "/api/account/password-reset", map[string]string{"email": "john@example.com"})
+	if w.Code != http.StatusAccepted || len(sender.messages) != 0 {
+		t.Fatalf("Expected status %d and no message for an unverified address, got %d and %d", http.StatusAccepted, w.Code, len(sender.messages))
+	}
+
+	w = postJSON(RequestPasswordReset(client, sender, "http://localhost:8000"), "/api/account/password-reset", map[string]string{"email": "Jane@Example.com"})
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Expected status %d, got %d", http.StatusAccepted, w.Code)
+	}
+	if len(sender.messages) != 1 {
+		t.Fatalf("Expected one message, got %d", len(sender.messages))
+	}
+	token := tokenFromMessage(t, sender.messages[0])
+
+	w = postJSON(ResetPassword(client), "/api/account/password", map[string]string{"token": token, "password": "short"})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for short password, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	session, err := startSession(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/auth/login", nil), client, userID, models.RoleUser, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w = postJSON(ResetPassword(client), "/api/account/password", map[string]string{"token": token, "password": "correct horse battery"})
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected status %d, got %d", http.StatusNoContent, w.Code)
+	}
+	if _, err := client.Get(context.Background(), "sessions", session.ID); err != db.ErrKeyNotFound {
+		t.Errorf("Expected the sessions of the user to end, got %v", err)
+	}
+
+	data, err := client.Get(context.Background(), "credentials", userID)
+	if err != nil {
+		t.Fatalf("Failed to get credentials: %v", err)
+	}
+	var creds credentials
+	json.Unmarshal(data, &creds)
+	if bcrypt.CompareHashAndPassword([]byte(creds.PasswordHash), []byte("correct horse battery")) != nil {
+		t.Error("Stored hash does not match new password")
+	}
+
+	w = postJSON(ResetPassword(client), "/api/account/password", map[string]string{"token": token, "password": "another password"})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d when reusing token, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestPasswordResetUnknownEmail(t *testing.T) {
+	_, _, client := newTestDB(t)
+	sender := &recordingSender{}
+
+	w := postJSON(RequestPasswordReset(client, sender, "http://localhost:8000"), "/api/account/password-reset", map[string]string{"email": "nobody@example.com"})
+	if w.Code != http.StatusAccepted {
+		t.Errorf("Expected status %d for unknown email, got %d", http.StatusAccepted, w.Code)
+	}
+	if len(sender.messages) != 0 {
+		t.Errorf("Expected no message for unknown email, got %d", len(sender.messages))
+	}
+}
+
+func TestVerifyEmailInvalidToken(t *testing.T) {
+	_, _, client := newTestDB(t)
+
+	w := postJSON(VerifyEmail(client), "/api/account/verify", map[string]string{"token": "bogus"})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
@@ -0,0 +1,159 @@
+//go:build !js
+
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"assette/apiclient"
+	"assette/codec"
+	"assette/models"
+	"assette/totp"
+)
+
+// TestAPIClient runs the typed client against the handler, in each of the
+// formats it can use
+func TestAPIClient(t *testing.T) {
+	for _, mediaType := range codec.MediaTypes() {
+		t.Run(mediaType, func(t *testing.T) {
+			_, _, client := newTestDB(t)
+			server := httptest.NewServer(NewHandler(Config{Client: client, Mailer: &recordingSender{}}))
+			defer server.Close()
+
+			c := apiclient.New(server.URL)
+			c.MediaType = mediaType
+			ctx := context.Background()
+
+			if message, err := c.Message(ctx); err != nil || message == "" {
+				t.Fatalf("Expected a message, got %q: %v", message, err)
+			}
+
+			user, err := c.CreateUser(ctx, models.User{Name: "Ada", Email: "ada@example.com"}, apiclient.IdempotencyKey("create-ada"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user.ID == "" || user.Name != "Ada" || user.Role != models.RoleUser || user.Version == 0 || user.CreatedAt.IsZero() {
+				t.Errorf("Unexpected created user %+v", user)
+			}
+			if err := c.SendVerification(ctx, user.ID); err != nil {
+				t.Error(err)
+			}
+
+			_, err = c.CreateUser(ctx, models.User{Name: "Ada", Email: "bad"})
+			var invalid models.ValidationErrors
+			if !errors.As(err, &invalid) || invalid.ByField()["email"] == "" {
+				t.Errorf("Expected an email field error, got %v", err)
+			}
+
+			// Lookups by email and changes to users need a session, here an
+			// admin's
+			serverURL, _ := url.Parse(server.URL)
+			c.HTTPClient.Jar.SetCookies(serverURL, newAdminSession(t, client).Result().Cookies())
+			found, err := c.FindUser(ctx, "ADA@example.com")
+			if err != nil || found.ID != user.ID {
+				t.Errorf("Expected to find %s by email, got %+v: %v", user.ID, found, err)
+			}
+			var problem *apiclient.Error
+			if _, err := c.FindUser(ctx, "nobody@example.com"); !errors.As(err, &problem) || problem.Status != http.StatusNotFound {
+				t.Errorf("Expected 404 for an unknown email, got %v", err)
+			}
+
+			patched, err := c.PatchUser(ctx, user.ID, map[string]interface{}{"name": "Ada Lovelace"}, apiclient.IfVersion(user.Version))
+			if err != nil || patched.Name != "Ada Lovelace" || patched.Email != "ada@example.com" {
+				t.Fatalf("Unexpected patched user %+v: %v", patched, err)
+			}
+			_, err = c.UpdateUser(ctx, user.ID, models.User{Name: "Ada", Email: "ada@example.com"}, apiclient.IfVersion(user.Version))
+			if !errors.As(err, &problem) || problem.Status != http.StatusPreconditionFailed {
+				t.Errorf("Expected 412 for a stale version, got %v", err)
+			}
+
+			history, err := c.UserHistory(ctx, user.ID, 0)
+			if err != nil || history.Count != 2 {
+				t.Fatalf("Expected 2 versions, got %+v: %v", history, err)
+			}
+			reverted, err := c.RevertUser(ctx, user.ID, history.Versions[1].Version)
+			if err != nil || reverted.Name != "Ada" {
+				t.Errorf("Unexpected reverted user %+v: %v", reverted, err)
+			}
+
+			results, err := c.BulkUsers(ctx, apiclient.BulkRequest{Operations: []apiclient.BulkOperation{
+				{Op: apiclient.BulkCreate, User: &models.User{Name: "Grace", Email: "grace@example.com"}},
+				{Op: apiclient.BulkDelete, ID: "user:missing"},
+			}})
+			if err != nil || results.Succeeded != 1 || results.Results[1].Error == nil || results.Results[1].Error.Status != http.StatusNotFound {
+				t.Errorf("Unexpected bulk results %+v: %v", results, err)
+			}
+
+			imported, err := c.ImportUsers(ctx, []byte("name,email\nAlan,alan@example.com\n"), apiclient.ImportOptions{Format: "csv", DryRun: true})
+			if err != nil || !imported.DryRun || imported.Created != 1 {
+				t.Errorf("Unexpected import results %+v: %v", imported, err)
+			}
+
+			list, err := c.ListUsers(ctx, apiclient.ListOptions{Sort: []string{"name"}, Fields: []string{"name"}})
+			if err != nil || list.Count != 3 || list.Users[0].Name != "Ada" || list.Users[0].Email != "" {
+				t.Errorf("Unexpected users %+v: %v", list, err)
+			}
+
+			if err := c.DeleteUser(ctx, user.ID); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := c.GetUser(ctx, user.ID); !errors.As(err, &problem) || problem.Status != http.StatusNotFound {
+				t.Errorf("Expected 404 for a trashed user, got %v", err)
+			}
+			if restored, err := c.RestoreUser(ctx, user.ID); err != nil || restored.ID != user.ID {
+				t.Errorf("Unexpected restored user %+v: %v", restored, err)
+			}
+		})
+	}
+}
+
+// TestAPIClientLogin runs the login and two-factor flows through the typed
+// client, which keeps the session cookie
+func TestAPIClientLogin(t *testing.T) {
+	_, _, client := newTestDB(t)
+	newTestAccount(t, client, models.User{Name: "Grace", Email: "grace@example.com", Role: models.RoleAdmin}, "correct horse battery")
+	server := httptest.NewServer(NewHandler(Config{Client: client}))
+	defer server.Close()
+
+	c := apiclient.New(server.URL)
+	ctx := context.Background()
+
+	var problem *apiclient.Error
+	if _, err := c.Login(ctx, "grace@example.com", "wrong password"); !errors.As(err, &problem) || problem.Status != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 for a wrong password, got %v", err)
+	}
+
+	result, err := c.Login(ctx, "grace@example.com", "correct horse battery")
+	if err != nil || result.MFARequired || !result.MFAEnrollmentRequired || result.UserID != "user:grace@example.com" {
+		t.Fatalf("Unexpected login %+v: %v", result, err)
+	}
+
+	enrollment, err := c.EnrollTOTP(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _ := totp.Code(enrollment.Secret, totp.Counter(time.Now())-1)
+	codes, err := c.ConfirmTOTP(ctx, code)
+	if err != nil || len(codes) != recoveryCodeCount {
+		t.Fatalf("Expected %d recovery codes, got %v: %v", recoveryCodeCount, codes, err)
+	}
+	if err := c.Logout(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err = c.Login(ctx, "grace@example.com", "correct horse battery")
+	if err != nil || !result.MFARequired || result.MFAToken == "" {
+		t.Fatalf("Expected a second factor challenge, got %+v: %v", result, err)
+	}
+	code, _ = totp.Code(enrollment.Secret, totp.Counter(time.Now()))
+	session, err := c.LoginTOTP(ctx, result.MFAToken, code)
+	if err != nil || !session.MFA || session.Role != models.RoleAdmin {
+		t.Errorf("Unexpected session %+v: %v", session, err)
+	}
+}
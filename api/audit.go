@@ -0,0 +1,213 @@
+//go:build !js
+
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"assette/db"
+)
+
+const (
+	AuditCreate  = "create"
+	AuditUpdate  = "update"
+	AuditDelete  = "delete"
+	AuditRestore = "restore"
+	AuditPurge   = "purge"
+)
+
+// AuditEntry records a single data mutation. Entries are written once to the
+// audit namespace and never updated.
+type AuditEntry struct {
+	ID        string                 `json:"id"`
+	Timestamp time.Time              `json:"timestamp"`
+	Actor     string                 `json:"actor"`
+	Action    string                 `json:"action"`
+	Target    string                 `json:"target"`
+	RequestID string                 `json:"requestId,omitempty"`
+	Before    json.RawMessage        `json:"before,omitempty"`
+	After     json.RawMessage        `json:"after,omitempty"`
+	Changes   map[string]AuditChange `json:"changes,omitempty"`
+}
+
+// AuditChange is the before and after value of a changed field
+type AuditChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// recordAudit stores an audit entry for a mutation of key in namespace made
+// while serving r. before is nil for creations and after is nil for
+// deletions. Never pass secrets: redact them before calling. Failures are
+// logged rather than failing the request, as the mutation already happened.
+func recordAudit(r *http.Request, client *db.Client, action string, namespace string, key string, before interface{}, after interface{}) {
+	actor, ok := UserIDFromContext(r.Context())
+	if !ok {
+		actor = "anonymous"
+	}
+
+	now := time.Now().UTC()
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+
+	entry := AuditEntry{
+		// Zero-padded so that entry IDs sort chronologically
+		ID:        auditKey(now) + "-" + hex.EncodeToString(suffix),
+		Timestamp: now,
+		Actor:     actor,
+		Action:    action,
+		Target:    namespace + "/" + key,
+		RequestID: RequestIDFromContext(r.Context()),
+		Before:    marshalAuditValue(before),
+		After:     marshalAuditValue(after),
+	}
+	entry.Changes = diffAuditValues(entry.Before, entry.After)
+
+	if err := client.Create(r.Context(), "audit", entry.ID, entry); err != nil {
+		log.Printf("[ERROR] recording audit entry for %s %s: %v", action, entry.Target, err)
+	}
+}
+
+// Bounds of the entries ListAudit returns at once
+const (
+	DefaultAuditLimit = 100
+	MaxAuditLimit     = 1000
+)
+
+// errAuditPageFull stops the scan of ListAudit once a page is full
+var errAuditPageFull = errors.New("audit page full")
+
+// ListAudit returns audit entries in chronological order. Entries can be
+// filtered with the actor, target (prefix, e.g. "users/"), since and until
+// (RFC 3339) query parameters, and are returned limit at a time,
+// DefaultAuditLimit unless given. When more entries match, next holds the
+// value of the after parameter that returns them.
+//
+// Entry IDs start with their time, so the entries of a period are read as a
+// range of keys rather than the whole namespace.
+func ListAudit(client *db.Client) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		actor := query.Get("actor")
+		target := query.Get("target")
+
+		var start, end string
+		if value := query.Get("since"); value != "" {
+			since, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				WriteError(w, r, NewProblem(http.StatusBadRequest, CodeInvalidParameter, "Invalid since parameter"))
+				return
+			}
+			start = auditKey(since)
+		}
+		if value := query.Get("until"); value != "" {
+			until, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				WriteError(w, r, NewProblem(http.StatusBadRequest, CodeInvalidParameter, "Invalid until parameter"))
+				return
+			}
+			end = auditKey(until.Add(time.Nanosecond))
+		}
+		if after := query.Get("after"); after != "" && after >= start {
+			start = after + "\x00"
+		}
+
+		limit := DefaultAuditLimit
+		if value := query.Get("limit"); value != "" {
+			var err error
+			if limit, err = strconv.Atoi(value); err != nil || limit < 0 || limit > MaxAuditLimit {
+				WriteError(w, r, NewProblem(http.StatusBadRequest, CodeInvalidParameter, fmt.Sprintf("The limit parameter must be between 1 and %d", MaxAuditLimit)))
+				return
+			}
+			if limit == 0 {
+				limit = DefaultAuditLimit
+			}
+		}
+
+		entries := []AuditEntry{}
+		next := ""
+		err := client.ScanRange(r.Context(), "audit", start, end, int64(limit)+1, func(record db.Record) error {
+			var entry AuditEntry
+			if err := json.Unmarshal(record.Value, &entry); err != nil {
+				return nil // Skip malformed entries
+			}
+			if actor != "" && entry.Actor != actor {
+				return nil
+			}
+			if target != "" && !strings.HasPrefix(entry.Target, target) {
+				return nil
+			}
+
+			if len(entries) == limit {
+				next = entries[len(entries)-1].ID
+				return errAuditPageFull
+			}
+			entries = append(entries, entry)
+			return nil
+		})
+		if err != nil && err != errAuditPageFull {
+			WriteError(w, r, err)
+			return
+		}
+
+		response := map[string]interface{}{
+			"entries": entries,
+			"count":   len(entries),
+		}
+		if next != "" {
+			response["next"] = next
+		}
+		respond(w, r, http.StatusOK, response)
+	}
+}
+
+// auditKey is the start of the IDs of the entries recorded at t
+func auditKey(t time.Time) string {
+	return fmt.Sprintf("%019d", t.UnixNano())
+}
+
+func marshalAuditValue(value interface{}) json.RawMessage {
+	if value == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// diffAuditValues compares the top-level fields of two JSON objects
+func diffAuditValues(before json.RawMessage, after json.RawMessage) map[string]AuditChange {
+	var beforeFields, afterFields map[string]interface{}
+	json.Unmarshal(before, &beforeFields)
+	json.Unmarshal(after, &afterFields)
+
+	changes := map[string]AuditChange{}
+	for field, value := range beforeFields {
+		if next, ok := afterFields[field]; !ok || !reflect.DeepEqual(value, next) {
+			changes[field] = AuditChange{Before: value, After: afterFields[field]}
+		}
+	}
+	for field, value := range afterFields {
+		if _, ok := beforeFields[field]; !ok {
+			changes[field] = AuditChange{Before: nil, After: value}
+		}
+	}
+
+	if len(changes) == 0 {
+		return nil
+	}
+	return changes
+}
@@ -0,0 +1,180 @@
+//go:build !js
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"assette/db"
+	"assette/models"
+)
+
+// asUser runs handler as the given user with a fixed request ID
+func asUser(handler func(w http.ResponseWriter, r *http.Request), userID string, req *http.Request) *httptest.ResponseRecorder {
+	ctx := WithUserID(req.Context(), userID)
+	ctx = context.WithValue(ctx, requestIDKey, "req-"+userID)
+
+	w := httptest.NewRecorder()
+	handler(w, req.WithContext(ctx))
+	return w
+}
+
+func listAudit(t *testing.T, client *db.Client, query url.Values) []AuditEntry {
+	t.Helper()
+
+	entries, _ := listAuditPage(t, client, query)
+	return entries
+}
+
+// listAuditPage also returns the cursor of the next page
+func listAuditPage(t *testing.T, client *db.Client, query url.Values) ([]AuditEntry, string) {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, "/api/admin/audit?"+query.Encode(), nil)
+	w := httptest.NewRecorder()
+	ListAudit(client)(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+
+	var response struct {
+		Entries []AuditEntry `json:"entries"`
+		Count   int          `json:"count"`
+		Next    string       `json:"next"`
+	}
+	json.NewDecoder(w.Body).Decode(&response)
+	return response.Entries, response.Next
+}
+
+func TestAuditUserMutations(t *testing.T) {
+	_, _, client := newTestDB(t)
+
+	body, _ := json.Marshal(models.User{Name: "John", Email: "john@example.com"})
+	w := asUser(CreateUser(client), "user:admin", httptest.NewRequest(http.MethodPost, "/api/users", bytes.NewBuffer(body)))
+
+	var created map[string]interface{}
+	json.NewDecoder(w.Body).Decode(&created)
+	userID := created["id"].(string)
+
+	body, _ = json.Marshal(models.User{Name: "Johnny", Email: "john@example.com"})
+	req := httptest.NewRequest(http.MethodPut, "/api/users/"+userID, bytes.NewBuffer(body))
+	req.SetPathValue("id", userID)
+	asUser(UpdateUser(client), "user:editor", req)
+
+	req = httptest.NewRequest(http.MethodDelete, "/api/users/"+userID, nil)
+	req.SetPathValue("id", userID)
+	asUser(DeleteUser(client, DefaultTrashRetention), "user:admin", req)
+
+	entries := listAudit(t, client, url.Values{"target": {"users/" + userID}})
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 audit entries, got %d", len(entries))
+	}
+
+	for i, action := range []string{AuditCreate, AuditUpdate, AuditDelete} {
+		if entries[i].Action != action {
+			t.Errorf("Entry %d: expected action %s, got %s", i, action, entries[i].Action)
+		}
+	}
+
+	update := entries[1]
+	if update.Actor != "user:editor" || update.RequestID != "req-user:editor" {
+		t.Errorf("Unexpected actor or request ID on update: %+v", update)
+	}
+	if change, ok := update.Changes["name"]; !ok || change.Before != "John" || change.After != "Johnny" {
+		t.Errorf("Expected name change John -> Johnny, got %+v", update.Changes)
+	}
+	if _, ok := update.Changes["email"]; ok {
+		t.Error("Expected unchanged email to be left out of changes")
+	}
+
+	if entries[2].Before == nil || entries[2].After != nil {
+		t.Errorf("Expected delete entry to keep only the previous value, got %+v", entries[2])
+	}
+}
+
+func TestListAuditFilters(t *testing.T) {
+	_, _, client := newTestDB(t)
+
+	for i, actor := range []string{"user:1", "user:2", "user:1"} {
+		body, _ := json.Marshal(models.User{Name: actor, Email: fmt.Sprintf("user%d@example.com", i)})
+		asUser(CreateUser(client), actor, httptest.NewRequest(http.MethodPost, "/api/users", bytes.NewBuffer(body)))
+	}
+
+	if entries := listAudit(t, client, url.Values{"actor": {"user:1"}}); len(entries) != 2 {
+		t.Errorf("Expected 2 entries for user:1, got %d", len(entries))
+	}
+
+	if entries := listAudit(t, client, url.Values{"limit": {"1"}}); len(entries) != 1 {
+		t.Errorf("Expected limit to cap entries, got %d", len(entries))
+	}
+
+	future := time.Now().Add(time.Hour).Format(time.RFC3339)
+	if entries := listAudit(t, client, url.Values{"since": {future}}); len(entries) != 0 {
+		t.Errorf("Expected no entries since the future, got %d", len(entries))
+	}
+
+	past := time.Now().Add(-time.Hour).Format(time.RFC3339)
+	if entries := listAudit(t, client, url.Values{"since": {past}, "until": {future}}); len(entries) != 3 {
+		t.Errorf("Expected 3 entries within range, got %d", len(entries))
+	}
+
+	for _, query := range []string{"since=yesterday", "limit=-1", fmt.Sprintf("limit=%d", MaxAuditLimit+1)} {
+		req := httptest.NewRequest(http.MethodGet, "/api/admin/audit?"+query, nil)
+		w := httptest.NewRecorder()
+		ListAudit(client)(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status %d for %s, got %d", http.StatusBadRequest, query, w.Code)
+		}
+	}
+}
+
+func TestListAuditPages(t *testing.T) {
+	_, _, client := newTestDB(t)
+
+	for i, actor := range []string{"user:1", "user:2", "user:1", "user:1"} {
+		body, _ := json.Marshal(models.User{Name: actor, Email: fmt.Sprintf("user%d@example.com", i)})
+		asUser(CreateUser(client), actor, httptest.NewRequest(http.MethodPost, "/api/users", bytes.NewBuffer(body)))
+	}
+
+	first, next := listAuditPage(t, client, url.Values{"actor": {"user:1"}, "limit": {"2"}})
+	if len(first) != 2 || next != first[1].ID {
+		t.Fatalf("Expected 2 entries and a cursor to the next page, got %d and %q", len(first), next)
+	}
+
+	second, next := listAuditPage(t, client, url.Values{"actor": {"user:1"}, "limit": {"2"}, "after": {next}})
+	if len(second) != 1 || next != "" {
+		t.Fatalf("Expected the last entry and no cursor, got %d and %q", len(second), next)
+	}
+	if second[0].ID <= first[1].ID || second[0].Actor != "user:1" {
+		t.Errorf("Expected the entry after %s, got %+v", first[1].ID, second[0])
+	}
+
+	// The last page is not followed by an empty one
+	if _, next := listAuditPage(t, client, url.Values{"limit": {"4"}}); next != "" {
+		t.Errorf("Expected no cursor when every entry fits, got %q", next)
+	}
+}
+
+func TestDiffAuditValues(t *testing.T) {
+	changes := diffAuditValues(json.RawMessage(`{"a":1,"b":2}`), json.RawMessage(`{"a":1,"c":3}`))
+
+	if len(changes) != 2 {
+		t.Fatalf("Expected 2 changes, got %+v", changes)
+	}
+	if changes["b"].After != nil || changes["c"].Before != nil {
+		t.Errorf("Unexpected changes %+v", changes)
+	}
+
+	if changes := diffAuditValues(nil, nil); changes != nil {
+		t.Errorf("Expected no changes, got %+v", changes)
+	}
+}
@@ -0,0 +1,381 @@
+//go:build !js
+
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"assette/apiclient"
+	"assette/db"
+	"assette/models"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	sessionCookie           = "session"
+	sessionTTL              = 24 * time.Hour
+	pendingLoginTTL         = 5 * time.Minute
+	maxSecondFactorAttempts = 5
+)
+
+// dummyHash is compared against when the email is unknown or the user has no
+// password, so that failed logins take the same time whether or not the
+// account exists. It hashes a random secret so that no password matches it.
+var dummyHash = func() []byte {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	hash, _ := bcrypt.GenerateFromPassword([]byte(hex.EncodeToString(secret)), bcrypt.DefaultCost)
+	return hash
+}()
+
+// Session is stored in the sessions namespace under the hash of the session
+// cookie. MFA records whether the second factor was checked at login.
+type Session struct {
+	ID     string `json:"-"`
+	UserID string `json:"userId"`
+	Role   string `json:"role"`
+	MFA    bool   `json:"mfa"`
+}
+
+// pendingLogin is a login waiting for its second factor
+type pendingLogin struct {
+	UserID string `json:"userId"`
+}
+
+// SessionFromContext returns the session of the authenticated user, if any
+func SessionFromContext(ctx context.Context) (Session, bool) {
+	session, ok := ctx.Value(sessionKey).(Session)
+	return session, ok
+}
+
+// Authenticate loads the session named by the session cookie and attaches it
+// to the request context. Requests without a valid session pass through
+// anonymously; use RequireRole to restrict access.
+func Authenticate(client *db.Client) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			cookie, err := r.Cookie(sessionCookie)
+			if err != nil || cookie.Value == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			id := hashToken(cookie.Value)
+			data, err := client.Get(r.Context(), "sessions", id)
+			if err != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			var session Session
+			if err := json.Unmarshal(data, &session); err != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			session.ID = id
+
+			ctx := context.WithValue(r.Context(), sessionKey, session)
+			ctx = WithUserID(ctx, session.UserID)
+			// Records written during the request are attributed to the user
+			ctx = db.WithActor(ctx, session.UserID)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// RequireRole only lets through users with the given role. For roles where
+// models.RequiresMFA holds, the session must also have passed a second
+// factor at login.
+func RequireRole(role string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			session, ok := SessionFromContext(r.Context())
+			if !ok {
+				WriteError(w, r, NewProblem(http.StatusUnauthorized, CodeUnauthenticated, "Authentication required"))
+				return
+			}
+
+			if session.Role != role {
+				WriteError(w, r, NewProblem(http.StatusForbidden, CodeForbidden, "Your role does not allow this request"))
+				return
+			}
+
+			if models.RequiresMFA(role) && !session.MFA {
+				WriteError(w, r, NewProblem(http.StatusForbidden, CodeMFARequired, "Two-factor authentication required"))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireSelf only lets through the user named by the id path value, and
+// users with the given role as RequireRole would
+func RequireSelf(role string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			session, ok := SessionFromContext(r.Context())
+			if ok && session.UserID == r.PathValue("id") {
+				next.ServeHTTP(w, r)
+				return
+			}
+			RequireRole(role)(next).ServeHTTP(w, r)
+		})
+	}
+}
+
+// Login checks an email and password. Users with two-factor authentication
+// enabled get a short-lived token to complete the login with LoginTOTP;
+// everyone else gets a session cookie straight away.
+func Login(client *db.Client) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request apiclient.LoginRequest
+		if err := decodeBody(r, &request); err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		userID, user, err := findUserByEmail(r.Context(), client, request.Email)
+		if err != nil && err != db.ErrKeyNotFound {
+			WriteError(w, r, err)
+			return
+		}
+
+		hash, found := dummyHash, false
+		if err == nil {
+			data, err := client.Get(r.Context(), "credentials", userID)
+			if err != nil && err != db.ErrKeyNotFound {
+				WriteError(w, r, err)
+				return
+			}
+
+			var creds credentials
+			if err == nil && json.Unmarshal(data, &creds) == nil && creds.PasswordHash != "" {
+				hash, found = []byte(creds.PasswordHash), true
+			}
+		}
+
+		// Compared even without credentials so that the response takes as long
+		if bcrypt.CompareHashAndPassword(hash, []byte(request.Password)) != nil || !found {
+			WriteError(w, r, NewProblem(http.StatusUnauthorized, CodeInvalidCredentials, "Invalid email or password"))
+			return
+		}
+
+		record, err := loadTOTP(r.Context(), client, userID)
+		if err != nil && err != db.ErrKeyNotFound {
+			WriteError(w, r, err)
+			return
+		}
+
+		if err == nil && record.Enabled {
+			token, err := newToken()
+			if err != nil {
+				WriteError(w, r, err)
+				return
+			}
+
+			if err := client.PutWithTTL(r.Context(), "mfa-pending", hashToken(token), pendingLogin{UserID: userID}, pendingLoginTTL); err != nil {
+				WriteError(w, r, err)
+				return
+			}
+
+			respond(w, r, http.StatusOK, apiclient.MFAChallenge{MFARequired: true, MFAToken: token})
+			return
+		}
+
+		session, err := startSession(w, r, client, userID, user.Role, false)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		writeSession(w, r, session)
+	}
+}
+
+// LoginTOTP completes a login started by Login with a one-time password or a
+// recovery code
+func LoginTOTP(client *db.Client) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request apiclient.TOTPLoginRequest
+		if err := decodeBody(r, &request); err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		pendingKey := hashToken(request.MFAToken)
+		data, err := client.Get(r.Context(), "mfa-pending", pendingKey)
+		if err != nil {
+			if err == db.ErrKeyNotFound {
+				WriteError(w, r, NewProblem(http.StatusUnauthorized, CodeInvalidToken, "Invalid or expired login"))
+				return
+			}
+			WriteError(w, r, err)
+			return
+		}
+
+		var pending pendingLogin
+		if err := json.Unmarshal(data, &pending); err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		// Give up on the pending login after a few wrong codes
+		attempts, err := client.Incr(r.Context(), "mfa-attempts", pendingKey, pendingLoginTTL)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		if attempts > maxSecondFactorAttempts {
+			client.Delete(r.Context(), "mfa-pending", pendingKey)
+			WriteError(w, r, NewProblem(http.StatusUnauthorized, CodeTooManyAttempts, "Too many attempts, please log in again"))
+			return
+		}
+
+		ok, err := checkSecondFactor(r.Context(), client, pending.UserID, request.Code)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		if !ok {
+			WriteError(w, r, NewProblem(http.StatusUnauthorized, CodeInvalidCode, "Invalid code"))
+			return
+		}
+
+		if _, err := client.Take(r.Context(), "mfa-pending", pendingKey); err != nil {
+			// Completed concurrently by another request
+			WriteError(w, r, NewProblem(http.StatusUnauthorized, CodeInvalidToken, "Invalid or expired login"))
+			return
+		}
+
+		userData, err := client.Get(r.Context(), "users", pending.UserID)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		var user models.User
+		if err := json.Unmarshal(userData, &user); err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		session, err := startSession(w, r, client, pending.UserID, user.Role, true)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		writeSession(w, r, session)
+	}
+}
+
+// Logout ends the current session
+func Logout(client *db.Client) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if session, ok := SessionFromContext(r.Context()); ok {
+			if _, err := client.Delete(r.Context(), "sessions", session.ID); err != nil {
+				WriteError(w, r, err)
+				return
+			}
+			client.Delete(r.Context(), userSessions, userSessionKey(session.UserID, session.ID))
+		}
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     sessionCookie,
+			Value:    "",
+			Path:     "/",
+			MaxAge:   -1,
+			HttpOnly: true,
+			Secure:   isHTTPS(r),
+			SameSite: http.SameSiteLaxMode,
+		})
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func startSession(w http.ResponseWriter, r *http.Request, client *db.Client, userID string, role string, mfa bool) (Session, error) {
+	token, err := newToken()
+	if err != nil {
+		return Session{}, err
+	}
+
+	session := Session{
+		ID:     hashToken(token),
+		UserID: userID,
+		Role:   role,
+		MFA:    mfa,
+	}
+	if err := client.PutWithTTL(r.Context(), "sessions", session.ID, session, sessionTTL); err != nil {
+		return Session{}, err
+	}
+	if err := client.PutWithTTL(r.Context(), userSessions, userSessionKey(userID, session.ID), struct{}{}, sessionTTL); err != nil {
+		return Session{}, err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(sessionTTL / time.Second),
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return session, nil
+}
+
+// userSessions indexes the sessions of each user, by userSessionKey, so
+// that they can be ended together
+const userSessions = "user-sessions"
+
+func userSessionKey(userID string, sessionID string) string {
+	return userID + "/" + sessionID
+}
+
+// endSessions deletes every session of a user, so that users who are
+// deleted or whose password is reset are signed out everywhere, rather than
+// keeping the role their sessions were started with until they expire
+func endSessions(ctx context.Context, client *db.Client, userID string) error {
+	var keys []string
+	// "0" follows "/", so the range ends after the last key of the user
+	err := client.ScanRange(ctx, userSessions, userID+"/", userID+"0", 100, func(record db.Record) error {
+		keys = append(keys, record.Key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if _, err := client.Delete(ctx, "sessions", strings.TrimPrefix(key, userID+"/")); err != nil {
+			return err
+		}
+		if _, err := client.Delete(ctx, userSessions, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeSession(w http.ResponseWriter, r *http.Request, session Session) {
+	respond(w, r, http.StatusOK, apiclient.Session{
+		UserID:                session.UserID,
+		Role:                  session.Role,
+		MFA:                   session.MFA,
+		MFAEnrollmentRequired: models.RequiresMFA(session.Role) && !session.MFA,
+	})
+}
+
+func isHTTPS(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
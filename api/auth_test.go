@@ -0,0 +1,238 @@
+//go:build !js
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"assette/db"
+	"assette/models"
+)
+
+// newTestAccount stores a user with a password and returns its ID
+func newTestAccount(t *testing.T, client *db.Client, user models.User, password string) string {
+	t.Helper()
+
+	userID := "user:" + user.Email
+	if err := client.PutIndexed(context.Background(), "users", userID, user, UsersByEmail); err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+	if err := setPassword(context.Background(), client, userID, password); err != nil {
+		t.Fatalf("Failed to set password: %v", err)
+	}
+	return userID
+}
+
+// withSession replays the session cookie set by a login response
+func withSession(req *http.Request, login *httptest.ResponseRecorder) *http.Request {
+	for _, cookie := range login.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	return req
+}
+
+// newAdminSession stores an admin account and returns a response setting
+// the cookie of a session that passed a second factor
+func newAdminSession(t *testing.T, client *db.Client) *httptest.ResponseRecorder {
+	t.Helper()
+
+	userID := newTestAccount(t, client, models.User{Name: "Admin", Email: "admin@example.com", Role: models.RoleAdmin}, "correct horse battery")
+	w := httptest.NewRecorder()
+	if _, err := startSession(w, httptest.NewRequest(http.MethodPost, "/api/auth/login", nil), client, userID, models.RoleAdmin, true); err != nil {
+		t.Fatalf("Failed to start session: %v", err)
+	}
+	return w
+}
+
+func TestLogin(t *testing.T) {
+	_, _, client := newTestDB(t)
+
+	userID := newTestAccount(t, client, models.User{Name: "John", Email: "john@example.com", Role: models.RoleUser}, "correct horse battery")
+
+	w := postJSON(Login(client), "/api/auth/login", map[string]string{"email": "john@example.com", "password": "wrong password"})
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d for wrong password, got %d", http.StatusUnauthorized, w.Code)
+	}
+
+	w = postJSON(Login(client), "/api/auth/login", map[string]string{"email": "nobody@example.com", "password": "correct horse battery"})
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d for unknown email, got %d", http.StatusUnauthorized, w.Code)
+	}
+
+	// Users created through the API have no password until they reset it
+	client.PutIndexed(context.Background(), "users", "user:nopassword", models.User{Name: "Jane", Email: "jane@example.com"}, UsersByEmail)
+	for _, password := range []string{"", "dummy password", "correct horse battery"} {
+		w = postJSON(Login(client), "/api/auth/login", map[string]string{"email": "jane@example.com", "password": password})
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status %d for a user without a password, got %d with %q", http.StatusUnauthorized, w.Code, password)
+		}
+	}
+
+	login := postJSON(Login(client), "/api/auth/login", map[string]string{"email": "john@example.com", "password": "correct horse battery"})
+	if login.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, login.Code)
+	}
+
+	var seen Session
+	handler := Authenticate(client)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen, _ = SessionFromContext(r.Context())
+		if id, _ := UserIDFromContext(r.Context()); id != userID {
+			t.Errorf("Expected user %q in context, got %q", userID, id)
+		}
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), withSession(httptest.NewRequest(http.MethodGet, "/api/users", nil), login))
+
+	if seen.UserID != userID || seen.MFA {
+		t.Errorf("Unexpected session %+v", seen)
+	}
+}
+
+func TestLogout(t *testing.T) {
+	_, _, client := newTestDB(t)
+
+	newTestAccount(t, client, models.User{Name: "John", Email: "john@example.com"}, "correct horse battery")
+	login := postJSON(Login(client), "/api/auth/login", map[string]string{"email": "john@example.com", "password": "correct horse battery"})
+
+	w := httptest.NewRecorder()
+	Authenticate(client)(http.HandlerFunc(Logout(client))).ServeHTTP(w, withSession(httptest.NewRequest(http.MethodPost, "/api/auth/logout", nil), login))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected status %d, got %d", http.StatusNoContent, w.Code)
+	}
+
+	handler := Authenticate(client)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := SessionFromContext(r.Context()); ok {
+			t.Error("Expected session to be gone after logout")
+		}
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), withSession(httptest.NewRequest(http.MethodGet, "/api/users", nil), login))
+}
+
+func TestRequireRole(t *testing.T) {
+	_, _, client := newTestDB(t)
+
+	newTestAccount(t, client, models.User{Name: "John", Email: "john@example.com", Role: models.RoleUser}, "correct horse battery")
+	newTestAccount(t, client, models.User{Name: "Ada", Email: "ada@example.com", Role: models.RoleAdmin}, "correct horse battery")
+
+	handler := Authenticate(client)(RequireRole(models.RoleAdmin)(okHandler()))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/admin", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d when anonymous, got %d", http.StatusUnauthorized, w.Code)
+	}
+
+	login := postJSON(Login(client), "/api/auth/login", map[string]string{"email": "john@example.com", "password": "correct horse battery"})
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, withSession(httptest.NewRequest(http.MethodGet, "/api/admin", nil), login))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d for regular user, got %d", http.StatusForbidden, w.Code)
+	}
+
+	// Admins without a second factor have to enroll first
+	login = postJSON(Login(client), "/api/auth/login", map[string]string{"email": "ada@example.com", "password": "correct horse battery"})
+	var response map[string]interface{}
+	json.NewDecoder(login.Body).Decode(&response)
+	if response["mfaEnrollmentRequired"] != true {
+		t.Errorf("Expected mfaEnrollmentRequired for admin, got %v", response)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, withSession(httptest.NewRequest(http.MethodGet, "/api/admin", nil), login))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d for admin without MFA, got %d", http.StatusForbidden, w.Code)
+	}
+}
+
+// TestRequireSelf checks that users can only be changed by themselves and
+// by admins, and bulk changes only by admins
+func TestRequireSelf(t *testing.T) {
+	_, _, client := newTestDB(t)
+	router := NewHandler(Config{Client: client})
+	adaID := newTestAccount(t, client, models.User{Name: "Ada", Email: "ada@example.com", Role: models.RoleUser}, "correct horse battery")
+	newTestAccount(t, client, models.User{Name: "Grace", Email: "grace@example.com", Role: models.RoleUser}, "correct horse battery")
+
+	login := func(email string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/auth/login", strings.NewReader(`{"email": "`+email+`", "password": "correct horse battery"}`)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected to log in as %s, got %d", email, w.Code)
+		}
+		return w
+	}
+	ada, grace, admin := login("ada@example.com"), login("grace@example.com"), newAdminSession(t, client)
+
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		session *httptest.ResponseRecorder
+		status  int
+	}{
+		{"anonymous", http.MethodPatch, "/api/users/" + adaID, nil, http.StatusUnauthorized},
+		{"another user", http.MethodPatch, "/api/users/" + adaID, grace, http.StatusForbidden},
+		{"themselves", http.MethodPatch, "/api/users/" + adaID, ada, http.StatusOK},
+		{"admin", http.MethodPatch, "/api/users/" + adaID, admin, http.StatusOK},
+		{"anonymous delete", http.MethodDelete, "/api/users/" + adaID, nil, http.StatusUnauthorized},
+		{"bulk as a user", http.MethodPost, "/api/users/bulk", ada, http.StatusForbidden},
+		{"bulk as an admin", http.MethodPost, "/api/users/bulk", admin, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, contentType := `{"name": "Ada Lovelace"}`, "application/merge-patch+json"
+			if tt.path == "/api/users/bulk" {
+				body, contentType = `{"operations": [{"op": "create", "user": {"name": "Alan", "email": "alan@example.com"}}]}`, "application/json"
+			}
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(body))
+			req.Header.Set("Content-Type", contentType)
+			if tt.session != nil {
+				req = withSession(req, tt.session)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code != tt.status {
+				t.Errorf("Expected status %d, got %d: %s", tt.status, w.Code, w.Body)
+			}
+		})
+	}
+}
+
+// TestEndSessions checks that deleting a user signs them out everywhere,
+// and no one else
+func TestEndSessions(t *testing.T) {
+	_, _, client := newTestDB(t)
+	router := NewHandler(Config{Client: client})
+	adaID := newTestAccount(t, client, models.User{Name: "Ada", Email: "ada@example.com", Role: models.RoleUser}, "correct horse battery")
+	newTestAccount(t, client, models.User{Name: "Grace", Email: "grace@example.com", Role: models.RoleUser}, "correct horse battery")
+	admin := newAdminSession(t, client)
+
+	login := func(email string) *httptest.ResponseRecorder {
+		return postJSON(Login(client), "/api/auth/login", map[string]string{"email": email, "password": "correct horse battery"})
+	}
+	signedIn := func(session *httptest.ResponseRecorder) bool {
+		var ok bool
+		Authenticate(client)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, ok = SessionFromContext(r.Context())
+		})).ServeHTTP(httptest.NewRecorder(), withSession(httptest.NewRequest(http.MethodGet, "/api/users", nil), session))
+		return ok
+	}
+	laptop, phone, grace := login("ada@example.com"), login("ada@example.com"), login("grace@example.com")
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, withSession(httptest.NewRequest(http.MethodDelete, "/api/users/"+adaID, nil), admin))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected status %d, got %d", http.StatusNoContent, w.Code)
+	}
+
+	if signedIn(laptop) || signedIn(phone) {
+		t.Error("Expected the sessions of the deleted user to end")
+	}
+	if !signedIn(grace) || !signedIn(admin) {
+		t.Error("Expected the sessions of other users to last")
+	}
+}
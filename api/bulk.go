@@ -0,0 +1,337 @@
+//go:build !js
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"assette/apiclient"
+	"assette/db"
+	"assette/models"
+)
+
+// MaxBulkOperations bounds the operations of a single bulk request
+const MaxBulkOperations = 1000
+
+// Operations accepted by BulkUsers
+const (
+	BulkCreate = apiclient.BulkCreate
+	BulkUpdate = apiclient.BulkUpdate
+	BulkDelete = apiclient.BulkDelete
+)
+
+// bulkRequest is the body of BulkUsers, shared with the API client
+type bulkRequest = apiclient.BulkRequest
+
+type bulkOperation = apiclient.BulkOperation
+
+// bulkItem is the outcome of an operation run by runBulk
+type bulkItem struct {
+	id       string
+	existing *models.User // Updated user as stored
+	user     models.User  // Created or updated user
+	meta     db.Metadata  // Metadata of the created or updated user
+	status   int
+	problem  *Problem
+}
+
+// BulkUsers creates, updates and deletes users in bulk. Operations are run
+// in as few etcd transactions as possible and the result of each is
+// returned in order, with the status and body the single user endpoint
+// would have returned, or its problem details. Updates keep the role and
+// email verification of users like UpdateUser does, and deletes move users
+// to the trash like DeleteUser.
+//
+// Unless atomic is set, operations succeed or fail independently and the
+// response is 200 if all succeeded, 207 Multi-Status otherwise. Atomic
+// requests fail with 424 Failed Dependency for the operations that were
+// not run because another one failed. Dry runs report what would happen
+// without writing anything.
+func BulkUsers(client *db.Client, retention time.Duration) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request bulkRequest
+		if err := decodeBody(r, &request); err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		switch {
+		case len(request.Operations) == 0:
+			WriteError(w, r, ValidationProblem(FieldError{Field: "operations", Code: "required", Message: "At least one operation is required"}))
+			return
+		case len(request.Operations) > MaxBulkOperations:
+			WriteError(w, r, ValidationProblem(FieldError{Field: "operations", Code: "too_many", Message: fmt.Sprintf("At most %d operations are allowed", MaxBulkOperations)}))
+			return
+		}
+
+		items, err := runBulk(r, client, request.Operations, request.Atomic, request.DryRun, retention)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		response := make([]map[string]interface{}, len(items))
+		succeeded := 0
+		for i, item := range items {
+			result := map[string]interface{}{"index": i, "op": request.Operations[i].Op, "status": item.status}
+			if item.id != "" {
+				result["id"] = item.id
+			}
+			switch {
+			case item.problem != nil:
+				result["error"] = bulkProblemResponse(r, item.problem)
+			case request.Operations[i].Op != BulkDelete:
+				result["user"] = userResponse(item.id, item.user, item.meta)
+			}
+			if item.problem == nil {
+				succeeded++
+			}
+			response[i] = result
+		}
+
+		status := http.StatusOK
+		if succeeded < len(items) {
+			status = http.StatusMultiStatus
+		}
+
+		respond(w, r, status, map[string]interface{}{
+			"dryRun":    request.DryRun,
+			"results":   response,
+			"succeeded": succeeded,
+			"failed":    len(items) - succeeded,
+		})
+	}
+}
+
+// runBulk runs operations as described for BulkUsers, auditing those that
+// succeed, and returns the outcome of each
+func runBulk(r *http.Request, client *db.Client, operations []bulkOperation, atomic bool, dryRun bool, retention time.Duration) ([]bulkItem, error) {
+	items := make([]bulkItem, len(operations))
+	var ops []db.BatchOp
+	var batched []int // Index of the item of each op
+	failed := false
+	for i, operation := range operations {
+		op, err := prepareBulkOperation(r, client, operation, retention, &items[i])
+		if err != nil {
+			items[i].problem = bulkProblem(err)
+			failed = true
+			continue
+		}
+		ops = append(ops, op)
+		batched = append(batched, i)
+	}
+
+	var results []db.BatchResult
+	switch {
+	case atomic && failed:
+		// Nothing is written
+	case dryRun:
+		var err error
+		if results, err = checkBulk(r, client, ops); err != nil {
+			return nil, err
+		}
+		if atomic {
+			for _, result := range results {
+				if result.Err != nil {
+					failed = true
+				}
+			}
+		}
+	default:
+		var err error
+		if results, err = client.Batch(r.Context(), ops, atomic); err != nil {
+			return nil, err
+		}
+	}
+
+	for j, i := range batched {
+		item := &items[i]
+		switch {
+		case results == nil || (dryRun && atomic && failed && results[j].Err == nil):
+			item.problem = bulkProblem(db.ErrBatchAborted)
+			continue
+		case results[j].Err != nil:
+			item.problem = bulkProblem(results[j].Err)
+			continue
+		}
+
+		item.meta = results[j].Record.Metadata
+		switch operations[i].Op {
+		case BulkCreate:
+			item.status = http.StatusCreated
+			if dryRun {
+				item.id = "" // Assigned when actually created
+			} else {
+				recordAudit(r, client, AuditCreate, "users", item.id, nil, item.user)
+			}
+		case BulkUpdate:
+			item.status = http.StatusOK
+			if !dryRun {
+				recordAudit(r, client, AuditUpdate, "users", item.id, item.existing, item.user)
+			}
+		case BulkDelete:
+			item.status = http.StatusNoContent
+			if !dryRun {
+				recordAudit(r, client, AuditDelete, "users", item.id, json.RawMessage(results[j].Record.Value), nil)
+				if err := endSessions(r.Context(), client, item.id); err != nil {
+					log.Printf("[ERROR] ending the sessions of %s: %v", item.id, err)
+				}
+			}
+		}
+	}
+
+	for i := range items {
+		if items[i].problem != nil {
+			items[i].status = items[i].problem.Status
+			if operations[i].Op == BulkCreate {
+				items[i].id = ""
+			}
+		}
+	}
+	return items, nil
+}
+
+// checkBulk reports the writes of ops that would fail because the user to
+// delete is missing or has changed, or because their email address is taken
+// by another user or an earlier op, without writing anything. Other
+// failures, such as concurrent changes, are only detected when writing.
+func checkBulk(r *http.Request, client *db.Client, ops []db.BatchOp) ([]db.BatchResult, error) {
+	results := make([]db.BatchResult, len(ops))
+	claimed := make(map[string]string)
+	for i, op := range ops {
+		if op.Trash > 0 {
+			record, err := client.GetRecord(r.Context(), op.Namespace, op.Key)
+			switch {
+			case err == db.ErrKeyNotFound:
+				results[i].Err = err
+			case err != nil:
+				return nil, err
+			case op.Revision != db.AnyRevision && op.Revision != record.ModRevision:
+				results[i].Err = db.ErrRevisionMismatch
+			}
+			continue
+		}
+
+		user, ok := op.Value.(models.User)
+		if !ok {
+			continue
+		}
+
+		email := normalizeEmail(user.Email)
+		holder, taken := claimed[email]
+		if !taken {
+			var err error
+			holder, err = client.Lookup(r.Context(), UsersByEmail, email)
+			if err != nil && err != db.ErrKeyNotFound {
+				return nil, err
+			}
+			taken = err == nil
+		}
+		if taken && holder != op.Key {
+			results[i].Err = db.ErrDuplicate
+			continue
+		}
+		claimed[email] = op.Key
+	}
+	return results, nil
+}
+
+// bulkProblemResponse completes a problem reported for a single operation
+func bulkProblemResponse(r *http.Request, p *Problem) Problem {
+	response := *p
+	response.Instance = r.URL.Path
+	response.RequestID = RequestIDFromContext(r.Context())
+	return response
+}
+
+// prepareBulkOperation validates operation and returns the write running it,
+// filling item with what the response needs
+func prepareBulkOperation(r *http.Request, client *db.Client, operation bulkOperation, retention time.Duration, item *bulkItem) (db.BatchOp, error) {
+	op := db.BatchOp{Namespace: "users", Indexes: []db.Index{UsersByEmail}}
+
+	if operation.Op != BulkCreate && operation.ID == "" {
+		return op, ValidationProblem(FieldError{Field: "id", Code: "required", Message: "ID is required"})
+	}
+	if operation.Op != BulkDelete && operation.User == nil {
+		return op, ValidationProblem(FieldError{Field: "user", Code: "required", Message: "User is required"})
+	}
+	item.id = operation.ID
+
+	switch operation.Op {
+	case BulkCreate:
+		if err := operation.User.Validate(); err != nil {
+			return op, err
+		}
+
+		// As with CreateUser, verification and roles are never set here
+		item.user = *operation.User
+		item.user.EmailVerified = false
+		item.user.Role = models.RoleUser
+		id, err := newUserID()
+		if err != nil {
+			return op, err
+		}
+		item.id = id
+
+		op.Key, op.Value, op.Revision = item.id, item.user, 0
+		return op, nil
+
+	case BulkUpdate:
+		if err := operation.User.Validate(); err != nil {
+			return op, err
+		}
+
+		record, err := client.GetRecord(r.Context(), "users", operation.ID)
+		if err != nil {
+			return op, err
+		}
+		if operation.Version != 0 && operation.Version != record.Metadata.Version {
+			return op, db.ErrRevisionMismatch
+		}
+
+		var existing models.User
+		if err := json.Unmarshal(record.Value, &existing); err != nil {
+			return op, err
+		}
+		item.existing = &existing
+
+		item.user = *operation.User
+		item.user.EmailVerified = existing.EmailVerified && strings.EqualFold(item.user.Email, existing.Email)
+		item.user.Role = existing.Role
+
+		op.Key, op.Value, op.Revision = operation.ID, item.user, record.ModRevision
+		return op, nil
+
+	case BulkDelete:
+		op.Key, op.Trash, op.Revision = operation.ID, retention, db.AnyRevision
+		if operation.Version != 0 {
+			op.Revision = operation.Version
+		}
+		return op, nil
+
+	default:
+		return op, ValidationProblem(FieldError{Field: "op", Code: "invalid", Message: "Operation must be create, update or delete"})
+	}
+}
+
+// bulkProblem describes why an operation failed, with the problem the single
+// user endpoints report for the same error
+func bulkProblem(err error) *Problem {
+	var p *Problem
+	switch {
+	case errors.As(err, &p):
+		return p
+	case err == db.ErrKeyNotFound:
+		return NewProblem(http.StatusNotFound, CodeNotFound, "User not found")
+	case errors.Is(err, db.ErrDuplicate):
+		return emailTaken()
+	default:
+		return problemFor(err)
+	}
+}
@@ -0,0 +1,143 @@
+//go:build !js
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"assette/db"
+	"assette/models"
+)
+
+type bulkResponse struct {
+	Results []struct {
+		Index  int                    `json:"index"`
+		Status int                    `json:"status"`
+		ID     string                 `json:"id"`
+		User   map[string]interface{} `json:"user"`
+		Error  *Problem               `json:"error"`
+	} `json:"results"`
+	Succeeded int `json:"succeeded"`
+	Failed    int `json:"failed"`
+}
+
+func callBulk(t *testing.T, client *db.Client, body string) (int, bulkResponse) {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/users/bulk", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	BulkUsers(client, DefaultTrashRetention)(w, req)
+
+	var response bulkResponse
+	json.NewDecoder(w.Body).Decode(&response)
+	return w.Code, response
+}
+
+func TestBulkUsers(t *testing.T) {
+	_, _, client := newTestDB(t)
+	ctx := context.Background()
+
+	client.PutIndexed(ctx, "users", "user:admin", models.User{Name: "Admin", Email: "admin@example.com", Role: models.RoleAdmin, EmailVerified: true}, UsersByEmail)
+	client.PutIndexed(ctx, "users", "user:old", models.User{Name: "Old", Email: "old@example.com"}, UsersByEmail)
+
+	code, response := callBulk(t, client, `{"operations": [
+		{"op": "create", "user": {"name": "Ada", "email": "ada@example.com", "role": "admin"}},
+		{"op": "create", "user": {"name": "Grace", "email": "admin@example.com"}},
+		{"op": "create", "user": {"name": "", "email": "bad"}},
+		{"op": "update", "id": "user:admin", "user": {"name": "Root", "email": "admin@example.com"}},
+		{"op": "update", "id": "user:missing", "user": {"name": "Nobody", "email": "nobody@example.com"}},
+		{"op": "delete", "id": "user:old"},
+		{"op": "rename", "id": "user:old"}
+	]}`)
+
+	if code != http.StatusMultiStatus {
+		t.Fatalf("Expected status %d, got %d", http.StatusMultiStatus, code)
+	}
+	if response.Succeeded != 3 || response.Failed != 4 || len(response.Results) != 7 {
+		t.Fatalf("Expected 3 operations to succeed and 4 to fail, got %+v", response)
+	}
+
+	expected := []int{http.StatusCreated, http.StatusConflict, http.StatusBadRequest, http.StatusOK, http.StatusNotFound, http.StatusNoContent, http.StatusBadRequest}
+	for i, status := range expected {
+		if response.Results[i].Index != i || response.Results[i].Status != status {
+			t.Errorf("Expected status %d for operation %d, got %+v", status, i, response.Results[i])
+		}
+	}
+
+	created := response.Results[0]
+	if created.User["role"] != models.RoleUser || created.User["version"] == nil {
+		t.Errorf("Expected a plain user with its version, got %v", created.User)
+	}
+	if _, err := client.Get(ctx, "users", created.ID); err != nil {
+		t.Errorf("Expected created user to be stored, got %v", err)
+	}
+	if response.Results[1].Error == nil || response.Results[1].Error.Code != CodeDuplicate {
+		t.Errorf("Expected duplicate email problem, got %+v", response.Results[1].Error)
+	}
+
+	updated := response.Results[3].User
+	if updated["name"] != "Root" || updated["role"] != models.RoleAdmin || updated["emailVerified"] != true {
+		t.Errorf("Expected role and verification to be kept, got %v", updated)
+	}
+
+	if _, err := client.Get(ctx, db.TrashNamespace("users"), "user:old"); err != nil {
+		t.Errorf("Expected deleted user in the trash, got %v", err)
+	}
+}
+
+func TestBulkUsersAtomic(t *testing.T) {
+	_, _, client := newTestDB(t)
+	ctx := context.Background()
+
+	client.PutIndexed(ctx, "users", "user:a", models.User{Name: "A", Email: "a@example.com"}, UsersByEmail)
+
+	code, response := callBulk(t, client, `{"atomic": true, "operations": [
+		{"op": "create", "user": {"name": "Ada", "email": "ada@example.com"}},
+		{"op": "delete", "id": "user:a", "version": 1}
+	]}`)
+	if code != http.StatusMultiStatus || response.Succeeded != 0 {
+		t.Fatalf("Expected the batch to fail, got %d %+v", code, response)
+	}
+	if response.Results[0].Status != http.StatusFailedDependency || response.Results[1].Status != http.StatusPreconditionFailed {
+		t.Errorf("Expected an aborted create and a failed delete, got %+v", response.Results)
+	}
+	if users, _ := client.List(ctx, "users"); len(users) != 1 {
+		t.Errorf("Expected nothing written, got %d users", len(users))
+	}
+
+	code, response = callBulk(t, client, `{"atomic": true, "operations": [
+		{"op": "create", "user": {"name": "Ada", "email": "ada@example.com"}},
+		{"op": "delete", "id": "user:a"}
+	]}`)
+	if code != http.StatusOK || response.Succeeded != 2 {
+		t.Fatalf("Expected the batch to succeed, got %d %+v", code, response)
+	}
+
+	code, response = callBulk(t, client, `{"dryRun": true, "operations": [
+		{"op": "create", "user": {"name": "Grace", "email": "ada@example.com"}},
+		{"op": "create", "user": {"name": "Grace", "email": "grace@example.com"}},
+		{"op": "create", "user": {"name": "Grace", "email": "grace@example.com"}},
+		{"op": "delete", "id": "user:a"}
+	]}`)
+	if code != http.StatusMultiStatus || response.Succeeded != 1 {
+		t.Fatalf("Expected a single operation to pass the dry run, got %d %+v", code, response)
+	}
+	for i, status := range []int{http.StatusConflict, http.StatusCreated, http.StatusConflict, http.StatusNotFound} {
+		if response.Results[i].Status != status {
+			t.Errorf("Expected status %d for operation %d, got %+v", status, i, response.Results[i])
+		}
+	}
+	if users, _ := client.List(ctx, "users"); len(users) != 1 {
+		t.Errorf("Expected nothing written by a dry run, got %d users", len(users))
+	}
+
+	code, _ = callBulk(t, client, `{"operations": []}`)
+	if code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for an empty batch, got %d", http.StatusBadRequest, code)
+	}
+}
@@ -0,0 +1,66 @@
+//go:build !js
+
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"assette/codec"
+)
+
+// MaxBodySize limits the bodies of API requests, other than the spreadsheets
+// read by ImportUsers
+const MaxBodySize = 1 << 20
+
+// respond writes v with status in the format the client accepts, JSON
+// unless its Accept header prefers MessagePack or CBOR
+func respond(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	c := codec.Negotiate(r.Header.Get("Accept"))
+	data, err := c.Marshal(v)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", c.MediaType)
+	w.Header().Add("Vary", "Accept")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// decodeBody decodes the request body into v in the format of its
+// Content-Type, returning a problem describing unsupported or malformed
+// bodies. Bodies without a Content-Type are read as JSON.
+func decodeBody(r *http.Request, v interface{}) error {
+	c, err := codec.ForContentType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return NewProblem(http.StatusUnsupportedMediaType, CodeUnsupportedMedia, "Content-Type must be one of "+strings.Join(codec.MediaTypes(), ", "))
+	}
+
+	data, err := readBody(r, MaxBodySize)
+	if err != nil {
+		return err
+	}
+	if err := c.Unmarshal(data, v); err != nil {
+		return NewProblem(http.StatusBadRequest, CodeInvalidBody, "Invalid "+c.MediaType+" body: "+err.Error())
+	}
+	return nil
+}
+
+// readBody reads the request body, returning a 413 problem rather than
+// reading on once it goes over limit bytes
+func readBody(r *http.Request, limit int64) ([]byte, error) {
+	data, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, limit))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, NewProblem(http.StatusRequestEntityTooLarge, CodeTooLarge, fmt.Sprintf("Request bodies are limited to %d MB", limit>>20))
+		}
+		return nil, NewProblem(http.StatusBadRequest, CodeInvalidBody, "Could not read the request body")
+	}
+	return data, nil
+}
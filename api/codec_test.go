@@ -0,0 +1,133 @@
+//go:build !js
+
+package api
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"assette/codec"
+)
+
+func TestBinaryBodies(t *testing.T) {
+	_, _, client := newTestDB(t)
+	router := NewHandler(Config{Client: client})
+
+	cbor, _ := codec.Lookup(codec.CBOR)
+	body, err := cbor.Marshal(map[string]string{"name": "Ada", "email": "ada@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/users", bytes.NewReader(body))
+	req.Header.Set("Content-Type", codec.CBOR)
+	req.Header.Set("Accept", codec.CBOR)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != codec.CBOR {
+		t.Errorf("Expected Content-Type %s, got %s", codec.CBOR, ct)
+	}
+
+	var created struct {
+		ID    string `json:"id"`
+		Email string `json:"email"`
+	}
+	if err := cbor.Unmarshal(w.Body.Bytes(), &created); err != nil || created.Email != "ada@example.com" {
+		t.Fatalf("Expected the created user, got %+v (%v)", created, err)
+	}
+
+	// The same user in MessagePack, by any of its media types
+	msgpack, _ := codec.Lookup(codec.MessagePack)
+	req = httptest.NewRequest(http.MethodGet, "/api/users/"+created.ID, nil)
+	req.Header.Set("Accept", "application/json;q=0.5, application/x-msgpack")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if ct := w.Header().Get("Content-Type"); w.Code != http.StatusOK || ct != codec.MessagePack {
+		t.Fatalf("Expected MessagePack, got %d %s: %s", w.Code, ct, w.Body)
+	}
+	if !strings.Contains(w.Header().Get("Vary"), "Accept") {
+		t.Errorf("Expected responses to vary on Accept, got %q", w.Header().Get("Vary"))
+	}
+	var fetched map[string]interface{}
+	if err := msgpack.Unmarshal(w.Body.Bytes(), &fetched); err != nil || fetched["id"] != created.ID {
+		t.Errorf("Expected user %s, got %v (%v)", created.ID, fetched, err)
+	}
+
+	// Errors stay problem details in JSON
+	req = httptest.NewRequest(http.MethodGet, "/api/users/user:0", nil)
+	req.Header.Set("Accept", codec.MessagePack)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if ct := w.Header().Get("Content-Type"); w.Code != http.StatusNotFound || ct != "application/problem+json" {
+		t.Errorf("Expected JSON problem details, got %d %s", w.Code, ct)
+	}
+}
+
+func TestUnsupportedBody(t *testing.T) {
+	_, _, client := newTestDB(t)
+	router := NewHandler(Config{Client: client})
+
+	tests := []struct {
+		contentType string
+		body        string
+		status      int
+	}{
+		{"text/plain", `{"name": "Ada", "email": "ada@example.com"}`, http.StatusUnsupportedMediaType},
+		{codec.MessagePack, `{"name": "Ada"}`, http.StatusBadRequest},
+		{"", `{"name": "Ada", "email": "ada@example.com"}`, http.StatusCreated},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/api/users", strings.NewReader(tt.body))
+		if tt.contentType != "" {
+			req.Header.Set("Content-Type", tt.contentType)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != tt.status {
+			t.Errorf("Content-Type %q: expected status %d, got %d: %s", tt.contentType, tt.status, w.Code, w.Body)
+		}
+	}
+}
+
+// TestBodyLimit checks that bodies over MaxBodySize are rejected with 413,
+// whether decoded, read as a patch or held for an idempotency key
+func TestBodyLimit(t *testing.T) {
+	_, _, client := newTestDB(t)
+	router := NewHandler(Config{Client: client})
+	session := newAdminSession(t, client)
+	large := `{"name": "` + strings.Repeat("a", MaxBodySize) + `", "email": "ada@example.com"}`
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		contentType string
+		key         string
+	}{
+		{"decoded", http.MethodPost, "/api/users", "application/json", ""},
+		{"idempotent", http.MethodPost, "/api/users", "application/json", "large"},
+		{"patch", http.MethodPatch, "/api/users/user:admin@example.com", "application/merge-patch+json", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := withSession(httptest.NewRequest(tt.method, tt.path, strings.NewReader(large)), session)
+			req.Header.Set("Content-Type", tt.contentType)
+			if tt.key != "" {
+				req.Header.Set("Idempotency-Key", tt.key)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code != http.StatusRequestEntityTooLarge || decodeProblem(t, w).Code != CodeTooLarge {
+				t.Errorf("Expected status %d, got %d: %s", http.StatusRequestEntityTooLarge, w.Code, w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,327 @@
+//go:build !js
+
+package api
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Content codings produced by Compress, by preference
+const (
+	EncodingBrotli = "br"
+	EncodingGzip   = "gzip"
+)
+
+// MinCompressSize is the size below which responses are sent as they are,
+// since compressing them would save less than it costs
+const MinCompressSize = 1024
+
+// brotliLevel trades some compression for speed, as responses are
+// compressed as they are served. Build time compression uses the best.
+const brotliLevel = 5
+
+var (
+	brotliWriters = sync.Pool{New: func() interface{} { return brotli.NewWriterLevel(nil, brotliLevel) }}
+	gzipWriters   = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+)
+
+// etagSuffixes are added to the ETags of encoded responses, which are other
+// representations than the identity one and so need other strong tags
+var etagSuffixes = map[string]string{
+	EncodingBrotli: "-br",
+	EncodingGzip:   "-gz",
+}
+
+// Compress encodes responses with brotli or gzip, whichever the client
+// prefers in Accept-Encoding, if their Content-Type is worth compressing.
+// Responses already encoded by the handler, such as precompressed assets,
+// are left alone, and range requests are answered without a coding, so that
+// ranges always apply to the identity bytes.
+//
+// The ETag of an encoded response gets the suffix of its coding, such as
+// "42-br", and Vary: Accept-Encoding keeps caches from mixing codings up.
+// Handlers still see the tags they set: the unsuffixed tags are added to the
+// If-Match and If-None-Match headers of requests, so that If-Match works
+// whichever coding a client got.
+func Compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := NegotiateEncoding(r.Header.Get("Accept-Encoding"), EncodingBrotli, EncodingGzip)
+		if r.Method == http.MethodHead || r.Header.Get("Range") != "" {
+			encoding = ""
+		}
+
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding, ifNoneMatch: r.Header.Get("If-None-Match")}
+		next.ServeHTTP(cw, decodedPreconditions(r, encoding))
+		cw.Close()
+	})
+}
+
+// encodedETag returns the ETag of a response with tag etag once encoded
+func encodedETag(etag string, encoding string) string {
+	suffix := etagSuffixes[encoding]
+	if suffix == "" || !strings.HasSuffix(etag, `"`) {
+		return etag
+	}
+	return etag[:len(etag)-1] + suffix + `"`
+}
+
+// decodedPreconditions returns r with the unsuffixed form of the encoded
+// tags in its If-Match header, and in its If-None-Match header of those
+// encoded with the coding of the response, as a cached response in another
+// coding cannot be reused
+func decodedPreconditions(r *http.Request, encoding string) *http.Request {
+	ifMatch := withDecodedTags(r.Header.Get("If-Match"), EncodingBrotli, EncodingGzip)
+	ifNoneMatch := withDecodedTags(r.Header.Get("If-None-Match"), encoding)
+	if ifMatch == r.Header.Get("If-Match") && ifNoneMatch == r.Header.Get("If-None-Match") {
+		return r
+	}
+
+	r = r.Clone(r.Context())
+	if ifMatch != "" {
+		r.Header.Set("If-Match", ifMatch)
+	}
+	if ifNoneMatch != "" {
+		r.Header.Set("If-None-Match", ifNoneMatch)
+	}
+	return r
+}
+
+// withDecodedTags adds to a list of ETags the unsuffixed form of those with
+// the suffix of one of encodings
+func withDecodedTags(header string, encodings ...string) string {
+	tags := header
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		for _, encoding := range encodings {
+			if suffix := etagSuffixes[encoding]; suffix != "" && strings.HasSuffix(tag, suffix+`"`) {
+				tags += ", " + strings.TrimSuffix(tag, suffix+`"`) + `"`
+			}
+		}
+	}
+	return tags
+}
+
+// NegotiateEncoding returns the coding among offered that the client prefers
+// according to an Accept-Encoding header, or "" to send the response as it
+// is. Ties are broken by the order of offered.
+func NegotiateEncoding(acceptEncoding string, offered ...string) string {
+	qualities := make(map[string]float64)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+
+		quality := 1.0
+		if name, value, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(name) == "q" {
+			var err error
+			if quality, err = strconv.ParseFloat(strings.TrimSpace(value), 64); err != nil {
+				continue
+			}
+		}
+		qualities[coding] = quality
+	}
+
+	best, bestQuality := "", 0.0
+	for _, coding := range offered {
+		quality, ok := qualities[coding]
+		if !ok {
+			quality = qualities["*"]
+		}
+		if quality > bestQuality {
+			best, bestQuality = coding, quality
+		}
+	}
+	return best
+}
+
+// compressible reports whether responses of a Content-Type get smaller when
+// compressed. Images other than SVG, archives and XLSX workbooks are
+// compressed already.
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "+json"),
+		strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/javascript", "application/xml", "application/wasm",
+		"application/msgpack", "application/cbor":
+		return true
+	}
+	return false
+}
+
+// compressWriter buffers the start of a response until it knows whether it is
+// worth compressing, then either compresses the rest or passes it through
+type compressWriter struct {
+	http.ResponseWriter
+	encoding    string
+	ifNoneMatch string // As sent by the client, with encoded tags
+	status      int
+	buf         []byte
+	encoder     io.WriteCloser
+	decided     bool
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.start(status)
+	} else if w.decided {
+		w.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.start(http.StatusOK)
+	}
+	if w.decided {
+		if w.encoder != nil {
+			return w.encoder.Write(b)
+		}
+		return w.ResponseWriter.Write(b)
+	}
+
+	w.buf = append(w.buf, b...)
+	if len(w.buf) >= MinCompressSize {
+		if err := w.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// start records the status of the response and passes it through right away
+// if it cannot be compressed
+func (w *compressWriter) start(status int) {
+	w.status = status
+
+	// A cached encoded response that is still fresh keeps its tag
+	if etag := w.Header().Get("ETag"); status == http.StatusNotModified && etag != "" {
+		if encoded := encodedETag(etag, w.encoding); encoded != etag && strings.Contains(w.ifNoneMatch, encoded) {
+			w.Header().Set("ETag", encoded)
+		}
+	}
+
+	if !w.eligible() {
+		w.decide(false)
+	}
+}
+
+// eligible reports whether the response, as far as its status and headers
+// tell, could be compressed
+func (w *compressWriter) eligible() bool {
+	h := w.Header()
+	if w.status < http.StatusOK || w.status == http.StatusNoContent || w.status == http.StatusNotModified ||
+		h.Get("Content-Encoding") != "" || !compressible(h.Get("Content-Type")) {
+		return false
+	}
+
+	// A larger response would be compressed, so caches must tell them apart
+	h.Add("Vary", "Accept-Encoding")
+	if w.encoding == "" {
+		return false
+	}
+	if length, err := strconv.Atoi(h.Get("Content-Length")); err == nil && length < MinCompressSize {
+		return false
+	}
+	return true
+}
+
+// decide sends the headers, with those of the coding if compress is set, and
+// then what was buffered
+func (w *compressWriter) decide(compress bool) error {
+	w.decided = true
+	if compress {
+		h := w.Header()
+		h.Set("Content-Encoding", w.encoding)
+		h.Del("Content-Length")
+		h.Del("Accept-Ranges") // Ranges would apply to the compressed bytes
+		if etag := h.Get("ETag"); etag != "" {
+			h.Set("ETag", encodedETag(etag, w.encoding))
+		}
+
+		switch w.encoding {
+		case EncodingBrotli:
+			encoder := brotliWriters.Get().(*brotli.Writer)
+			encoder.Reset(w.ResponseWriter)
+			w.encoder = encoder
+		case EncodingGzip:
+			encoder := gzipWriters.Get().(*gzip.Writer)
+			encoder.Reset(w.ResponseWriter)
+			w.encoder = encoder
+		}
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+
+	if len(w.buf) == 0 {
+		return nil
+	}
+	buf := w.buf
+	w.buf = nil
+	if w.encoder != nil {
+		_, err := w.encoder.Write(buf)
+		return err
+	}
+	_, err := w.ResponseWriter.Write(buf)
+	return err
+}
+
+// Flush sends what has been written so far, compressed if the response is
+// eligible at all, since a streamed response is likely to grow large
+func (w *compressWriter) Flush() {
+	if w.status == 0 {
+		w.start(http.StatusOK)
+	}
+	if !w.decided {
+		w.decide(true)
+	}
+	if flusher, ok := w.encoder.(interface{ Flush() error }); ok {
+		flusher.Flush()
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Close ends the response, sending small responses as they are
+func (w *compressWriter) Close() error {
+	if w.status == 0 {
+		return nil // Nothing was written, leave the response to the server
+	}
+	if !w.decided {
+		return w.decide(false)
+	}
+	if w.encoder == nil {
+		return nil
+	}
+
+	err := w.encoder.Close()
+	switch encoder := w.encoder.(type) {
+	case *brotli.Writer:
+		brotliWriters.Put(encoder)
+	case *gzip.Writer:
+		gzipWriters.Put(encoder)
+	}
+	w.encoder = nil
+	return err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,159 @@
+//go:build !js
+
+package api
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"assette/db"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		expected       string
+	}{
+		{"", ""},
+		{"gzip", EncodingGzip},
+		{"gzip, deflate, br", EncodingBrotli},
+		{"br;q=0.5, gzip", EncodingGzip},
+		{"br;q=0, *", EncodingGzip},
+		{"*;q=0", ""},
+		{"identity", ""},
+		{"GZIP", EncodingGzip},
+	}
+
+	for _, tt := range tests {
+		if encoding := NegotiateEncoding(tt.acceptEncoding, EncodingBrotli, EncodingGzip); encoding != tt.expected {
+			t.Errorf("NegotiateEncoding(%q) = %q, expected %q", tt.acceptEncoding, encoding, tt.expected)
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+	large := strings.Repeat(`{"name":"Ada","email":"ada@example.com"},`, 100)
+	handler := Compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/large":
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, large)
+		case "/small":
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{}`)
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+			io.WriteString(w, large)
+		case "/encoded":
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Encoding", EncodingGzip)
+			io.WriteString(w, large)
+		case "/empty":
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+
+	request := func(path, acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	decoders := map[string]func(io.Reader) (io.Reader, error){
+		EncodingBrotli: func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil },
+		EncodingGzip:   func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+	}
+	for encoding, decoder := range decoders {
+		w := request("/large", encoding)
+		if w.Header().Get("Content-Encoding") != encoding || w.Header().Get("Vary") != "Accept-Encoding" {
+			t.Fatalf("Expected a %s response varying on Accept-Encoding, got %v", encoding, w.Header())
+		}
+		if w.Body.Len() >= len(large) {
+			t.Errorf("Expected %s to shrink the response, got %d bytes", encoding, w.Body.Len())
+		}
+		r, err := decoder(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body, err := io.ReadAll(r); err != nil || string(body) != large {
+			t.Errorf("Expected the %s response to decode to the original body, got %v", encoding, err)
+		}
+	}
+
+	for _, path := range []string{"/small", "/image", "/empty"} {
+		if w := request(path, "br, gzip"); w.Header().Get("Content-Encoding") != "" {
+			t.Errorf("Expected %s to be sent as it is, got %s", path, w.Header().Get("Content-Encoding"))
+		}
+	}
+	if w := request("/small", "gzip"); w.Body.String() != `{}` || w.Header().Get("Vary") != "Accept-Encoding" {
+		t.Errorf("Expected the small response as it is, varying on Accept-Encoding, got %q %v", w.Body, w.Header())
+	}
+	if w := request("/encoded", "br"); w.Header().Get("Content-Encoding") != EncodingGzip || w.Body.String() != large {
+		t.Errorf("Expected an encoded response to be left alone, got %v", w.Header())
+	}
+	if w := request("/large", ""); w.Header().Get("Content-Encoding") != "" || w.Body.String() != large {
+		t.Errorf("Expected no coding without Accept-Encoding, got %v", w.Header())
+	}
+}
+
+// TestCompressETags checks that encoded responses get the ETag of their
+// coding, which handlers still recognize in preconditions
+func TestCompressETags(t *testing.T) {
+	large := strings.Repeat(`{"name":"Ada","email":"ada@example.com"},`, 100)
+	handler := Compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", versionETag(7))
+		switch {
+		case !ifMatch(r, db.Metadata{Version: 7}):
+			w.WriteHeader(http.StatusPreconditionFailed)
+		case ifNoneMatch(r, versionETag(7)):
+			w.WriteHeader(http.StatusNotModified)
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, large)
+		}
+	}))
+
+	request := func(method, acceptEncoding string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/large", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	tests := []struct {
+		name           string
+		method         string
+		acceptEncoding string
+		header         []string
+		status         int
+		etag           string
+	}{
+		{"brotli", http.MethodGet, "br", nil, http.StatusOK, `"7-br"`},
+		{"gzip", http.MethodGet, "gzip", nil, http.StatusOK, `"7-gz"`},
+		{"identity", http.MethodGet, "", nil, http.StatusOK, `"7"`},
+		{"range", http.MethodGet, "br", []string{"Range", "bytes=0-9"}, http.StatusOK, `"7"`},
+		{"cached brotli", http.MethodGet, "br", []string{"If-None-Match", `"7-br"`}, http.StatusNotModified, `"7-br"`},
+		{"cached identity", http.MethodGet, "br", []string{"If-None-Match", `"7"`}, http.StatusNotModified, `"7"`},
+		{"cached in another coding", http.MethodGet, "gzip", []string{"If-None-Match", `"7-br"`}, http.StatusOK, `"7-gz"`},
+		{"if-match brotli", http.MethodPut, "", []string{"If-Match", `"7-br"`}, http.StatusOK, `"7"`},
+		{"if-match stale", http.MethodPut, "", []string{"If-Match", `"6-br"`}, http.StatusPreconditionFailed, `"7"`},
+	}
+	for _, tt := range tests {
+		w := request(tt.method, tt.acceptEncoding, tt.header...)
+		if w.Code != tt.status || w.Header().Get("ETag") != tt.etag {
+			t.Errorf("%s: expected %d with ETag %s, got %d with %s", tt.name, tt.status, tt.etag, w.Code, w.Header().Get("ETag"))
+		}
+	}
+}
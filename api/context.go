@@ -0,0 +1,26 @@
+//go:build !js
+
+package api
+
+import "context"
+
+type contextKey int
+
+const (
+	userIDKey contextKey = iota
+	cspNonceKey
+	sessionKey
+	requestIDKey
+	parentRequestKey
+)
+
+// WithUserID returns a copy of ctx carrying the ID of the authenticated user
+func WithUserID(ctx context.Context, userID string) context.Context {
+	return context.WithValue(ctx, userIDKey, userID)
+}
+
+// UserIDFromContext returns the ID of the authenticated user, if any
+func UserIDFromContext(ctx context.Context) (string, bool) {
+	userID, ok := ctx.Value(userIDKey).(string)
+	return userID, ok && userID != ""
+}
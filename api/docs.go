@@ -0,0 +1,166 @@
+//go:build !js
+
+package api
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+//go:embed docs.html
+var docsPage string
+
+var docsTemplate = template.Must(template.New("docs").Parse(docsPage))
+
+// docsEndpoint is an operation of the OpenAPI document as shown on the
+// documentation page
+type docsEndpoint struct {
+	Method      string
+	Path        string
+	Summary     string
+	Description string
+	Deprecated  bool
+	Parameters  []Parameter
+	Request     []docsBody
+	Responses   []docsBody
+}
+
+// docsBody is a request or response body, with the media types sharing
+// its schema
+type docsBody struct {
+	Status      string
+	Description string
+	MediaTypes  []string
+	Schema      string
+}
+
+// ServeDocs serves a page documenting the endpoints of the OpenAPI document
+// of r, rendered on the server so that the API needs no scripts or assets
+func ServeDocs(r *Router) func(w http.ResponseWriter, req *http.Request) {
+	var once sync.Once
+	var page []byte
+	var err error
+	return func(w http.ResponseWriter, req *http.Request) {
+		once.Do(func() {
+			page, err = renderDocs(OpenAPI(r))
+		})
+		if err != nil {
+			WriteError(w, req, err)
+			return
+		}
+
+		// The page only needs its inline styles
+		w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; frame-ancestors 'none'")
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(page)
+	}
+}
+
+func renderDocs(openapi map[string]interface{}) ([]byte, error) {
+	data, err := json.Marshal(openapi)
+	if err != nil {
+		return nil, err
+	}
+
+	type body struct {
+		Description string
+		Content     map[string]struct {
+			Schema json.RawMessage
+		}
+	}
+	var document struct {
+		Info struct {
+			Title       string
+			Description string
+		}
+		Paths map[string]map[string]struct {
+			Summary     string
+			Description string
+			Deprecated  bool
+			Parameters  []Parameter
+			RequestBody *body
+			Responses   map[string]body
+		}
+		Components struct {
+			Schemas map[string]json.RawMessage
+		}
+	}
+	if err := json.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+
+	// Bodies usually have the same schema in every codec, shown once
+	bodies := func(status string, b body) []docsBody {
+		var bodies []docsBody
+	next:
+		for _, mediaType := range sortedKeys(b.Content) {
+			schema := indentJSON(b.Content[mediaType].Schema)
+			for i := range bodies {
+				if bodies[i].Schema == schema {
+					bodies[i].MediaTypes = append(bodies[i].MediaTypes, mediaType)
+					continue next
+				}
+			}
+			bodies = append(bodies, docsBody{Status: status, Description: b.Description, MediaTypes: []string{mediaType}, Schema: schema})
+		}
+		if len(bodies) == 0 {
+			bodies = append(bodies, docsBody{Status: status, Description: b.Description})
+		}
+		return bodies
+	}
+
+	var endpoints []docsEndpoint
+	methods := map[string]int{"get": 0, "post": 1, "put": 2, "patch": 3, "delete": 4}
+	for _, path := range sortedKeys(document.Paths) {
+		operations := document.Paths[path]
+		keys := sortedKeys(operations)
+		sort.SliceStable(keys, func(i, j int) bool { return methods[keys[i]] < methods[keys[j]] })
+
+		for _, method := range keys {
+			operation := operations[method]
+			endpoint := docsEndpoint{
+				Method:      strings.ToUpper(method),
+				Path:        path,
+				Summary:     operation.Summary,
+				Description: operation.Description,
+				Deprecated:  operation.Deprecated,
+				Parameters:  operation.Parameters,
+			}
+			if operation.RequestBody != nil {
+				endpoint.Request = bodies("", *operation.RequestBody)
+			}
+			for _, status := range sortedKeys(operation.Responses) {
+				endpoint.Responses = append(endpoint.Responses, bodies(status, operation.Responses[status])...)
+			}
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+
+	var schemas []docsBody
+	for _, name := range sortedKeys(document.Components.Schemas) {
+		schemas = append(schemas, docsBody{Description: name, Schema: indentJSON(document.Components.Schemas[name])})
+	}
+
+	var buf bytes.Buffer
+	err = docsTemplate.Execute(&buf, map[string]interface{}{
+		"Title":       document.Info.Title,
+		"Description": document.Info.Description,
+		"Endpoints":   endpoints,
+		"Schemas":     schemas,
+	})
+	return buf.Bytes(), err
+}
+
+func indentJSON(data json.RawMessage) string {
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, data, "", "  "); err != nil {
+		return string(data)
+	}
+	return buf.String()
+}
@@ -0,0 +1,167 @@
+//go:build !js
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"assette/db"
+	"assette/models"
+	"assette/patch"
+	"assette/query"
+)
+
+// Machine-readable error codes, stable across releases. Clients should
+// branch on these rather than on the human-readable detail.
+const (
+	CodeInvalidBody        = "invalid_body"
+	CodeInvalidParameter   = "invalid_parameter"
+	CodeInvalidPatch       = "invalid_patch"
+	CodeUnsupportedMedia   = "unsupported_media_type"
+	CodeValidation         = "validation_failed"
+	CodeInvalidToken       = "invalid_token"
+	CodeInvalidCredentials = "invalid_credentials"
+	CodeInvalidCode        = "invalid_code"
+	CodeUnauthenticated    = "unauthenticated"
+	CodeForbidden          = "forbidden"
+	CodeMFARequired        = "mfa_required"
+	CodeNotFound           = "not_found"
+	CodeMethodNotAllowed   = "method_not_allowed"
+	CodeSunset             = "version_sunset"
+	CodeConflict           = "conflict"
+	CodeDuplicate          = "duplicate"
+	CodePreconditionFailed = "precondition_failed"
+	CodeTooLarge           = "too_large"
+	CodeAborted            = "aborted"
+	CodeRequestInProgress  = "idempotency_in_progress"
+	CodeIdempotencyReused  = "idempotency_key_reused"
+	CodeRateLimited        = "rate_limited"
+	CodeTooManyAttempts    = "too_many_attempts"
+	CodeMailFailed         = "mail_failed"
+	CodeUnavailable        = "unavailable"
+	CodeInternal           = "internal_error"
+)
+
+// Problem is an API error, written as RFC 9457 problem details with
+// Content-Type application/problem+json
+type Problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	Instance  string       `json:"instance,omitempty"`
+	Code      string       `json:"code"`
+	RequestID string       `json:"requestId,omitempty"`
+	Errors    []FieldError `json:"errors,omitempty"`
+
+	// cause is logged for server errors and never sent to clients
+	cause error
+}
+
+// FieldError describes why a single request field was rejected
+type FieldError = models.FieldError
+
+// NewProblem returns a problem with the given status, code and detail. The
+// detail is sent to clients, so it must not contain internal error messages.
+func NewProblem(status int, code string, detail string) *Problem {
+	return &Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Code:   code,
+	}
+}
+
+// ValidationProblem reports request fields that failed validation
+func ValidationProblem(fields ...FieldError) *Problem {
+	p := NewProblem(http.StatusBadRequest, CodeValidation, "The request contains invalid fields")
+	p.Errors = fields
+	return p
+}
+
+// WithCause attaches the underlying error, which is logged but not exposed
+func (p *Problem) WithCause(err error) *Problem {
+	p.cause = err
+	return p
+}
+
+func (p *Problem) Error() string {
+	if p.cause != nil {
+		return fmt.Sprintf("%s: %s: %v", p.Code, p.Detail, p.cause)
+	}
+	return p.Code + ": " + p.Detail
+}
+
+func (p *Problem) Unwrap() error {
+	return p.cause
+}
+
+// WriteError writes err as problem details. Errors that are not a *Problem
+// are mapped from models.ValidationErrors or their db or context cause, and
+// anything else becomes a 500
+// whose message is only logged, tagged with the request ID that the client
+// also receives.
+func WriteError(w http.ResponseWriter, r *http.Request, err error) {
+	var p *Problem
+	if !errors.As(err, &p) {
+		p = problemFor(err)
+	}
+
+	response := *p
+	response.Instance = r.URL.Path
+	response.RequestID = RequestIDFromContext(r.Context())
+
+	if response.Status >= http.StatusInternalServerError {
+		log.Printf("[ERROR] %s %s request=%s: %v", r.Method, r.URL.Path, response.RequestID, err)
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(response.Status)
+	json.NewEncoder(w).Encode(response)
+}
+
+func problemFor(err error) *Problem {
+	var invalid models.ValidationErrors
+	var badQuery *query.Error
+	var badPatch *patch.Error
+	switch {
+	case errors.As(err, &invalid):
+		return ValidationProblem(invalid...)
+	case errors.As(err, &badQuery):
+		p := NewProblem(http.StatusBadRequest, CodeInvalidParameter, "Invalid query parameter")
+		p.Errors = []FieldError{{Field: badQuery.Parameter, Code: CodeInvalidParameter, Message: badQuery.Message}}
+		return p
+	case errors.As(err, &badPatch):
+		if errors.Is(err, patch.ErrTestFailed) {
+			return NewProblem(http.StatusConflict, CodeConflict, "Patch test failed: "+badPatch.Error())
+		}
+		return NewProblem(http.StatusUnprocessableEntity, CodeInvalidPatch, "Patch cannot be applied: "+badPatch.Error())
+	case errors.Is(err, patch.ErrInvalid):
+		return NewProblem(http.StatusBadRequest, CodeInvalidBody, "Invalid patch document")
+	case errors.Is(err, db.ErrRevisionMismatch):
+		return NewProblem(http.StatusPreconditionFailed, CodePreconditionFailed, "The resource has been modified")
+	case errors.Is(err, db.ErrBatchTooLarge):
+		return NewProblem(http.StatusRequestEntityTooLarge, CodeTooLarge, "Too many changes for a single transaction")
+	case errors.Is(err, db.ErrBatchConflict):
+		return NewProblem(http.StatusConflict, CodeConflict, "Changed by an earlier operation of the batch")
+	case errors.Is(err, db.ErrBatchAborted):
+		return NewProblem(http.StatusFailedDependency, CodeAborted, "Not applied because another operation of the batch failed")
+	case errors.Is(err, db.ErrKeyNotFound):
+		return NewProblem(http.StatusNotFound, CodeNotFound, "Resource not found")
+	case errors.Is(err, db.ErrKeyExists):
+		return NewProblem(http.StatusConflict, CodeConflict, "Resource already exists")
+	case errors.Is(err, db.ErrDuplicate):
+		return NewProblem(http.StatusConflict, CodeDuplicate, "A unique value is already in use")
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return NewProblem(http.StatusServiceUnavailable, CodeUnavailable, "The request could not be completed in time")
+	default:
+		return NewProblem(http.StatusInternalServerError, CodeInternal, "An internal error occurred; quote the request ID when reporting it")
+	}
+}
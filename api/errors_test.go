@@ -0,0 +1,136 @@
+//go:build !js
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"assette/db"
+)
+
+func decodeProblem(t *testing.T, w *httptest.ResponseRecorder) Problem {
+	t.Helper()
+
+	if ct := w.Header().Get("Content-Type"); ct != "application/problem+json" {
+		t.Fatalf("Expected Content-Type application/problem+json, got %q", ct)
+	}
+
+	var problem Problem
+	if err := json.NewDecoder(w.Body).Decode(&problem); err != nil {
+		t.Fatalf("Failed to decode problem: %v", err)
+	}
+	return problem
+}
+
+func TestWriteErrorMapsDBErrors(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{db.ErrKeyNotFound, http.StatusNotFound, CodeNotFound},
+		{fmt.Errorf("loading user: %w", db.ErrKeyNotFound), http.StatusNotFound, CodeNotFound},
+		{db.ErrKeyExists, http.StatusConflict, CodeConflict},
+		{NewProblem(http.StatusBadRequest, CodeInvalidToken, "Invalid or expired token"), http.StatusBadRequest, CodeInvalidToken},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		WriteError(w, httptest.NewRequest(http.MethodGet, "/api/users/user:1", nil), tt.err)
+
+		if w.Code != tt.status {
+			t.Errorf("%v: expected status %d, got %d", tt.err, tt.status, w.Code)
+		}
+
+		problem := decodeProblem(t, w)
+		if problem.Status != tt.status || problem.Code != tt.code {
+			t.Errorf("%v: expected %d %s, got %d %s", tt.err, tt.status, tt.code, problem.Status, problem.Code)
+		}
+		if problem.Instance != "/api/users/user:1" || problem.Title != http.StatusText(tt.status) {
+			t.Errorf("%v: unexpected instance or title in %+v", tt.err, problem)
+		}
+	}
+}
+
+func TestWriteErrorHidesInternalErrors(t *testing.T) {
+	buf := captureLog(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/users", nil)
+	req.Header.Set("X-Request-ID", "corr-42")
+
+	w := httptest.NewRecorder()
+	RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		WriteError(w, r, errors.New("etcdserver: request timed out at 10.0.0.3"))
+	})).ServeHTTP(w, req)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status %d, got %d", http.StatusInternalServerError, w.Code)
+	}
+
+	problem := decodeProblem(t, w)
+	if problem.Code != CodeInternal || problem.RequestID != "corr-42" {
+		t.Errorf("Expected internal error with request ID corr-42, got %+v", problem)
+	}
+	if strings.Contains(problem.Detail, "etcdserver") {
+		t.Errorf("Expected internal error to stay out of the response, got %q", problem.Detail)
+	}
+
+	if line := buf.String(); !strings.Contains(line, "etcdserver") || !strings.Contains(line, "request=corr-42") {
+		t.Errorf("Expected internal error to be logged with its request ID, got %q", line)
+	}
+}
+
+func TestValidationProblem(t *testing.T) {
+	w := httptest.NewRecorder()
+	WriteError(w, httptest.NewRequest(http.MethodPost, "/api/account/password", nil),
+		ValidationProblem(FieldError{Field: "password", Code: "too_short", Message: "Too short"}))
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	problem := decodeProblem(t, w)
+	if len(problem.Errors) != 1 || problem.Errors[0].Field != "password" || problem.Errors[0].Code != "too_short" {
+		t.Errorf("Expected a password field error, got %+v", problem.Errors)
+	}
+}
+
+func TestHandlersReturnProblems(t *testing.T) {
+	_, _, client := newTestDB(t)
+	handler := NewHandler(Config{Client: client})
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		status int
+		code   string
+	}{
+		{http.MethodGet, "/api/users/user:missing", "", http.StatusNotFound, CodeNotFound},
+		{http.MethodPost, "/api/users", "{not json", http.StatusBadRequest, CodeInvalidBody},
+		{http.MethodPost, "/api/auth/login", `{"email":"nobody@example.com","password":"secret"}`, http.StatusUnauthorized, CodeInvalidCredentials},
+		{http.MethodDelete, "/api/users", "", http.StatusMethodNotAllowed, CodeMethodNotAllowed},
+		{http.MethodGet, "/api/nowhere", "", http.StatusNotFound, CodeNotFound},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+
+		if w.Code != tt.status {
+			t.Errorf("%s %s: expected status %d, got %d", tt.method, tt.path, tt.status, w.Code)
+			continue
+		}
+
+		problem := decodeProblem(t, w)
+		if problem.Code != tt.code || problem.RequestID == "" {
+			t.Errorf("%s %s: expected code %s with a request ID, got %+v", tt.method, tt.path, tt.code, problem)
+		}
+	}
+}
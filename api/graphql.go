@@ -0,0 +1,364 @@
+//go:build !js
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+
+	"assette/apiclient"
+)
+
+// MaxGraphQLDepth is how deeply the fields of a query may be nested, and
+// MaxGraphQLCost how many objects it may resolve as estimated by
+// graphqlCost, so that fields such as history, which can be nested in
+// themselves, cannot turn one request into unbounded reads
+const (
+	MaxGraphQLDepth = 8
+	MaxGraphQLCost  = 1000
+)
+
+// graphqlKeepAlive is how often a comment is sent on idle subscriptions, so
+// that proxies do not close them
+const graphqlKeepAlive = 15 * time.Second
+
+// graphqlRequest is a GraphQL request, read from the body of POST requests
+// and from the query parameters of GET requests
+type graphqlRequest struct {
+	Query         string                 `json:"query"`
+	Variables     map[string]interface{} `json:"variables,omitempty"`
+	OperationName string                 `json:"operationName,omitempty"`
+}
+
+// GraphQL serves the GraphQL schema of the API on GET and POST. Queries and
+// mutations are answered with their result in the format the client accepts.
+// Subscriptions, open to signed-in users only, stream a "next" server-sent
+// event for each result and a "complete" one once they end, so that browsers
+// can follow them with EventSource. Mutations must be sent with POST, which cross-site forms cannot
+// do with a GraphQL body.
+//
+// Queries and mutations run on the v1 endpoints registered on router, as
+// sub-requests sharing the context of the GraphQL request: the session it
+// was authenticated with, its request ID and its deadline. They are rate
+// limited like requests of their own, and given config.Timeout like the v1
+// requests. Queries nested deeper than MaxGraphQLDepth, or costing more than
+// MaxGraphQLCost, are rejected before they run.
+func GraphQL(router *Router, config Config) func(w http.ResponseWriter, r *http.Request) {
+	calls := routerTransport{handler: RateLimit(config.Client, config.RateLimits...)(http.HandlerFunc(router.dispatch))}
+	api := &apiclient.Client{HTTPClient: &http.Client{Transport: calls}}
+	schema, err := graphqlSchema(api, config.Client)
+	if err != nil {
+		panic(err) // The schema does not depend on anything at runtime
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req graphqlRequest
+		if r.Method == http.MethodGet {
+			values := r.URL.Query()
+			req.Query, req.OperationName = values.Get("query"), values.Get("operationName")
+			if variables := values.Get("variables"); variables != "" {
+				if err := json.Unmarshal([]byte(variables), &req.Variables); err != nil {
+					WriteError(w, r, NewProblem(http.StatusBadRequest, CodeInvalidParameter, "The variables parameter must be a JSON object"))
+					return
+				}
+			}
+		} else if err := decodeBody(r, &req); err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		if req.Query == "" {
+			WriteError(w, r, NewProblem(http.StatusBadRequest, CodeInvalidParameter, "The request has no query"))
+			return
+		}
+
+		var operation string
+		if definition, fragments := graphqlOperation(req.Query, req.OperationName); definition != nil {
+			operation = definition.Operation
+			depth, cost := graphqlCost(schema, definition, fragments, req.Variables)
+			if depth > MaxGraphQLDepth || cost > MaxGraphQLCost {
+				WriteError(w, r, NewProblem(http.StatusBadRequest, CodeInvalidParameter,
+					fmt.Sprintf("The query is too complex: it may nest fields %d deep and resolve %d objects at most", MaxGraphQLDepth, MaxGraphQLCost)))
+				return
+			}
+		}
+		if operation == ast.OperationTypeMutation && r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			WriteError(w, r, NewProblem(http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Mutations must be sent with POST"))
+			return
+		}
+
+		params := graphql.Params{
+			Schema:         schema,
+			RequestString:  req.Query,
+			VariableValues: req.Variables,
+			OperationName:  req.OperationName,
+			Context:        context.WithValue(r.Context(), parentRequestKey, r),
+		}
+		if operation == ast.OperationTypeSubscription {
+			// Each subscription holds an etcd watch for as long as it runs
+			if _, ok := SessionFromContext(r.Context()); !ok {
+				WriteError(w, r, NewProblem(http.StatusUnauthorized, CodeUnauthenticated, "Subscriptions require authentication"))
+				return
+			}
+			streamGraphQL(w, params)
+			return
+		}
+
+		var execute http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			params.Context = context.WithValue(r.Context(), parentRequestKey, r)
+			respond(w, r, http.StatusOK, graphql.Do(params))
+		})
+		if config.Timeout > 0 {
+			execute = Timeout(config.Timeout)(execute)
+		}
+		execute.ServeHTTP(w, r)
+	}
+}
+
+// graphqlOperation returns the operation a request runs and the fragments
+// of its document, or nil if the query does not parse, which is then
+// reported in the result
+func graphqlOperation(query string, operationName string) (*ast.OperationDefinition, map[string]*ast.FragmentDefinition) {
+	document, err := parser.Parse(parser.ParseParams{Source: query})
+	if err != nil {
+		return nil, nil
+	}
+
+	var found *ast.OperationDefinition
+	fragments := make(map[string]*ast.FragmentDefinition)
+	for _, definition := range document.Definitions {
+		switch definition := definition.(type) {
+		case *ast.OperationDefinition:
+			if found == nil && (operationName == "" || definition.Name != nil && definition.Name.Value == operationName) {
+				found = definition
+			}
+		case *ast.FragmentDefinition:
+			fragments[definition.Name.Value] = definition
+		}
+	}
+	return found, fragments
+}
+
+// graphqlCost returns how deeply the fields of operation are nested and an
+// estimate of the objects it resolves, each of which may read etcd. The
+// objects of a field with a first or limit argument are counted as many
+// times as it asks for, MaxGraphQLPage times if it does not say.
+func graphqlCost(schema graphql.Schema, operation *ast.OperationDefinition, fragments map[string]*ast.FragmentDefinition, variables map[string]interface{}) (int, int) {
+	var root graphql.Type
+	switch operation.Operation {
+	case ast.OperationTypeMutation:
+		root = schema.MutationType()
+	case ast.OperationTypeSubscription:
+		root = schema.SubscriptionType()
+	default:
+		root = schema.QueryType()
+	}
+
+	c := &costCounter{fragments: fragments, variables: variables, spreading: make(map[string]bool)}
+	return c.selections(operation.SelectionSet, root, 1)
+}
+
+// costCounter walks the selections of an operation for graphqlCost
+type costCounter struct {
+	fragments map[string]*ast.FragmentDefinition
+	variables map[string]interface{}
+	spreading map[string]bool // Fragments being walked, which may not spread themselves
+}
+
+// selections returns the depth and cost of set, whose fields are those of
+// parent and at the given depth
+func (c *costCounter) selections(set *ast.SelectionSet, parent graphql.Type, depth int) (int, int) {
+	if set == nil {
+		return depth - 1, 0
+	}
+
+	maxDepth, cost := depth, 0
+	add := func(d int, n int) {
+		maxDepth, cost = max(maxDepth, d), cost+n
+	}
+	for _, selection := range set.Selections {
+		switch selection := selection.(type) {
+		case *ast.Field:
+			var fieldType graphql.Type
+			var definition *graphql.FieldDefinition
+			if fields, ok := parent.(interface{ Fields() graphql.FieldDefinitionMap }); ok {
+				if definition = fields.Fields()[selection.Name.Value]; definition != nil {
+					fieldType, _ = graphql.GetNamed(definition.Type).(graphql.Type)
+				}
+			}
+			d, n := c.selections(selection.SelectionSet, fieldType, depth+1)
+			if _, ok := fieldType.(*graphql.Object); ok || selection.SelectionSet != nil {
+				n = 1 + c.multiplier(selection, definition)*n
+			}
+			add(d, n)
+		case *ast.InlineFragment:
+			add(c.selections(selection.SelectionSet, parent, depth))
+		case *ast.FragmentSpread:
+			name := selection.Name.Value
+			if fragment, ok := c.fragments[name]; ok && !c.spreading[name] {
+				c.spreading[name] = true
+				add(c.selections(fragment.SelectionSet, parent, depth))
+				c.spreading[name] = false
+			}
+		}
+	}
+	return maxDepth, cost
+}
+
+// multiplier returns how many objects field asks for, going by its first or
+// limit argument
+func (c *costCounter) multiplier(field *ast.Field, definition *graphql.FieldDefinition) int {
+	if definition == nil {
+		return 1
+	}
+	for _, arg := range definition.Args {
+		if arg.Name() != "first" && arg.Name() != "limit" {
+			continue
+		}
+
+		n := 0
+		for _, given := range field.Arguments {
+			if given.Name.Value != arg.Name() {
+				continue
+			}
+			switch value := given.Value.(type) {
+			case *ast.IntValue:
+				n, _ = strconv.Atoi(value.Value)
+			case *ast.Variable:
+				if v, ok := c.variables[value.Name.Value].(float64); ok {
+					n = int(v)
+				}
+			}
+		}
+		if n <= 0 {
+			return MaxGraphQLPage // Left to the default, or all of them
+		}
+		return n
+	}
+	return 1
+}
+
+// streamGraphQL runs a subscription, writing its results as server-sent
+// events until it ends or the client goes away
+func streamGraphQL(w http.ResponseWriter, params graphql.Params) {
+	ctx, cancel := context.WithCancel(params.Context)
+	params.Context = ctx
+	results := graphql.Subscribe(params)
+	defer func() {
+		cancel()
+		// Drained so that the subscription is not left blocked on a result
+		for range results {
+		}
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	controller := http.NewResponseController(w)
+	controller.Flush()
+
+	keepAlive := time.NewTicker(graphqlKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case result, ok := <-results:
+			if !ok {
+				io.WriteString(w, "event: complete\ndata:\n\n")
+				controller.Flush()
+				return
+			}
+			data, _ := json.Marshal(result)
+			fmt.Fprintf(w, "event: next\ndata: %s\n\n", data)
+		case <-keepAlive.C:
+			io.WriteString(w, ": keep-alive\n\n")
+		case <-ctx.Done():
+			return
+		}
+		if err := controller.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// routerTransport sends requests to the routes of a router in process, such
+// as the dispatch of a Router. Each one is a sub-request of the GraphQL or
+// WebSocket request in its context, from the same client and with the same
+// session, and skips the middlewares of the root router that already ran for
+// that request, such as authentication.
+type routerTransport struct {
+	handler http.Handler
+}
+
+func (t routerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	parent, ok := req.Context().Value(parentRequestKey).(*http.Request)
+	if !ok {
+		return nil, fmt.Errorf("%s %s: not a sub-request", req.Method, req.URL.Path)
+	}
+
+	sub := req.Clone(req.Context())
+	sub.Header = parent.Header.Clone()
+	for _, header := range []string{"Content-Type", "Content-Length", "Content-Encoding", "Accept", "Accept-Encoding",
+		"If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since", "Idempotency-Key"} {
+		sub.Header.Del(header)
+	}
+	for key, values := range req.Header {
+		sub.Header[key] = values
+	}
+	sub.Host = parent.Host
+	sub.RemoteAddr = parent.RemoteAddr
+	sub.RequestURI = req.URL.RequestURI()
+	if sub.Body == nil {
+		sub.Body = http.NoBody
+	}
+
+	recorder := &responseRecorder{header: http.Header{}}
+	t.handler.ServeHTTP(recorder, sub)
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", recorder.status, http.StatusText(recorder.status)),
+		StatusCode:    recorder.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        recorder.header,
+		Body:          io.NopCloser(&recorder.body),
+		ContentLength: int64(recorder.body.Len()),
+		Request:       req,
+	}, nil
+}
+
+// responseRecorder keeps the status, headers and body of a response
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *responseRecorder) Header() http.Header {
+	return w.header
+}
+
+func (w *responseRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(b)
+}
@@ -0,0 +1,546 @@
+//go:build !js
+
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/graphql-go/graphql"
+
+	"assette/apiclient"
+	"assette/db"
+	"assette/models"
+	"assette/query"
+)
+
+// MaxGraphQLPage is the most users returned by a page of the users query,
+// and the size of pages that do not ask for one
+const MaxGraphQLPage = 100
+
+// userConnection is a page of the users query
+type userConnection struct {
+	Nodes      []apiclient.User `json:"nodes"`
+	TotalCount int              `json:"totalCount"`
+	PageInfo   pageInfo         `json:"pageInfo"`
+}
+
+// pageInfo tells how to get the next page: pass endCursor as the after
+// argument while hasNextPage is true
+type pageInfo struct {
+	HasNextPage bool   `json:"hasNextPage"`
+	EndCursor   string `json:"endCursor,omitempty"`
+}
+
+// userEvent is a change to a user, sent by the userChanged subscription. The
+// user of a delete is its last version.
+type userEvent struct {
+	Type     db.EventType    `json:"type"`
+	ID       string          `json:"id"`
+	Revision int64           `json:"revision"` // To resume after, in the after argument
+	User     *apiclient.User `json:"user"`
+}
+
+// graphqlTypes reflects Go types into GraphQL object types, each named after
+// its Go type and built once
+type graphqlTypes struct {
+	objects map[reflect.Type]*graphql.Object
+}
+
+// output returns the GraphQL type of the values of t, non-null unless
+// nullable
+func (g *graphqlTypes) output(t reflect.Type, nullable bool) graphql.Output {
+	var output graphql.Output
+	switch {
+	case t == reflect.TypeOf(time.Time{}):
+		output = graphql.DateTime
+	case t.Kind() == reflect.Ptr:
+		return g.output(t.Elem(), true)
+	case t.Kind() == reflect.Slice:
+		output = graphql.NewList(g.output(t.Elem(), false))
+	case t.Kind() == reflect.Struct:
+		output = g.object(t)
+	default:
+		output = graphqlScalar(t)
+	}
+	if nullable {
+		return output
+	}
+	return graphql.NewNonNull(output)
+}
+
+// object returns the object type of struct type t, with a field for each
+// member of its JSON encoding: unexported and "-" fields are left out,
+// embedded structs are flattened, and fields are nullable if omitempty, in
+// which case their zero value is null
+func (g *graphqlTypes) object(t reflect.Type) *graphql.Object {
+	if object, ok := g.objects[t]; ok {
+		return object
+	}
+
+	fields := graphql.Fields{}
+	object := graphql.NewObject(graphql.ObjectConfig{Name: exported(t.Name()), Fields: fields})
+	g.objects[t] = object
+
+	var add func(t reflect.Type, index []int)
+	add = func(t reflect.Type, index []int) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			tag := field.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			name, options, _ := strings.Cut(tag, ",")
+			fieldIndex := append(append([]int(nil), index...), i)
+			if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+				add(field.Type, fieldIndex)
+				continue
+			}
+			if !field.IsExported() {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+
+			omitempty := strings.Contains(options, "omitempty")
+			output := g.output(field.Type, omitempty)
+			if name == "id" {
+				output = graphql.NewNonNull(graphql.ID)
+			}
+			fields[name] = &graphql.Field{
+				Type: output,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					value := reflect.Indirect(reflect.ValueOf(p.Source)).FieldByIndex(fieldIndex)
+					if omitempty && value.IsZero() {
+						return nil, nil
+					}
+					return value.Interface(), nil
+				},
+			}
+		}
+	}
+	add(t, nil)
+	return object
+}
+
+// graphqlScalar returns the scalar type of values of a basic kind
+func graphqlScalar(t reflect.Type) graphql.Output {
+	switch t.Kind() {
+	case reflect.String:
+		return graphql.String
+	case reflect.Bool:
+		return graphql.Boolean
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return graphql.Int
+	case reflect.Float32, reflect.Float64:
+		return graphql.Float
+	}
+	panic(fmt.Sprintf("graphql: no type for %s", t))
+}
+
+// graphqlInput returns an input type with a nullable field for each member
+// of the JSON encoding of struct type t. Fields are left to the validation
+// of the endpoint the input is sent to.
+func graphqlInput(name string, t reflect.Type) *graphql.InputObject {
+	fields := graphql.InputObjectConfigFieldMap{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if tag == "-" || !field.IsExported() {
+			continue
+		}
+		if tag == "" {
+			tag = field.Name
+		}
+		fields[tag] = &graphql.InputObjectFieldConfig{Type: graphqlScalar(field.Type)}
+	}
+	return graphql.NewInputObject(graphql.InputObjectConfig{Name: name, Fields: fields})
+}
+
+// graphqlEnum returns an enum whose values are the given names
+func graphqlEnum(name string, values []string) *graphql.Enum {
+	enumValues := graphql.EnumValueConfigMap{}
+	for _, value := range values {
+		enumValues[value] = &graphql.EnumValueConfig{Value: value}
+	}
+	return graphql.NewEnum(graphql.EnumConfig{Name: name, Values: enumValues})
+}
+
+// graphqlError is an error response of an endpoint, reported in GraphQL
+// results with the code, status and field errors of its problem details as
+// extensions
+type graphqlError struct {
+	problem *apiclient.Error
+}
+
+func (e graphqlError) Error() string {
+	return e.problem.Error()
+}
+
+func (e graphqlError) Extensions() map[string]interface{} {
+	extensions := map[string]interface{}{"code": e.problem.Code, "status": e.problem.Status}
+	if len(e.problem.Errors) > 0 {
+		extensions["errors"] = e.problem.Errors
+	}
+	if e.problem.RequestID != "" {
+		extensions["requestId"] = e.problem.RequestID
+	}
+	return extensions
+}
+
+// resolveError returns err as reported to GraphQL clients
+func resolveError(err error) error {
+	var problem *apiclient.Error
+	if errors.As(err, &problem) {
+		return graphqlError{problem}
+	}
+	return err
+}
+
+// invalidArgument reports an argument no endpoint was called with
+func invalidArgument(detail string) error {
+	return graphqlError{&apiclient.Error{Status: http.StatusBadRequest, Code: CodeInvalidParameter, Detail: detail}}
+}
+
+// decodeArgument decodes an input object argument into out, a type whose
+// JSON encoding it was reflected from
+func decodeArgument(argument interface{}, out interface{}) error {
+	data, err := json.Marshal(argument)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
+// mutationOptions returns the headers set by the version and idempotencyKey
+// arguments of a mutation
+func mutationOptions(args map[string]interface{}) []apiclient.Option {
+	var opts []apiclient.Option
+	if version, ok := args["version"].(int); ok {
+		opts = append(opts, apiclient.IfVersion(int64(version)))
+	}
+	if key, ok := args["idempotencyKey"].(string); ok {
+		opts = append(opts, apiclient.IdempotencyKey(key))
+	}
+	return opts
+}
+
+// sourceUser returns the user a field of the User type is resolved for
+func sourceUser(p graphql.ResolveParams) apiclient.User {
+	switch user := p.Source.(type) {
+	case *apiclient.User:
+		return *user
+	case apiclient.User:
+		return user
+	}
+	return apiclient.User{}
+}
+
+// eventUser returns the user of a watched record as ListUsers returns it
+func eventUser(record db.Record) (*apiclient.User, error) {
+	var user models.User
+	if err := json.Unmarshal(record.Value, &user); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(userResponse(record.Key, user, record.Metadata))
+	if err != nil {
+		return nil, err
+	}
+	var response apiclient.User
+	return &response, json.Unmarshal(data, &response)
+}
+
+// The cursors of the users query are opaque to clients, and are offsets in
+// the sorted list of matching users
+func encodeCursor(offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte("offset:" + strconv.Itoa(offset)))
+}
+
+func decodeCursor(cursor string) (int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err == nil {
+		if offset, ok := strings.CutPrefix(string(data), "offset:"); ok {
+			if n, err := strconv.Atoi(offset); err == nil && n >= 0 {
+				return n, nil
+			}
+		}
+	}
+	return 0, invalidArgument("Invalid cursor")
+}
+
+// paginate returns the page of users starting after the cursor in args, of
+// at most first users
+func paginate(users []apiclient.User, args map[string]interface{}) (userConnection, error) {
+	start := 0
+	if after, ok := args["after"].(string); ok {
+		offset, err := decodeCursor(after)
+		if err != nil {
+			return userConnection{}, err
+		}
+		start = min(offset+1, len(users))
+	}
+	first := MaxGraphQLPage
+	if n, ok := args["first"].(int); ok {
+		if n < 0 || n > MaxGraphQLPage {
+			return userConnection{}, invalidArgument(fmt.Sprintf("first must be between 0 and %d", MaxGraphQLPage))
+		}
+		first = n
+	}
+	end := min(start+first, len(users))
+
+	page := userConnection{Nodes: users[start:end], TotalCount: len(users)}
+	page.PageInfo.HasNextPage = end < len(users)
+	if end > start {
+		page.PageInfo.EndCursor = encodeCursor(end - 1)
+	}
+	return page, nil
+}
+
+// graphqlSchema returns the schema served by GraphQL. Its object types are
+// reflected from those of the v1 API, and its queries and mutations call the
+// v1 endpoints through api, so that they are validated, authorized and
+// audited as REST requests are. Subscriptions watch the users namespace of
+// client.
+func graphqlSchema(api *apiclient.Client, client *db.Client) (graphql.Schema, error) {
+	types := &graphqlTypes{objects: make(map[reflect.Type]*graphql.Object)}
+	userType := types.object(reflect.TypeOf(apiclient.User{}))
+	connectionType := types.object(reflect.TypeOf(userConnection{}))
+	eventType := types.object(reflect.TypeOf(userEvent{}))
+	userInput := graphqlInput("UserInput", reflect.TypeOf(models.User{}))
+
+	userType.AddFieldConfig("history", &graphql.Field{
+		Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(userType))),
+		Description: "Past versions of the user, most recent first",
+		Args: graphql.FieldConfigArgument{
+			"limit": {Type: graphql.Int, Description: "Returns at most this many versions"},
+		},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			limit, _ := p.Args["limit"].(int)
+			history, err := api.UserHistory(p.Context, sourceUser(p).ID, limit)
+			if err != nil {
+				return nil, resolveError(err)
+			}
+			return history.Versions, nil
+		},
+	})
+
+	filterInput := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "UserFilter",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"field": {Type: graphql.NewNonNull(graphqlEnum("UserFilterField", userQuery.Filterable))},
+			"op": {Type: graphql.NewEnum(graphql.EnumConfig{Name: "FilterOp", Values: graphql.EnumValueConfigMap{
+				"EQ":       {Value: query.OpEq, Description: "Exact match"},
+				"PREFIX":   {Value: query.OpPrefix, Description: "Case-insensitive prefix"},
+				"CONTAINS": {Value: query.OpContains, Description: "Case-insensitive substring"},
+			}}), DefaultValue: query.OpEq},
+			"value": {Type: graphql.NewNonNull(graphql.String)},
+		},
+	})
+	sortInput := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "UserSort",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"field": {Type: graphql.NewNonNull(graphqlEnum("UserSortField", append([]string{query.CreatedAt}, userQuery.Sortable...)))},
+			"desc":  {Type: graphql.Boolean, DefaultValue: false},
+		},
+	})
+
+	queryType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"user": {
+				Type: userType,
+				Args: graphql.FieldConfigArgument{"id": {Type: graphql.NewNonNull(graphql.ID)}},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					user, err := api.GetUser(p.Context, p.Args["id"].(string))
+					var problem *apiclient.Error
+					if errors.As(err, &problem) && problem.Status == http.StatusNotFound {
+						return nil, nil
+					}
+					if err != nil {
+						return nil, resolveError(err)
+					}
+					return user, nil
+				},
+			},
+			"users": {
+				Type:        graphql.NewNonNull(connectionType),
+				Description: "Users matching every filter, in the order of sort, by pages",
+				Args: graphql.FieldConfigArgument{
+					"filter": {Type: graphql.NewList(graphql.NewNonNull(filterInput))},
+					"sort":   {Type: graphql.NewList(graphql.NewNonNull(sortInput))},
+					"email":  {Type: graphql.String, Description: "Looks a user up by address, ignoring case, for admins only"},
+					"first":  {Type: graphql.Int, Description: fmt.Sprintf("Size of the page, at most %d", MaxGraphQLPage)},
+					"after":  {Type: graphql.String, Description: "endCursor of the previous page"},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					opts := apiclient.ListOptions{Filters: map[string]string{}}
+					filters, _ := p.Args["filter"].([]interface{})
+					for _, f := range filters {
+						filter := f.(map[string]interface{})
+						parameter := filter["field"].(string)
+						if op := filter["op"].(string); op != query.OpEq {
+							parameter += "[" + op + "]"
+						}
+						opts.Filters[parameter] = filter["value"].(string)
+					}
+					if email, ok := p.Args["email"].(string); ok {
+						opts.Filters["email"] = email
+					}
+					sorts, _ := p.Args["sort"].([]interface{})
+					for _, s := range sorts {
+						sort := s.(map[string]interface{})
+						field := sort["field"].(string)
+						if sort["desc"] == true {
+							field = "-" + field
+						}
+						opts.Sort = append(opts.Sort, field)
+					}
+
+					list, err := api.ListUsers(p.Context, opts)
+					if err != nil {
+						return nil, resolveError(err)
+					}
+					return paginate(list.Users, p.Args)
+				},
+			},
+		},
+	})
+
+	id := &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)}
+	version := &graphql.ArgumentConfig{Type: graphql.Int, Description: "Fails unless the user is at this version"}
+	idempotencyKey := &graphql.ArgumentConfig{Type: graphql.String, Description: "Replays the first result for retries with the same key"}
+	input := &graphql.ArgumentConfig{Type: graphql.NewNonNull(userInput)}
+
+	mutationType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Mutation",
+		Fields: graphql.Fields{
+			"createUser": {
+				Type: graphql.NewNonNull(userType),
+				Args: graphql.FieldConfigArgument{"input": input, "idempotencyKey": idempotencyKey},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					var user models.User
+					if err := decodeArgument(p.Args["input"], &user); err != nil {
+						return nil, err
+					}
+					created, err := api.CreateUser(p.Context, user, mutationOptions(p.Args)...)
+					return created, resolveError(err)
+				},
+			},
+			"updateUser": {
+				Type:        graphql.NewNonNull(userType),
+				Description: "Replaces the name and email of a user",
+				Args:        graphql.FieldConfigArgument{"id": id, "input": input, "version": version, "idempotencyKey": idempotencyKey},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					var user models.User
+					if err := decodeArgument(p.Args["input"], &user); err != nil {
+						return nil, err
+					}
+					updated, err := api.UpdateUser(p.Context, p.Args["id"].(string), user, mutationOptions(p.Args)...)
+					return updated, resolveError(err)
+				},
+			},
+			"patchUser": {
+				Type:        graphql.NewNonNull(userType),
+				Description: "Changes the fields of a user given in input, leaving the others as they are",
+				Args:        graphql.FieldConfigArgument{"id": id, "input": input, "version": version, "idempotencyKey": idempotencyKey},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					changes, _ := p.Args["input"].(map[string]interface{})
+					patched, err := api.PatchUser(p.Context, p.Args["id"].(string), changes, mutationOptions(p.Args)...)
+					return patched, resolveError(err)
+				},
+			},
+			"deleteUser": {
+				Type:        graphql.NewNonNull(graphql.Boolean),
+				Description: "Moves a user to the trash",
+				Args:        graphql.FieldConfigArgument{"id": id, "version": version, "idempotencyKey": idempotencyKey},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if err := api.DeleteUser(p.Context, p.Args["id"].(string), mutationOptions(p.Args)...); err != nil {
+						return nil, resolveError(err)
+					}
+					return true, nil
+				},
+			},
+			"restoreUser": {
+				Type:        graphql.NewNonNull(userType),
+				Description: "Brings a user back from the trash",
+				Args:        graphql.FieldConfigArgument{"id": id},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					restored, err := api.RestoreUser(p.Context, p.Args["id"].(string))
+					return restored, resolveError(err)
+				},
+			},
+			"revertUser": {
+				Type:        graphql.NewNonNull(userType),
+				Description: "Writes a past version of a user as its current one",
+				Args: graphql.FieldConfigArgument{
+					"id":      id,
+					"version": {Type: graphql.NewNonNull(graphql.Int), Description: "Version from the history of the user"},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					reverted, err := api.RevertUser(p.Context, p.Args["id"].(string), int64(p.Args["version"].(int)))
+					return reverted, resolveError(err)
+				},
+			},
+		},
+	})
+
+	// Users can be read without signing in, so events are sent to every
+	// subscriber as ListUsers would return them
+	subscriptionType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Subscription",
+		Fields: graphql.Fields{
+			"userChanged": {
+				Type:        graphql.NewNonNull(eventType),
+				Description: "Sends the creation, updates and deletion of users as they happen",
+				Args: graphql.FieldConfigArgument{
+					"id":    {Type: graphql.ID, Description: "Only sends the changes of this user"},
+					"after": {Type: graphql.Int, Description: "Resumes after the revision of the last event received"},
+				},
+				Subscribe: func(p graphql.ResolveParams) (interface{}, error) {
+					id, _ := p.Args["id"].(string)
+					after, _ := p.Args["after"].(int)
+					watch := client.Watch(p.Context, "users", int64(after))
+
+					events := make(chan interface{})
+					go func() {
+						defer close(events)
+						for event := range watch {
+							if id != "" && event.Record.Key != id {
+								continue
+							}
+							select {
+							case events <- event:
+							case <-p.Context.Done():
+								return
+							}
+						}
+					}()
+					return events, nil
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					event := p.Source.(db.Event)
+					user, err := eventUser(event.Record)
+					if err != nil {
+						return nil, err
+					}
+					return userEvent{Type: event.Type, ID: event.Record.Key, Revision: event.Record.ModRevision, User: user}, nil
+				},
+			},
+		},
+	})
+
+	return graphql.NewSchema(graphql.SchemaConfig{
+		Query:        queryType,
+		Mutation:     mutationType,
+		Subscription: subscriptionType,
+	})
+}
@@ -0,0 +1,294 @@
+//go:build !js
+
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"assette/apiclient"
+	"assette/models"
+)
+
+type graphqlResponse struct {
+	Data   map[string]json.RawMessage `json:"data"`
+	Errors []struct {
+		Message    string                 `json:"message"`
+		Extensions map[string]interface{} `json:"extensions"`
+	} `json:"errors"`
+}
+
+// postGraphQL posts a GraphQL request and decodes its result
+func postGraphQL(t *testing.T, c *http.Client, server *httptest.Server, query string, variables map[string]interface{}) graphqlResponse {
+	t.Helper()
+
+	body, _ := json.Marshal(graphqlRequest{Query: query, Variables: variables})
+	resp, err := c.Post(server.URL+"/api/graphql", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", resp.StatusCode)
+	}
+
+	var result graphqlResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+// field decodes a field of the data of a result
+func field(t *testing.T, result graphqlResponse, name string, out interface{}) {
+	t.Helper()
+	if len(result.Errors) > 0 {
+		t.Fatalf("Unexpected errors %+v", result.Errors)
+	}
+	if err := json.Unmarshal(result.Data[name], out); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGraphQL(t *testing.T) {
+	_, _, client := newTestDB(t)
+	server := httptest.NewServer(NewHandler(Config{Client: client}))
+	defer server.Close()
+	c := server.Client()
+
+	const createUser = `mutation($input: UserInput!) { createUser(input: $input) { id name role version createdAt } }`
+	var users []apiclient.User
+	for _, name := range []string{"Ada", "Alan", "Grace"} {
+		var user apiclient.User
+		field(t, postGraphQL(t, c, server, createUser, map[string]interface{}{
+			"input": map[string]interface{}{"name": name, "email": strings.ToLower(name) + "@example.com"},
+		}), "createUser", &user)
+		if user.ID == "" || user.Name != name || user.Role != models.RoleUser || user.Version == 0 || user.CreatedAt.IsZero() {
+			t.Fatalf("Unexpected created user %+v", user)
+		}
+		users = append(users, user)
+	}
+
+	// Validated by the endpoint
+	result := postGraphQL(t, c, server, createUser, map[string]interface{}{"input": map[string]interface{}{"name": "Bad", "email": "bad"}})
+	if len(result.Errors) != 1 || result.Errors[0].Extensions["code"] != CodeValidation {
+		t.Fatalf("Expected a validation error, got %+v", result.Errors)
+	}
+	if errors, _ := result.Errors[0].Extensions["errors"].([]interface{}); len(errors) != 1 || errors[0].(map[string]interface{})["field"] != "email" {
+		t.Errorf("Expected an email field error, got %+v", result.Errors[0].Extensions)
+	}
+
+	const listUsers = `query($after: String) {
+		users(filter: [{field: name, op: PREFIX, value: "a"}], sort: [{field: name, desc: true}], first: 1, after: $after) {
+			nodes { id name }
+			totalCount
+			pageInfo { hasNextPage endCursor }
+		}
+	}`
+	var page userConnection
+	field(t, postGraphQL(t, c, server, listUsers, nil), "users", &page)
+	if len(page.Nodes) != 1 || page.Nodes[0].Name != "Alan" || page.TotalCount != 2 || !page.PageInfo.HasNextPage {
+		t.Fatalf("Unexpected first page %+v", page)
+	}
+	field(t, postGraphQL(t, c, server, listUsers, map[string]interface{}{"after": page.PageInfo.EndCursor}), "users", &page)
+	if len(page.Nodes) != 1 || page.Nodes[0].Name != "Ada" || page.PageInfo.HasNextPage {
+		t.Errorf("Unexpected second page %+v", page)
+	}
+	result = postGraphQL(t, c, server, listUsers, map[string]interface{}{"after": "not a cursor"})
+	if len(result.Errors) != 1 || result.Errors[0].Extensions["code"] != CodeInvalidParameter {
+		t.Errorf("Expected an invalid cursor error, got %+v", result.Errors)
+	}
+
+	ada := users[0]
+	const patchUser = `mutation($id: ID!, $version: Int) { patchUser(id: $id, input: {name: "Ada Lovelace"}, version: $version) { name email version } }`
+	result = postGraphQL(t, c, server, patchUser, map[string]interface{}{"id": ada.ID})
+	if len(result.Errors) != 1 || result.Errors[0].Extensions["status"] != float64(http.StatusUnauthorized) {
+		t.Errorf("Expected 401 for an anonymous change, got %+v", result.Errors)
+	}
+
+	c.Jar, _ = cookiejar.New(nil)
+	serverURL, _ := url.Parse(server.URL)
+	c.Jar.SetCookies(serverURL, newAdminSession(t, client).Result().Cookies())
+	var patched apiclient.User
+	field(t, postGraphQL(t, c, server, patchUser, map[string]interface{}{"id": ada.ID, "version": ada.Version}), "patchUser", &patched)
+	if patched.Name != "Ada Lovelace" || patched.Email != "ada@example.com" || patched.Version <= ada.Version {
+		t.Errorf("Unexpected patched user %+v", patched)
+	}
+	result = postGraphQL(t, c, server, patchUser, map[string]interface{}{"id": ada.ID, "version": ada.Version})
+	if len(result.Errors) != 1 || result.Errors[0].Extensions["status"] != float64(http.StatusPreconditionFailed) {
+		t.Errorf("Expected 412 for a stale version, got %+v", result.Errors)
+	}
+
+	// Related data in the same request
+	var user struct {
+		Name    string `json:"name"`
+		History []struct {
+			Name string `json:"name"`
+		} `json:"history"`
+	}
+	field(t, postGraphQL(t, c, server, `query($id: ID!) { user(id: $id) { name history { name } } }`, map[string]interface{}{"id": ada.ID}), "user", &user)
+	if user.Name != "Ada Lovelace" || len(user.History) != 2 || user.History[1].Name != "Ada" {
+		t.Errorf("Unexpected user with history %+v", user)
+	}
+
+	var deleted bool
+	field(t, postGraphQL(t, c, server, `mutation($id: ID!) { deleteUser(id: $id) }`, map[string]interface{}{"id": ada.ID}), "deleteUser", &deleted)
+	if !deleted {
+		t.Error("Expected the user to be deleted")
+	}
+	result = postGraphQL(t, c, server, `query($id: ID!) { user(id: $id) { name } }`, map[string]interface{}{"id": ada.ID})
+	if len(result.Errors) > 0 || string(result.Data["user"]) != "null" {
+		t.Errorf("Expected no trashed user, got %+v", result)
+	}
+
+	// Mutations cannot be sent with GET
+	resp, err := c.Get(server.URL + "/api/graphql?query=" + url.QueryEscape(`mutation { deleteUser(id: "`+users[1].ID+`") }`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != http.MethodPost {
+		t.Errorf("Expected 405 for a mutation sent with GET, got %d", resp.StatusCode)
+	}
+}
+
+// TestGraphQLLimits checks that queries nesting too deep or resolving too
+// many objects are rejected before they run
+func TestGraphQLLimits(t *testing.T) {
+	_, _, client := newTestDB(t)
+	server := httptest.NewServer(NewHandler(Config{Client: client}))
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		query  string
+		status int
+	}{
+		{"history of a page", `{ users { nodes { history { name } } } }`, http.StatusOK},
+		{"bounded nested history", `{ user(id: "a") { history(limit: 5) { history(limit: 5) { name } } } }`, http.StatusOK},
+		{"nested history", `{ users { nodes { history { history { name } } } } }`, http.StatusBadRequest},
+		{"nested in fragments", `{ users { nodes { ...h } } } fragment h on User { history { ...n } } fragment n on User { history { name } }`, http.StatusBadRequest},
+		{"too deep", `{ user(id: "a") { ` + strings.Repeat("history(limit: 1) { ", 8) + `name` + strings.Repeat(" }", 8) + ` } }`, http.StatusBadRequest},
+		{"spreading itself", `{ user(id: "a") { ...f } } fragment f on User { history(limit: 1) { ...f } }`, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, _ := json.Marshal(graphqlRequest{Query: tt.query})
+			resp, err := server.Client().Post(server.URL+"/api/graphql", "application/json", bytes.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Errorf("Expected status %d, got %d", tt.status, resp.StatusCode)
+			}
+		})
+	}
+}
+
+// TestGraphQLSession checks that mutations run with the session of the
+// GraphQL request
+func TestGraphQLSession(t *testing.T) {
+	_, _, client := newTestDB(t)
+	userID := newTestAccount(t, client, models.User{Name: "Ada", Email: "ada@example.com", Role: models.RoleUser}, "correct horse battery")
+	server := httptest.NewServer(NewHandler(Config{Client: client}))
+	defer server.Close()
+
+	api := apiclient.New(server.URL)
+	if _, err := api.Login(context.Background(), "ada@example.com", "correct horse battery"); err != nil {
+		t.Fatal(err)
+	}
+
+	var created apiclient.User
+	field(t, postGraphQL(t, api.HTTPClient, server, `mutation { createUser(input: {name: "Grace", email: "grace@example.com"}) { createdBy } }`, nil), "createUser", &created)
+	if created.CreatedBy != userID {
+		t.Errorf("Expected the user to be created by %s, got %q", userID, created.CreatedBy)
+	}
+}
+
+func TestGraphQLSubscription(t *testing.T) {
+	_, _, client := newTestDB(t)
+	server := httptest.NewServer(NewHandler(Config{Client: client}))
+	defer server.Close()
+	c := server.Client()
+	c.Jar, _ = cookiejar.New(nil)
+	serverURL, _ := url.Parse(server.URL)
+	c.Jar.SetCookies(serverURL, newAdminSession(t, client).Result().Cookies())
+
+	var ada apiclient.User
+	field(t, postGraphQL(t, c, server, `mutation { createUser(input: {name: "Ada", email: "ada@example.com"}) { id version } }`, nil), "createUser", &ada)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	subscription := `subscription($after: Int) { userChanged(after: $after) { type id revision user { name } } }`
+	variables, _ := json.Marshal(map[string]interface{}{"after": ada.Version - 1})
+	subscribeURL := server.URL + "/api/graphql?query=" + url.QueryEscape(subscription) + "&variables=" + url.QueryEscape(string(variables))
+
+	// Each subscription holds a watch, anonymous clients cannot open one
+	anonymous, err := http.Get(subscribeURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	anonymous.Body.Close()
+	if anonymous.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected status %d for an anonymous subscription, got %d", http.StatusUnauthorized, anonymous.StatusCode)
+	}
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, subscribeURL, nil)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Expected an event stream, got %q", resp.Header.Get("Content-Type"))
+	}
+
+	events := bufio.NewScanner(resp.Body)
+	next := func() userEvent {
+		t.Helper()
+		for events.Scan() {
+			data, ok := strings.CutPrefix(events.Text(), "data: ")
+			if !ok {
+				continue
+			}
+			var result struct {
+				Data struct {
+					UserChanged userEvent `json:"userChanged"`
+				} `json:"data"`
+			}
+			if err := json.Unmarshal([]byte(data), &result); err != nil {
+				t.Fatal(err)
+			}
+			return result.Data.UserChanged
+		}
+		t.Fatalf("Expected an event: %v", events.Err())
+		return userEvent{}
+	}
+
+	// Resumed from before the creation
+	if event := next(); event.Type != "create" || event.ID != ada.ID || event.Revision != ada.Version || event.User.Name != "Ada" {
+		t.Errorf("Unexpected creation event %+v", event)
+	}
+
+	postGraphQL(t, c, server, `mutation($id: ID!) { patchUser(id: $id, input: {name: "Ada Lovelace"}) { version } }`, map[string]interface{}{"id": ada.ID})
+	if event := next(); event.Type != "update" || event.User.Name != "Ada Lovelace" {
+		t.Errorf("Unexpected update event %+v", event)
+	}
+
+	postGraphQL(t, c, server, `mutation($id: ID!) { deleteUser(id: $id) }`, map[string]interface{}{"id": ada.ID})
+	if event := next(); event.Type != "delete" || event.User.Name != "Ada Lovelace" {
+		t.Errorf("Unexpected delete event %+v", event)
+	}
+}
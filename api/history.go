@@ -0,0 +1,94 @@
+//go:build !js
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"assette/apiclient"
+	"assette/db"
+	"assette/models"
+)
+
+// GetUserHistory returns the versions of a user, most recent first. The
+// limit query parameter caps how many are returned.
+func GetUserHistory(client *db.Client) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.PathValue("id")
+
+		limit := 0
+		if value := r.URL.Query().Get("limit"); value != "" {
+			var err error
+			if limit, err = strconv.Atoi(value); err != nil || limit < 0 {
+				WriteError(w, r, NewProblem(http.StatusBadRequest, CodeInvalidParameter, "Invalid limit parameter"))
+				return
+			}
+		}
+
+		records, err := client.History(r.Context(), "users", userID, limit)
+		if err != nil {
+			if err == db.ErrKeyNotFound {
+				WriteError(w, r, NewProblem(http.StatusNotFound, CodeNotFound, "User not found"))
+				return
+			}
+			WriteError(w, r, err)
+			return
+		}
+		if notModified(w, r, listETag(records)) {
+			return
+		}
+
+		versions := make([]map[string]interface{}, 0, len(records))
+		for _, record := range records {
+			var user models.User
+			if err := json.Unmarshal(record.Value, &user); err != nil {
+				continue // Skip malformed versions
+			}
+			versions = append(versions, userResponse(userID, user, record.Metadata))
+		}
+
+		respond(w, r, http.StatusOK, map[string]interface{}{
+			"versions": versions,
+			"count":    len(versions),
+		})
+	}
+}
+
+// RevertUser writes a past version of a user, as listed by GetUserHistory,
+// as its new version. The version is validated like an update, and the role
+// and email verification are kept as they are now.
+func RevertUser(client *db.Client) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request apiclient.RevertRequest
+		if err := decodeBody(r, &request); err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		if request.Version <= 0 {
+			WriteError(w, r, ValidationProblem(FieldError{Field: "version", Code: "required", Message: "Version is required"}))
+			return
+		}
+
+		record, err := client.GetVersion(r.Context(), "users", r.PathValue("id"), request.Version)
+		if err != nil {
+			if err == db.ErrKeyNotFound {
+				WriteError(w, r, NewProblem(http.StatusNotFound, CodeNotFound, "Version not found"))
+				return
+			}
+			WriteError(w, r, err)
+			return
+		}
+
+		var version models.User
+		if err := json.Unmarshal(record.Value, &version); err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		updateUser(w, r, client, func(existing []byte) (models.User, error) {
+			return version, nil
+		})
+	}
+}
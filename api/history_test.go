@@ -0,0 +1,70 @@
+//go:build !js
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"assette/models"
+)
+
+func userHistory(t *testing.T, handler http.HandlerFunc, userID string) []map[string]interface{} {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, "/api/users/"+userID+"/history", nil)
+	req.SetPathValue("id", userID)
+	w := httptest.NewRecorder()
+	handler(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+
+	var response struct {
+		Versions []map[string]interface{} `json:"versions"`
+	}
+	json.NewDecoder(w.Body).Decode(&response)
+	return response.Versions
+}
+
+func TestUserHistoryAndRevert(t *testing.T) {
+	_, _, client := newTestDB(t)
+	client.KeepHistory("users")
+
+	userID := "user:history"
+	for _, name := range []string{"Ada", "Ada Lovelace", "Countess"} {
+		client.PutIndexed(context.Background(), "users", userID, models.User{Name: name, Email: "ada@example.com"}, UsersByEmail)
+	}
+
+	versions := userHistory(t, GetUserHistory(client), userID)
+	if len(versions) != 3 || versions[0]["name"] != "Countess" || versions[2]["name"] != "Ada" {
+		t.Fatalf("Expected three versions, most recent first, got %v", versions)
+	}
+
+	first := versions[2]["version"]
+	w := callUser(RevertUser(client), http.MethodPost, userID, fmt.Sprintf(`{"version":%v}`, first))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+
+	var reverted map[string]interface{}
+	json.NewDecoder(w.Body).Decode(&reverted)
+	if reverted["name"] != "Ada" || reverted["version"] == first {
+		t.Errorf("Expected the first version written as a new one, got %v", reverted)
+	}
+
+	if versions := userHistory(t, GetUserHistory(client), userID); len(versions) != 4 || versions[0]["name"] != "Ada" {
+		t.Errorf("Expected the revert to add a version, got %v", versions)
+	}
+
+	if w := callUser(RevertUser(client), http.MethodPost, userID, `{"version":1}`); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for an unknown version, got %d", http.StatusNotFound, w.Code)
+	}
+	if w := callUser(GetUserHistory(client), http.MethodGet, "user:missing", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for an unknown user, got %d", http.StatusNotFound, w.Code)
+	}
+}
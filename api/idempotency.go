@@ -0,0 +1,209 @@
+//go:build !js
+
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"assette/codec"
+	"assette/db"
+)
+
+// DefaultIdempotencyTTL is how long responses are kept for replay when
+// Config.IdempotencyTTL is not set
+const DefaultIdempotencyTTL = 24 * time.Hour
+
+// idempotencyLockTTL is how long a key stays claimed by a request that has
+// not completed, in case the node handling it goes away
+const idempotencyLockTTL = time.Minute
+
+// MaxIdempotencyKeyLength bounds the Idempotency-Key header
+const MaxIdempotencyKeyLength = 255
+
+// replayedHeaders are the response headers stored for replay. Others, such
+// as the request ID or rate limit headers, describe the retry itself.
+var replayedHeaders = []string{"Content-Type", "Vary", "Location", "ETag", "Last-Modified", "Accept-Patch"}
+
+// idempotentResponse is stored in the idempotency namespace for each key
+type idempotentResponse struct {
+	Fingerprint string            `json:"fingerprint"`
+	Status      int               `json:"status,omitempty"` // Zero until the request completes
+	Header      map[string]string `json:"header,omitempty"`
+	Body        []byte            `json:"body,omitempty"`
+}
+
+// Idempotency makes POST and PATCH requests carrying an Idempotency-Key
+// header safe to retry. The first request with a key is handled and its
+// response stored in the idempotency namespace of etcd for ttl, so that
+// every node of a cluster answers retries with the same key with that
+// response, marked by Idempotent-Replayed: true. Reusing a key for a
+// different request, or asking for the response in another format, gets 422, and retrying while the first request is still
+// running gets 409. Server errors are not stored, so the request can be
+// retried.
+//
+// Keys are scoped to the authenticated user, if any.
+func Idempotency(client *db.Client, ttl time.Duration) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get("Idempotency-Key")
+			if key == "" || (r.Method != http.MethodPost && r.Method != http.MethodPatch) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if len(key) > MaxIdempotencyKeyLength {
+				WriteError(w, r, NewProblem(http.StatusBadRequest, CodeInvalidParameter, "Idempotency-Key is too long"))
+				return
+			}
+
+			// Held whole to fingerprint it, so limited to the largest body of
+			// the endpoints, which still apply their own limit
+			body, err := readBody(r, MaxImportSize)
+			if err != nil {
+				WriteError(w, r, err)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			recordKey := idempotencyRecordKey(r, key)
+			fingerprint := requestFingerprint(r, body)
+
+			err = client.CreateWithTTL(r.Context(), "idempotency", recordKey, idempotentResponse{Fingerprint: fingerprint}, idempotencyLockTTL)
+			if err == db.ErrKeyExists {
+				replayResponse(w, r, client, recordKey, fingerprint)
+				return
+			}
+			if err != nil {
+				WriteError(w, r, err)
+				return
+			}
+
+			recorder := &responseCapture{ResponseWriter: w}
+			completed := false
+			defer func() {
+				// Let the request be retried if it panicked or failed
+				if !completed {
+					if _, err := client.Delete(r.Context(), "idempotency", recordKey); err != nil {
+						log.Printf("[WARNING] idempotency key release: %v", err)
+					}
+				}
+			}()
+
+			next.ServeHTTP(recorder, r)
+
+			status := recorder.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			if status >= http.StatusInternalServerError {
+				return
+			}
+
+			stored := idempotentResponse{
+				Fingerprint: fingerprint,
+				Status:      status,
+				Header:      make(map[string]string),
+				Body:        recorder.body.Bytes(),
+			}
+			for _, name := range replayedHeaders {
+				if value := w.Header().Get(name); value != "" {
+					stored.Header[name] = value
+				}
+			}
+
+			if err := client.PutWithTTL(r.Context(), "idempotency", recordKey, stored, ttl); err != nil {
+				log.Printf("[WARNING] idempotency key %s: %v", recordKey, err)
+				return
+			}
+			completed = true
+		})
+	}
+}
+
+// replayResponse answers a request whose key has already been used
+func replayResponse(w http.ResponseWriter, r *http.Request, client *db.Client, recordKey string, fingerprint string) {
+	data, err := client.Get(r.Context(), "idempotency", recordKey)
+	if err == db.ErrKeyNotFound {
+		// Released by a failed request or expired since, let the client retry
+		w.Header().Set("Retry-After", "1")
+		WriteError(w, r, NewProblem(http.StatusConflict, CodeRequestInProgress, "A request with this Idempotency-Key is in progress"))
+		return
+	}
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+
+	var stored idempotentResponse
+	if err := json.Unmarshal(data, &stored); err != nil {
+		WriteError(w, r, err)
+		return
+	}
+
+	switch {
+	case stored.Fingerprint != fingerprint:
+		WriteError(w, r, NewProblem(http.StatusUnprocessableEntity, CodeIdempotencyReused, "Idempotency-Key was already used for a different request"))
+	case stored.Status == 0:
+		w.Header().Set("Retry-After", "1")
+		WriteError(w, r, NewProblem(http.StatusConflict, CodeRequestInProgress, "A request with this Idempotency-Key is in progress"))
+	default:
+		for name, value := range stored.Header {
+			w.Header().Set(name, value)
+		}
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.WriteHeader(stored.Status)
+		w.Write(stored.Body)
+	}
+}
+
+// idempotencyRecordKey scopes key to the authenticated user, hashed so that
+// any header value makes a valid etcd key
+func idempotencyRecordKey(r *http.Request, key string) string {
+	userID, _ := UserIDFromContext(r.Context())
+	sum := sha256.Sum256([]byte(userID + "\n" + key))
+	return hex.EncodeToString(sum[:])
+}
+
+// requestFingerprint identifies what a request asks for, to recognize a key
+// reused for another request. That includes the format the response is
+// negotiated in, since the stored response is replayed as it was written.
+func requestFingerprint(r *http.Request, body []byte) string {
+	hash := sha256.New()
+	io.WriteString(hash, r.Method+" "+r.URL.RequestURI()+"\n"+r.Header.Get("Content-Type")+"\n")
+	io.WriteString(hash, codec.Negotiate(r.Header.Get("Accept")).MediaType+"\n")
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// responseCapture copies the response written by a handler
+type responseCapture struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *responseCapture) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseCapture) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *responseCapture) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,145 @@
+//go:build !js
+
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"assette/codec"
+)
+
+func TestIdempotencyKey(t *testing.T) {
+	_, _, client := newTestDB(t)
+	router := NewHandler(Config{Client: client})
+
+	post := func(key string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/users", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	body := `{"name": "Ada", "email": "ada@example.com"}`
+	first := post("key-1", body)
+	if first.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, first.Code, first.Body)
+	}
+
+	retry := post("key-1", body)
+	if retry.Code != http.StatusCreated || retry.Body.String() != first.Body.String() {
+		t.Errorf("Expected the original response to be replayed, got %d: %s", retry.Code, retry.Body)
+	}
+	if retry.Header().Get("Idempotent-Replayed") != "true" || retry.Header().Get("ETag") != first.Header().Get("ETag") {
+		t.Errorf("Expected replayed headers, got %v", retry.Header())
+	}
+	if users, _ := client.List(t.Context(), "users"); len(users) != 1 {
+		t.Errorf("Expected a single user to be created, got %d", len(users))
+	}
+
+	if w := post("key-1", `{"name": "Grace", "email": "grace@example.com"}`); w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), CodeIdempotencyReused) {
+		t.Errorf("Expected status %d reusing a key for another request, got %d: %s", http.StatusUnprocessableEntity, w.Code, w.Body)
+	}
+
+	// The stored response is in the format of the first request
+	req := httptest.NewRequest(http.MethodPost, "/api/users", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", codec.MessagePack)
+	req.Header.Set("Idempotency-Key", "key-1")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected status %d asking for another format, got %d: %s", http.StatusUnprocessableEntity, w.Code, w.Header().Get("Content-Type"))
+	}
+
+	// Failed requests are replayed too, as long as they are not server errors
+	invalid := `{"name": "", "email": "bad"}`
+	if w := post("key-2", invalid); w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+	if w := post("key-2", invalid); w.Code != http.StatusBadRequest || w.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("Expected the validation error to be replayed, got %d %v", w.Code, w.Header())
+	}
+
+	if w := post("", body); w.Code != http.StatusConflict {
+		t.Errorf("Expected requests without a key to run again, got %d", w.Code)
+	}
+	if w := post(strings.Repeat("k", MaxIdempotencyKeyLength+1), body); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for a long key, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestIdempotencyKeyInProgress(t *testing.T) {
+	_, _, client := newTestDB(t)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	handler := Idempotency(client, DefaultIdempotencyTTL)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	request := func() *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/api/users", strings.NewReader("{}"))
+		req.Header.Set("Idempotency-Key", "slow")
+		return req
+	}
+
+	done := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, request())
+		done <- w.Code
+	}()
+	<-started
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, request())
+	if w.Code != http.StatusConflict || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected status %d while the first request runs, got %d", http.StatusConflict, w.Code)
+	}
+
+	close(release)
+	if code := <-done; code != http.StatusCreated {
+		t.Fatalf("Expected first request to complete, got %d", code)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, request())
+	if w.Code != http.StatusCreated {
+		t.Errorf("Expected the response to be replayed once complete, got %d", w.Code)
+	}
+}
+
+func TestIdempotencyKeyServerError(t *testing.T) {
+	_, _, client := newTestDB(t)
+
+	calls := 0
+	handler := Idempotency(client, DefaultIdempotencyTTL)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	for _, expected := range []int{http.StatusServiceUnavailable, http.StatusCreated, http.StatusCreated} {
+		req := httptest.NewRequest(http.MethodPost, "/api/users", strings.NewReader("{}"))
+		req.Header.Set("Idempotency-Key", "flaky")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != expected {
+			t.Errorf("Expected status %d, got %d", expected, w.Code)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("Expected the handler to run again after a server error only, got %d calls", calls)
+	}
+}
@@ -3,27 +3,17 @@
 package api
 
 import (
-	"encoding/json"
 	"net/http"
 )
 
 func GetMessage() func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
-			return
-		}
-
 		response := struct {
 			Text string `json:"text"`
 		}{
 			Text: "Welcome to the Go PWA template!",
 		}
 
-		w.Header().Set("Content-Type", "application/json")
-		if err := json.NewEncoder(w).Encode(response); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+		respond(w, r, http.StatusOK, response)
 	}
 }
\ No newline at end of file
@@ -40,13 +40,13 @@ func TestGetMessage(t *testing.T) {
 }
 
 func TestGetMessageInvalidMethod(t *testing.T) {
-	handler := GetMessage()
+	handler := NewHandler(Config{})
 
 	// Test POST request (should fail)
 	req := httptest.NewRequest(http.MethodPost, "/api/message", nil)
 	w := httptest.NewRecorder()
 
-	handler(w, req)
+	handler.ServeHTTP(w, req)
 
 	if w.Code != http.StatusMethodNotAllowed {
 		t.Errorf("Expected status code %d for POST request, got %d", http.StatusMethodNotAllowed, w.Code)
@@ -0,0 +1,127 @@
+//go:build !js
+
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"assette/db"
+)
+
+// addMetadata adds the metadata of a record to its API representation.
+// Records written before metadata was maintained only have a version.
+func addMetadata(response map[string]interface{}, meta db.Metadata) {
+	response["version"] = meta.Version
+	if meta.CreatedAt.IsZero() {
+		return
+	}
+
+	response["createdAt"] = meta.CreatedAt
+	response["updatedAt"] = meta.UpdatedAt
+	if meta.CreatedBy != "" {
+		response["createdBy"] = meta.CreatedBy
+	}
+	if meta.UpdatedBy != "" {
+		response["updatedBy"] = meta.UpdatedBy
+	}
+	if !meta.DeletedAt.IsZero() {
+		response["deletedAt"] = meta.DeletedAt
+		response["deletedBy"] = meta.DeletedBy
+	}
+}
+
+// setVersionHeaders sets the ETag and Last-Modified headers of a record,
+// which clients send back in If-Match and If-Modified-Since
+func setVersionHeaders(w http.ResponseWriter, meta db.Metadata) {
+	w.Header().Set("ETag", versionETag(meta.Version))
+	if !meta.UpdatedAt.IsZero() {
+		w.Header().Set("Last-Modified", meta.UpdatedAt.Format(http.TimeFormat))
+	}
+}
+
+// versionETag is the entity tag of a record at a given version
+func versionETag(version int64) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+// ifMatch reports whether the If-Match header of r, if any, matches the
+// version of a record. Weak tags never match, as required by RFC 9110.
+func ifMatch(r *http.Request, meta db.Metadata) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" || strings.TrimSpace(header) == "*" {
+		return true
+	}
+
+	etag := versionETag(meta.Version)
+	for _, tag := range strings.Split(header, ",") {
+		if strings.TrimSpace(tag) == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModifiedSince reports whether a GET can be answered with 304 Not
+// Modified because the record has not changed since If-Modified-Since.
+// HTTP dates have a one-second resolution, so the update time is truncated.
+func notModifiedSince(r *http.Request, meta db.Metadata) bool {
+	header := r.Header.Get("If-Modified-Since")
+	if header == "" || meta.UpdatedAt.IsZero() || r.Header.Get("If-None-Match") != "" {
+		return false
+	}
+
+	since, err := http.ParseTime(header)
+	if err != nil {
+		return false
+	}
+	return !meta.UpdatedAt.Truncate(time.Second).After(since)
+}
+
+// listETag is the entity tag of a list of records. Writing a record gives it
+// the highest revision and deleting one lowers the count, so the tag changes
+// whenever the list does.
+func listETag(records []db.Record) string {
+	var latest int64
+	for _, record := range records {
+		if record.ModRevision > latest {
+			latest = record.ModRevision
+		}
+	}
+	return fmt.Sprintf(`"%d-%d"`, latest, len(records))
+}
+
+// ifNoneMatch reports whether the If-None-Match header of r matches etag, in
+// which case a GET is answered with 304 Not Modified. Weak tags match too, as
+// required by RFC 9110.
+func ifNoneMatch(r *http.Request, etag string) bool {
+	header := r.Header.Get("If-None-Match")
+	if header == "" {
+		return false
+	}
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+
+	for _, tag := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(tag), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified answers r with 304 Not Modified, returning true, if the client
+// already has the version tagged etag. The tag is set either way.
+func notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+	if !ifNoneMatch(r, etag) {
+		return false
+	}
+	// As respond would have for the full response
+	w.Header().Add("Vary", "Accept")
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
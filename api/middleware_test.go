@@ -0,0 +1,160 @@
+//go:build !js
+
+package api
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &buf
+}
+
+func TestLogger(t *testing.T) {
+	buf := captureLog(t)
+
+	handler := RequestID(Logger(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusTeapot)
+	})))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/message", nil)
+	req.Header.Set("X-Request-ID", "abc-123")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	line := buf.String()
+	for _, want := range []string{"GET", "/api/message", "418", "request=abc-123"} {
+		if !strings.Contains(line, want) {
+			t.Errorf("Expected log line to contain %q, got %q", want, line)
+		}
+	}
+}
+
+func TestRecoverer(t *testing.T) {
+	buf := captureLog(t)
+
+	handler := Recoverer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status %d, got %d", http.StatusInternalServerError, w.Code)
+	}
+	if strings.Contains(w.Body.String(), "boom") {
+		t.Error("Expected panic value to stay out of the response")
+	}
+	if !strings.Contains(buf.String(), "boom") {
+		t.Error("Expected panic to be logged")
+	}
+}
+
+func TestCORS(t *testing.T) {
+	handler := CORS(CORSConfig{
+		AllowedOrigins:   []string{"https://app.example.com"},
+		AllowCredentials: true,
+		MaxAge:           time.Hour,
+	})(okHandler())
+
+	// Preflight from an allowed origin
+	req := httptest.NewRequest(http.MethodOptions, "/api/users", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", http.MethodPut)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Expected status %d for preflight, got %d", http.StatusNoContent, w.Code)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://app.example.com" {
+		t.Errorf("Expected allowed origin to be echoed, got %q", got)
+	}
+	if !strings.Contains(w.Header().Get("Access-Control-Allow-Methods"), http.MethodPut) {
+		t.Errorf("Expected PUT in allowed methods, got %q", w.Header().Get("Access-Control-Allow-Methods"))
+	}
+	if got := w.Header().Get("Access-Control-Max-Age"); got != "3600" {
+		t.Errorf("Expected max age 3600, got %q", got)
+	}
+
+	// Simple request from an allowed origin
+	req = httptest.NewRequest(http.MethodGet, "/api/users", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Credentials") != "true" {
+		t.Errorf("Expected credentialed CORS response, got status %d and headers %v", w.Code, w.Header())
+	}
+
+	// Other origins get no CORS headers
+	req = httptest.NewRequest(http.MethodGet, "/api/users", nil)
+	req.Header.Set("Origin", "https://evil.example.com")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Error("Expected no CORS headers for a disallowed origin")
+	}
+
+	// Any origin is allowed without credentials, but never echoed
+	for _, credentials := range []bool{false, true} {
+		handler = CORS(CORSConfig{AllowedOrigins: []string{"*"}, AllowCredentials: credentials})(okHandler())
+		req = httptest.NewRequest(http.MethodGet, "/api/users", nil)
+		req.Header.Set("Origin", "https://evil.example.com")
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		expected := "*"
+		if credentials {
+			expected = ""
+		}
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != expected || w.Header().Get("Access-Control-Allow-Credentials") != "" {
+			t.Errorf("Expected origin %q for a wildcard with credentials %v, got headers %v", expected, credentials, w.Header())
+		}
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	handler := Timeout(20 * time.Millisecond)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+			w.Write([]byte("late"))
+		}
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Content-Type") != "application/problem+json" {
+		t.Errorf("Expected status %d with a problem, got %d %s", http.StatusServiceUnavailable, w.Code, w.Header().Get("Content-Type"))
+	}
+	if p := decodeProblem(t, w); p.Code != CodeUnavailable {
+		t.Errorf("Expected code %s, got %s", CodeUnavailable, p.Code)
+	}
+
+	// Responses in time are written as the handler wrote them
+	handler = Timeout(time.Second)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("done"))
+	}))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusAccepted || w.Header().Get("Content-Type") != "text/plain" || w.Body.String() != "done" {
+		t.Errorf("Expected the response of the handler, got %d %v %q", w.Code, w.Header(), w.Body)
+	}
+}
@@ -0,0 +1,404 @@
+//go:build !js
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"assette/codec"
+	"assette/query"
+)
+
+// Operation describes an endpoint in the OpenAPI document. Bodies are given
+// as values of the Go types they are encoded from, and their schemas are
+// derived from those types the way encoding/json would encode them.
+type Operation struct {
+	ID          string // Unique within a version, such as listUsers
+	Summary     string
+	Description string
+	Tags        []string
+	Parameters  []Parameter // Query and header parameters, path ones are derived
+
+	// Request is the body, a value of its type or a Content for other media
+	// types than those of the codec package. Nil if there is none.
+	Request interface{}
+
+	// Responses maps statuses to the body returned with them, nil for none.
+	// Problem values are described as problem details.
+	Responses map[int]interface{}
+}
+
+// Parameter is a query or header parameter of an operation
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+// Content maps the media types of a body to a value of its type
+type Content map[string]interface{}
+
+// File is a body of any of the given media types that is not described
+// further, such as a spreadsheet. Their parameters are left out.
+func File(mediaTypes ...string) Content {
+	content := make(Content)
+	for _, mediaType := range mediaTypes {
+		if parsed, _, err := mime.ParseMediaType(mediaType); err == nil {
+			mediaType = parsed
+		}
+		content[mediaType] = binary{}
+	}
+	return content
+}
+
+// OneOf is a body that is one of several types
+type OneOf []interface{}
+
+// binary stands for the bytes of a File
+type binary struct{}
+
+// Schema is a JSON Schema, in the 2020-12 dialect used by OpenAPI 3.1
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 interface{}        `json:"type,omitempty"` // A type name, or several
+	Format               string             `json:"format,omitempty"`
+	ContentMediaType     string             `json:"contentMediaType,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Enum                 []interface{}      `json:"enum,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties interface{}        `json:"additionalProperties,omitempty"` // A *Schema, or false
+	Items                *Schema            `json:"items,omitempty"`
+	OneOf                []*Schema          `json:"oneOf,omitempty"`
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+	binaryType     = reflect.TypeOf(binary{})
+)
+
+// schemas derives schemas from Go types, collecting named structs as
+// components referenced from the schemas using them
+type schemas struct {
+	types map[reflect.Type]*Schema   // Components by type
+	refs  map[reflect.Type][]*Schema // References, pointed at a component by name
+}
+
+func newSchemas() *schemas {
+	return &schemas{types: make(map[reflect.Type]*Schema), refs: make(map[reflect.Type][]*Schema)}
+}
+
+func (s *schemas) of(v interface{}) *Schema {
+	if alternatives, ok := v.(OneOf); ok {
+		schema := &Schema{}
+		for _, alternative := range alternatives {
+			schema.OneOf = append(schema.OneOf, s.of(alternative))
+		}
+		return schema
+	}
+	return s.ofType(reflect.TypeOf(v))
+}
+
+func (s *schemas) ofType(t reflect.Type) *Schema {
+	switch t {
+	case timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	case rawMessageType:
+		return &Schema{}
+	case binaryType:
+		return &Schema{Type: "string", Format: "binary"}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return s.ofType(t.Elem())
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: "string", ContentMediaType: "application/octet-stream"}
+		}
+		return &Schema{Type: "array", Items: s.ofType(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: s.ofType(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return s.object(t)
+		}
+		if _, ok := s.types[t]; !ok {
+			// Registered before its fields so that recursive types end
+			s.types[t] = &Schema{}
+			*s.types[t] = *s.object(t)
+		}
+		ref := &Schema{}
+		s.refs[t] = append(s.refs[t], ref)
+		return ref
+	default:
+		return &Schema{}
+	}
+}
+
+// components names the components after their Go type, qualified with
+// its package when types of several packages share a name, and points the
+// references at them
+func (s *schemas) components() map[string]*Schema {
+	shared := make(map[string]int)
+	for t := range s.types {
+		shared[t.Name()]++
+	}
+
+	components := make(map[string]*Schema)
+	for t, schema := range s.types {
+		name := exported(t.Name())
+		if shared[t.Name()] > 1 {
+			name = exported(path.Base(t.PkgPath())) + name
+		}
+		components[name] = schema
+		for _, ref := range s.refs[t] {
+			ref.Ref = "#/components/schemas/" + name
+		}
+	}
+	return components
+}
+
+// exported capitalizes the first letter of a name
+func exported(name string) string {
+	return strings.ToUpper(name[:1]) + name[1:]
+}
+
+// object describes the fields of a struct as encoding/json encodes them:
+// unexported and "-" fields are left out, embedded structs are flattened,
+// and fields are required unless omitempty
+func (s *schemas) object(t reflect.Type) *Schema {
+	schema := &Schema{Type: "object", Properties: make(map[string]*Schema), AdditionalProperties: false}
+	var add func(t reflect.Type)
+	add = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			tag := field.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			name, options, _ := strings.Cut(tag, ",")
+			if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+				add(field.Type)
+				continue
+			}
+			if !field.IsExported() {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+
+			schema.Properties[name] = s.ofType(field.Type)
+			if !strings.Contains(options, "omitempty") {
+				schema.Required = append(schema.Required, name)
+			}
+		}
+	}
+	add(t)
+	return schema
+}
+
+// QueryParameters describes the query parameters of a list endpoint
+// accepting the syntax of the query package
+func QueryParameters(options query.Options) []Parameter {
+	var parameters []Parameter
+	for _, field := range options.Filterable {
+		parameters = append(parameters, Parameter{
+			Name:        field,
+			In:          "query",
+			Description: fmt.Sprintf("Keeps items whose %[1]s is exactly this value; %[1]s[prefix] and %[1]s[contains] match case-insensitively", field),
+			Schema:      &Schema{Type: "string"},
+		})
+	}
+
+	sortable := append([]string{query.CreatedAt}, options.Sortable...)
+	parameters = append(parameters,
+		Parameter{
+			Name:        "sort",
+			In:          "query",
+			Description: "Comma-separated fields to sort by, descending with a leading dash: " + strings.Join(sortable, ", "),
+			Schema:      &Schema{Type: "string"},
+		},
+		Parameter{
+			Name:        "fields",
+			In:          "query",
+			Description: "Comma-separated fields to return, besides the id: " + strings.Join(options.Selectable, ", "),
+			Schema:      &Schema{Type: "string"},
+		},
+	)
+	return parameters
+}
+
+// pathParameter matches the wildcards of route patterns
+var pathParameter = regexp.MustCompile(`\{([^}.]+)(\.\.\.)?\}`)
+
+// OpenAPI returns the OpenAPI 3.1 document describing the routes of the
+// versions registered on r, with the operations they document. Routes of
+// deprecated versions are marked as such.
+func OpenAPI(r *Router) map[string]interface{} {
+	s := newSchemas()
+	problem := s.of(Problem{})
+
+	paths := make(map[string]map[string]interface{})
+	for _, route := range r.Routes() {
+		if route.Version == nil {
+			continue
+		}
+		path := strings.TrimPrefix(route.Pattern, route.Version.Prefix())
+		operation, ok := route.Version.Operations[route.Method+" "+path]
+		if !ok {
+			operation = Operation{Summary: "Undocumented"}
+		}
+
+		document := map[string]interface{}{
+			"summary":   operation.Summary,
+			"responses": responses(s, operation.Responses, problem),
+		}
+		if operation.ID != "" {
+			document["operationId"] = operation.ID
+			if route.Version.Name != "" {
+				document["operationId"] = route.Version.Name + "." + operation.ID
+			}
+		}
+		if operation.Description != "" {
+			document["description"] = operation.Description
+		}
+		tags := operation.Tags
+		if len(tags) == 0 {
+			tags = []string{strings.Split(strings.TrimPrefix(path, "/"), "/")[0]}
+		}
+		document["tags"] = tags
+		if !route.Version.Deprecated.IsZero() {
+			document["deprecated"] = true
+		}
+
+		parameters := []Parameter{}
+		for _, match := range pathParameter.FindAllStringSubmatch(route.Pattern, -1) {
+			parameters = append(parameters, Parameter{Name: match[1], In: "path", Required: true, Schema: &Schema{Type: "string"}})
+		}
+		parameters = append(parameters, operation.Parameters...)
+		if len(parameters) > 0 {
+			document["parameters"] = parameters
+		}
+
+		if operation.Request != nil {
+			document["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content":  content(s, operation.Request, codec.MediaTypes()),
+			}
+		}
+
+		key := pathParameter.ReplaceAllString(route.Pattern, "{$1}")
+		if paths[key] == nil {
+			paths[key] = make(map[string]interface{})
+		}
+		paths[key][strings.ToLower(route.Method)] = document
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.1.0",
+		"info": map[string]interface{}{
+			"title":   "Go PWA API",
+			"version": "1",
+			"description": "Bodies can be sent and received as JSON, MessagePack or CBOR, chosen with Content-Type and Accept. " +
+				"Errors are RFC 9457 problem details.",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": s.components(),
+			"securitySchemes": map[string]interface{}{
+				"session": map[string]interface{}{"type": "apiKey", "in": "cookie", "name": "session"},
+			},
+		},
+		// Endpoints that need no authentication accept anonymous requests
+		"security": []map[string][]string{{}, {"session": {}}},
+	}
+}
+
+// content describes a body in each of its media types
+func content(s *schemas, body interface{}, mediaTypes []string) map[string]interface{} {
+	described, ok := body.(Content)
+	if !ok {
+		described = make(Content)
+		for _, mediaType := range mediaTypes {
+			described[mediaType] = body
+		}
+	}
+
+	content := make(map[string]interface{})
+	for mediaType, value := range described {
+		content[mediaType] = map[string]interface{}{"schema": s.of(value)}
+	}
+	return content
+}
+
+// responses describes the responses of an operation, with problem details
+// for the errors it does not list
+func responses(s *schemas, bodies map[int]interface{}, problem *Schema) map[string]interface{} {
+	problemContent := map[string]interface{}{"application/problem+json": map[string]interface{}{"schema": problem}}
+	responses := map[string]interface{}{
+		"default": map[string]interface{}{"description": "Error", "content": problemContent},
+	}
+
+	for status, body := range bodies {
+		response := map[string]interface{}{"description": http.StatusText(status)}
+		switch body.(type) {
+		case nil:
+		case Problem, *Problem:
+			response["content"] = problemContent
+		default:
+			response["content"] = content(s, body, codec.MediaTypes())
+		}
+		responses[strconv.Itoa(status)] = response
+	}
+	return responses
+}
+
+// ServeOpenAPI serves the OpenAPI document of the routes registered on r
+func ServeOpenAPI(r *Router) func(w http.ResponseWriter, req *http.Request) {
+	var once sync.Once
+	var document []byte
+	return func(w http.ResponseWriter, req *http.Request) {
+		// Built on first use, once every route is registered
+		once.Do(func() {
+			document, _ = json.MarshalIndent(OpenAPI(r), "", "  ")
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(document)
+	}
+}
+
+// sortedKeys returns the keys of a map in order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
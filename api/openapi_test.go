@@ -0,0 +1,294 @@
+//go:build !js
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"assette/models"
+	"assette/totp"
+)
+
+// TestOpenAPIOperations checks that every route of every version is
+// documented and that every documented operation has a route, so that
+// adding or removing an endpoint without its documentation fails
+func TestOpenAPIOperations(t *testing.T) {
+	_, _, client := newTestDB(t)
+	router := NewHandler(Config{Client: client})
+
+	registered := make(map[*Version]map[string]bool)
+	for _, route := range router.Routes() {
+		if route.Version == nil {
+			continue
+		}
+		if registered[route.Version] == nil {
+			registered[route.Version] = make(map[string]bool)
+		}
+		key := route.Method + " " + strings.TrimPrefix(route.Pattern, route.Version.Prefix())
+		registered[route.Version][key] = true
+
+		if _, ok := route.Version.Operations[key]; !ok {
+			t.Errorf("%s %s is not documented", route.Method, route.Pattern)
+		}
+	}
+	if len(registered) != len(DefaultVersions()) {
+		t.Fatalf("Expected routes for %d versions, got %d", len(DefaultVersions()), len(registered))
+	}
+
+	for version, keys := range registered {
+		ids := make(map[string]string)
+		for key, operation := range version.Operations {
+			if !keys[key] {
+				t.Errorf("%s documents %s, which has no route", version.Prefix(), key)
+			}
+			if operation.ID == "" || operation.Summary == "" {
+				t.Errorf("%s %s: missing ID or summary", version.Prefix(), key)
+			}
+			if other, ok := ids[operation.ID]; ok {
+				t.Errorf("%s: %s and %s share the ID %s", version.Prefix(), key, other, operation.ID)
+			}
+			ids[operation.ID] = key
+		}
+	}
+}
+
+// TestOpenAPIResponses sends requests to the v1 endpoints and checks that
+// the status of each response is documented and that its body matches the
+// schema documented for that status
+func TestOpenAPIResponses(t *testing.T) {
+	_, _, client := newTestDB(t)
+	router := NewHandler(Config{Client: client, Mailer: &recordingSender{}})
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/openapi.json", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 for the document, got %d", w.Code)
+	}
+	var document map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &document); err != nil {
+		t.Fatalf("Invalid document: %v", err)
+	}
+	if document["openapi"] != "3.1.0" {
+		t.Errorf("Expected OpenAPI 3.1.0, got %v", document["openapi"])
+	}
+	// Admin endpoints need a session with a second factor
+	newTestAccount(t, client, models.User{Name: "Grace", Email: "grace@example.com", Role: models.RoleAdmin}, "correct horse battery")
+	var session *httptest.ResponseRecorder
+
+	components := document["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+	paths := document["paths"].(map[string]interface{})
+
+	// call requests the path template with its {id} replaced by id, and
+	// validates the response against the documented one
+	call := func(method, template, id, contentType, body string, status int) map[string]interface{} {
+		t.Helper()
+		req := httptest.NewRequest(method, strings.ReplaceAll(template, "{id}", id), strings.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		if session != nil {
+			req = withSession(req, session)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if len(w.Result().Cookies()) > 0 {
+			session = w
+		}
+		if w.Code != status {
+			t.Fatalf("%s %s: expected status %d, got %d: %s", method, template, status, w.Code, w.Body)
+		}
+
+		operation, ok := paths[template].(map[string]interface{})[strings.ToLower(method)].(map[string]interface{})
+		if !ok {
+			t.Fatalf("%s %s is not in the document", method, template)
+		}
+		responses := operation["responses"].(map[string]interface{})
+		response, ok := responses[strconv.Itoa(status)].(map[string]interface{})
+		if !ok {
+			if status < http.StatusBadRequest {
+				t.Fatalf("%s %s: status %d is not documented", method, template, status)
+			}
+			response = responses["default"].(map[string]interface{})
+		}
+
+		content, ok := response["content"].(map[string]interface{})
+		if !ok {
+			if w.Body.Len() > 0 {
+				t.Errorf("%s %s: status %d is documented without a body, got %s", method, template, status, w.Body)
+			}
+			return nil
+		}
+		mediaType := strings.Split(w.Header().Get("Content-Type"), ";")[0]
+		media, ok := content[mediaType].(map[string]interface{})
+		if !ok {
+			t.Fatalf("%s %s: %s is not documented for status %d", method, template, mediaType, status)
+		}
+		if schema := media["schema"].(map[string]interface{}); schema["format"] == "binary" {
+			return nil
+		}
+
+		var value map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &value); err != nil {
+			t.Fatalf("%s %s: invalid JSON: %v", method, template, err)
+		}
+		for _, mismatch := range validateSchema(components, "", media["schema"], value) {
+			t.Errorf("%s %s: %s", method, template, mismatch)
+		}
+		return value
+	}
+
+	call(http.MethodGet, "/api/v1/message", "", "", "", http.StatusOK)
+
+	call(http.MethodPost, "/api/v1/auth/login", "", "application/json", `{"email": "grace@example.com", "password": "wrong password"}`, http.StatusUnauthorized)
+	call(http.MethodPost, "/api/v1/auth/login", "", "application/json", `{"email": "grace@example.com", "password": "correct horse battery"}`, http.StatusOK)
+	enrollment := call(http.MethodPost, "/api/v1/auth/totp/enroll", "", "", "", http.StatusOK)
+	code, _ := totp.Code(enrollment["secret"].(string), totp.Counter(time.Now())-1)
+	call(http.MethodPost, "/api/v1/auth/totp/confirm", "", "application/json", `{"code": "000000x"}`, http.StatusBadRequest)
+	call(http.MethodPost, "/api/v1/auth/totp/confirm", "", "application/json", `{"code": "`+code+`"}`, http.StatusOK)
+	challenge := call(http.MethodPost, "/api/v1/auth/login", "", "application/json", `{"email": "grace@example.com", "password": "correct horse battery"}`, http.StatusOK)
+	code, _ = totp.Code(enrollment["secret"].(string), totp.Counter(time.Now()))
+	call(http.MethodPost, "/api/v1/auth/login/totp", "", "application/json", `{"mfaToken": "`+challenge["mfaToken"].(string)+`", "code": "`+code+`"}`, http.StatusOK)
+
+	user := call(http.MethodPost, "/api/v1/users", "", "application/json", `{"name": "Ada", "email": "ada@example.com"}`, http.StatusCreated)
+	id := user["id"].(string)
+	call(http.MethodPost, "/api/v1/users", "", "application/json", `{"name": "", "email": "bad"}`, http.StatusBadRequest)
+	call(http.MethodGet, "/api/v1/users/{id}", id, "", "", http.StatusOK)
+	call(http.MethodGet, "/api/v1/users/{id}", "user:missing", "", "", http.StatusNotFound)
+	call(http.MethodGet, "/api/v1/users", "", "", "", http.StatusOK)
+	call(http.MethodPut, "/api/v1/users/{id}", id, "application/json", `{"name": "Ada Lovelace", "email": "ada@example.com"}`, http.StatusOK)
+	call(http.MethodPatch, "/api/v1/users/{id}", id, "application/merge-patch+json", `{"name": "Ada"}`, http.StatusOK)
+	call(http.MethodPatch, "/api/v1/users/{id}", id, "application/json-patch+json", `[{"op": "replace", "path": "/name", "value": "Ada L."}]`, http.StatusOK)
+	history := call(http.MethodGet, "/api/v1/users/{id}/history", id, "", "", http.StatusOK)
+	versions := history["versions"].([]interface{})
+	first := versions[len(versions)-1].(map[string]interface{})["version"]
+	call(http.MethodPost, "/api/v1/users/{id}/revert", id, "application/json", fmt.Sprintf(`{"version": %v}`, first), http.StatusOK)
+	call(http.MethodPost, "/api/v1/users/bulk", "", "application/json",
+		`{"operations": [{"op": "create", "user": {"name": "Grace", "email": "grace@example.com"}}, {"op": "delete", "id": "user:missing"}]}`, http.StatusMultiStatus)
+	imported := call(http.MethodPost, "/api/v1/users/import", "", "text/csv", "name,email,extra\nAlan,alan@example.com,x\n,bad,x\n", http.StatusOK)
+	report := imported["report"].(string)
+	call(http.MethodGet, "/api/v1/users/import/reports/{id}", report[strings.LastIndex(report, "/")+1:], "", "", http.StatusOK)
+	call(http.MethodGet, "/api/v1/users/export", "", "", "", http.StatusOK)
+
+	call(http.MethodDelete, "/api/v1/users/{id}", id, "", "", http.StatusNoContent)
+	call(http.MethodGet, "/api/v1/admin/trash/users", "", "", "", http.StatusOK)
+	call(http.MethodPost, "/api/v1/users/{id}/restore", id, "", "", http.StatusOK)
+	call(http.MethodDelete, "/api/v1/users/{id}", id, "", "", http.StatusNoContent)
+	call(http.MethodDelete, "/api/v1/admin/trash/users/{id}", id, "", "", http.StatusNoContent)
+	call(http.MethodDelete, "/api/v1/admin/trash/users", "", "", "", http.StatusOK)
+	call(http.MethodGet, "/api/v1/admin/audit", "", "", "", http.StatusOK)
+
+	hook := call(http.MethodPost, "/api/v1/admin/webhooks", "", "application/json", `{"url": "https://example.com/hooks", "events": ["user.created"]}`, http.StatusCreated)
+	hookID := hook["id"].(string)
+	call(http.MethodPost, "/api/v1/admin/webhooks", "", "application/json", `{"url": "ftp://example.com"}`, http.StatusBadRequest)
+	call(http.MethodGet, "/api/v1/admin/webhooks", "", "", "", http.StatusOK)
+	call(http.MethodGet, "/api/v1/admin/webhooks/{id}", hookID, "", "", http.StatusOK)
+	call(http.MethodGet, "/api/v1/admin/webhooks/{id}/deliveries", hookID, "", "", http.StatusOK)
+	call(http.MethodGet, "/api/v1/admin/webhooks/dead-letters", "", "", "", http.StatusOK)
+	call(http.MethodPost, "/api/v1/admin/webhooks/dead-letters/{id}/redeliver", "missing", "", "", http.StatusNotFound)
+	call(http.MethodDelete, "/api/v1/admin/webhooks/{id}", hookID, "", "", http.StatusNoContent)
+	call(http.MethodGet, "/api/v1/admin/webhooks/{id}", hookID, "", "", http.StatusNotFound)
+
+	call(http.MethodPost, "/api/v1/account/password-reset", "", "application/json", `{"email": "nobody@example.com"}`, http.StatusAccepted)
+	call(http.MethodPost, "/api/v1/account/verification", "", "application/json", `{"userId": "user:grace@example.com"}`, http.StatusAccepted)
+	call(http.MethodPost, "/api/v1/account/verify", "", "application/json", `{"token": "unknown"}`, http.StatusBadRequest)
+	call(http.MethodPost, "/api/v1/account/password", "", "application/json", `{"token": "unknown", "password": "correct horse battery"}`, http.StatusBadRequest)
+	call(http.MethodPost, "/api/v1/auth/logout", "", "", "", http.StatusNoContent)
+}
+
+// validateSchema lists where value does not match a schema of the document,
+// supporting the keywords the document uses
+func validateSchema(components map[string]interface{}, path string, schema interface{}, value interface{}) []string {
+	s, _ := schema.(map[string]interface{})
+	if ref, ok := s["$ref"].(string); ok {
+		return validateSchema(components, path, components[strings.TrimPrefix(ref, "#/components/schemas/")], value)
+	}
+
+	if alternatives, ok := s["oneOf"].([]interface{}); ok {
+		matching := 0
+		for _, alternative := range alternatives {
+			if len(validateSchema(components, path, alternative, value)) == 0 {
+				matching++
+			}
+		}
+		if matching != 1 {
+			return []string{fmt.Sprintf("%s: matches %d of the oneOf schemas", path, matching)}
+		}
+		return nil
+	}
+
+	var mismatches []string
+	switch s["type"] {
+	case nil:
+		return nil
+	case "string":
+		if _, ok := value.(string); !ok {
+			return []string{fmt.Sprintf("%s: expected a string, got %T", path, value)}
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return []string{fmt.Sprintf("%s: expected a boolean, got %T", path, value)}
+		}
+	case "integer", "number":
+		number, ok := value.(float64)
+		if !ok || (s["type"] == "integer" && number != math.Trunc(number)) {
+			return []string{fmt.Sprintf("%s: expected an %s, got %v", path, s["type"], value)}
+		}
+	case "array":
+		array, ok := value.([]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s: expected an array, got %T", path, value)}
+		}
+		for i, element := range array {
+			mismatches = append(mismatches, validateSchema(components, fmt.Sprintf("%s[%d]", path, i), s["items"], element)...)
+		}
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s: expected an object, got %T", path, value)}
+		}
+		required, _ := s["required"].([]interface{})
+		for _, name := range required {
+			if _, ok := object[name.(string)]; !ok {
+				mismatches = append(mismatches, fmt.Sprintf("%s.%s: missing", path, name))
+			}
+		}
+		properties, _ := s["properties"].(map[string]interface{})
+		for name, field := range object {
+			if property, ok := properties[name]; ok {
+				mismatches = append(mismatches, validateSchema(components, path+"."+name, property, field)...)
+			} else if s["additionalProperties"] == false {
+				mismatches = append(mismatches, fmt.Sprintf("%s.%s: not documented", path, name))
+			} else {
+				mismatches = append(mismatches, validateSchema(components, path+"."+name, s["additionalProperties"], field)...)
+			}
+		}
+	}
+	return mismatches
+}
+
+func TestDocs(t *testing.T) {
+	_, _, client := newTestDB(t)
+	router := NewHandler(Config{Client: client})
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/docs", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	if contentType := w.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/html") {
+		t.Errorf("Expected an HTML page, got %s", contentType)
+	}
+	for _, expected := range []string{"/api/v1/users/{id}", "List users", "/api/users/{id} (deprecated)", "/api/openapi.json"} {
+		if !strings.Contains(w.Body.String(), expected) {
+			t.Errorf("Expected the page to mention %s", expected)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+//go:build !js
+
+package api
+
+import (
+	"net/http"
+
+	"assette/apiclient"
+	"assette/models"
+	"assette/patch"
+	"assette/sheet"
+	"assette/webhook"
+)
+
+// Bodies of v1 that handlers build as maps, described by the types the API
+// client decodes them into, so that the tests checking responses against the
+// document also check the client. The others are described here.
+type (
+	userMergePatch struct {
+		Name  string `json:"name,omitempty"`
+		Email string `json:"email,omitempty"`
+	}
+
+	auditList struct {
+		Entries []AuditEntry `json:"entries"`
+		Count   int          `json:"count"`
+		Next    string       `json:"next,omitempty"`
+	}
+
+	purgeResult struct {
+		Purged int64 `json:"purged"`
+	}
+
+	webhookList struct {
+		Webhooks []webhook.Subscription `json:"webhooks"`
+		Count    int                    `json:"count"`
+	}
+
+	deliveryList struct {
+		Deliveries []webhook.Delivery `json:"deliveries"`
+		Count      int                `json:"count"`
+	}
+)
+
+// spreadsheet is a body holding users as CSV or as an XLSX workbook
+var spreadsheet = File(sheet.CSV.ContentType(), sheet.XLSX.ContentType())
+
+// limitParameter caps the items of a list
+var limitParameter = Parameter{Name: "limit", In: "query", Description: "Returns at most this many items", Schema: &Schema{Type: "integer"}}
+
+// formatParameter picks the format of a spreadsheet
+var formatParameter = Parameter{Name: "format", In: "query", Description: "csv or xlsx", Schema: &Schema{Type: "string", Enum: []interface{}{"csv", "xlsx"}}}
+
+// V1Operations describes the endpoints registered by V1
+var V1Operations = map[string]Operation{
+	"GET /message": {
+		ID:        "getMessage",
+		Summary:   "Get a sample message",
+		Responses: map[int]interface{}{http.StatusOK: apiclient.Message{}},
+	},
+
+	"GET /users": {
+		ID:          "listUsers",
+		Summary:     "List users",
+		Description: "Filtered, sorted and trimmed with the query parameters of the query package. The email parameter looks a user up by address, ignoring case, for admins only.",
+		Parameters:  QueryParameters(userQuery),
+		Responses:   map[int]interface{}{http.StatusOK: apiclient.UserList{}, http.StatusNotModified: nil, http.StatusBadRequest: Problem{}},
+	},
+	"POST /users": {
+		ID:          "createUser",
+		Summary:     "Create a user",
+		Description: "New users are unverified with the user role, whatever the request says.",
+		Request:     models.User{},
+		Responses:   map[int]interface{}{http.StatusCreated: apiclient.User{}, http.StatusBadRequest: Problem{}, http.StatusConflict: Problem{}},
+	},
+	"POST /users/bulk": {
+		ID:          "bulkUsers",
+		Summary:     "Create, update and delete users in bulk",
+		Description: "Only for admins. Up to 1000 operations, applied in as few transactions as possible. Returns 207 if some failed.",
+		Request:     apiclient.BulkRequest{},
+		Responses:   map[int]interface{}{http.StatusOK: apiclient.BulkResults{}, http.StatusMultiStatus: apiclient.BulkResults{}, http.StatusUnauthorized: Problem{}, http.StatusForbidden: Problem{}, http.StatusBadRequest: Problem{}},
+	},
+	"GET /users/export": {
+		ID:         "exportUsers",
+		Summary:    "Download every user as a spreadsheet",
+		Parameters: []Parameter{formatParameter},
+		Responses:  map[int]interface{}{http.StatusOK: spreadsheet},
+	},
+	"POST /users/import": {
+		ID:          "importUsers",
+		Summary:     "Create and update users from a spreadsheet",
+		Description: "Only for admins. Rows with an id update that user, others create one. Columns are named by the first non-empty row.",
+		Parameters: []Parameter{
+			formatParameter,
+			{Name: "atomic", In: "query", Description: "Imports every row or none", Schema: &Schema{Type: "boolean"}},
+			{Name: "dryRun", In: "query", Description: "Checks the rows without writing them", Schema: &Schema{Type: "boolean"}},
+			{Name: "map", In: "query", Description: "Maps a header to a field, as Header=field; repeatable", Schema: &Schema{Type: "string"}},
+		},
+		Request:   spreadsheet,
+		Responses: map[int]interface{}{http.StatusOK: apiclient.ImportResults{}, http.StatusUnauthorized: Problem{}, http.StatusForbidden: Problem{}, http.StatusBadRequest: Problem{}, http.StatusRequestEntityTooLarge: Problem{}, http.StatusUnsupportedMediaType: Problem{}},
+	},
+	"GET /users/import/reports/{id}": {
+		ID:         "getImportReport",
+		Summary:    "Download the rows an import rejected, with the reason",
+		Parameters: []Parameter{formatParameter},
+		Responses:  map[int]interface{}{http.StatusOK: spreadsheet, http.StatusUnauthorized: Problem{}, http.StatusForbidden: Problem{}, http.StatusNotFound: Problem{}},
+	},
+	"GET /users/{id}": {
+		ID:        "getUser",
+		Summary:   "Get a user",
+		Responses: map[int]interface{}{http.StatusOK: apiclient.User{}, http.StatusNotModified: nil, http.StatusNotFound: Problem{}},
+	},
+	"PUT /users/{id}": {
+		ID:          "updateUser",
+		Summary:     "Update a user",
+		Description: "Only for the user themselves and admins. The role is kept, and the email verification unless the address changes. Send the ETag in If-Match to get 412 rather than overwrite a concurrent change.",
+		Request:     models.User{},
+		Responses:   map[int]interface{}{http.StatusOK: apiclient.User{}, http.StatusUnauthorized: Problem{}, http.StatusForbidden: Problem{}, http.StatusBadRequest: Problem{}, http.StatusNotFound: Problem{}, http.StatusConflict: Problem{}, http.StatusPreconditionFailed: Problem{}},
+	},
+	"PATCH /users/{id}": {
+		ID:      "patchUser",
+		Summary: "Update some fields of a user",
+		Request: Content{
+			patch.MergePatchType: userMergePatch{},
+			patch.JSONPatchType:  []patch.Operation{},
+		},
+		Responses: map[int]interface{}{http.StatusOK: apiclient.User{}, http.StatusUnauthorized: Problem{}, http.StatusForbidden: Problem{}, http.StatusBadRequest: Problem{}, http.StatusNotFound: Problem{}, http.StatusConflict: Problem{}, http.StatusPreconditionFailed: Problem{}, http.StatusUnsupportedMediaType: Problem{}, http.StatusUnprocessableEntity: Problem{}},
+	},
+	"DELETE /users/{id}": {
+		ID:        "deleteUser",
+		Summary:   "Move a user to the trash",
+		Responses: map[int]interface{}{http.StatusNoContent: nil, http.StatusUnauthorized: Problem{}, http.StatusForbidden: Problem{}, http.StatusNotFound: Problem{}, http.StatusPreconditionFailed: Problem{}},
+	},
+	"POST /users/{id}/restore": {
+		ID:        "restoreUser",
+		Summary:   "Restore a user from the trash",
+		Responses: map[int]interface{}{http.StatusOK: apiclient.User{}, http.StatusUnauthorized: Problem{}, http.StatusForbidden: Problem{}, http.StatusNotFound: Problem{}, http.StatusConflict: Problem{}},
+	},
+	"GET /users/{id}/history": {
+		ID:         "getUserHistory",
+		Summary:    "List past versions of a user, most recent first",
+		Parameters: []Parameter{limitParameter},
+		Responses:  map[int]interface{}{http.StatusOK: apiclient.UserVersions{}, http.StatusNotModified: nil, http.StatusNotFound: Problem{}},
+	},
+	"POST /users/{id}/revert": {
+		ID:        "revertUser",
+		Summary:   "Write a past version of a user as the current one",
+		Request:   apiclient.RevertRequest{},
+		Responses: map[int]interface{}{http.StatusOK: apiclient.User{}, http.StatusUnauthorized: Problem{}, http.StatusForbidden: Problem{}, http.StatusBadRequest: Problem{}, http.StatusNotFound: Problem{}, http.StatusConflict: Problem{}},
+	},
+
+	"POST /account/verification": {
+		ID:          "sendVerification",
+		Summary:     "Email a verification link to a user",
+		Description: "Limited to a few emails per user every hour.",
+		Request:     apiclient.VerificationRequest{},
+		Responses:   map[int]interface{}{http.StatusAccepted: nil, http.StatusNotFound: Problem{}, http.StatusConflict: Problem{}, http.StatusTooManyRequests: Problem{}},
+	},
+	"POST /account/verify": {
+		ID:        "verifyEmail",
+		Summary:   "Confirm an email address",
+		Request:   apiclient.TokenRequest{},
+		Responses: map[int]interface{}{http.StatusNoContent: nil, http.StatusBadRequest: Problem{}},
+	},
+	"POST /account/password-reset": {
+		ID:          "requestPasswordReset",
+		Summary:     "Email a password reset link",
+		Description: "Only sent to verified addresses, but accepted whatever the address, so that addresses cannot be probed.",
+		Request:     apiclient.PasswordResetRequest{},
+		Responses:   map[int]interface{}{http.StatusAccepted: nil},
+	},
+	"POST /account/password": {
+		ID:        "resetPassword",
+		Summary:   "Set a new password with a reset token",
+		Request:   apiclient.PasswordRequest{},
+		Responses: map[int]interface{}{http.StatusNoContent: nil, http.StatusBadRequest: Problem{}},
+	},
+
+	"POST /auth/login": {
+		ID:          "login",
+		Summary:     "Log in with an email address and password",
+		Description: "Sets an HttpOnly session cookie, or returns an MFA token to complete with /auth/login/totp when two-factor authentication is enabled.",
+		Request:     apiclient.LoginRequest{},
+		Responses:   map[int]interface{}{http.StatusOK: OneOf{apiclient.Session{}, apiclient.MFAChallenge{}}, http.StatusUnauthorized: Problem{}},
+	},
+	"POST /auth/login/totp": {
+		ID:        "loginTOTP",
+		Summary:   "Complete a login with a one-time password or a recovery code",
+		Request:   apiclient.TOTPLoginRequest{},
+		Responses: map[int]interface{}{http.StatusOK: apiclient.Session{}, http.StatusUnauthorized: Problem{}},
+	},
+	"POST /auth/logout": {
+		ID:        "logout",
+		Summary:   "End the current session",
+		Responses: map[int]interface{}{http.StatusNoContent: nil},
+	},
+	"POST /auth/totp/enroll": {
+		ID:        "enrollTOTP",
+		Summary:   "Start two-factor enrollment",
+		Responses: map[int]interface{}{http.StatusOK: apiclient.TOTPEnrollment{}, http.StatusUnauthorized: Problem{}},
+	},
+	"POST /auth/totp/confirm": {
+		ID:        "confirmTOTP",
+		Summary:   "Confirm two-factor enrollment and get recovery codes",
+		Request:   apiclient.CodeRequest{},
+		Responses: map[int]interface{}{http.StatusOK: apiclient.RecoveryCodes{}, http.StatusBadRequest: Problem{}, http.StatusUnauthorized: Problem{}},
+	},
+
+	"GET /admin/audit": {
+		ID:      "listAudit",
+		Summary: "List audit entries",
+		Parameters: []Parameter{
+			{Name: "actor", In: "query", Description: "Keeps entries by this actor", Schema: &Schema{Type: "string"}},
+			{Name: "target", In: "query", Description: "Keeps entries whose target starts with this prefix, such as users/", Schema: &Schema{Type: "string"}},
+			{Name: "since", In: "query", Description: "Keeps entries from this time on", Schema: &Schema{Type: "string", Format: "date-time"}},
+			{Name: "until", In: "query", Description: "Keeps entries up to this time", Schema: &Schema{Type: "string", Format: "date-time"}},
+			{Name: "after", In: "query", Description: "Returns the entries after this one, as given by next", Schema: &Schema{Type: "string"}},
+			limitParameter,
+		},
+		Responses: map[int]interface{}{http.StatusOK: auditList{}, http.StatusBadRequest: Problem{}, http.StatusForbidden: Problem{}},
+	},
+	"GET /admin/trash/users": {
+		ID:         "listTrashedUsers",
+		Summary:    "List trashed users, most recently deleted first",
+		Parameters: QueryParameters(trashQuery),
+		Responses:  map[int]interface{}{http.StatusOK: apiclient.UserList{}, http.StatusNotModified: nil, http.StatusForbidden: Problem{}},
+	},
+	"DELETE /admin/trash/users": {
+		ID:        "emptyUserTrash",
+		Summary:   "Permanently delete every trashed user",
+		Responses: map[int]interface{}{http.StatusOK: purgeResult{}, http.StatusForbidden: Problem{}},
+	},
+	"DELETE /admin/trash/users/{id}": {
+		ID:        "purgeUser",
+		Summary:   "Permanently delete a trashed user",
+		Responses: map[int]interface{}{http.StatusNoContent: nil, http.StatusForbidden: Problem{}, http.StatusNotFound: Problem{}},
+	},
+
+	"GET /admin/webhooks": {
+		ID:        "listWebhooks",
+		Summary:   "List webhooks",
+		Responses: map[int]interface{}{http.StatusOK: webhookList{}, http.StatusForbidden: Problem{}},
+	},
+	"POST /admin/webhooks": {
+		ID:          "createWebhook",
+		Summary:     "Register a webhook",
+		Description: "Events are sent to the URL as signed POST requests. The response holds the signing secret, which is never returned again.",
+		Request:     models.Webhook{},
+		Responses:   map[int]interface{}{http.StatusCreated: webhook.Subscription{}, http.StatusBadRequest: Problem{}, http.StatusForbidden: Problem{}},
+	},
+	"GET /admin/webhooks/{id}": {
+		ID:        "getWebhook",
+		Summary:   "Get a webhook",
+		Responses: map[int]interface{}{http.StatusOK: webhook.Subscription{}, http.StatusForbidden: Problem{}, http.StatusNotFound: Problem{}},
+	},
+	"DELETE /admin/webhooks/{id}": {
+		ID:        "deleteWebhook",
+		Summary:   "Unregister a webhook",
+		Responses: map[int]interface{}{http.StatusNoContent: nil, http.StatusForbidden: Problem{}, http.StatusNotFound: Problem{}},
+	},
+	"GET /admin/webhooks/{id}/deliveries": {
+		ID:         "listWebhookDeliveries",
+		Summary:    "List the deliveries to a webhook, most recent first",
+		Parameters: []Parameter{limitParameter},
+		Responses:  map[int]interface{}{http.StatusOK: deliveryList{}, http.StatusBadRequest: Problem{}, http.StatusForbidden: Problem{}, http.StatusNotFound: Problem{}},
+	},
+	"GET /admin/webhooks/dead-letters": {
+		ID:         "listWebhookDeadLetters",
+		Summary:    "List the deliveries that failed every attempt, most recent first",
+		Parameters: []Parameter{limitParameter},
+		Responses:  map[int]interface{}{http.StatusOK: deliveryList{}, http.StatusBadRequest: Problem{}, http.StatusForbidden: Problem{}},
+	},
+	"POST /admin/webhooks/dead-letters/{id}/redeliver": {
+		ID:        "redeliverWebhook",
+		Summary:   "Queue a failed delivery again",
+		Responses: map[int]interface{}{http.StatusAccepted: webhook.Delivery{}, http.StatusForbidden: Problem{}, http.StatusNotFound: Problem{}, http.StatusConflict: Problem{}},
+	},
+}
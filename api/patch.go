@@ -0,0 +1,39 @@
+//go:build !js
+
+package api
+
+import (
+	"mime"
+	"net/http"
+
+	"assette/patch"
+)
+
+// patchFormats maps the Content-Types accepted by PATCH endpoints to the
+// function applying them
+var patchFormats = map[string]func(document []byte, p []byte) ([]byte, error){
+	patch.MergePatchType: patch.Merge,
+	patch.JSONPatchType:  patch.Apply,
+}
+
+// acceptPatch is advertised in the Accept-Patch header of PATCH endpoints
+var acceptPatch = patch.MergePatchType + ", " + patch.JSONPatchType
+
+// readPatch reads the body of a PATCH request and returns a function applying
+// it to a stored document
+func readPatch(r *http.Request) (func(document []byte) ([]byte, error), error) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	apply, ok := patchFormats[mediaType]
+	if err != nil || !ok {
+		return nil, NewProblem(http.StatusUnsupportedMediaType, CodeUnsupportedMedia, "Content-Type must be one of "+acceptPatch)
+	}
+
+	body, err := readBody(r, MaxBodySize)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(document []byte) ([]byte, error) {
+		return apply(document, body)
+	}, nil
+}
@@ -0,0 +1,141 @@
+//go:build !js
+
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"assette/db"
+)
+
+// RateLimitRule allows at most Limit requests sharing the same key per Window.
+// Key extracts the key from the request; requests for which it returns an
+// empty string are not counted against the rule.
+type RateLimitRule struct {
+	Name   string
+	Limit  int64
+	Window time.Duration
+	Key    func(r *http.Request) string
+}
+
+// RateLimit returns a middleware enforcing the given rules. Counters live in
+// the ratelimit namespace of etcd, so the limits hold across every node of a
+// cluster rather than per process. Requests are let through when etcd cannot
+// be reached.
+func RateLimit(client *db.Client, rules ...RateLimitRule) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			now := time.Now()
+
+			// Report the rule closest to its limit
+			var (
+				limit     int64
+				remaining int64 = -1
+				reset     time.Duration
+				exceeded  bool
+			)
+
+			for _, rule := range rules {
+				key := rule.Key(r)
+				if key == "" {
+					continue
+				}
+
+				windowStart := now.Truncate(rule.Window)
+				windowReset := windowStart.Add(rule.Window).Sub(now)
+				counterKey := fmt.Sprintf("%s:%s:%d", rule.Name, key, windowStart.Unix())
+
+				count, err := client.Incr(r.Context(), "ratelimit", counterKey, rule.Window)
+				if err != nil {
+					log.Printf("[WARNING] rate limit %s: %v", rule.Name, err)
+					continue
+				}
+
+				left := rule.Limit - count
+				if left < 0 {
+					left = 0
+				}
+
+				if count > rule.Limit {
+					if !exceeded || windowReset > reset {
+						limit, remaining, reset = rule.Limit, left, windowReset
+					}
+					exceeded = true
+				} else if !exceeded && (remaining < 0 || left < remaining) {
+					limit, remaining, reset = rule.Limit, left, windowReset
+				}
+			}
+
+			if remaining >= 0 {
+				resetSeconds := strconv.FormatInt(int64((reset+time.Second-1)/time.Second), 10)
+				w.Header().Set("RateLimit-Limit", strconv.FormatInt(limit, 10))
+				w.Header().Set("RateLimit-Remaining", strconv.FormatInt(remaining, 10))
+				w.Header().Set("RateLimit-Reset", resetSeconds)
+
+				if exceeded {
+					w.Header().Set("Retry-After", resetSeconds)
+					WriteError(w, r, NewProblem(http.StatusTooManyRequests, CodeRateLimited, "Too many requests"))
+					return
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// KeyByIP keys requests by client address. When trustProxy is set, the
+// X-Real-IP or X-Forwarded-For header added by the load balancer in front of
+// the cluster takes precedence over the connection address.
+func KeyByIP(trustProxy bool) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		return ClientIP(r, trustProxy)
+	}
+}
+
+// KeyByToken keys requests by the API token sent as a bearer token or in the
+// X-API-Key header. Tokens are hashed so they never end up in etcd keys.
+func KeyByToken(r *http.Request) string {
+	token := r.Header.Get("X-API-Key")
+	if auth := r.Header.Get("Authorization"); token == "" && strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if token == "" {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// KeyByUser keys requests by the authenticated user
+func KeyByUser(r *http.Request) string {
+	userID, _ := UserIDFromContext(r.Context())
+	return userID
+}
+
+// ClientIP returns the address of the client that issued the request
+func ClientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); ip != "" {
+			return ip
+		}
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
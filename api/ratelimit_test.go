@@ -0,0 +1,136 @@
+//go:build !js
+
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func okHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+func TestRateLimit(t *testing.T) {
+	_, _, client := newTestDB(t)
+
+	handler := RateLimit(client, RateLimitRule{
+		Name:   "ip",
+		Limit:  2,
+		Window: time.Minute,
+		Key:    KeyByIP(false),
+	})(okHandler())
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/api/users", nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Request %d: expected status %d, got %d", i+1, http.StatusOK, w.Code)
+		}
+		if got := w.Header().Get("RateLimit-Remaining"); got != strconv.Itoa(1-i) {
+			t.Errorf("Request %d: expected RateLimit-Remaining %d, got %q", i+1, 1-i, got)
+		}
+		if got := w.Header().Get("RateLimit-Limit"); got != "2" {
+			t.Errorf("Request %d: expected RateLimit-Limit 2, got %q", i+1, got)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/users", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status %d, got %d", http.StatusTooManyRequests, w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("Expected Retry-After header on 429 response")
+	}
+}
+
+func TestRateLimitSharedAcrossHandlers(t *testing.T) {
+	_, _, client := newTestDB(t)
+
+	rule := RateLimitRule{Name: "ip", Limit: 1, Window: time.Minute, Key: KeyByIP(false)}
+
+	// Two middlewares sharing etcd behave like two nodes of a cluster
+	node1 := RateLimit(client, rule)(okHandler())
+	node2 := RateLimit(client, rule)(okHandler())
+
+	w := httptest.NewRecorder()
+	node1.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/users", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d on first node, got %d", http.StatusOK, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	node2.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/users", nil))
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status %d on second node, got %d", http.StatusTooManyRequests, w.Code)
+	}
+}
+
+func TestRateLimitSkipsEmptyKey(t *testing.T) {
+	_, _, client := newTestDB(t)
+
+	handler := RateLimit(client, RateLimitRule{
+		Name:   "token",
+		Limit:  1,
+		Window: time.Minute,
+		Key:    KeyByToken,
+	})(okHandler())
+
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/users", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected requests without token to pass, got status %d", w.Code)
+		}
+	}
+
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		req := httptest.NewRequest(http.MethodGet, "/api/users", nil)
+		req.Header.Set("Authorization", "Bearer secret-token")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Errorf("Request %d with token: expected status %d, got %d", i+1, want, w.Code)
+		}
+	}
+}
+
+func TestKeyByUser(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/api/users", nil)
+	if key := KeyByUser(req); key != "" {
+		t.Errorf("Expected empty key for anonymous request, got %q", key)
+	}
+
+	req = req.WithContext(WithUserID(req.Context(), "user:1"))
+	if key := KeyByUser(req); key != "user:1" {
+		t.Errorf("Expected key %q, got %q", "user:1", key)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/api/users", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "203.0.113.7, 10.0.0.1")
+
+	if ip := ClientIP(req, false); ip != "10.0.0.1" {
+		t.Errorf("Expected connection address when proxy is untrusted, got %q", ip)
+	}
+	if ip := ClientIP(req, true); ip != "203.0.113.7" {
+		t.Errorf("Expected forwarded address when proxy is trusted, got %q", ip)
+	}
+
+	req.Header.Set("X-Real-IP", "198.51.100.2")
+	if ip := ClientIP(req, true); ip != "198.51.100.2" {
+		t.Errorf("Expected X-Real-IP to take precedence, got %q", ip)
+	}
+}
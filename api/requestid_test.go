@@ -0,0 +1,47 @@
+//go:build !js
+
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestID(t *testing.T) {
+	var seen string
+	handler := RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = RequestIDFromContext(r.Context())
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/users", nil))
+
+	if seen == "" {
+		t.Fatal("Expected a generated request ID in context")
+	}
+	if got := w.Header().Get("X-Request-ID"); got != seen {
+		t.Errorf("Expected response header %q, got %q", seen, got)
+	}
+}
+
+func TestRequestIDFromHeader(t *testing.T) {
+	var seen string
+	handler := RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = RequestIDFromContext(r.Context())
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/users", nil)
+	req.Header.Set("X-Request-ID", "lb-1234")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if seen != "lb-1234" {
+		t.Errorf("Expected incoming request ID to be kept, got %q", seen)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/users", nil)
+	req.Header.Set("X-Request-ID", "bad id\nInjected: yes")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if seen == "bad id\nInjected: yes" {
+		t.Error("Expected unsafe request ID to be replaced")
+	}
+}
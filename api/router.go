@@ -0,0 +1,164 @@
+//go:build !js
+
+package api
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Middleware wraps a handler with extra behaviour
+type Middleware func(http.Handler) http.Handler
+
+// Chain composes middlewares so that the first one is the outermost
+func Chain(middlewares ...Middleware) Middleware {
+	return func(next http.Handler) http.Handler {
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			next = middlewares[i](next)
+		}
+		return next
+	}
+}
+
+// Router dispatches requests with the method and path patterns of
+// http.ServeMux ("GET /api/users/{id}"), reading path parameters with
+// r.PathValue. Routes registered on a group share its path prefix and
+// middlewares.
+type Router struct {
+	mux         *http.ServeMux
+	prefix      string
+	middlewares []Middleware
+	root        *Router
+	version     *Version
+	routes      []Route // Registered on the root router
+}
+
+// Route is a route registered on a router
+type Route struct {
+	Method  string
+	Pattern string   // Full path pattern, such as /api/v1/users/{id}
+	Version *Version // Version of the API the route belongs to, if any
+}
+
+// NewRouter returns an empty router
+func NewRouter() *Router {
+	r := &Router{mux: http.NewServeMux()}
+	r.root = r
+	return r
+}
+
+// Routes returns the routes registered so far, in order
+func (rt *Router) Routes() []Route {
+	return append([]Route(nil), rt.root.routes...)
+}
+
+// Use adds middlewares. On the root router they wrap every request, including
+// those answered with 404 or 405; on a group they wrap the routes registered
+// on it afterwards.
+func (rt *Router) Use(middlewares ...Middleware) {
+	rt.middlewares = append(rt.middlewares, middlewares...)
+}
+
+// Group returns a router registering routes under prefix, wrapped by the
+// middlewares of the parent group and the given ones
+func (rt *Router) Group(prefix string, middlewares ...Middleware) *Router {
+	group := &Router{
+		mux:     rt.mux,
+		prefix:  rt.prefix + prefix,
+		root:    rt.root,
+		version: rt.version,
+	}
+	if rt != rt.root {
+		group.middlewares = append(group.middlewares, rt.middlewares...)
+	}
+	group.middlewares = append(group.middlewares, middlewares...)
+	return group
+}
+
+// Handle registers handler for method and pattern, relative to the group prefix
+func (rt *Router) Handle(method string, pattern string, handler http.Handler) {
+	var h http.Handler = handler
+	if rt != rt.root {
+		h = Chain(rt.middlewares...)(h)
+	}
+
+	path := strings.TrimSuffix(rt.prefix+pattern, "/")
+	if path == "" {
+		path = "/"
+	}
+	rt.mux.Handle(method+" "+path, h)
+	rt.root.routes = append(rt.root.routes, Route{Method: method, Pattern: path, Version: rt.version})
+}
+
+func (rt *Router) Get(pattern string, handler http.HandlerFunc) {
+	rt.Handle(http.MethodGet, pattern, handler)
+}
+
+func (rt *Router) Post(pattern string, handler http.HandlerFunc) {
+	rt.Handle(http.MethodPost, pattern, handler)
+}
+
+func (rt *Router) Put(pattern string, handler http.HandlerFunc) {
+	rt.Handle(http.MethodPut, pattern, handler)
+}
+
+func (rt *Router) Patch(pattern string, handler http.HandlerFunc) {
+	rt.Handle(http.MethodPatch, pattern, handler)
+}
+
+func (rt *Router) Delete(pattern string, handler http.HandlerFunc) {
+	rt.Handle(http.MethodDelete, pattern, handler)
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	Chain(rt.root.middlewares...)(http.HandlerFunc(rt.dispatch)).ServeHTTP(w, r)
+}
+
+// dispatch serves matched routes, and answers unmatched ones with problem
+// details instead of the plain text written by http.ServeMux
+func (rt *Router) dispatch(w http.ResponseWriter, r *http.Request) {
+	if _, pattern := rt.mux.Handler(r); pattern != "" {
+		rt.mux.ServeHTTP(w, r)
+		return
+	}
+
+	unmatched := &headerRecorder{header: http.Header{}}
+	rt.mux.ServeHTTP(unmatched, r)
+
+	switch unmatched.status {
+	case http.StatusMethodNotAllowed:
+		w.Header().Set("Allow", unmatched.header.Get("Allow"))
+		WriteError(w, r, NewProblem(http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method "+r.Method+" is not allowed for "+r.URL.Path))
+	case http.StatusNotFound:
+		WriteError(w, r, NewProblem(http.StatusNotFound, CodeNotFound, "No route for "+r.URL.Path))
+	default:
+		// Redirects to the cleaned path
+		for key, values := range unmatched.header {
+			w.Header()[key] = values
+		}
+		w.WriteHeader(unmatched.status)
+	}
+}
+
+// headerRecorder keeps the status and headers of a response, discarding its body
+type headerRecorder struct {
+	header http.Header
+	status int
+}
+
+func (w *headerRecorder) Header() http.Header {
+	return w.header
+}
+
+func (w *headerRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *headerRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return len(b), nil
+}
@@ -0,0 +1,134 @@
+//go:build !js
+
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// tag returns a middleware appending name to the X-Trace response header
+func tag(name string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("X-Trace", name)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func TestChainOrder(t *testing.T) {
+	handler := Chain(tag("a"), tag("b"), tag("c"))(okHandler())
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if trace := strings.Join(w.Header().Values("X-Trace"), ","); trace != "a,b,c" {
+		t.Errorf("Expected middlewares to run in order a,b,c, got %s", trace)
+	}
+}
+
+func TestRouterPatterns(t *testing.T) {
+	r := NewRouter()
+	users := r.Group("/api/users")
+	users.Get("", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("list"))
+	})
+	users.Get("/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("get " + r.PathValue("id")))
+	})
+	users.Delete("/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	tests := []struct {
+		method string
+		path   string
+		status int
+		body   string
+	}{
+		{http.MethodGet, "/api/users", http.StatusOK, "list"},
+		{http.MethodGet, "/api/users/user:1", http.StatusOK, "get user:1"},
+		{http.MethodDelete, "/api/users/user:1", http.StatusNoContent, ""},
+		{http.MethodPost, "/api/users/user:1", http.StatusMethodNotAllowed, ""},
+		{http.MethodGet, "/api/users/user:1/extra", http.StatusNotFound, ""},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+
+		if w.Code != tt.status {
+			t.Errorf("%s %s: expected status %d, got %d", tt.method, tt.path, tt.status, w.Code)
+		}
+		if tt.body != "" && w.Body.String() != tt.body {
+			t.Errorf("%s %s: expected body %q, got %q", tt.method, tt.path, tt.body, w.Body.String())
+		}
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/api/users/user:1", nil))
+	if allow := w.Header().Get("Allow"); !strings.Contains(allow, "GET") || !strings.Contains(allow, "DELETE") {
+		t.Errorf("Expected Allow header to list GET and DELETE, got %q", allow)
+	}
+}
+
+func TestRouterGroupMiddlewares(t *testing.T) {
+	r := NewRouter()
+	r.Use(tag("root"))
+
+	api := r.Group("/api", tag("api"))
+	api.Get("/open", okHandler().ServeHTTP)
+
+	admin := api.Group("/admin", tag("admin"))
+	admin.Get("/audit", okHandler().ServeHTTP)
+
+	tests := []struct {
+		path  string
+		trace string
+	}{
+		{"/api/open", "root,api"},
+		{"/api/admin/audit", "root,api,admin"},
+		{"/missing", "root"},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+		if trace := strings.Join(w.Header().Values("X-Trace"), ","); trace != tt.trace {
+			t.Errorf("%s: expected middlewares %s, got %s", tt.path, tt.trace, trace)
+		}
+	}
+}
+
+func TestNewHandlerRoutes(t *testing.T) {
+	_, _, client := newTestDB(t)
+	handler := NewHandler(Config{Client: client})
+
+	tests := []struct {
+		method string
+		path   string
+		status int
+	}{
+		{http.MethodGet, "/api/message", http.StatusOK},
+		{http.MethodGet, "/api/users/user:missing", http.StatusNotFound},
+		{http.MethodGet, "/api/auth/login", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/api/admin/audit", http.StatusUnauthorized},
+		{http.MethodGet, "/api/unknown", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+
+		if w.Code != tt.status {
+			t.Errorf("%s %s: expected status %d, got %d", tt.method, tt.path, tt.status, w.Code)
+		}
+		if w.Header().Get("X-Request-ID") == "" {
+			t.Errorf("%s %s: expected X-Request-ID header", tt.method, tt.path)
+		}
+	}
+}
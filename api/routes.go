@@ -0,0 +1,158 @@
+//go:build !js
+
+package api
+
+import (
+	"time"
+
+	"assette/apiclient"
+	"assette/db"
+	"assette/mail"
+	"assette/models"
+)
+
+// Config holds what the API handlers depend on
+type Config struct {
+	Client  *db.Client
+	Mailer  mail.Sender
+	BaseURL string // Public URL of the PWA, used in emailed links
+	Issuer  string // Name shown in authenticator apps
+
+	// How long deleted users stay in the trash, DefaultTrashRetention if zero
+	TrashRetention time.Duration
+
+	// How long responses are replayed for an Idempotency-Key,
+	// DefaultIdempotencyTTL if zero
+	IdempotencyTTL time.Duration
+
+	RateLimits []RateLimitRule
+	CORS       CORSConfig
+	Timeout    time.Duration // No timeout when zero
+
+	// Versions of the API served, DefaultVersions if nil
+	Versions []Version
+}
+
+// DefaultRateLimits are the limits applied by the server. Behind the load
+// balancer from CLUSTER.md, trustProxy identifies clients by X-Real-IP
+// instead of the proxy address.
+func DefaultRateLimits(trustProxy bool) []RateLimitRule {
+	return []RateLimitRule{
+		{Name: "ip", Limit: 300, Window: time.Minute, Key: KeyByIP(trustProxy)},
+		{Name: "user", Limit: 600, Window: time.Minute, Key: KeyByUser},
+		{Name: "token", Limit: 1200, Window: time.Minute, Key: KeyByToken},
+	}
+}
+
+// NewHandler returns the router serving every /api endpoint, with each of
+// config.Versions, DefaultVersions if nil, under its own prefix
+func NewHandler(config Config) *Router {
+	if config.TrashRetention == 0 {
+		config.TrashRetention = DefaultTrashRetention
+	}
+	if config.IdempotencyTTL == 0 {
+		config.IdempotencyTTL = DefaultIdempotencyTTL
+	}
+	versions := append([]Version(nil), config.Versions...)
+	if config.Versions == nil {
+		versions = DefaultVersions()
+	}
+
+	r := NewRouter()
+	// Sessions are loaded before rate limiting so limits apply per user
+	r.Use(
+		RequestID,
+		Logger,
+		Recoverer,
+		Compress,
+		SecurityHeaders(APISecurityPolicy()),
+		CORS(config.CORS),
+		Authenticate(config.Client),
+		RateLimit(config.Client, config.RateLimits...),
+	)
+
+	for i := range versions {
+		version := &versions[i]
+		prefix := version.Prefix()
+		middlewares := []Middleware{Deprecation(*version)}
+		streams := r.Group(prefix, middlewares...)
+		if config.Timeout > 0 {
+			middlewares = append(middlewares, Timeout(config.Timeout))
+		}
+		api := r.Group(prefix, middlewares...)
+		streams.version, api.version = version, version
+		version.Routes(Endpoints{Config: config, API: api, Streams: streams})
+	}
+
+	// Described from the routes above once they are all registered
+	r.Get("/api/openapi.json", ServeOpenAPI(r))
+	r.Get("/api/docs", ServeDocs(r))
+
+	// Run on the v1 endpoints and stream subscriptions, so kept out of the
+	// versions, and given their timeout apart from subscriptions
+	graphQL := GraphQL(r, config)
+	r.Get("/api/graphql", graphQL)
+	r.Post("/api/graphql", graphQL)
+	r.Get(apiclient.SocketPath, WebSocket(r, config))
+
+	return r
+}
+
+// V1 registers the endpoints of version 1 of the API
+func V1(e Endpoints) {
+	client := e.Config.Client
+	retention := e.Config.TrashRetention
+	idempotent := Idempotency(client, e.Config.IdempotencyTTL)
+	api := e.API
+
+	api.Get("/message", GetMessage())
+
+	users := api.Group("/users", idempotent)
+	users.Get("", ListUsers(client))
+	users.Post("", CreateUser(client))
+	users.Get("/{id}", GetUser(client))
+	users.Get("/{id}/history", GetUserHistory(client))
+
+	// Changes to a user are limited to themselves and admins, checked before
+	// idempotent requests are replayed
+	self := api.Group("/users", RequireSelf(models.RoleAdmin), idempotent)
+	self.Put("/{id}", UpdateUser(client))
+	self.Patch("/{id}", PatchUser(client))
+	self.Delete("/{id}", DeleteUser(client, retention))
+	self.Post("/{id}/restore", RestoreUser(client))
+	self.Post("/{id}/revert", RevertUser(client))
+
+	bulk := api.Group("/users", RequireRole(models.RoleAdmin), idempotent)
+	bulk.Post("/bulk", BulkUsers(client, retention))
+	bulk.Post("/import", ImportUsers(client))
+	bulk.Get("/import/reports/{id}", GetImportReport(client))
+
+	// Streamed, so kept out of the buffering Timeout middleware
+	e.Streams.Group("/users").Get("/export", ExportUsers(client))
+
+	account := api.Group("/account", idempotent)
+	account.Post("/verification", SendVerification(client, e.Config.Mailer, e.Config.BaseURL))
+	account.Post("/verify", VerifyEmail(client))
+	account.Post("/password-reset", RequestPasswordReset(client, e.Config.Mailer, e.Config.BaseURL))
+	account.Post("/password", ResetPassword(client))
+
+	auth := api.Group("/auth")
+	auth.Post("/login", Login(client))
+	auth.Post("/login/totp", LoginTOTP(client))
+	auth.Post("/logout", Logout(client))
+	auth.Post("/totp/enroll", EnrollTOTP(client, e.Config.Issuer))
+	auth.Post("/totp/confirm", ConfirmTOTP(client))
+
+	admin := api.Group("/admin", RequireRole(models.RoleAdmin))
+	admin.Get("/audit", ListAudit(client))
+	admin.Get("/trash/users", ListTrashedUsers(client))
+	admin.Delete("/trash/users", EmptyUserTrash(client))
+	admin.Delete("/trash/users/{id}", PurgeUser(client))
+	admin.Get("/webhooks", ListWebhooks(client))
+	admin.Post("/webhooks", CreateWebhook(client))
+	admin.Get("/webhooks/dead-letters", ListWebhookDeadLetters(client))
+	admin.Post("/webhooks/dead-letters/{id}/redeliver", RedeliverWebhook(client))
+	admin.Get("/webhooks/{id}", GetWebhook(client))
+	admin.Delete("/webhooks/{id}", DeleteWebhook(client))
+	admin.Get("/webhooks/{id}/deliveries", ListWebhookDeliveries(client))
+}
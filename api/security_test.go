@@ -0,0 +1,136 @@
+//go:build !js
+
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/maxence-charriere/go-app/v10/pkg/app"
+)
+
+func assertSecurityHeaders(t *testing.T, h http.Header) {
+	t.Helper()
+
+	expected := map[string]string{
+		"Strict-Transport-Security": "max-age=31536000; includeSubDomains",
+		"X-Content-Type-Options":    "nosniff",
+		"X-Frame-Options":           "DENY",
+	}
+	for name, want := range expected {
+		if got := h.Get(name); got != want {
+			t.Errorf("Expected %s %q, got %q", name, want, got)
+		}
+	}
+
+	for _, name := range []string{"Referrer-Policy", "Permissions-Policy", "Content-Security-Policy"} {
+		if h.Get(name) == "" {
+			t.Errorf("Expected %s header to be set", name)
+		}
+	}
+}
+
+type testPage struct {
+	app.Compo
+}
+
+func (p *testPage) Render() app.UI {
+	return app.Div()
+}
+
+func TestSecurityHeadersPWA(t *testing.T) {
+	app.Route("/security-test", func() app.Composer { return &testPage{} })
+
+	handler := SecurityHeaders(PWASecurityPolicy())(&app.Handler{
+		Name:        "Go PWA",
+		Description: "A Go PWA template",
+	})
+
+	// The page and the wasm loader script must both be covered
+	for _, path := range []string{"/security-test", "/app.js"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status %d for %s, got %d", http.StatusOK, path, w.Code)
+		}
+
+		assertSecurityHeaders(t, w.Header())
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/security-test", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	csp := w.Header().Get("Content-Security-Policy")
+	if !strings.Contains(csp, "'wasm-unsafe-eval'") {
+		t.Errorf("Expected CSP to allow wasm compilation, got %q", csp)
+	}
+	if strings.Contains(csp, "'unsafe-eval'") {
+		t.Errorf("Expected CSP not to allow unsafe-eval, got %q", csp)
+	}
+	if strings.Contains(csp, NoncePlaceholder) || !strings.Contains(csp, "'nonce-") {
+		t.Errorf("Expected CSP nonce to be filled in, got %q", csp)
+	}
+}
+
+func TestSecurityHeadersAPI(t *testing.T) {
+	handler := SecurityHeaders(APISecurityPolicy())(http.HandlerFunc(GetMessage()))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/message", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	assertSecurityHeaders(t, w.Header())
+
+	if got := w.Header().Get("Content-Security-Policy"); got != "default-src 'none'; frame-ancestors 'none'" {
+		t.Errorf("Unexpected API CSP %q", got)
+	}
+}
+
+func TestSecurityHeadersNonce(t *testing.T) {
+	var nonces []string
+	handler := SecurityHeaders(PWASecurityPolicy())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonce, ok := CSPNonceFromContext(r.Context())
+		if !ok || nonce == "" {
+			t.Error("Expected nonce in request context")
+		}
+		nonces = append(nonces, nonce)
+	}))
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		if csp := w.Header().Get("Content-Security-Policy"); !strings.Contains(csp, "'nonce-"+nonces[i]+"'") {
+			t.Errorf("Expected CSP to contain request nonce, got %q", csp)
+		}
+	}
+
+	if nonces[0] == nonces[1] {
+		t.Error("Expected a fresh nonce for every request")
+	}
+}
+
+func TestSecurityHeadersEmptyPolicy(t *testing.T) {
+	handler := SecurityHeaders(SecurityPolicy{})(okHandler())
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if w.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Error("Expected X-Content-Type-Options to always be set")
+	}
+	for _, name := range []string{"Strict-Transport-Security", "Content-Security-Policy", "Referrer-Policy"} {
+		if got := w.Header().Get(name); got != "" {
+			t.Errorf("Expected no %s header, got %q", name, got)
+		}
+	}
+}
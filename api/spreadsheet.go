@@ -0,0 +1,444 @@
+//go:build !js
+
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"assette/db"
+	"assette/models"
+	"assette/sheet"
+)
+
+// Limits of ImportUsers. Imports are written within the request, so rows
+// are bounded like bulk operations to finish well within Config.Timeout.
+// Files are read no further than the limits, and rows no wider than their
+// header.
+const (
+	MaxImportSize    = 10 << 20
+	MaxImportRows    = MaxBulkOperations
+	MaxImportColumns = 100
+)
+
+// ImportReportTTL is how long the error report of an import can be downloaded
+const ImportReportTTL = 24 * time.Hour
+
+// exportPageSize is how many users ExportUsers reads from etcd at a time
+const exportPageSize = 500
+
+// userColumns are the columns of exported users. Imports read id, name and
+// email; the others are managed by the server.
+var userColumns = []string{"id", "name", "email", "emailVerified", "role", "createdAt", "updatedAt"}
+
+// importFields are the user fields an import can set
+var importFields = []string{"id", "name", "email"}
+
+// importReport is stored for imports with failed rows: the rows as they were
+// in the file, followed by why they failed
+type importReport struct {
+	UserID string     `json:"userId,omitempty"`
+	Header []string   `json:"header"`
+	Rows   [][]string `json:"rows"`
+}
+
+// ExportUsers streams every user as a CSV file, or an XLSX workbook with
+// format=xlsx. Users are read from etcd a page at a time, so the export
+// never holds the whole namespace in memory. Names and emails are chosen by
+// users, so the sheet writers keep them from being read as formulas: CSV
+// cells starting with =, +, -, @, a tab or a carriage return get a leading
+// quote, and XLSX cells are inline strings, which are never evaluated.
+func ExportUsers(client *db.Client) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		format, err := spreadsheetFormat(r)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", format.ContentType())
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="users-%s.%s"`, time.Now().UTC().Format("20060102"), format))
+
+		writer, _ := sheet.NewWriter(w, format)
+		err = writer.Write(userColumns)
+		if err == nil {
+			err = client.Scan(r.Context(), "users", exportPageSize, func(record db.Record) error {
+				var user models.User
+				if err := json.Unmarshal(record.Value, &user); err != nil {
+					return nil // Skip malformed users
+				}
+				return writer.Write([]string{
+					record.Key,
+					user.Name,
+					user.Email,
+					strconv.FormatBool(user.EmailVerified),
+					user.Role,
+					formatTime(record.Metadata.CreatedAt),
+					formatTime(record.Metadata.UpdatedAt),
+				})
+			})
+		}
+		if err == nil {
+			err = writer.Close()
+		}
+		if err != nil {
+			// The status is sent already, cut the response short so that the
+			// client does not take a truncated file for a complete one
+			log.Printf("[ERROR] export users request=%s: %v", RequestIDFromContext(r.Context()), err)
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// ImportUsers creates and updates users from a CSV file or XLSX workbook
+// sent as the request body, in the format given by the format parameter or
+// the Content-Type. The first non-empty row names the columns: id, name
+// and email, ignoring case, or any header mapped to them with map
+// parameters such as map=Full Name=name. Rows with an id update that user,
+// others create one, and each is validated and written like a bulk
+// operation, with the same atomic and dryRun options, given as parameters.
+//
+// The response counts created, updated and failed rows and lists why rows
+// failed, by row number. When some did, report links to a copy of the file
+// holding only the failed rows with an error column, kept for
+// ImportReportTTL, so that they can be fixed and imported again.
+func ImportUsers(client *db.Client) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		atomic, err1 := parseBoolParam(query.Get("atomic"), "atomic")
+		dryRun, err2 := parseBoolParam(query.Get("dryRun"), "dryRun")
+		if err := errors.Join(err1, err2); err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		mapping, err := importMapping(query["map"])
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		format := sheet.Format("")
+		if name := query.Get("format"); name != "" {
+			format, err = sheet.ParseFormat(name)
+		} else {
+			format, err = sheet.FormatOf(r.Header.Get("Content-Type"))
+		}
+		if err != nil {
+			WriteError(w, r, NewProblem(http.StatusUnsupportedMediaType, CodeUnsupportedMedia, "Send a CSV file (text/csv) or an XLSX workbook"))
+			return
+		}
+
+		data, err := readBody(r, MaxImportSize)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		rows, err := sheet.ReadLimited(data, format, sheet.Limits{Rows: MaxImportRows, Columns: MaxImportColumns})
+		if errors.Is(err, sheet.ErrTooManyRows) {
+			WriteError(w, r, ValidationProblem(FieldError{Field: "file", Code: "too_many", Message: fmt.Sprintf("At most %d rows can be imported at once", MaxImportRows)}))
+			return
+		}
+		if errors.Is(err, sheet.ErrTooManyColumns) {
+			WriteError(w, r, ValidationProblem(FieldError{Field: "file", Code: "too_many", Message: fmt.Sprintf("Rows can have at most %d columns, and no cells beyond the header", MaxImportColumns)}))
+			return
+		}
+		if err != nil {
+			WriteError(w, r, NewProblem(http.StatusBadRequest, CodeInvalidBody, fmt.Sprintf("The file cannot be read as %s", strings.ToUpper(string(format)))).WithCause(err))
+			return
+		}
+
+		// The header is the first non-empty row
+		headerRow := 0
+		for headerRow < len(rows) && isEmptyRow(rows[headerRow]) {
+			headerRow++
+		}
+		if headerRow == len(rows) {
+			WriteError(w, r, ValidationProblem(FieldError{Field: "file", Code: "required", Message: "The file has no header row"}))
+			return
+		}
+		header := rows[headerRow]
+
+		columns, ignored, err := importColumns(header, mapping)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		var operations []bulkOperation
+		var rowNumbers []int
+		for i := headerRow + 1; i < len(rows); i++ {
+			if isEmptyRow(rows[i]) {
+				continue
+			}
+			cell := func(field string) string {
+				if column, ok := columns[field]; ok && column < len(rows[i]) {
+					return strings.TrimSpace(rows[i][column])
+				}
+				return ""
+			}
+
+			operation := bulkOperation{Op: BulkCreate, ID: cell("id"), User: &models.User{Name: cell("name"), Email: cell("email")}}
+			if operation.ID != "" {
+				operation.Op = BulkUpdate
+			}
+			operations = append(operations, operation)
+			rowNumbers = append(rowNumbers, i+1)
+		}
+		items, err := runBulk(r, client, operations, atomic, dryRun, 0)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		created, updated := 0, 0
+		failures := []map[string]interface{}{}
+		report := importReport{Header: append(append([]string{}, header...), "error")}
+		report.UserID, _ = UserIDFromContext(r.Context())
+		for i, item := range items {
+			if item.problem == nil {
+				if operations[i].Op == BulkCreate {
+					created++
+				} else {
+					updated++
+				}
+				continue
+			}
+
+			failure := map[string]interface{}{
+				"row":    rowNumbers[i],
+				"status": item.status,
+				"code":   item.problem.Code,
+				"detail": item.problem.Detail,
+			}
+			if operations[i].ID != "" {
+				failure["id"] = operations[i].ID
+			}
+			if len(item.problem.Errors) > 0 {
+				failure["errors"] = item.problem.Errors
+			}
+			failures = append(failures, failure)
+
+			row := make([]string, len(header), len(header)+1)
+			copy(row, rows[rowNumbers[i]-1])
+			report.Rows = append(report.Rows, append(row, importError(item.problem)))
+		}
+
+		response := map[string]interface{}{
+			"dryRun":  dryRun,
+			"rows":    len(operations),
+			"created": created,
+			"updated": updated,
+			"failed":  len(failures),
+			"errors":  failures,
+			"ignored": ignored,
+		}
+
+		if len(failures) > 0 {
+			reportID, err := storeImportReport(r, client, report)
+			if err != nil {
+				log.Printf("[WARNING] import report request=%s: %v", RequestIDFromContext(r.Context()), err)
+			} else {
+				response["report"] = r.URL.Path + "/reports/" + reportID
+			}
+		}
+
+		respond(w, r, http.StatusOK, response)
+	}
+}
+
+// GetImportReport downloads the failed rows of an import as CSV, or XLSX
+// with format=xlsx. Reports can only be read by the user who imported the
+// file, if any.
+func GetImportReport(client *db.Client) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		reportID := r.PathValue("id")
+
+		format, err := spreadsheetFormat(r)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		data, err := client.Get(r.Context(), "import-reports", reportID)
+		if err != nil {
+			if err == db.ErrKeyNotFound {
+				WriteError(w, r, NewProblem(http.StatusNotFound, CodeNotFound, "Import report not found or expired"))
+				return
+			}
+			WriteError(w, r, err)
+			return
+		}
+
+		var report importReport
+		if err := json.Unmarshal(data, &report); err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		if userID, _ := UserIDFromContext(r.Context()); report.UserID != "" && report.UserID != userID {
+			WriteError(w, r, NewProblem(http.StatusNotFound, CodeNotFound, "Import report not found or expired"))
+			return
+		}
+
+		w.Header().Set("Content-Type", format.ContentType())
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="import-errors.%s"`, format))
+
+		writer, _ := sheet.NewWriter(w, format)
+		writer.Write(report.Header)
+		for _, row := range report.Rows {
+			writer.Write(row)
+		}
+		writer.Close()
+	}
+}
+
+// spreadsheetFormat reads the format parameter of an export, CSV by default
+func spreadsheetFormat(r *http.Request) (sheet.Format, error) {
+	name := r.URL.Query().Get("format")
+	if name == "" {
+		return sheet.CSV, nil
+	}
+
+	format, err := sheet.ParseFormat(name)
+	if err != nil {
+		p := NewProblem(http.StatusBadRequest, CodeInvalidParameter, "Invalid query parameter")
+		p.Errors = []FieldError{{Field: "format", Code: CodeInvalidParameter, Message: "Format must be csv or xlsx"}}
+		return "", p
+	}
+	return format, nil
+}
+
+func parseBoolParam(value string, name string) (bool, error) {
+	if value == "" {
+		return false, nil
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		p := NewProblem(http.StatusBadRequest, CodeInvalidParameter, "Invalid query parameter")
+		p.Errors = []FieldError{{Field: name, Code: CodeInvalidParameter, Message: name + " must be true or false"}}
+		return false, p
+	}
+	return b, nil
+}
+
+// importMapping reads map parameters, each naming a header of the file and
+// the field its column holds, as in "Full Name=name"
+func importMapping(values []string) (map[string]string, error) {
+	mapping := make(map[string]string)
+	for _, value := range values {
+		i := strings.LastIndex(value, "=")
+		if i < 0 {
+			return nil, mappingProblem(fmt.Sprintf("%q must be written header=field", value))
+		}
+
+		header, field := normalizeHeader(value[:i]), strings.TrimSpace(value[i+1:])
+		if !containsField(importFields, field) {
+			return nil, mappingProblem(fmt.Sprintf("%q is not one of %s", field, strings.Join(importFields, ", ")))
+		}
+		mapping[header] = field
+	}
+	return mapping, nil
+}
+
+func mappingProblem(message string) *Problem {
+	p := NewProblem(http.StatusBadRequest, CodeInvalidParameter, "Invalid query parameter")
+	p.Errors = []FieldError{{Field: "map", Code: CodeInvalidParameter, Message: message}}
+	return p
+}
+
+// importColumns returns the column of each field in header, and the headers
+// of the columns that are not imported
+func importColumns(header []string, mapping map[string]string) (map[string]int, []string, error) {
+	columns := make(map[string]int)
+	ignored := []string{}
+	for i, name := range header {
+		normalized := normalizeHeader(name)
+		field, ok := mapping[normalized]
+		if !ok && containsField(importFields, normalized) {
+			field, ok = normalized, true
+		}
+		if !ok || normalized == "" {
+			if name != "" {
+				ignored = append(ignored, name)
+			}
+			continue
+		}
+
+		if _, duplicate := columns[field]; duplicate {
+			return nil, nil, ValidationProblem(FieldError{Field: "file", Code: "duplicate_column", Message: fmt.Sprintf("Several columns hold %s", field)})
+		}
+		columns[field] = i
+	}
+
+	var missing []FieldError
+	for _, field := range []string{"name", "email"} {
+		if _, ok := columns[field]; !ok {
+			missing = append(missing, FieldError{Field: field, Code: "missing_column", Message: fmt.Sprintf("No column holds %s, add it or map a header to it", field)})
+		}
+	}
+	if len(missing) > 0 {
+		return nil, nil, ValidationProblem(missing...)
+	}
+	return columns, ignored, nil
+}
+
+func normalizeHeader(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+func containsField(fields []string, field string) bool {
+	for _, f := range fields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+func isEmptyRow(row []string) bool {
+	for _, cell := range row {
+		if strings.TrimSpace(cell) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// importError describes why a row failed in the error report
+func importError(p *Problem) string {
+	if len(p.Errors) == 0 {
+		return p.Detail
+	}
+	messages := make([]string, len(p.Errors))
+	for i, e := range p.Errors {
+		messages[i] = e.Field + ": " + e.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+func storeImportReport(r *http.Request, client *db.Client, report importReport) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	reportID := hex.EncodeToString(b)
+
+	return reportID, client.PutWithTTL(r.Context(), "import-reports", reportID, report, ImportReportTTL)
+}
@@ -0,0 +1,246 @@
+//go:build !js
+
+package api
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"assette/models"
+	"assette/sheet"
+)
+
+type importResponse struct {
+	DryRun  bool     `json:"dryRun"`
+	Rows    int      `json:"rows"`
+	Created int      `json:"created"`
+	Updated int      `json:"updated"`
+	Failed  int      `json:"failed"`
+	Ignored []string `json:"ignored"`
+	Report  string   `json:"report"`
+	Errors  []struct {
+		Row    int          `json:"row"`
+		Status int          `json:"status"`
+		Code   string       `json:"code"`
+		Errors []FieldError `json:"errors"`
+	} `json:"errors"`
+}
+
+func callImport(t *testing.T, router http.Handler, session *httptest.ResponseRecorder, query string, contentType string, body []byte) (int, importResponse) {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/users/import"+query, bytes.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	if session != nil {
+		req = withSession(req, session)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	var response importResponse
+	json.NewDecoder(w.Body).Decode(&response)
+	return w.Code, response
+}
+
+func TestImportUsers(t *testing.T) {
+	_, _, client := newTestDB(t)
+	router := NewHandler(Config{Client: client})
+	ctx := context.Background()
+
+	client.PutIndexed(ctx, "users", "user:ada", models.User{Name: "Ada", Email: "ada@example.com", EmailVerified: true}, UsersByEmail)
+
+	file := "Full Name,E-mail,ID,Notes\n" +
+		"Ada Lovelace,ada@example.com,user:ada,renamed\n" +
+		"Grace Hopper,grace@example.com,,\n" +
+		"\n" +
+		",not-an-email,,\n" +
+		"Grace Again,GRACE@example.com,,\n"
+	mapping := "?map=Full%20Name%3Dname&map=e-mail%3Demail"
+
+	if code, _ := callImport(t, router, nil, mapping, "text/csv", []byte(file)); code != http.StatusUnauthorized {
+		t.Fatalf("Expected status %d without a session, got %d", http.StatusUnauthorized, code)
+	}
+
+	session := newAdminSession(t, client)
+	code, response := callImport(t, router, session, mapping+"&dryRun=true", "text/csv", []byte(file))
+	if code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, code)
+	}
+	if !response.DryRun || response.Rows != 4 || response.Created != 1 || response.Updated != 1 || response.Failed != 2 {
+		t.Errorf("Unexpected dry run result %+v", response)
+	}
+	if users, _ := client.List(ctx, "users"); len(users) != 2 {
+		t.Errorf("Expected nothing written by a dry run, got %d users", len(users))
+	}
+
+	code, response = callImport(t, router, session, mapping, "text/csv; charset=utf-8", []byte(file))
+	if code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, code)
+	}
+	if response.Created != 1 || response.Updated != 1 || response.Failed != 2 {
+		t.Fatalf("Unexpected import result %+v", response)
+	}
+	if len(response.Ignored) != 1 || response.Ignored[0] != "Notes" {
+		t.Errorf("Expected the Notes column to be ignored, got %v", response.Ignored)
+	}
+
+	invalid, duplicate := response.Errors[0], response.Errors[1]
+	if invalid.Row != 5 || invalid.Status != http.StatusBadRequest || len(invalid.Errors) != 2 {
+		t.Errorf("Expected row 5 to fail validation, got %+v", invalid)
+	}
+	if duplicate.Row != 6 || duplicate.Code != CodeDuplicate {
+		t.Errorf("Expected row 6 to have a taken email, got %+v", duplicate)
+	}
+
+	var ada models.User
+	data, _ := client.Get(ctx, "users", "user:ada")
+	json.Unmarshal(data, &ada)
+	if ada.Name != "Ada Lovelace" || !ada.EmailVerified {
+		t.Errorf("Expected Ada to be renamed and stay verified, got %+v", ada)
+	}
+
+	// The report holds the failed rows as they were, with why they failed
+	if response.Report == "" {
+		t.Fatal("Expected a report for the failed rows")
+	}
+	req := withSession(httptest.NewRequest(http.MethodGet, response.Report+"?format=xlsx", nil), session)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d for the report, got %d", http.StatusOK, w.Code)
+	}
+	rows, err := sheet.ReadAll(w.Body.Bytes(), sheet.XLSX)
+	if err != nil {
+		t.Fatalf("Failed to read the report: %v", err)
+	}
+	if len(rows) != 3 || rows[0][4] != "error" || rows[1][1] != "not-an-email" || !strings.Contains(rows[2][4], "already in use") {
+		t.Errorf("Unexpected report %q", rows)
+	}
+}
+
+func TestImportUsersErrors(t *testing.T) {
+	_, _, client := newTestDB(t)
+	router := NewHandler(Config{Client: client})
+	session := newAdminSession(t, client)
+
+	tests := []struct {
+		name        string
+		query       string
+		contentType string
+		body        string
+		status      int
+	}{
+		{"unknown type", "", "application/pdf", "name,email\n", http.StatusUnsupportedMediaType},
+		{"missing column", "", "text/csv", "name\nAda\n", http.StatusBadRequest},
+		{"empty file", "", "text/csv", "\n\n", http.StatusBadRequest},
+		{"bad mapping", "?map=Name%3Dpassword", "text/csv", "name,email\n", http.StatusBadRequest},
+		{"bad workbook", "?format=xlsx", "application/octet-stream", "name,email\n", http.StatusBadRequest},
+		{"bad option", "?dryRun=maybe", "text/csv", "name,email\n", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, _ := callImport(t, router, session, tt.query, tt.contentType, []byte(tt.body))
+			if code != tt.status {
+				t.Errorf("Expected status %d, got %d", tt.status, code)
+			}
+		})
+	}
+}
+
+func TestExportUsers(t *testing.T) {
+	_, _, client := newTestDB(t)
+	router := NewHandler(Config{Client: client})
+	ctx := context.Background()
+
+	client.PutIndexed(ctx, "users", "user:1", models.User{Name: "=cmd()", Email: "ada@example.com"}, UsersByEmail)
+	client.PutIndexed(ctx, "users", "user:2", models.User{Name: "Grace", Email: "grace@example.com", Role: models.RoleAdmin}, UsersByEmail)
+
+	for _, format := range []sheet.Format{sheet.CSV, sheet.XLSX} {
+		req := httptest.NewRequest(http.MethodGet, "/api/users/export?format="+string(format), nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != format.ContentType() {
+			t.Fatalf("%s: expected status %d, got %d %v", format, http.StatusOK, w.Code, w.Header())
+		}
+		if format == sheet.CSV && !strings.Contains(w.Body.String(), "user:1,'=cmd()") {
+			t.Errorf("Expected the formula to be quoted in the CSV file, got %q", w.Body)
+		}
+		if !strings.Contains(w.Header().Get("Content-Disposition"), "attachment") {
+			t.Errorf("%s: expected a download, got %q", format, w.Header().Get("Content-Disposition"))
+		}
+
+		rows, err := sheet.ReadAll(w.Body.Bytes(), format)
+		if err != nil {
+			t.Fatalf("%s: failed to read the export: %v", format, err)
+		}
+		if len(rows) != 3 || strings.Join(rows[0], ",") != strings.Join(userColumns, ",") {
+			t.Fatalf("%s: unexpected export %q", format, rows)
+		}
+		if rows[1][0] != "user:1" || rows[1][1] != "=cmd()" || rows[2][4] != models.RoleAdmin || rows[2][5] == "" {
+			t.Errorf("%s: unexpected users %q", format, rows[1:])
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/users/export?format=pdf", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for an unknown format, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+// TestImportUsersLimit checks that the largest import allowed is written
+// within the timeout of the API, and that larger ones are refused
+func TestImportUsersLimit(t *testing.T) {
+	_, _, client := newTestDB(t)
+	router := NewHandler(Config{Client: client, Timeout: 10 * time.Second})
+	session := newAdminSession(t, client)
+
+	file := func(rows int) []byte {
+		var b strings.Builder
+		b.WriteString("name,email\n")
+		for i := 0; i < rows; i++ {
+			fmt.Fprintf(&b, "User %d,user%d@example.com\n", i, i)
+		}
+		return []byte(b.String())
+	}
+
+	if code, response := callImport(t, router, session, "", "text/csv", file(MaxImportRows)); code != http.StatusOK || response.Created != MaxImportRows {
+		t.Fatalf("Expected %d users to be created, got %d %+v", MaxImportRows, code, response)
+	}
+	if code, _ := callImport(t, router, session, "", "text/csv", file(MaxImportRows+1)); code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for too many rows, got %d", http.StatusBadRequest, code)
+	}
+
+	// A cell in the last column of a workbook would otherwise pad its row
+	var workbook bytes.Buffer
+	archive := zip.NewWriter(&workbook)
+	for name, content := range map[string]string{
+		"xl/workbook.xml": `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"/>`,
+		"xl/worksheets/sheet1.xml": `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>` +
+			`<row r="1"><c r="A1" t="inlineStr"><is><t>name</t></is></c><c r="B1" t="inlineStr"><is><t>email</t></is></c></row>` +
+			`<row r="1048576"><c r="XFD1048576"><v>1</v></c></row>` +
+			`</sheetData></worksheet>`,
+	} {
+		f, _ := archive.Create(name)
+		f.Write([]byte(content))
+	}
+	archive.Close()
+	req := withSession(httptest.NewRequest(http.MethodPost, "/api/users/import", bytes.NewReader(workbook.Bytes())), session)
+	req.Header.Set("Content-Type", sheet.XLSX.ContentType())
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if problem := decodeProblem(t, w); w.Code != http.StatusBadRequest || len(problem.Errors) != 1 || problem.Errors[0].Code != "too_many" {
+		t.Errorf("Expected status %d for a cell beyond the header, got %d %+v", http.StatusBadRequest, w.Code, problem)
+	}
+}
@@ -0,0 +1,144 @@
+//go:build !js
+
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// precompressed lists the files the build may write next to an asset, by
+// the coding they hold, in order of preference
+var precompressed = []struct{ encoding, extension string }{
+	{EncodingBrotli, ".br"},
+	{EncodingGzip, ".gz"},
+}
+
+// StaticAssets serves the files of dir under /web/, and app.wasm at the
+// other paths go-app loads it from, with a strong ETag hashed from their
+// content and 304 Not Modified answers to If-None-Match. If the build wrote
+// app.wasm.br or app.wasm.gz next to a file, that file is sent instead to
+// clients accepting its coding, with the ETag suffixed as by Compress, except
+// for range requests, which always get the identity bytes. Other requests,
+// and files that do not exist, are passed to next.
+func StaticAssets(dir string) Middleware {
+	tags := &assetTags{tags: make(map[string]assetTag)}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			name, ok := assetName(r.URL.Path)
+			if !ok || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			file := filepath.Join(dir, filepath.FromSlash(name))
+			info, err := os.Stat(file)
+			if err != nil || info.IsDir() {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			etag, err := tags.get(file, info)
+			if err != nil {
+				WriteError(w, r, err)
+				return
+			}
+
+			// Precompressed files older than the asset are left over from a
+			// previous build
+			var offered []string
+			variants := make(map[string]string)
+			for _, p := range precompressed {
+				if variant, err := os.Stat(file + p.extension); err == nil && !variant.ModTime().Before(info.ModTime()) {
+					offered = append(offered, p.encoding)
+					variants[p.encoding] = file + p.extension
+				}
+			}
+
+			served := file
+			if len(offered) > 0 {
+				w.Header().Add("Vary", "Accept-Encoding")
+				if encoding := NegotiateEncoding(r.Header.Get("Accept-Encoding"), offered...); encoding != "" && r.Header.Get("Range") == "" {
+					served = variants[encoding]
+					etag = encodedETag(etag, encoding)
+					w.Header().Set("Content-Encoding", encoding)
+				}
+			}
+
+			f, err := os.Open(served)
+			if err != nil {
+				WriteError(w, r, err)
+				return
+			}
+			defer f.Close()
+
+			// Typed after the asset rather than the compressed file
+			if contentType := mime.TypeByExtension(path.Ext(name)); contentType != "" {
+				w.Header().Set("Content-Type", contentType)
+			}
+			w.Header().Set("ETag", etag)
+			w.Header().Set("Cache-Control", "no-cache")
+			http.ServeContent(w, r, name, info.ModTime(), f)
+		})
+	}
+}
+
+// assetName returns the path of a requested asset relative to the assets
+// directory, cleaned so that it cannot leave it
+func assetName(urlPath string) (string, bool) {
+	if urlPath == "/app.wasm" || urlPath == "/goapp.wasm" {
+		return "app.wasm", true
+	}
+	name, ok := strings.CutPrefix(path.Clean(urlPath), "/web/")
+	return name, ok && name != ""
+}
+
+// assetTag is the ETag of a file as of its modification time and size
+type assetTag struct {
+	modTime time.Time
+	size    int64
+	etag    string
+}
+
+// assetTags remembers the ETags of files so that they are only hashed again
+// when rebuilt
+type assetTags struct {
+	mu   sync.Mutex
+	tags map[string]assetTag
+}
+
+func (t *assetTags) get(file string, info os.FileInfo) (string, error) {
+	t.mu.Lock()
+	tag, ok := t.tags[file]
+	t.mu.Unlock()
+	if ok && tag.modTime.Equal(info.ModTime()) && tag.size == info.Size() {
+		return tag.etag, nil
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	tag = assetTag{modTime: info.ModTime(), size: info.Size(), etag: `"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`}
+
+	t.mu.Lock()
+	t.tags[file] = tag
+	t.mu.Unlock()
+	return tag.etag, nil
+}
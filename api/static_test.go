@@ -0,0 +1,94 @@
+//go:build !js
+
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStaticAssets(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "app.wasm"), []byte("wasm"), 0o644)
+	os.WriteFile(filepath.Join(dir, "app.wasm.br"), []byte("brotli"), 0o644)
+	os.WriteFile(filepath.Join(dir, "app.wasm.gz"), []byte("gzip"), 0o644)
+	os.WriteFile(filepath.Join(dir, "app.css"), []byte("body{}"), 0o644)
+
+	handler := StaticAssets(dir)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	request := func(path string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request("/web/app.wasm")
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || w.Body.String() != "wasm" || w.Header().Get("Content-Type") != "application/wasm" {
+		t.Fatalf("Expected the asset, got %d %v: %s", w.Code, w.Header(), w.Body)
+	}
+	if len(etag) < 3 || etag[0] != '"' || w.Header().Get("Vary") != "Accept-Encoding" {
+		t.Errorf("Expected a strong ETag varying on Accept-Encoding, got %v", w.Header())
+	}
+
+	// Each coding is another representation, with its own ETag
+	tests := []struct {
+		acceptEncoding string
+		body           string
+		encoding       string
+		suffix         string
+	}{
+		{"gzip, br", "brotli", EncodingBrotli, "-br"},
+		{"gzip", "gzip", EncodingGzip, "-gz"},
+		{"deflate", "wasm", "", ""},
+	}
+	for _, tt := range tests {
+		w := request("/app.wasm", "Accept-Encoding", tt.acceptEncoding)
+		if w.Body.String() != tt.body || w.Header().Get("Content-Encoding") != tt.encoding || w.Header().Get("Content-Type") != "application/wasm" {
+			t.Errorf("Accept-Encoding %q: expected %q in %q, got %q %v", tt.acceptEncoding, tt.body, tt.encoding, w.Body, w.Header())
+		}
+		if expected := etag[:len(etag)-1] + tt.suffix + `"`; w.Header().Get("ETag") != expected {
+			t.Errorf("Accept-Encoding %q: expected ETag %s, got %s", tt.acceptEncoding, expected, w.Header().Get("ETag"))
+		}
+	}
+
+	brotliTag := etag[:len(etag)-1] + `-br"`
+	if w := request("/web/app.wasm", "If-None-Match", brotliTag, "Accept-Encoding", "br"); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("Expected status %d, got %d", http.StatusNotModified, w.Code)
+	}
+	if w := request("/web/app.wasm", "If-None-Match", etag, "Accept-Encoding", "br"); w.Code != http.StatusOK || w.Body.String() != "brotli" {
+		t.Errorf("Expected the brotli file for the tag of another coding, got %d %q", w.Code, w.Body)
+	}
+
+	// Ranges apply to the identity bytes
+	if w := request("/web/app.wasm", "Range", "bytes=1-2", "Accept-Encoding", "br"); w.Code != http.StatusPartialContent || w.Body.String() != "as" || w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("Expected a range of the identity file, got %d %q %v", w.Code, w.Body, w.Header())
+	}
+
+	// Precompressed files older than the asset are ignored
+	os.WriteFile(filepath.Join(dir, "app.wasm"), []byte("rebuilt"), 0o644)
+	stale, _ := os.Stat(filepath.Join(dir, "app.wasm.br"))
+	os.Chtimes(filepath.Join(dir, "app.wasm"), stale.ModTime().Add(time.Second), stale.ModTime().Add(time.Second))
+	w = request("/web/app.wasm", "Accept-Encoding", "br", "If-None-Match", etag)
+	if w.Code != http.StatusOK || w.Body.String() != "rebuilt" || w.Header().Get("ETag") == etag {
+		t.Errorf("Expected the rebuilt asset with a new ETag, got %d %q %v", w.Code, w.Body, w.Header())
+	}
+
+	if w := request("/web/app.css", "Accept-Encoding", "br"); w.Body.String() != "body{}" || w.Header().Get("Vary") != "" {
+		t.Errorf("Expected the asset without precompressed variants, got %q %v", w.Body, w.Header())
+	}
+	for _, path := range []string{"/web/missing.js", "/web/../static_test.go", "/web/", "/"} {
+		if w := request(path); w.Code != http.StatusTeapot {
+			t.Errorf("Expected %s to be passed on, got %d", path, w.Code)
+		}
+	}
+}
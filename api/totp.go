@@ -0,0 +1,237 @@
+//go:build !js
+
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"assette/apiclient"
+	"assette/db"
+	"assette/models"
+	"assette/totp"
+
+	"github.com/skip2/go-qrcode"
+)
+
+const recoveryCodeCount = 10
+
+// totpRecord is stored in the totp namespace under the user ID. Recovery
+// codes are kept as hashes and removed once used.
+type totpRecord struct {
+	Secret        string   `json:"secret"`
+	Enabled       bool     `json:"enabled"`
+	LastCounter   int64    `json:"lastCounter"`
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+// EnrollTOTP starts two-factor enrollment for the current user. It returns
+// the secret, its provisioning URI and a QR code of that URI as a PNG data
+// URI. The secret only becomes active once confirmed with ConfirmTOTP.
+func EnrollTOTP(client *db.Client, issuer string) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, ok := SessionFromContext(r.Context())
+		if !ok {
+			WriteError(w, r, NewProblem(http.StatusUnauthorized, CodeUnauthenticated, "Authentication required"))
+			return
+		}
+
+		record, err := loadTOTP(r.Context(), client, session.UserID)
+		if err != nil && err != db.ErrKeyNotFound {
+			WriteError(w, r, err)
+			return
+		}
+		if record.Enabled {
+			WriteError(w, r, NewProblem(http.StatusConflict, CodeConflict, "Two-factor authentication already enabled"))
+			return
+		}
+
+		userData, err := client.Get(r.Context(), "users", session.UserID)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		var user models.User
+		if err := json.Unmarshal(userData, &user); err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		secret, err := totp.GenerateSecret()
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		if err := client.Put(r.Context(), "totp", session.UserID, totpRecord{Secret: secret}); err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		uri := totp.ProvisioningURI(issuer, user.Email, secret)
+		png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		respond(w, r, http.StatusOK, apiclient.TOTPEnrollment{
+			Secret: secret,
+			URI:    uri,
+			QRCode: "data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+		})
+	}
+}
+
+// ConfirmTOTP activates a pending enrollment with a code from the
+// authenticator app and returns single-use recovery codes. They are shown
+// only once. The current session counts as two-factor authenticated from then on.
+func ConfirmTOTP(client *db.Client) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, ok := SessionFromContext(r.Context())
+		if !ok {
+			WriteError(w, r, NewProblem(http.StatusUnauthorized, CodeUnauthenticated, "Authentication required"))
+			return
+		}
+
+		var request apiclient.CodeRequest
+		if err := decodeBody(r, &request); err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		record, err := loadTOTP(r.Context(), client, session.UserID)
+		if err != nil {
+			if err == db.ErrKeyNotFound {
+				WriteError(w, r, NewProblem(http.StatusConflict, CodeConflict, "No enrollment in progress"))
+				return
+			}
+			WriteError(w, r, err)
+			return
+		}
+		if record.Enabled {
+			WriteError(w, r, NewProblem(http.StatusConflict, CodeConflict, "Two-factor authentication already enabled"))
+			return
+		}
+
+		counter, ok := totp.Validate(record.Secret, request.Code, time.Now())
+		if !ok {
+			WriteError(w, r, NewProblem(http.StatusBadRequest, CodeInvalidCode, "Invalid code"))
+			return
+		}
+
+		codes, hashes, err := newRecoveryCodes()
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		record.Enabled = true
+		record.LastCounter = counter
+		record.RecoveryCodes = hashes
+		if err := client.Put(r.Context(), "totp", session.UserID, record); err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		// Secrets and recovery codes are never recorded
+		recordAudit(r, client, AuditUpdate, "totp", session.UserID, map[string]bool{"enabled": false}, map[string]bool{"enabled": true})
+
+		session.MFA = true
+		if err := client.PutWithTTL(r.Context(), "sessions", session.ID, session, sessionTTL); err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		respond(w, r, http.StatusOK, apiclient.RecoveryCodes{RecoveryCodes: codes})
+	}
+}
+
+func loadTOTP(ctx context.Context, client *db.Client, userID string) (totpRecord, error) {
+	data, err := client.Get(ctx, "totp", userID)
+	if err != nil {
+		return totpRecord{}, err
+	}
+
+	var record totpRecord
+	err = json.Unmarshal(data, &record)
+	return record, err
+}
+
+// checkSecondFactor accepts either a one-time password newer than the last
+// one used, or an unused recovery code, and records its use. The use is
+// written at the revision the record was read at, so that of two logins
+// sending the same code at once, only one succeeds.
+func checkSecondFactor(ctx context.Context, client *db.Client, userID string, code string) (bool, error) {
+	stored, err := client.GetRecord(ctx, "totp", userID)
+	if err != nil {
+		return false, err
+	}
+	var record totpRecord
+	if err := json.Unmarshal(stored.Value, &record); err != nil {
+		return false, err
+	}
+	if !record.Enabled {
+		return false, nil
+	}
+
+	use := func() (bool, error) {
+		_, err := client.CompareAndPut(ctx, "totp", userID, record, stored.ModRevision)
+		if err == db.ErrRevisionMismatch {
+			return false, nil // Used up by a concurrent login
+		}
+		return err == nil, err
+	}
+
+	if counter, ok := totp.Validate(record.Secret, code, time.Now()); ok {
+		if counter <= record.LastCounter {
+			return false, nil
+		}
+		record.LastCounter = counter
+		return use()
+	}
+
+	hash := hashToken(normalizeRecoveryCode(code))
+	for i, hashed := range record.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(hashed), []byte(hash)) == 1 {
+			record.RecoveryCodes = append(record.RecoveryCodes[:i], record.RecoveryCodes[i+1:]...)
+			return use()
+		}
+	}
+
+	return false, nil
+}
+
+// newRecoveryCodes returns codes formatted as xxxxx-xxxxx along with their hashes
+func newRecoveryCodes() ([]string, []string, error) {
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+
+		code := strings.ToLower(encoding.EncodeToString(b))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+		hashes[i] = hashToken(normalizeRecoveryCode(codes[i]))
+	}
+
+	return codes, hashes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
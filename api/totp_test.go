@@ -0,0 +1,247 @@
+//go:build !js
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"assette/models"
+	"assette/totp"
+)
+
+// newAuthServer serves the auth endpoints for an admin account
+// ada@example.com with password "correct horse battery"
+func newAuthServer(t *testing.T) http.Handler {
+	_, _, client := newTestDB(t)
+
+	newTestAccount(t, client, models.User{Name: "Ada", Email: "ada@example.com", Role: models.RoleAdmin}, "correct horse battery")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/auth/login", Login(client))
+	mux.HandleFunc("/api/auth/login/totp", LoginTOTP(client))
+	mux.HandleFunc("/api/auth/totp/enroll", EnrollTOTP(client, "Go PWA"))
+	mux.HandleFunc("/api/auth/totp/confirm", ConfirmTOTP(client))
+	mux.Handle("/api/admin", RequireRole(models.RoleAdmin)(okHandler()))
+
+	return Authenticate(client)(mux)
+}
+
+func serve(handler http.Handler, method string, path string, body interface{}, session *httptest.ResponseRecorder) *httptest.ResponseRecorder {
+	var data []byte
+	if body != nil {
+		data, _ = json.Marshal(body)
+	}
+
+	req := httptest.NewRequest(method, path, bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	if session != nil {
+		req = withSession(req, session)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func loginAda(handler http.Handler) *httptest.ResponseRecorder {
+	return serve(handler, http.MethodPost, "/api/auth/login", map[string]string{"email": "ada@example.com", "password": "correct horse battery"}, nil)
+}
+
+// enrollTOTP runs the enrollment flow for a logged in user and returns the
+// secret and recovery codes
+func enrollTOTP(t *testing.T, handler http.Handler, session *httptest.ResponseRecorder) (string, []string) {
+	t.Helper()
+
+	w := serve(handler, http.MethodPost, "/api/auth/totp/enroll", nil, session)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d on enroll, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+
+	var enrollment struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+		QRCode string `json:"qrCode"`
+	}
+	json.NewDecoder(w.Body).Decode(&enrollment)
+
+	if !strings.HasPrefix(enrollment.URI, "otpauth://totp/") || !strings.Contains(enrollment.URI, enrollment.Secret) {
+		t.Errorf("Unexpected provisioning URI %q", enrollment.URI)
+	}
+	if !strings.HasPrefix(enrollment.QRCode, "data:image/png;base64,") {
+		t.Errorf("Expected QR code as PNG data URI, got %.40q", enrollment.QRCode)
+	}
+
+	// Use the previous period so that logins in the test can use the current one
+	code, _ := totp.Code(enrollment.Secret, totp.Counter(time.Now())-1)
+	w = serve(handler, http.MethodPost, "/api/auth/totp/confirm", map[string]string{"code": code}, session)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d on confirm, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+
+	var confirmation struct {
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}
+	json.NewDecoder(w.Body).Decode(&confirmation)
+	if len(confirmation.RecoveryCodes) != recoveryCodeCount {
+		t.Errorf("Expected %d recovery codes, got %d", recoveryCodeCount, len(confirmation.RecoveryCodes))
+	}
+
+	return enrollment.Secret, confirmation.RecoveryCodes
+}
+
+// startSecondFactor logs in with the password and returns the pending token
+func startSecondFactor(t *testing.T, handler http.Handler) string {
+	t.Helper()
+
+	w := loginAda(handler)
+	var response struct {
+		MFARequired bool   `json:"mfaRequired"`
+		MFAToken    string `json:"mfaToken"`
+	}
+	json.NewDecoder(w.Body).Decode(&response)
+
+	if !response.MFARequired || response.MFAToken == "" {
+		t.Fatalf("Expected login to require a second factor, got status %d", w.Code)
+	}
+	if len(w.Result().Cookies()) != 0 {
+		t.Error("Expected no session cookie before the second factor")
+	}
+	return response.MFAToken
+}
+
+func TestTOTPEnrollmentUpgradesSession(t *testing.T) {
+	handler := newAuthServer(t)
+
+	session := loginAda(handler)
+	if w := serve(handler, http.MethodGet, "/api/admin", nil, session); w.Code != http.StatusForbidden {
+		t.Fatalf("Expected status %d before enrollment, got %d", http.StatusForbidden, w.Code)
+	}
+
+	enrollTOTP(t, handler, session)
+
+	if w := serve(handler, http.MethodGet, "/api/admin", nil, session); w.Code != http.StatusOK {
+		t.Errorf("Expected admin access after enrollment, got status %d", w.Code)
+	}
+}
+
+func TestLoginTOTP(t *testing.T) {
+	handler := newAuthServer(t)
+
+	secret, _ := enrollTOTP(t, handler, loginAda(handler))
+
+	mfaToken := startSecondFactor(t, handler)
+
+	w := serve(handler, http.MethodPost, "/api/auth/login/totp", map[string]string{"mfaToken": mfaToken, "code": "000000"}, nil)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d for wrong code, got %d", http.StatusUnauthorized, w.Code)
+	}
+
+	code, _ := totp.Code(secret, totp.Counter(time.Now()))
+	session := serve(handler, http.MethodPost, "/api/auth/login/totp", map[string]string{"mfaToken": mfaToken, "code": code}, nil)
+	if session.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, session.Code, session.Body)
+	}
+
+	if w := serve(handler, http.MethodGet, "/api/admin", nil, session); w.Code != http.StatusOK {
+		t.Errorf("Expected admin access after second factor, got status %d", w.Code)
+	}
+
+	// The same code cannot be replayed for another login
+	mfaToken = startSecondFactor(t, handler)
+	w = serve(handler, http.MethodPost, "/api/auth/login/totp", map[string]string{"mfaToken": mfaToken, "code": code}, nil)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d for replayed code, got %d", http.StatusUnauthorized, w.Code)
+	}
+}
+
+func TestLoginRecoveryCode(t *testing.T) {
+	handler := newAuthServer(t)
+
+	_, recoveryCodes := enrollTOTP(t, handler, loginAda(handler))
+
+	mfaToken := startSecondFactor(t, handler)
+	w := serve(handler, http.MethodPost, "/api/auth/login/totp", map[string]string{"mfaToken": mfaToken, "code": strings.ToUpper(recoveryCodes[0])}, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d with recovery code, got %d", http.StatusOK, w.Code)
+	}
+
+	// Recovery codes are single use
+	mfaToken = startSecondFactor(t, handler)
+	w = serve(handler, http.MethodPost, "/api/auth/login/totp", map[string]string{"mfaToken": mfaToken, "code": recoveryCodes[0]}, nil)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d for used recovery code, got %d", http.StatusUnauthorized, w.Code)
+	}
+}
+
+// TestRecoveryCodeConcurrentUse checks that a recovery code sent by several
+// logins at once lets only one of them in
+func TestRecoveryCodeConcurrentUse(t *testing.T) {
+	_, _, client := newTestDB(t)
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Put(context.Background(), "totp", "user:ada", totpRecord{Secret: "JBSWY3DPEHPK3PXP", Enabled: true, RecoveryCodes: hashes}); err != nil {
+		t.Fatal(err)
+	}
+
+	const logins = 10
+	var accepted atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < logins; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := checkSecondFactor(context.Background(), client, "user:ada", codes[0])
+			if err != nil {
+				t.Error(err)
+			}
+			if ok {
+				accepted.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if accepted.Load() != 1 {
+		t.Errorf("Expected the code to be accepted once, got %d", accepted.Load())
+	}
+	record, _ := loadTOTP(context.Background(), client, "user:ada")
+	if len(record.RecoveryCodes) != len(codes)-1 {
+		t.Errorf("Expected one code to be used up, got %d left", len(record.RecoveryCodes))
+	}
+}
+
+func TestLoginTOTPAttemptLimit(t *testing.T) {
+	handler := newAuthServer(t)
+
+	secret, _ := enrollTOTP(t, handler, loginAda(handler))
+	mfaToken := startSecondFactor(t, handler)
+
+	for i := 0; i < maxSecondFactorAttempts; i++ {
+		serve(handler, http.MethodPost, "/api/auth/login/totp", map[string]string{"mfaToken": mfaToken, "code": "000000"}, nil)
+	}
+
+	code, _ := totp.Code(secret, totp.Counter(time.Now()))
+	w := serve(handler, http.MethodPost, "/api/auth/login/totp", map[string]string{"mfaToken": mfaToken, "code": code}, nil)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d after too many attempts, got %d", http.StatusUnauthorized, w.Code)
+	}
+}
+
+func TestEnrollTOTPRequiresSession(t *testing.T) {
+	handler := newAuthServer(t)
+
+	if w := serve(handler, http.MethodPost, "/api/auth/totp/enroll", nil, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d, got %d", http.StatusUnauthorized, w.Code)
+	}
+}
@@ -0,0 +1,157 @@
+//go:build !js
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"assette/db"
+	"assette/models"
+	"assette/query"
+)
+
+// DefaultTrashRetention is how long deleted users can be restored when
+// Config.TrashRetention is not set
+const DefaultTrashRetention = 30 * 24 * time.Hour
+
+// trashQuery lists the query parameters accepted by ListTrashedUsers
+var trashQuery = query.Options{
+	Filterable:  userQuery.Filterable,
+	Sortable:    append([]string{"deletedAt"}, userQuery.Sortable...),
+	Selectable:  append([]string{"deletedAt", "deletedBy"}, userQuery.Selectable...),
+	DefaultSort: []query.Sort{{Field: "deletedAt", Desc: true}},
+}
+
+// RestoreUser moves a user back from the trash
+func RestoreUser(client *db.Client) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.PathValue("id")
+
+		record, err := client.Restore(r.Context(), "users", userID, UsersByEmail)
+		if err != nil {
+			switch {
+			case err == db.ErrKeyNotFound:
+				WriteError(w, r, NewProblem(http.StatusNotFound, CodeNotFound, "User not found in the trash"))
+			case err == db.ErrKeyExists:
+				WriteError(w, r, NewProblem(http.StatusConflict, CodeConflict, "A user with this ID exists"))
+			case errors.Is(err, db.ErrDuplicate):
+				WriteError(w, r, emailTaken())
+			default:
+				WriteError(w, r, err)
+			}
+			return
+		}
+
+		var user models.User
+		if err := json.Unmarshal(record.Value, &user); err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		recordAudit(r, client, AuditRestore, "users", userID, nil, user)
+
+		response := userResponse(userID, user, record.Metadata)
+
+		setVersionHeaders(w, record.Metadata)
+		respond(w, r, http.StatusOK, response)
+	}
+}
+
+// ListTrashedUsers returns the users in the trash, most recently deleted
+// first, with the same query parameters as ListUsers
+func ListTrashedUsers(client *db.Client) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q, err := query.Parse(r.URL.Query(), trashQuery)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		records, err := client.List(r.Context(), db.TrashNamespace("users"))
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		if notModified(w, r, listETag(records)) {
+			return
+		}
+
+		users := q.Apply(query.Documents(records, func(record db.Record) (map[string]interface{}, error) {
+			var user models.User
+			if err := json.Unmarshal(record.Value, &user); err != nil {
+				return nil, err
+			}
+			return userResponse(record.Key, user, record.Metadata), nil
+		}))
+
+		respond(w, r, http.StatusOK, map[string]interface{}{
+			"users": users,
+			"count": len(users),
+		})
+	}
+}
+
+// PurgeUser permanently deletes a user from the trash, along with its history
+// and any session left
+func PurgeUser(client *db.Client) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.PathValue("id")
+
+		deleted, err := client.Delete(r.Context(), db.TrashNamespace("users"), userID)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		if deleted == 0 {
+			WriteError(w, r, NewProblem(http.StatusNotFound, CodeNotFound, "User not found in the trash"))
+			return
+		}
+		if _, err := client.DeleteHistory(r.Context(), "users", userID); err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		if err := endSessions(r.Context(), client, userID); err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		recordAudit(r, client, AuditPurge, "users", userID, nil, nil)
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// EmptyUserTrash permanently deletes every user in the trash, along with
+// their history
+func EmptyUserTrash(client *db.Client) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		trashed, err := client.List(r.Context(), db.TrashNamespace("users"))
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		purged, err := client.DeleteAll(r.Context(), db.TrashNamespace("users"))
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		for _, record := range trashed {
+			if _, err := client.DeleteHistory(r.Context(), "users", record.Key); err != nil {
+				WriteError(w, r, err)
+				return
+			}
+			if err := endSessions(r.Context(), client, record.Key); err != nil {
+				WriteError(w, r, err)
+				return
+			}
+		}
+
+		recordAudit(r, client, AuditPurge, "users", "*", nil, map[string]int64{"purged": purged})
+
+		respond(w, r, http.StatusOK, map[string]interface{}{"purged": purged})
+	}
+}
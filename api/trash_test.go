@@ -0,0 +1,129 @@
+//go:build !js
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"assette/db"
+	"assette/models"
+)
+
+// callUser calls a handler for the user with the given ID
+func callUser(handler func(w http.ResponseWriter, r *http.Request), method string, userID string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/api/users/"+userID, strings.NewReader(body))
+	req.SetPathValue("id", userID)
+	w := httptest.NewRecorder()
+	handler(w, req)
+	return w
+}
+
+func listTrash(t *testing.T, client *db.Client) []map[string]interface{} {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, "/api/admin/trash/users", nil)
+	w := httptest.NewRecorder()
+	ListTrashedUsers(client)(w, req)
+
+	var response struct {
+		Users []map[string]interface{} `json:"users"`
+	}
+	json.NewDecoder(w.Body).Decode(&response)
+	return response.Users
+}
+
+func TestDeleteAndRestoreUser(t *testing.T) {
+	_, _, client := newTestDB(t)
+
+	userID := "user:trash"
+	client.PutIndexed(context.Background(), "users", userID, models.User{Name: "Ada", Email: "ada@example.com"}, UsersByEmail)
+
+	if w := callUser(DeleteUser(client, DefaultTrashRetention), http.MethodDelete, userID, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("Expected status %d, got %d", http.StatusNoContent, w.Code)
+	}
+
+	// Trashed users are hidden from the API but listed for admins
+	if w := callUser(GetUser(client), http.MethodGet, userID, ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for a trashed user, got %d", http.StatusNotFound, w.Code)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/api/users", nil)
+	w := httptest.NewRecorder()
+	ListUsers(client)(w, req)
+	if strings.Contains(w.Body.String(), userID) {
+		t.Errorf("Expected trashed user not to be listed, got %s", w.Body)
+	}
+
+	trash := listTrash(t, client)
+	if len(trash) != 1 || trash[0]["id"] != userID || trash[0]["deletedAt"] == nil {
+		t.Fatalf("Expected the user in the trash, got %v", trash)
+	}
+
+	w = callUser(RestoreUser(client), http.MethodPost, userID, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+	if w := callUser(GetUser(client), http.MethodGet, userID, ""); w.Code != http.StatusOK {
+		t.Errorf("Expected restored user to be found, got %d", w.Code)
+	}
+	if len(listTrash(t, client)) != 0 {
+		t.Error("Expected the trash to be empty after restoring")
+	}
+
+	if w := callUser(RestoreUser(client), http.MethodPost, userID, ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d restoring twice, got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestRestoreUserEmailTaken(t *testing.T) {
+	_, _, client := newTestDB(t)
+
+	client.PutIndexed(context.Background(), "users", "user:old", models.User{Name: "Ada", Email: "ada@example.com"}, UsersByEmail)
+	callUser(DeleteUser(client, DefaultTrashRetention), http.MethodDelete, "user:old", "")
+
+	// Deleting frees the address for someone else
+	if err := client.PutIndexed(context.Background(), "users", "user:new", models.User{Name: "Ada", Email: "ada@example.com"}, UsersByEmail); err != nil {
+		t.Fatalf("Expected the address to be free, got %v", err)
+	}
+
+	w := callUser(RestoreUser(client), http.MethodPost, "user:old", "")
+	if w.Code != http.StatusConflict {
+		t.Fatalf("Expected status %d, got %d", http.StatusConflict, w.Code)
+	}
+	if problem := decodeProblem(t, w); problem.Code != CodeDuplicate {
+		t.Errorf("Expected code %s, got %s", CodeDuplicate, problem.Code)
+	}
+}
+
+func TestPurgeUser(t *testing.T) {
+	_, _, client := newTestDB(t)
+
+	for _, id := range []string{"user:a", "user:b", "user:c"} {
+		client.Put(context.Background(), "users", id, models.User{Name: "Ada", Email: id[5:] + "@example.com"})
+		callUser(DeleteUser(client, DefaultTrashRetention), http.MethodDelete, id, "")
+	}
+
+	if w := callUser(PurgeUser(client), http.MethodDelete, "user:a", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("Expected status %d, got %d", http.StatusNoContent, w.Code)
+	}
+	if w := callUser(RestoreUser(client), http.MethodPost, "user:a", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected purged user not to be restorable, got %d", w.Code)
+	}
+	if w := callUser(PurgeUser(client), http.MethodDelete, "user:a", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d purging twice, got %d", http.StatusNotFound, w.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, "/api/admin/trash/users", nil)
+	w := httptest.NewRecorder()
+	EmptyUserTrash(client)(w, req)
+
+	var response map[string]int64
+	json.NewDecoder(w.Body).Decode(&response)
+	if response["purged"] != 2 || len(listTrash(t, client)) != 0 {
+		t.Errorf("Expected 2 users purged and an empty trash, got %v", response)
+	}
+}
@@ -4,255 +4,367 @@ package api
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"net/http"
 	"strings"
+	"time"
 
 	"assette/db"
 	"assette/models"
+	"assette/query"
 )
 
+// UsersByEmail indexes users by email address, ignoring case, so that each
+// address belongs to a single user
+var UsersByEmail = db.Index{
+	Namespace: "users-email",
+	Value: func(data []byte) string {
+		var user models.User
+		if err := json.Unmarshal(data, &user); err != nil {
+			return ""
+		}
+		return normalizeEmail(user.Email)
+	},
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// emailTaken is reported when another user already has the address
+func emailTaken() *Problem {
+	p := NewProblem(http.StatusConflict, CodeDuplicate, "Email is already in use")
+	p.Errors = []FieldError{{Field: "email", Code: "taken", Message: "Email is already in use"}}
+	return p
+}
+
 // CreateUser creates a new user
 func CreateUser(client *db.Client) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		var user models.User
+		if err := decodeBody(r, &user); err != nil {
+			WriteError(w, r, err)
 			return
 		}
 
-		var user models.User
-		if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+		if err := user.Validate(); err != nil {
+			WriteError(w, r, err)
 			return
 		}
 
-		// Generate a simple ID (in production, use UUID or similar)
-		userID := fmt.Sprintf("user:%d", generateID())
+		// Only the verification flow can mark an email as verified, and roles
+		// are never granted through this endpoint
+		user.EmailVerified = false
+		user.Role = models.RoleUser
 
-		if err := client.Put(context.Background(), "users", userID, user); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		userID, err := newUserID()
+		if err != nil {
+			WriteError(w, r, err)
 			return
 		}
 
-		// Return the created user with ID
-		response := map[string]interface{}{
-			"id":    userID,
-			"name":  user.Name,
-			"email": user.Email,
+		record, err := client.CompareAndPutIndexed(r.Context(), "users", userID, user, 0, UsersByEmail)
+		if err != nil {
+			if errors.Is(err, db.ErrDuplicate) {
+				WriteError(w, r, emailTaken())
+				return
+			}
+			WriteError(w, r, err)
+			return
 		}
 
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusCreated)
-		json.NewEncoder(w).Encode(response)
+		recordAudit(r, client, AuditCreate, "users", userID, nil, user)
+
+		// Return the created user with ID
+		response := userResponse(userID, user, record.Metadata)
+
+		setVersionHeaders(w, record.Metadata)
+		respond(w, r, http.StatusCreated, response)
 	}
 }
 
 // GetUser retrieves a single user by ID
 func GetUser(client *db.Client) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
-			return
-		}
-
-		// Extract user ID from URL path (e.g., /api/users/user:1)
-		pathParts := strings.Split(r.URL.Path, "/")
-		if len(pathParts) < 4 {
-			http.Error(w, "User ID required", http.StatusBadRequest)
-			return
-		}
-		userID := pathParts[3]
+		userID := r.PathValue("id")
 
-		userData, err := client.Get(context.Background(), "users", userID)
+		record, err := client.GetRecord(r.Context(), "users", userID)
 		if err != nil {
 			if err == db.ErrKeyNotFound {
-				http.Error(w, "User not found", http.StatusNotFound)
+				WriteError(w, r, NewProblem(http.StatusNotFound, CodeNotFound, "User not found"))
 				return
 			}
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			WriteError(w, r, err)
 			return
 		}
 
 		var user models.User
-		err = json.Unmarshal(userData, &user)
+		err = json.Unmarshal(record.Value, &user)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			WriteError(w, r, err)
 			return
 		}
 
-		response := map[string]interface{}{
-			"id":    userID,
-			"name":  user.Name,
-			"email": user.Email,
+		setVersionHeaders(w, record.Metadata)
+		if ifNoneMatch(r, versionETag(record.Metadata.Version)) || notModifiedSince(r, record.Metadata) {
+			w.Header().Add("Vary", "Accept")
+			w.WriteHeader(http.StatusNotModified)
+			return
 		}
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(response)
+		response := userResponse(userID, user, record.Metadata)
+		respond(w, r, http.StatusOK, response)
 	}
 }
 
-// ListUsers retrieves all users
+// userQuery lists the query parameters accepted by ListUsers
+var userQuery = query.Options{
+	Filterable:  []string{"id", "name", "email", "emailVerified", "role"},
+	Sortable:    []string{"id", "name", "email", "updatedAt"},
+	Selectable:  []string{"name", "email", "emailVerified", "role", "createdAt", "createdBy", "updatedAt", "updatedBy", "version"},
+	Reserved:    []string{"email"},
+	DefaultSort: []query.Sort{{Field: query.CreatedAt}},
+}
+
+// ListUsers retrieves users, filtered, sorted and trimmed as described in
+// the query package. The email parameter looks a user up by address, for
+// admins only, since it tells whether an address is registered.
 func ListUsers(client *db.Client) func(w http.ResponseWriter, r *http.Request) {
+	list := listUsers(client)
+	lookup := RequireRole(models.RoleAdmin)(http.HandlerFunc(list))
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("email") != "" {
+			lookup.ServeHTTP(w, r)
+			return
+		}
+		list(w, r)
+	}
+}
+
+func listUsers(client *db.Client) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		q, err := query.Parse(r.URL.Query(), userQuery)
+		if err != nil {
+			WriteError(w, r, err)
 			return
 		}
 
-		// Get all users from the users namespace
-		usersData, err := client.GetAll(context.Background(), "users")
+		var records []db.Record
+		if email := r.URL.Query().Get("email"); email != "" {
+			records, err = findUsersByEmail(r.Context(), client, email)
+		} else {
+			records, err = client.List(r.Context(), "users")
+		}
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			WriteError(w, r, err)
+			return
+		}
+		if notModified(w, r, listETag(records)) {
 			return
 		}
 
-		users := []map[string]interface{}{}
-		for userID, userData := range usersData {
+		users := q.Apply(query.Documents(records, func(record db.Record) (map[string]interface{}, error) {
 			var user models.User
-			err = json.Unmarshal(userData, &user)
-			if err != nil {
-				continue // Skip malformed user data
+			if err := json.Unmarshal(record.Value, &user); err != nil {
+				return nil, err
 			}
+			return userResponse(record.Key, user, record.Metadata), nil
+		}))
 
-			users = append(users, map[string]interface{}{
-				"id":    userID,
-				"name":  user.Name,
-				"email": user.Email,
-			})
-		}
-
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
+		respond(w, r, http.StatusOK, map[string]interface{}{
 			"users": users,
 			"count": len(users),
 		})
 	}
 }
 
-// UpdateUser updates an existing user
+// UpdateUser replaces the fields a client can set on a user
 func UpdateUser(client *db.Client) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPut {
-			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		var user models.User
+		if err := decodeBody(r, &user); err != nil {
+			WriteError(w, r, err)
 			return
 		}
 
-		// Extract user ID from URL path
-		pathParts := strings.Split(r.URL.Path, "/")
-		if len(pathParts) < 4 {
-			http.Error(w, "User ID required", http.StatusBadRequest)
+		updateUser(w, r, client, func(existing []byte) (models.User, error) {
+			return user, nil
+		})
+	}
+}
+
+// PatchUser updates some fields of a user with a JSON Merge Patch or a JSON
+// Patch applied to the stored user
+func PatchUser(client *db.Client) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Accept-Patch", acceptPatch)
+
+		apply, err := readPatch(r)
+		if err != nil {
+			WriteError(w, r, err)
 			return
 		}
-		userID := pathParts[3]
 
-		// Check if user exists
-		_, err := client.Get(context.Background(), "users", userID)
+		updateUser(w, r, client, func(existing []byte) (models.User, error) {
+			patched, err := apply(existing)
+			if err != nil {
+				return models.User{}, err
+			}
+
+			var user models.User
+			if err := json.Unmarshal(patched, &user); err != nil {
+				return models.User{}, NewProblem(http.StatusUnprocessableEntity, CodeInvalidPatch, "The patched user is not valid: "+err.Error())
+			}
+			return user, nil
+		})
+	}
+}
+
+// updateAttempts bounds how many times an update is reapplied when the user
+// changes concurrently and the client did not send If-Match
+const updateAttempts = 5
+
+// updateUser writes the user returned by change for the stored user, only if
+// the stored user has not changed meanwhile. Otherwise change is applied to
+// the new version, unless the request has an If-Match header, in which case
+// the client is told with 412 Precondition Failed.
+func updateUser(w http.ResponseWriter, r *http.Request, client *db.Client, change func(existing []byte) (models.User, error)) {
+	userID := r.PathValue("id")
+
+	for attempt := 1; ; attempt++ {
+		record, err := client.GetRecord(r.Context(), "users", userID)
 		if err != nil {
 			if err == db.ErrKeyNotFound {
-				http.Error(w, "User not found", http.StatusNotFound)
+				WriteError(w, r, NewProblem(http.StatusNotFound, CodeNotFound, "User not found"))
 				return
 			}
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			WriteError(w, r, err)
 			return
 		}
 
-		var user models.User
-		if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+		if !ifMatch(r, record.Metadata) {
+			WriteError(w, r, db.ErrRevisionMismatch)
 			return
 		}
 
-		if err := client.Put(context.Background(), "users", userID, user); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		var existing models.User
+		if err := json.Unmarshal(record.Value, &existing); err != nil {
+			WriteError(w, r, err)
 			return
 		}
 
-		response := map[string]interface{}{
-			"id":    userID,
-			"name":  user.Name,
-			"email": user.Email,
+		user, err := change(record.Value)
+		if err != nil {
+			WriteError(w, r, err)
+			return
 		}
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(response)
-	}
-}
-
-// DeleteUser deletes a user
-func DeleteUser(client *db.Client) func(w http.ResponseWriter, r *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodDelete {
-			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		if err := user.Validate(); err != nil {
+			WriteError(w, r, err)
 			return
 		}
 
-		// Extract user ID from URL path
-		pathParts := strings.Split(r.URL.Path, "/")
-		if len(pathParts) < 4 {
-			http.Error(w, "User ID required", http.StatusBadRequest)
+		// A changed email has to be verified again
+		user.EmailVerified = existing.EmailVerified && strings.EqualFold(user.Email, existing.Email)
+		user.Role = existing.Role
+
+		stored, err := client.CompareAndPutIndexed(r.Context(), "users", userID, user, record.ModRevision, UsersByEmail)
+		if err == db.ErrRevisionMismatch && r.Header.Get("If-Match") == "" && attempt < updateAttempts {
+			continue
+		}
+		if err != nil {
+			if errors.Is(err, db.ErrDuplicate) {
+				WriteError(w, r, emailTaken())
+				return
+			}
+			WriteError(w, r, err)
 			return
 		}
-		userID := pathParts[3]
+
+		recordAudit(r, client, AuditUpdate, "users", userID, existing, user)
+
+		response := userResponse(userID, user, stored.Metadata)
+
+		setVersionHeaders(w, stored.Metadata)
+		respond(w, r, http.StatusOK, response)
+		return
+	}
+}
+
+// DeleteUser moves a user to the trash, from which it can be restored until
+// retention has elapsed
+func DeleteUser(client *db.Client, retention time.Duration) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.PathValue("id")
 
 		// Check if user exists
-		_, err := client.Get(context.Background(), "users", userID)
+		existingData, err := client.Get(r.Context(), "users", userID)
 		if err != nil {
 			if err == db.ErrKeyNotFound {
-				http.Error(w, "User not found", http.StatusNotFound)
+				WriteError(w, r, NewProblem(http.StatusNotFound, CodeNotFound, "User not found"))
 				return
 			}
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			WriteError(w, r, err)
 			return
 		}
 
-		// Delete the user
-		_, err = client.Delete(context.Background(), "users", userID)
+		err = client.Trash(r.Context(), "users", userID, retention, UsersByEmail)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			WriteError(w, r, err)
+			return
+		}
+		if err := endSessions(r.Context(), client, userID); err != nil {
+			WriteError(w, r, err)
 			return
 		}
 
+		recordAudit(r, client, AuditDelete, "users", userID, json.RawMessage(existingData), nil)
+
 		w.WriteHeader(http.StatusNoContent)
 	}
 }
 
-// UserRouter handles routing for all user endpoints
-func UserRouter(client *db.Client) func(w http.ResponseWriter, r *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		path := r.URL.Path
-
-		// Route to appropriate handler based on path and method
-		if path == "/api/users" {
-			switch r.Method {
-			case http.MethodGet:
-				ListUsers(client)(w, r)
-			case http.MethodPost:
-				CreateUser(client)(w, r)
-			default:
-				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			}
-		} else if strings.HasPrefix(path, "/api/users/") {
-			switch r.Method {
-			case http.MethodGet:
-				GetUser(client)(w, r)
-			case http.MethodPut:
-				UpdateUser(client)(w, r)
-			case http.MethodDelete:
-				DeleteUser(client)(w, r)
-			default:
-				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			}
-		} else {
-			http.Error(w, "Not found", http.StatusNotFound)
-		}
+// findUsersByEmail returns the user owning email, if any
+func findUsersByEmail(ctx context.Context, client *db.Client, email string) ([]db.Record, error) {
+	userID, err := client.Lookup(ctx, UsersByEmail, normalizeEmail(email))
+	if err == db.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
 	}
+
+	record, err := client.GetRecord(ctx, "users", userID)
+	if err == db.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []db.Record{record}, nil
 }
 
-// Simple ID generator (in production, use UUID or database sequence)
-var idCounter = 0
+func userResponse(userID string, user models.User, meta db.Metadata) map[string]interface{} {
+	response := map[string]interface{}{
+		"id":            userID,
+		"name":          user.Name,
+		"email":         user.Email,
+		"emailVerified": user.EmailVerified,
+		"role":          user.Role,
+	}
+	addMetadata(response, meta)
+	return response
+}
 
-func generateID() int {
-	idCounter++
-	return idCounter
+// newUserID returns a random user ID. Being random rather than a counter,
+// IDs are unique across restarts and across the nodes of a cluster.
+func newUserID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "user:" + hex.EncodeToString(b), nil
 }
\ No newline at end of file
@@ -14,6 +14,7 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -130,6 +131,64 @@ func TestCreateUser(t *testing.T) {
 	}
 }
 
+// TestNewUserID checks that user IDs do not repeat, even from concurrent
+// requests or after a restart
+func TestNewUserID(t *testing.T) {
+	ids := make(chan string, 100)
+	for i := 0; i < cap(ids); i++ {
+		go func() {
+			id, err := newUserID()
+			if err != nil {
+				t.Error(err)
+			}
+			ids <- id
+		}()
+	}
+
+	seen := map[string]bool{}
+	for i := 0; i < cap(ids); i++ {
+		id := <-ids
+		if !strings.HasPrefix(id, "user:") || seen[id] {
+			t.Fatalf("Expected a new user ID, got %q", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestCreateUserValidation(t *testing.T) {
+	_, _, client := newTestDB(t)
+
+	body, _ := json.Marshal(models.User{Name: "", Email: "not-an-email"})
+	req := httptest.NewRequest(http.MethodPost, "/api/users", bytes.NewBuffer(body))
+	w := httptest.NewRecorder()
+	CreateUser(client)(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	problem := decodeProblem(t, w)
+	if problem.Code != CodeValidation {
+		t.Errorf("Expected code %s, got %s", CodeValidation, problem.Code)
+	}
+
+	// The same errors the Profile page shows before submitting
+	expected := models.User{Name: "", Email: "not-an-email"}.Validate().(models.ValidationErrors)
+	if len(problem.Errors) != len(expected) {
+		t.Fatalf("Expected field errors %+v, got %+v", expected, problem.Errors)
+	}
+	for i := range expected {
+		if problem.Errors[i] != expected[i] {
+			t.Errorf("Expected field error %+v, got %+v", expected[i], problem.Errors[i])
+		}
+	}
+
+	usersData, _ := client.GetAll(context.Background(), "users")
+	if len(usersData) != 0 {
+		t.Errorf("Expected invalid user not to be stored, got %d users", len(usersData))
+	}
+}
+
 func TestGetUser(t *testing.T) {
 	_, _, client := newTestDB(t)
 
@@ -147,6 +206,7 @@ func TestGetUser(t *testing.T) {
 
 	// Test getting the user
 	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/api/users/%s", userID), nil)
+	req.SetPathValue("id", userID)
 	w := httptest.NewRecorder()
 
 	handler := GetUser(client)
@@ -169,6 +229,7 @@ func TestGetUserNotFound(t *testing.T) {
 	_, _, client := newTestDB(t)
 
 	req := httptest.NewRequest(http.MethodGet, "/api/users/user:nonexistent", nil)
+	req.SetPathValue("id", "user:nonexistent")
 	w := httptest.NewRecorder()
 
 	handler := GetUser(client)
@@ -248,6 +309,7 @@ func TestUpdateUser(t *testing.T) {
 
 	body, _ := json.Marshal(updatedUser)
 	req := httptest.NewRequest(http.MethodPut, fmt.Sprintf("/api/users/%s", userID), bytes.NewBuffer(body))
+	req.SetPathValue("id", userID)
 	req.Header.Set("Content-Type", "application/json")
 	w := httptest.NewRecorder()
 
@@ -301,9 +363,10 @@ func TestDeleteUser(t *testing.T) {
 
 	// Delete the user
 	req := httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/api/users/%s", userID), nil)
+	req.SetPathValue("id", userID)
 	w := httptest.NewRecorder()
 
-	handler := DeleteUser(client)
+	handler := DeleteUser(client, DefaultTrashRetention)
 	handler(w, req)
 
 	resp := w.Result()
@@ -322,9 +385,10 @@ func TestDeleteUserNotFound(t *testing.T) {
 	_, _, client := newTestDB(t)
 
 	req := httptest.NewRequest(http.MethodDelete, "/api/users/user:nonexistent", nil)
+	req.SetPathValue("id", "user:nonexistent")
 	w := httptest.NewRecorder()
 
-	handler := DeleteUser(client)
+	handler := DeleteUser(client, DefaultTrashRetention)
 	handler(w, req)
 
 	resp := w.Result()
@@ -336,12 +400,12 @@ func TestDeleteUserNotFound(t *testing.T) {
 func TestUserRouter(t *testing.T) {
 	_, _, client := newTestDB(t)
 
-	router := UserRouter(client)
+	router := NewHandler(Config{Client: client})
 
 	// Test routing to ListUsers
 	req := httptest.NewRequest(http.MethodGet, "/api/users", nil)
 	w := httptest.NewRecorder()
-	router(w, req)
+	router.ServeHTTP(w, req)
 
 	if w.Result().StatusCode != http.StatusOK {
 		t.Errorf("Router failed for GET /api/users: got status %d", w.Result().StatusCode)
@@ -350,9 +414,358 @@ func TestUserRouter(t *testing.T) {
 	// Test invalid method
 	req = httptest.NewRequest(http.MethodPatch, "/api/users", nil)
 	w = httptest.NewRecorder()
-	router(w, req)
+	router.ServeHTTP(w, req)
 
 	if w.Result().StatusCode != http.StatusMethodNotAllowed {
 		t.Errorf("Router should return 405 for PATCH /api/users: got status %d", w.Result().StatusCode)
 	}
-}
\ No newline at end of file
+}
+func TestUniqueEmail(t *testing.T) {
+	_, _, client := newTestDB(t)
+	handler := NewHandler(Config{Client: client})
+
+	create := func(email string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(models.User{Name: "Ada", Email: email})
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/users", bytes.NewBuffer(body)))
+		return w
+	}
+
+	first := create("ada@example.com")
+	if first.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d", http.StatusCreated, first.Code)
+	}
+	var created map[string]interface{}
+	json.NewDecoder(first.Body).Decode(&created)
+	adaID := created["id"].(string)
+
+	w := create("ADA@example.com")
+	if w.Code != http.StatusConflict {
+		t.Fatalf("Expected status %d for duplicate email, got %d", http.StatusConflict, w.Code)
+	}
+	problem := decodeProblem(t, w)
+	if problem.Code != CodeDuplicate || len(problem.Errors) != 1 || problem.Errors[0].Field != "email" {
+		t.Errorf("Expected duplicate email field error, got %+v", problem)
+	}
+
+	// Updating another user to a taken address is rejected too
+	other := create("grace@example.com")
+	json.NewDecoder(other.Body).Decode(&created)
+	graceID := created["id"].(string)
+
+	session := newAdminSession(t, client)
+	body, _ := json.Marshal(models.User{Name: "Grace", Email: "ada@example.com"})
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, withSession(httptest.NewRequest(http.MethodPut, "/api/users/"+graceID, bytes.NewBuffer(body)), session))
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d when updating to a taken email, got %d", http.StatusConflict, w.Code)
+	}
+
+	// Deleting a user frees the address
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, withSession(httptest.NewRequest(http.MethodDelete, "/api/users/"+adaID, nil), session))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected status %d, got %d", http.StatusNoContent, w.Code)
+	}
+	if w := create("ada@example.com"); w.Code != http.StatusCreated {
+		t.Errorf("Expected freed email to be available, got status %d", w.Code)
+	}
+}
+
+func TestListUsersByEmail(t *testing.T) {
+	_, _, client := newTestDB(t)
+
+	client.PutIndexed(context.Background(), "users", "user:ada", models.User{Name: "Ada", Email: "ada@example.com"}, UsersByEmail)
+	client.PutIndexed(context.Background(), "users", "user:grace", models.User{Name: "Grace", Email: "grace@example.com"}, UsersByEmail)
+
+	router := NewHandler(Config{Client: client})
+	session := newAdminSession(t, client)
+
+	// Whether an address is registered is for admins to know
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/users?email=ada@example.com", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d for an anonymous lookup, got %d", http.StatusUnauthorized, w.Code)
+	}
+
+	lookup := func(email string) []interface{} {
+		req := withSession(httptest.NewRequest(http.MethodGet, "/api/users?email="+email, nil), session)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+		}
+
+		var response map[string]interface{}
+		json.NewDecoder(w.Body).Decode(&response)
+		return response["users"].([]interface{})
+	}
+
+	users := lookup("Ada@Example.com")
+	if len(users) != 1 || users[0].(map[string]interface{})["id"] != "user:ada" {
+		t.Errorf("Expected only user:ada, got %v", users)
+	}
+
+	if users := lookup("nobody@example.com"); len(users) != 0 {
+		t.Errorf("Expected no users, got %v", users)
+	}
+}
+
+func TestListUsersQuery(t *testing.T) {
+	_, _, client := newTestDB(t)
+
+	for _, u := range []struct {
+		ID   string
+		User models.User
+	}{
+		{"user:b", models.User{Name: "Grace", Email: "grace@navy.mil"}},
+		{"user:a", models.User{Name: "ada", Email: "ada@example.com", EmailVerified: true}},
+		{"user:c", models.User{Name: "Alan", Email: "alan@example.com"}},
+	} {
+		client.Put(context.Background(), "users", u.ID, u.User)
+	}
+
+	list := func(rawQuery string) (int, []map[string]interface{}) {
+		req := httptest.NewRequest(http.MethodGet, "/api/users?"+rawQuery, nil)
+		w := httptest.NewRecorder()
+		ListUsers(client)(w, req)
+
+		var response struct {
+			Users []map[string]interface{} `json:"users"`
+		}
+		json.NewDecoder(w.Body).Decode(&response)
+		return w.Code, response.Users
+	}
+
+	ids := func(users []map[string]interface{}) string {
+		var list []string
+		for _, user := range users {
+			list = append(list, user["id"].(string))
+		}
+		return strings.Join(list, ",")
+	}
+
+	tests := []struct {
+		query string
+		ids   string
+	}{
+		{"", "user:b,user:a,user:c"},
+		{"sort=name", "user:a,user:c,user:b"},
+		{"sort=-createdAt", "user:c,user:a,user:b"},
+		{"name[prefix]=a&sort=email", "user:a,user:c"},
+		{"email[contains]=example&emailVerified=false", "user:c"},
+	}
+
+	for _, tt := range tests {
+		status, users := list(tt.query)
+		if status != http.StatusOK {
+			t.Errorf("%q: expected status %d, got %d", tt.query, http.StatusOK, status)
+		}
+		if got := ids(users); got != tt.ids {
+			t.Errorf("%q: expected %s, got %s", tt.query, tt.ids, got)
+		}
+	}
+
+	_, users := list("fields=name&sort=name")
+	if len(users[0]) != 2 || users[0]["name"] != "ada" {
+		t.Errorf("Expected only id and name, got %v", users[0])
+	}
+
+	if status, _ := list("password=secret"); status != http.StatusBadRequest {
+		t.Errorf("Expected status %d for unknown filter, got %d", http.StatusBadRequest, status)
+	}
+}
+
+func TestPatchUser(t *testing.T) {
+	_, _, client := newTestDB(t)
+
+	userID := "user:patch"
+	client.PutIndexed(context.Background(), "users", userID, models.User{Name: "Ada", Email: "ada@example.com", EmailVerified: true, Role: models.RoleUser}, UsersByEmail)
+
+	patchUser := func(contentType string, body string, ifMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPatch, "/api/users/"+userID, strings.NewReader(body))
+		req.SetPathValue("id", userID)
+		req.Header.Set("Content-Type", contentType)
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		w := httptest.NewRecorder()
+		PatchUser(client)(w, req)
+		return w
+	}
+
+	stored := func() models.User {
+		data, _ := client.Get(context.Background(), "users", userID)
+		var user models.User
+		json.Unmarshal(data, &user)
+		return user
+	}
+
+	// Merge patch changes only the fields sent
+	w := patchUser("application/merge-patch+json", `{"name":"Ada Lovelace"}`, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+	if user := stored(); user.Name != "Ada Lovelace" || user.Email != "ada@example.com" || !user.EmailVerified {
+		t.Errorf("Expected only the name to change, got %+v", user)
+	}
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("Expected an ETag")
+	}
+
+	// JSON Patch, guarded by the ETag from the previous response
+	w = patchUser("application/json-patch+json", `[{"op":"test","path":"/name","value":"Ada Lovelace"},{"op":"replace","path":"/email","value":"lovelace@example.com"}]`, etag)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+	if user := stored(); user.Email != "lovelace@example.com" || user.EmailVerified {
+		t.Errorf("Expected a new, unverified email, got %+v", user)
+	}
+
+	// The old ETag no longer matches
+	if w := patchUser("application/merge-patch+json", `{"name":"Stale"}`, etag); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected status %d for stale If-Match, got %d", http.StatusPreconditionFailed, w.Code)
+	}
+
+	tests := []struct {
+		contentType string
+		body        string
+		status      int
+		code        string
+	}{
+		{"application/json", `{"name":"Grace"}`, http.StatusUnsupportedMediaType, CodeUnsupportedMedia},
+		{"application/merge-patch+json", `{"name":`, http.StatusBadRequest, CodeInvalidBody},
+		{"application/merge-patch+json", `{"name":null}`, http.StatusBadRequest, CodeValidation},
+		{"application/merge-patch+json", `{"name":42}`, http.StatusUnprocessableEntity, CodeInvalidPatch},
+		{"application/json-patch+json", `[{"op":"remove","path":"/missing"}]`, http.StatusUnprocessableEntity, CodeInvalidPatch},
+		{"application/json-patch+json", `[{"op":"test","path":"/name","value":"Grace"}]`, http.StatusConflict, CodeConflict},
+	}
+
+	for _, tt := range tests {
+		w := patchUser(tt.contentType, tt.body, "")
+		if w.Code != tt.status {
+			t.Errorf("%s %s: expected status %d, got %d", tt.contentType, tt.body, tt.status, w.Code)
+			continue
+		}
+		if problem := decodeProblem(t, w); problem.Code != tt.code {
+			t.Errorf("%s %s: expected code %s, got %s", tt.contentType, tt.body, tt.code, problem.Code)
+		}
+	}
+
+	// Role and verification cannot be patched
+	patchUser("application/merge-patch+json", `{"role":"admin","emailVerified":true}`, "")
+	if user := stored(); user.Role != models.RoleUser || user.EmailVerified {
+		t.Errorf("Expected role and verification to be kept, got %+v", user)
+	}
+}
+
+func TestUserMetadata(t *testing.T) {
+	_, _, client := newTestDB(t)
+
+	body := strings.NewReader(`{"name":"Ada","email":"ada@example.com"}`)
+	req := httptest.NewRequest(http.MethodPost, "/api/users", body)
+	req = req.WithContext(db.WithActor(req.Context(), "user:admin"))
+	w := httptest.NewRecorder()
+	CreateUser(client)(w, req)
+
+	var created map[string]interface{}
+	json.NewDecoder(w.Body).Decode(&created)
+	userID, _ := created["id"].(string)
+	if created["createdAt"] == nil || created["createdBy"] != "user:admin" || created["version"] == nil {
+		t.Fatalf("Expected metadata in the created user, got %v", created)
+	}
+
+	get := func(header string, value string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/users/"+userID, nil)
+		req.SetPathValue("id", userID)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		w := httptest.NewRecorder()
+		GetUser(client)(w, req)
+		return w
+	}
+
+	w = get("", "")
+	lastModified := w.Header().Get("Last-Modified")
+	etag := w.Header().Get("ETag")
+	if lastModified == "" || etag != fmt.Sprintf(`"%v"`, created["version"]) {
+		t.Fatalf("Expected Last-Modified and an ETag matching the version, got %q and %q", lastModified, etag)
+	}
+
+	if w := get("If-Modified-Since", lastModified); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("Expected status %d with no body, got %d", http.StatusNotModified, w.Code)
+	}
+	if w := get("If-Modified-Since", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)); w.Code != http.StatusOK {
+		t.Errorf("Expected status %d for an older date, got %d", http.StatusOK, w.Code)
+	}
+	for _, tag := range []string{etag, "W/" + etag, `"0", ` + etag} {
+		if w := get("If-None-Match", tag); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+			t.Errorf("Expected status %d for If-None-Match %s, got %d", http.StatusNotModified, tag, w.Code)
+		}
+	}
+
+	put := func(ifMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, "/api/users/"+userID, strings.NewReader(`{"name":"Ada Lovelace","email":"ada@example.com"}`))
+		req.SetPathValue("id", userID)
+		req.Header.Set("If-Match", ifMatch)
+		w := httptest.NewRecorder()
+		UpdateUser(client)(w, req)
+		return w
+	}
+
+	w = put(etag)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+	var updated map[string]interface{}
+	json.NewDecoder(w.Body).Decode(&updated)
+	if updated["createdAt"] != created["createdAt"] || updated["version"] == created["version"] {
+		t.Errorf("Expected the creation time to be kept and the version to change, got %v", updated)
+	}
+
+	if w := put(etag); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected status %d for a stale ETag, got %d", http.StatusPreconditionFailed, w.Code)
+	}
+	if w := get("If-None-Match", etag); w.Code != http.StatusOK {
+		t.Errorf("Expected status %d for a stale If-None-Match, got %d", http.StatusOK, w.Code)
+	}
+}
+
+func TestListUsersETag(t *testing.T) {
+	_, _, client := newTestDB(t)
+	router := NewHandler(Config{Client: client})
+	session := newAdminSession(t, client)
+
+	request := func(method, path, body, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := withSession(httptest.NewRequest(method, path, strings.NewReader(body)), session)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	request(http.MethodPost, "/api/users", `{"name":"Ada","email":"ada@example.com"}`, "")
+	w := request(http.MethodPost, "/api/users", `{"name":"Grace","email":"grace@example.com"}`, "")
+	var grace map[string]interface{}
+	json.NewDecoder(w.Body).Decode(&grace)
+
+	etag := request(http.MethodGet, "/api/users", "", "").Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("Expected an ETag on the list")
+	}
+	if w := request(http.MethodGet, "/api/users?sort=name", "", etag); w.Code != http.StatusNotModified {
+		t.Errorf("Expected status %d, got %d", http.StatusNotModified, w.Code)
+	}
+
+	// Deleting the most recently written user changes the tag too
+	request(http.MethodDelete, fmt.Sprintf("/api/users/%v", grace["id"]), "", "")
+	w = request(http.MethodGet, "/api/users", "", etag)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Errorf("Expected a new ETag after a delete, got %d %s", w.Code, w.Header().Get("ETag"))
+	}
+}
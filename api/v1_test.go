@@ -0,0 +1,139 @@
+//go:build !js
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Shapes of the v1 responses: the fields each must have and the JSON type of
+// their values. Responses may gain fields, but those listed here must not be
+// removed, renamed or change type while v1 is served.
+var v1Shapes = map[string]string{
+	"message": `{"text": "string"}`,
+	"user": `{"id": "string", "name": "string", "email": "string", "emailVerified": "boolean", "role": "string",
+		"version": "number", "createdAt": "string", "updatedAt": "string"}`,
+	"users":    `{"count": "number", "users": [{"id": "string", "name": "string", "email": "string", "version": "number"}]}`,
+	"history":  `{"count": "number", "versions": [{"id": "string", "name": "string", "version": "number"}]}`,
+	"bulk":     `{"dryRun": "boolean", "succeeded": "number", "failed": "number", "results": [{"index": "number", "op": "string", "status": "number"}]}`,
+	"problem":  `{"type": "string", "title": "string", "status": "number", "detail": "string", "instance": "string", "code": "string", "requestId": "string"}`,
+	"invalid":  `{"status": "number", "code": "string", "errors": [{"field": "string", "code": "string", "message": "string"}]}`,
+	"restored": `{"id": "string", "email": "string", "version": "number"}`,
+}
+
+// TestV1Compatibility runs the v1 endpoints through their usual calls and
+// checks every response against v1Shapes, under /api/v1 and under the
+// unversioned paths that serve the same version
+func TestV1Compatibility(t *testing.T) {
+	for name, prefix := range map[string]string{"v1": "/api/v1", "unversioned": "/api"} {
+		t.Run(name, func(t *testing.T) {
+			_, _, client := newTestDB(t)
+			router := NewHandler(Config{Client: client})
+			session := newAdminSession(t, client)
+
+			call := func(method, path, contentType, body string, status int, shape string) map[string]interface{} {
+				t.Helper()
+				req := withSession(httptest.NewRequest(method, prefix+path, strings.NewReader(body)), session)
+				if contentType != "" {
+					req.Header.Set("Content-Type", contentType)
+				}
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+				if w.Code != status {
+					t.Fatalf("%s %s: expected status %d, got %d: %s", method, path, status, w.Code, w.Body)
+				}
+				if shape == "" {
+					return nil
+				}
+
+				var document map[string]interface{}
+				if err := json.Unmarshal(w.Body.Bytes(), &document); err != nil {
+					t.Fatalf("%s %s: invalid JSON: %v", method, path, err)
+				}
+				var expected interface{}
+				if err := json.Unmarshal([]byte(v1Shapes[shape]), &expected); err != nil {
+					t.Fatalf("Invalid shape %s: %v", shape, err)
+				}
+				for _, difference := range shapeDifferences("", expected, document) {
+					t.Errorf("%s %s: %s", method, path, difference)
+				}
+				return document
+			}
+
+			call(http.MethodGet, "/message", "", "", http.StatusOK, "message")
+
+			user := call(http.MethodPost, "/users", "application/json", `{"name": "Ada", "email": "ada@example.com"}`, http.StatusCreated, "user")
+			id := user["id"].(string)
+			call(http.MethodGet, "/users/"+id, "", "", http.StatusOK, "user")
+			call(http.MethodGet, "/users?sort=name", "", "", http.StatusOK, "users")
+			call(http.MethodPut, "/users/"+id, "application/json", `{"name": "Ada Lovelace", "email": "ada@example.com"}`, http.StatusOK, "user")
+			call(http.MethodPatch, "/users/"+id, "application/merge-patch+json", `{"name": "Ada"}`, http.StatusOK, "user")
+			call(http.MethodGet, "/users/"+id+"/history", "", "", http.StatusOK, "history")
+			call(http.MethodPost, "/users/bulk", "application/json", `{"operations": [{"op": "create", "user": {"name": "Grace", "email": "grace@example.com"}}]}`, http.StatusOK, "bulk")
+
+			call(http.MethodDelete, "/users/"+id, "", "", http.StatusNoContent, "")
+			call(http.MethodPost, "/users/"+id+"/restore", "", "", http.StatusOK, "restored")
+
+			call(http.MethodGet, "/users/user:missing", "", "", http.StatusNotFound, "problem")
+			call(http.MethodPost, "/users", "application/json", `{"name": "", "email": "bad"}`, http.StatusBadRequest, "invalid")
+		})
+	}
+}
+
+// shapeDifferences lists where document lacks the fields of expected, a shape
+// giving the JSON type of each value and a single element for arrays
+func shapeDifferences(path string, expected interface{}, document interface{}) []string {
+	var differences []string
+	switch expected := expected.(type) {
+	case map[string]interface{}:
+		object, ok := document.(map[string]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s: expected an object, got %T", path, document)}
+		}
+		keys := make([]string, 0, len(expected))
+		for key := range expected {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			value, ok := object[key]
+			if !ok {
+				differences = append(differences, fmt.Sprintf("%s.%s: missing", path, key))
+				continue
+			}
+			differences = append(differences, shapeDifferences(path+"."+key, expected[key], value)...)
+		}
+	case []interface{}:
+		array, ok := document.([]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s: expected an array, got %T", path, document)}
+		}
+		for i, element := range array {
+			differences = append(differences, shapeDifferences(fmt.Sprintf("%s[%d]", path, i), expected[0], element)...)
+		}
+	case string:
+		var actual string
+		switch document.(type) {
+		case string:
+			actual = "string"
+		case float64:
+			actual = "number"
+		case bool:
+			actual = "boolean"
+		case nil:
+			actual = "null"
+		default:
+			actual = fmt.Sprintf("%T", document)
+		}
+		if actual != expected {
+			differences = append(differences, fmt.Sprintf("%s: expected a %s, got a %s", path, expected, actual))
+		}
+	}
+	return differences
+}
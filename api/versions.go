@@ -0,0 +1,105 @@
+//go:build !js
+
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version is a version of the API, whose endpoints are served under
+// /api/<Name>. A new version registers its own routes, which may reuse the
+// handlers of the previous one for the endpoints that did not change, and
+// the previous one is then deprecated so that its clients know to move on.
+type Version struct {
+	// Name is the path segment of the version, such as v1. The unversioned
+	// paths served before versioning have an empty name.
+	Name string
+
+	// Routes registers the endpoints of the version
+	Routes func(e Endpoints)
+
+	// Operations describes the endpoints registered by Routes for the
+	// OpenAPI document, by method and path relative to the version prefix
+	// such as "GET /users/{id}"
+	Operations map[string]Operation
+
+	// Deprecated is when the version was deprecated, announced in the
+	// Deprecation header of its responses. Zero while it is current.
+	Deprecated time.Time
+
+	// Sunset is when the version stops being served, announced in the Sunset
+	// header of its responses. Requests get 410 Gone afterwards.
+	Sunset time.Time
+
+	// Successor names the version replacing a deprecated one, linked from
+	// its responses
+	Successor string
+}
+
+// Endpoints is where a Version registers its routes
+type Endpoints struct {
+	Config Config
+
+	// API registers routes under the prefix of the version
+	API *Router
+
+	// Streams registers routes under the same prefix without the request
+	// timeout, which buffers responses, for those streamed to the client
+	Streams *Router
+}
+
+// unversionedDeprecated is when /api/v1 replaced the unversioned paths
+var unversionedDeprecated = time.Date(2026, time.October, 18, 0, 0, 0, 0, time.UTC)
+
+// DefaultVersions returns the versions served by the API: v1, and the
+// unversioned paths that predate it, which serve the same endpoints for
+// existing clients and are deprecated in its favour
+func DefaultVersions() []Version {
+	return []Version{
+		{Name: "v1", Routes: V1, Operations: V1Operations},
+		{Routes: V1, Operations: V1Operations, Deprecated: unversionedDeprecated, Successor: "v1"},
+	}
+}
+
+// Prefix returns the path the endpoints of the version are served under
+func (v Version) Prefix() string {
+	if v.Name == "" {
+		return "/api"
+	}
+	return "/api/" + v.Name
+}
+
+// Deprecation announces the deprecation and sunset of a version in the
+// Deprecation (RFC 9745) and Sunset (RFC 8594) headers of its responses,
+// with a successor-version link to the same path in the version replacing
+// it. Once the sunset has passed, requests are answered with 410 Gone.
+func Deprecation(v Version) Middleware {
+	return func(next http.Handler) http.Handler {
+		if v.Deprecated.IsZero() && v.Sunset.IsZero() {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h := w.Header()
+			if !v.Deprecated.IsZero() {
+				h.Set("Deprecation", "@"+strconv.FormatInt(v.Deprecated.Unix(), 10))
+			}
+			if !v.Sunset.IsZero() {
+				h.Set("Sunset", v.Sunset.UTC().Format(http.TimeFormat))
+			}
+			if v.Successor != "" {
+				successor := Version{Name: v.Successor}.Prefix() + strings.TrimPrefix(r.URL.Path, v.Prefix())
+				h.Add("Link", "<"+successor+`>; rel="successor-version"`)
+			}
+
+			if !v.Sunset.IsZero() && !time.Now().Before(v.Sunset) {
+				WriteError(w, r, NewProblem(http.StatusGone, CodeSunset, "This version of the API is no longer served"))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
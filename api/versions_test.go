@@ -0,0 +1,87 @@
+//go:build !js
+
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVersions(t *testing.T) {
+	_, _, client := newTestDB(t)
+
+	deprecated := time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)
+	sunset := time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second)
+	router := NewHandler(Config{Client: client, Versions: []Version{
+		{Name: "v1", Routes: V1, Deprecated: deprecated, Sunset: sunset, Successor: "v2"},
+		{Name: "v2", Routes: func(e Endpoints) {
+			e.API.Get("/message", func(w http.ResponseWriter, r *http.Request) {
+				respond(w, r, http.StatusOK, map[string]string{"message": "v2"})
+			})
+		}},
+		{Name: "v0", Routes: func(e Endpoints) {
+			e.API.Get("/message", GetMessage())
+		}, Sunset: time.Now().Add(-time.Hour)},
+	}})
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("/api/v1/message")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Welcome") {
+		t.Fatalf("Expected the v1 message, got %d: %s", w.Code, w.Body)
+	}
+	if d := w.Header().Get("Deprecation"); d != "@1767225600" {
+		t.Errorf("Expected Deprecation @1767225600, got %q", d)
+	}
+	if s := w.Header().Get("Sunset"); s != sunset.Format(http.TimeFormat) {
+		t.Errorf("Expected Sunset %s, got %q", sunset.Format(http.TimeFormat), s)
+	}
+	if link := w.Header().Get("Link"); link != `</api/v2/message>; rel="successor-version"` {
+		t.Errorf("Expected a link to the v2 message, got %q", link)
+	}
+
+	w = get("/api/v2/message")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"v2"`) {
+		t.Fatalf("Expected the v2 message, got %d: %s", w.Code, w.Body)
+	}
+	if w.Header().Get("Deprecation") != "" || w.Header().Get("Sunset") != "" {
+		t.Errorf("Expected no deprecation headers on the current version, got %v", w.Header())
+	}
+
+	if w := get("/api/v0/message"); w.Code != http.StatusGone || !strings.Contains(w.Body.String(), CodeSunset) {
+		t.Errorf("Expected status %d after the sunset, got %d: %s", http.StatusGone, w.Code, w.Body)
+	}
+	if w := get("/api/v2/users"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected routes missing from v2 not to be served, got %d", w.Code)
+	}
+	if w := get("/api/message"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected no unversioned routes unless configured, got %d", w.Code)
+	}
+}
+
+func TestUnversionedDeprecated(t *testing.T) {
+	_, _, client := newTestDB(t)
+	router := NewHandler(Config{Client: client})
+
+	req := httptest.NewRequest(http.MethodGet, "/api/users/user:1", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Header().Get("Deprecation") == "" || w.Header().Get("Link") != `</api/v1/users/user:1>; rel="successor-version"` {
+		t.Errorf("Expected unversioned paths to be deprecated in favour of v1, got %v", w.Header())
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/users/user:1", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Header().Get("Deprecation") != "" || w.Header().Get("Link") != "" {
+		t.Errorf("Expected v1 not to be deprecated, got %v", w.Header())
+	}
+}
@@ -0,0 +1,221 @@
+//go:build !js
+
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"assette/db"
+	"assette/models"
+	"assette/webhook"
+)
+
+// UserWebhooks sends the changes to users to webhooks, as the user returned
+// by the API. A restored user is sent as created again.
+var UserWebhooks = webhook.Source{
+	Namespace: "users",
+	Events: map[db.EventType]string{
+		db.EventCreate: models.EventUserCreated,
+		db.EventUpdate: models.EventUserUpdated,
+		db.EventDelete: models.EventUserDeleted,
+	},
+	Data: func(record db.Record) (interface{}, error) {
+		return eventUser(record)
+	},
+}
+
+// CreateWebhook registers a URL for events. The response holds the secret
+// signing the deliveries, which is never returned again.
+func CreateWebhook(client *db.Client) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var hook models.Webhook
+		if err := decodeBody(r, &hook); err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		if err := hook.Validate(); err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		id := make([]byte, 8)
+		rand.Read(id)
+		subscription := webhook.Subscription{
+			ID:        "webhook:" + hex.EncodeToString(id),
+			Webhook:   hook,
+			Secret:    webhook.NewSecret(),
+			CreatedAt: time.Now().UTC(),
+		}
+		subscription.CreatedBy, _ = UserIDFromContext(r.Context())
+
+		if err := client.Create(r.Context(), webhook.Namespace, subscription.ID, subscription); err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		recordAudit(r, client, AuditCreate, webhook.Namespace, subscription.ID, nil, hook)
+
+		respond(w, r, http.StatusCreated, subscription)
+	}
+}
+
+// ListWebhooks returns the registered webhooks, without their secrets
+func ListWebhooks(client *db.Client) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		subscriptions, err := webhook.Subscriptions(r.Context(), client)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		for i := range subscriptions {
+			subscriptions[i].Secret = ""
+		}
+
+		respond(w, r, http.StatusOK, map[string]interface{}{
+			"webhooks": subscriptions,
+			"count":    len(subscriptions),
+		})
+	}
+}
+
+// GetWebhook returns a registered webhook, without its secret
+func GetWebhook(client *db.Client) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var subscription webhook.Subscription
+		if !getWebhook(w, r, client, &subscription) {
+			return
+		}
+		subscription.Secret = ""
+
+		respond(w, r, http.StatusOK, subscription)
+	}
+}
+
+// DeleteWebhook unregisters a webhook. Its queued deliveries are dropped.
+func DeleteWebhook(client *db.Client) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+
+		deleted, err := client.Delete(r.Context(), webhook.Namespace, id)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		if deleted == 0 {
+			WriteError(w, r, NewProblem(http.StatusNotFound, CodeNotFound, "Webhook not found"))
+			return
+		}
+
+		recordAudit(r, client, AuditDelete, webhook.Namespace, id, nil, nil)
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// ListWebhookDeliveries returns the pending and logged deliveries to a
+// webhook with their attempts, most recent first. The limit query parameter
+// caps how many are returned.
+func ListWebhookDeliveries(client *db.Client) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit, ok := limitParam(w, r)
+		if !ok {
+			return
+		}
+		var subscription webhook.Subscription
+		if !getWebhook(w, r, client, &subscription) {
+			return
+		}
+
+		deliveries, err := webhook.Deliveries(r.Context(), client, subscription.ID)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		respondDeliveries(w, r, deliveries, limit)
+	}
+}
+
+// ListWebhookDeadLetters returns the deliveries that failed every attempt,
+// most recent first. The limit query parameter caps how many are returned.
+func ListWebhookDeadLetters(client *db.Client) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit, ok := limitParam(w, r)
+		if !ok {
+			return
+		}
+
+		deliveries, err := webhook.DeadLetters(r.Context(), client)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		respondDeliveries(w, r, deliveries, limit)
+	}
+}
+
+// RedeliverWebhook queues a dead letter again, with its attempts reset
+func RedeliverWebhook(client *db.Client) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		delivery, err := webhook.Redeliver(r.Context(), client, r.PathValue("id"))
+		if err != nil {
+			switch err {
+			case db.ErrKeyNotFound:
+				WriteError(w, r, NewProblem(http.StatusNotFound, CodeNotFound, "Dead letter not found"))
+			case db.ErrKeyExists:
+				WriteError(w, r, NewProblem(http.StatusConflict, CodeConflict, "Delivery is already queued"))
+			default:
+				WriteError(w, r, err)
+			}
+			return
+		}
+
+		respond(w, r, http.StatusAccepted, delivery)
+	}
+}
+
+// getWebhook loads the webhook of the id path value, or writes a 404
+func getWebhook(w http.ResponseWriter, r *http.Request, client *db.Client, subscription *webhook.Subscription) bool {
+	data, err := client.Get(r.Context(), webhook.Namespace, r.PathValue("id"))
+	if err != nil {
+		if err == db.ErrKeyNotFound {
+			err = NewProblem(http.StatusNotFound, CodeNotFound, "Webhook not found")
+		}
+		WriteError(w, r, err)
+		return false
+	}
+	if err := json.Unmarshal(data, subscription); err != nil {
+		WriteError(w, r, err)
+		return false
+	}
+	return true
+}
+
+// limitParam parses the limit query parameter, zero if absent, or writes a
+// 400
+func limitParam(w http.ResponseWriter, r *http.Request) (int, bool) {
+	value := r.URL.Query().Get("limit")
+	if value == "" {
+		return 0, true
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 0 {
+		WriteError(w, r, NewProblem(http.StatusBadRequest, CodeInvalidParameter, "Invalid limit parameter"))
+		return 0, false
+	}
+	return limit, true
+}
+
+func respondDeliveries(w http.ResponseWriter, r *http.Request, deliveries []webhook.Delivery, limit int) {
+	if limit > 0 && len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+	}
+	respond(w, r, http.StatusOK, map[string]interface{}{
+		"deliveries": deliveries,
+		"count":      len(deliveries),
+	})
+}
@@ -0,0 +1,155 @@
+//go:build !js
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"assette/models"
+	"assette/webhook"
+)
+
+func TestWebhookEndpoints(t *testing.T) {
+	_, _, client := newTestDB(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/admin/webhooks", strings.NewReader(`{"url": "https://example.com/hooks", "events": ["user.created"]}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	CreateWebhook(client)(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body)
+	}
+	var created webhook.Subscription
+	json.NewDecoder(w.Body).Decode(&created)
+	if !strings.HasPrefix(created.ID, "webhook:") || !strings.HasPrefix(created.Secret, "whsec_") || created.URL != "https://example.com/hooks" {
+		t.Fatalf("Unexpected webhook %+v", created)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/api/admin/webhooks", strings.NewReader(`{"url": "https://example.com", "events": ["user.renamed"]}`))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	CreateWebhook(client)(w, req)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "events[0]") {
+		t.Errorf("Expected an invalid event to be rejected, got %d: %s", w.Code, w.Body)
+	}
+
+	// The secret is only returned at creation
+	w = httptest.NewRecorder()
+	ListWebhooks(client)(w, httptest.NewRequest(http.MethodGet, "/api/admin/webhooks", nil))
+	if body := w.Body.String(); !strings.Contains(body, created.ID) || strings.Contains(body, created.Secret) {
+		t.Errorf("Expected the webhook without its secret, got %s", body)
+	}
+	if w := callUser(GetWebhook(client), http.MethodGet, created.ID, ""); w.Code != http.StatusOK || strings.Contains(w.Body.String(), created.Secret) {
+		t.Errorf("Expected the webhook without its secret, got %d: %s", w.Code, w.Body)
+	}
+
+	if w := callUser(ListWebhookDeliveries(client), http.MethodGet, "webhook:missing", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for the deliveries of an unknown webhook, got %d", http.StatusNotFound, w.Code)
+	}
+	if w := callUser(RedeliverWebhook(client), http.MethodPost, "missing", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d redelivering an unknown dead letter, got %d", http.StatusNotFound, w.Code)
+	}
+
+	if w := callUser(DeleteWebhook(client), http.MethodDelete, created.ID, ""); w.Code != http.StatusNoContent {
+		t.Errorf("Expected status %d, got %d", http.StatusNoContent, w.Code)
+	}
+	if w := callUser(DeleteWebhook(client), http.MethodDelete, created.ID, ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d deleting twice, got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+// TestUserWebhooks checks that changes to users reach webhooks as the users
+// returned by the API
+func TestUserWebhooks(t *testing.T) {
+	_, _, client := newTestDB(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	deliveries := make(chan webhook.Payload, 100)
+	var secret string
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if err := webhook.Verify(secret, r.Header.Get(webhook.HeaderSignature), body, time.Minute); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		var payload webhook.Payload
+		json.Unmarshal(body, &payload)
+		deliveries <- payload
+	}))
+	defer receiver.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/admin/webhooks", strings.NewReader(`{"url": "`+receiver.URL+`"}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	CreateWebhook(client)(w, req)
+	var created webhook.Subscription
+	json.NewDecoder(w.Body).Decode(&created)
+	secret = created.Secret
+
+	done := make(chan struct{})
+	go func() {
+		(&webhook.Dispatcher{Client: client, Sources: []webhook.Source{UserWebhooks}}).Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	createUser := func(name string) string {
+		req := httptest.NewRequest(http.MethodPost, "/api/users", strings.NewReader(fmt.Sprintf(`{"name": %q, "email": "%s@example.com"}`, name, strings.ToLower(name))))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		CreateUser(client)(w, req)
+		var user map[string]interface{}
+		json.NewDecoder(w.Body).Decode(&user)
+		return user["id"].(string)
+	}
+
+	// Changes are sent from the election of the dispatcher on
+	deadline := time.After(10 * time.Second)
+	for i := 0; len(deliveries) == 0; i++ {
+		createUser(fmt.Sprintf("Warmup%d", i))
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("Expected a delivery")
+		}
+	}
+	for len(deliveries) > 0 {
+		<-deliveries
+	}
+
+	next := func() (webhook.Payload, models.User) {
+		t.Helper()
+		select {
+		case payload := <-deliveries:
+			var user models.User
+			json.Unmarshal(payload.Data, &user)
+			return payload, user
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected a delivery")
+		}
+		return webhook.Payload{}, models.User{}
+	}
+
+	userID := createUser("Ada")
+	if payload, user := next(); payload.Event != models.EventUserCreated || user.Name != "Ada" || !strings.Contains(string(payload.Data), userID) {
+		t.Errorf("Unexpected delivery %+v", payload)
+	}
+	if w := callUser(DeleteUser(client, DefaultTrashRetention), http.MethodDelete, userID, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("Expected status %d, got %d", http.StatusNoContent, w.Code)
+	}
+	if payload, user := next(); payload.Event != models.EventUserDeleted || user.Name != "Ada" {
+		t.Errorf("Unexpected delivery %+v", payload)
+	}
+}
@@ -0,0 +1,406 @@
+//go:build !js
+
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"assette/apiclient"
+	"assette/db"
+)
+
+// Limits of WebSocket connections
+const (
+	socketMaxMessage       = 64 << 10
+	socketSendBuffer       = 256 // Messages waiting for a client before it is disconnected as too slow
+	socketMaxSubscriptions = 32
+	socketMaxCalls         = 8 // Calls running at once, beyond which messages are left unread
+	socketWriteTimeout     = 10 * time.Second
+	socketPingInterval     = 30 * time.Second
+)
+
+// socketNamespaces are the namespaces clients can subscribe to, with the
+// data each change is sent with
+var socketNamespaces = map[string]func(record db.Record) (interface{}, error){
+	"users": func(record db.Record) (interface{}, error) {
+		return eventUser(record)
+	},
+}
+
+// WebSocket serves the messages of apiclient.SocketMessage to signed-in
+// users: subscriptions to the changes of socketNamespaces, followed with etcd
+// watches so that changes made through any node of a cluster reach the
+// clients of every node, and calls to the v1 endpoints registered on router.
+// Calls are sub-requests of the WebSocket request, with its session, and are
+// rate limited like requests of their own.
+//
+// Each connection queues a bounded number of messages for its client, and
+// is closed with 1013 Try Again Later when the client falls behind, rather
+// than buffering without bounds or dropping changes. Clients reconnect and
+// subscribe again from the last revision they received. Messages from the
+// client are left unread while socketMaxCalls calls are running. The
+// connection is closed with 1008 Policy Violation once its session ends.
+func WebSocket(router *Router, config Config) func(w http.ResponseWriter, r *http.Request) {
+	calls := routerTransport{handler: RateLimit(config.Client, config.RateLimits...)(http.HandlerFunc(router.dispatch))}
+	upgrader := websocket.Upgrader{
+		// Sessions are cookies, which browsers send along with sockets opened
+		// by pages of any site, so only the origins listed for CORS can open
+		// one, never any origin
+		CheckOrigin: func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				return true // Not from a browser
+			}
+			u, err := url.Parse(origin)
+			return err == nil && strings.EqualFold(u.Host, r.Host) || config.CORS.listed(origin)
+		},
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, ok := SessionFromContext(r.Context())
+		if !ok {
+			WriteError(w, r, NewProblem(http.StatusUnauthorized, CodeUnauthenticated, "Authentication required"))
+			return
+		}
+
+		conn, err := upgrader.Upgrade(hijacker{w}, r, nil)
+		if err != nil {
+			return // Answered by Upgrade
+		}
+
+		ctx, cancel := context.WithCancel(context.WithValue(r.Context(), parentRequestKey, r))
+		s := &socket{
+			conn:          conn,
+			client:        config.Client,
+			calls:         calls,
+			session:       session,
+			ctx:           ctx,
+			cancel:        cancel,
+			out:           make(chan apiclient.SocketMessage, socketSendBuffer),
+			running:       make(chan struct{}, socketMaxCalls),
+			subscriptions: map[string]context.CancelFunc{},
+		}
+		s.serve()
+	}
+}
+
+// hijacker lets the WebSocket upgrade take the connection over through the
+// writers of the middlewares, which only unwrap for http.ResponseController
+type hijacker struct {
+	http.ResponseWriter
+}
+
+func (h hijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(h.ResponseWriter).Hijack()
+}
+
+// socket is a WebSocket connection
+type socket struct {
+	conn    *websocket.Conn
+	client  *db.Client
+	calls   routerTransport
+	session Session
+
+	// Parent of the subscriptions and calls, done once the socket closes
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	out     chan apiclient.SocketMessage
+	running chan struct{} // Holds a token per running call
+	closing sync.Once
+	wg      sync.WaitGroup
+
+	mu            sync.Mutex
+	subscriptions map[string]context.CancelFunc
+}
+
+// serve runs the connection until either side closes it
+func (s *socket) serve() {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.write()
+	}()
+
+	s.read()
+	s.cancel()
+	s.wg.Wait()
+	s.conn.Close()
+}
+
+// read handles the messages of the client
+func (s *socket) read() {
+	s.conn.SetReadLimit(socketMaxMessage)
+	s.conn.SetReadDeadline(time.Now().Add(2 * socketPingInterval))
+	s.conn.SetPongHandler(func(string) error {
+		return s.conn.SetReadDeadline(time.Now().Add(2 * socketPingInterval))
+	})
+
+	for {
+		_, data, err := s.conn.ReadMessage()
+		if err != nil {
+			return // Closed by either side, or the client stopped answering pings
+		}
+
+		var msg apiclient.SocketMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			s.fail("", NewProblem(http.StatusBadRequest, CodeInvalidBody, "Messages must be JSON objects"))
+			continue
+		}
+
+		switch msg.Type {
+		case apiclient.SocketSubscribe:
+			s.subscribe(msg)
+		case apiclient.SocketUnsubscribe:
+			s.unsubscribe(msg)
+		case apiclient.SocketCall:
+			select {
+			case s.running <- struct{}{}:
+			case <-s.ctx.Done():
+				return
+			}
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				defer func() { <-s.running }()
+				s.call(msg)
+			}()
+		default:
+			s.fail(msg.ID, NewProblem(http.StatusBadRequest, CodeInvalidBody, "Unknown message type "+msg.Type))
+		}
+	}
+}
+
+// write sends the queued messages, and pings the client to detect dead
+// connections
+func (s *socket) write() {
+	ping := time.NewTicker(socketPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case msg := <-s.out:
+			s.conn.SetWriteDeadline(time.Now().Add(socketWriteTimeout))
+			if err := s.conn.WriteJSON(msg); err != nil {
+				s.close(websocket.CloseGoingAway, "")
+				return
+			}
+		case <-ping.C:
+			if !s.sessionActive() {
+				s.close(websocket.ClosePolicyViolation, "Session ended")
+				return
+			}
+			if err := s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(socketWriteTimeout)); err != nil {
+				s.close(websocket.CloseGoingAway, "")
+				return
+			}
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// send queues a message for the client, closing the connection if the
+// client is too slow to keep up
+func (s *socket) send(msg apiclient.SocketMessage) {
+	select {
+	case s.out <- msg:
+	case <-s.ctx.Done():
+	default:
+		s.close(websocket.CloseTryAgainLater, "Too slow to keep up")
+	}
+}
+
+// fail answers the message id with a problem
+func (s *socket) fail(id string, p *Problem) {
+	s.send(apiclient.SocketMessage{Type: apiclient.SocketError, ID: id, Error: &apiclient.Error{
+		Type:      p.Type,
+		Title:     p.Title,
+		Status:    p.Status,
+		Detail:    p.Detail,
+		Code:      p.Code,
+		RequestID: RequestIDFromContext(s.ctx),
+	}})
+}
+
+// close sends a close frame and closes the connection, which ends read
+func (s *socket) close(code int, reason string) {
+	s.closing.Do(func() {
+		s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(socketWriteTimeout))
+		s.cancel()
+		s.conn.Close()
+	})
+}
+
+// sessionActive reports whether the session the connection was opened with
+// still exists. When etcd cannot tell, the session is taken as ended, and the
+// client has to connect again once it can.
+func (s *socket) sessionActive() bool {
+	_, err := s.client.Get(s.ctx, "sessions", s.session.ID)
+	if err != nil && err != db.ErrKeyNotFound && s.ctx.Err() == nil {
+		log.Printf("[WARNING] checking the session of a socket: %v", err)
+	}
+	return err == nil
+}
+
+func (s *socket) subscribe(msg apiclient.SocketMessage) {
+	data, ok := socketNamespaces[msg.Namespace]
+	switch {
+	case msg.ID == "":
+		s.fail(msg.ID, NewProblem(http.StatusBadRequest, CodeInvalidParameter, "Subscriptions need an id"))
+		return
+	case !ok:
+		s.fail(msg.ID, NewProblem(http.StatusNotFound, CodeNotFound, "Cannot subscribe to namespace "+msg.Namespace))
+		return
+	}
+
+	s.mu.Lock()
+	if _, exists := s.subscriptions[msg.ID]; exists {
+		s.mu.Unlock()
+		s.fail(msg.ID, NewProblem(http.StatusConflict, CodeConflict, "A subscription with this id exists"))
+		return
+	}
+	if len(s.subscriptions) >= socketMaxSubscriptions {
+		s.mu.Unlock()
+		s.fail(msg.ID, NewProblem(http.StatusBadRequest, CodeInvalidParameter, "Too many subscriptions on this connection"))
+		return
+	}
+	ctx, cancel := context.WithCancel(s.ctx)
+	s.subscriptions[msg.ID] = cancel
+	s.mu.Unlock()
+
+	events := s.client.Watch(ctx, msg.Namespace, msg.After)
+	s.send(apiclient.SocketMessage{Type: apiclient.SocketSubscribed, ID: msg.ID})
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.follow(ctx, msg, data, events)
+	}()
+}
+
+// follow sends the changes of a subscription until it is cancelled or etcd
+// ends the watch
+func (s *socket) follow(ctx context.Context, msg apiclient.SocketMessage, data func(db.Record) (interface{}, error), events <-chan db.Event) {
+	for event := range events {
+		if msg.Key != "" && event.Record.Key != msg.Key {
+			continue
+		}
+
+		value, err := data(event.Record)
+		if err == nil {
+			var body []byte
+			if body, err = json.Marshal(value); err == nil {
+				s.send(apiclient.SocketMessage{Type: apiclient.SocketEvent, ID: msg.ID, Event: &apiclient.Change{
+					Type:     string(event.Type),
+					Key:      event.Record.Key,
+					Revision: event.Record.ModRevision,
+					Data:     body,
+				}})
+				continue
+			}
+		}
+		log.Printf("[WARNING] skipping change to %s/%s: %v", msg.Namespace, event.Record.Key, err)
+	}
+
+	if ctx.Err() == nil {
+		// Such as when the cluster has no leader
+		s.mu.Lock()
+		delete(s.subscriptions, msg.ID)
+		s.mu.Unlock()
+		s.fail(msg.ID, NewProblem(http.StatusServiceUnavailable, CodeUnavailable, "The subscription ended, subscribe again after the last revision received"))
+	}
+}
+
+func (s *socket) unsubscribe(msg apiclient.SocketMessage) {
+	s.mu.Lock()
+	cancel, ok := s.subscriptions[msg.ID]
+	delete(s.subscriptions, msg.ID)
+	s.mu.Unlock()
+
+	if !ok {
+		s.fail(msg.ID, NewProblem(http.StatusNotFound, CodeNotFound, "No subscription with this id"))
+		return
+	}
+	cancel()
+	s.send(apiclient.SocketMessage{Type: apiclient.SocketUnsubscribed, ID: msg.ID})
+}
+
+// call sends a request to the v1 endpoints and answers with its response.
+// Bodies are JSON, and bodies of responses in other formats are sent as a
+// JSON string.
+func (s *socket) call(msg apiclient.SocketMessage) {
+	if msg.ID == "" {
+		s.fail(msg.ID, NewProblem(http.StatusBadRequest, CodeInvalidParameter, "Calls need an id"))
+		return
+	}
+	if !strings.HasPrefix(msg.Path, apiclient.Prefix+"/") {
+		s.fail(msg.ID, NewProblem(http.StatusBadRequest, CodeInvalidParameter, "Calls must be made to paths under "+apiclient.Prefix))
+		return
+	}
+	if !s.sessionActive() {
+		s.close(websocket.ClosePolicyViolation, "Session ended")
+		return
+	}
+
+	method := msg.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	var body io.Reader
+	if len(msg.Body) > 0 {
+		body = bytes.NewReader(msg.Body)
+	}
+	req, err := http.NewRequestWithContext(s.ctx, method, msg.Path, body)
+	if err != nil {
+		s.fail(msg.ID, NewProblem(http.StatusBadRequest, CodeInvalidParameter, "Invalid method or path"))
+		return
+	}
+	for key, value := range msg.Headers {
+		req.Header.Set(key, value)
+	}
+	if body != nil && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if req.Header.Get("Accept") == "" {
+		req.Header.Set("Accept", "application/json")
+	}
+
+	resp, err := s.calls.RoundTrip(req)
+	if err != nil {
+		s.fail(msg.ID, NewProblem(http.StatusInternalServerError, CodeInternal, "The call failed"))
+		return
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		s.fail(msg.ID, NewProblem(http.StatusInternalServerError, CodeInternal, "Failed to read the response of the call"))
+		return
+	}
+
+	result := apiclient.SocketMessage{Type: apiclient.SocketResult, ID: msg.ID, Status: resp.StatusCode, Headers: map[string]string{}}
+	for key := range resp.Header {
+		result.Headers[key] = resp.Header.Get(key)
+	}
+	switch {
+	case len(data) == 0:
+	case json.Valid(data):
+		result.Body = data
+	default:
+		result.Body, _ = json.Marshal(string(data))
+	}
+	s.send(result)
+}
@@ -0,0 +1,192 @@
+//go:build !js
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"assette/apiclient"
+	"assette/models"
+)
+
+// dialSocket opens the WebSocket endpoint of server with the cookies of c
+func dialSocket(t *testing.T, server *httptest.Server, c *http.Client, header http.Header) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+	dialer := websocket.Dialer{Jar: c.Jar, HandshakeTimeout: 5 * time.Second}
+	return dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+apiclient.SocketPath, header)
+}
+
+// readSocket reads the next message of a connection
+func readSocket(t *testing.T, conn *websocket.Conn) apiclient.SocketMessage {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg apiclient.SocketMessage
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestWebSocket(t *testing.T) {
+	_, _, client := newTestDB(t)
+	newTestAccount(t, client, models.User{Name: "Ada", Email: "ada@example.com", Role: models.RoleUser}, "correct horse battery")
+	server := httptest.NewServer(NewHandler(Config{Client: client}))
+	defer server.Close()
+
+	if _, resp, err := dialSocket(t, server, server.Client(), nil); err == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 without a session, got %v", err)
+	}
+
+	api := apiclient.New(server.URL)
+	if _, err := api.Login(context.Background(), "ada@example.com", "correct horse battery"); err != nil {
+		t.Fatal(err)
+	}
+	if _, resp, err := dialSocket(t, server, api.HTTPClient, http.Header{"Origin": {"https://elsewhere.example.com"}}); err == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected 403 from another origin, got %v", err)
+	}
+
+	// Not even when CORS allows any origin
+	open := httptest.NewServer(NewHandler(Config{Client: client, CORS: CORSConfig{AllowedOrigins: []string{"*"}}}))
+	defer open.Close()
+	if _, resp, err := dialSocket(t, open, api.HTTPClient, http.Header{"Origin": {"https://elsewhere.example.com"}}); err == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected 403 from another origin with a CORS wildcard, got %v", err)
+	}
+
+	conn, _, err := dialSocket(t, server, api.HTTPClient, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.WriteJSON(apiclient.SocketMessage{Type: apiclient.SocketSubscribe, ID: "all", Namespace: "users"})
+	if msg := readSocket(t, conn); msg.Type != apiclient.SocketSubscribed || msg.ID != "all" {
+		t.Fatalf("Expected the subscription to start, got %+v", msg)
+	}
+
+	conn.WriteJSON(apiclient.SocketMessage{Type: apiclient.SocketCall, ID: "create", Method: http.MethodPost, Path: "/api/v1/users", Body: json.RawMessage(`{"name": "Grace", "email": "grace@example.com"}`)})
+	var created apiclient.User
+	var event *apiclient.Change
+	for created.ID == "" || event == nil {
+		switch msg := readSocket(t, conn); msg.Type {
+		case apiclient.SocketResult:
+			if msg.ID != "create" || msg.Status != http.StatusCreated || msg.Headers["Etag"] == "" {
+				t.Fatalf("Unexpected result %+v", msg)
+			}
+			json.Unmarshal(msg.Body, &created)
+		case apiclient.SocketEvent:
+			event = msg.Event
+		default:
+			t.Fatalf("Unexpected message %+v", msg)
+		}
+	}
+	var user apiclient.User
+	json.Unmarshal(event.Data, &user)
+	if event.Type != "create" || event.Key != created.ID || event.Revision != created.Version || user.Name != "Grace" || user.CreatedBy == "" {
+		t.Errorf("Unexpected event %+v with %+v", event, user)
+	}
+
+	// Subscriptions to a single key, resumed after a revision
+	conn.WriteJSON(apiclient.SocketMessage{Type: apiclient.SocketUnsubscribe, ID: "all"})
+	if msg := readSocket(t, conn); msg.Type != apiclient.SocketUnsubscribed {
+		t.Fatalf("Expected the subscription to stop, got %+v", msg)
+	}
+	conn.WriteJSON(apiclient.SocketMessage{Type: apiclient.SocketSubscribe, ID: "grace", Namespace: "users", Key: created.ID, After: created.Version - 1})
+	readSocket(t, conn)
+	if msg := readSocket(t, conn); msg.Type != apiclient.SocketEvent || msg.ID != "grace" || msg.Event.Revision != created.Version {
+		t.Errorf("Expected the creation again, got %+v", msg)
+	}
+
+	for _, bad := range []apiclient.SocketMessage{
+		{Type: apiclient.SocketSubscribe, ID: "sessions", Namespace: "sessions"},
+		{Type: apiclient.SocketSubscribe, ID: "grace", Namespace: "users"},
+		{Type: apiclient.SocketUnsubscribe, ID: "unknown"},
+		{Type: apiclient.SocketCall, ID: "graphql", Method: http.MethodPost, Path: "/api/graphql"},
+		{Type: "shout", ID: "shout"},
+	} {
+		conn.WriteJSON(bad)
+		if msg := readSocket(t, conn); msg.Type != apiclient.SocketError || msg.ID != bad.ID || msg.Error == nil || msg.Error.Code == "" {
+			t.Errorf("Expected an error for %+v, got %+v", bad, msg)
+		}
+	}
+
+	// Calls share the session of the connection, which closes once it ends
+	conn.WriteJSON(apiclient.SocketMessage{Type: apiclient.SocketCall, ID: "logout", Method: http.MethodPost, Path: "/api/v1/auth/logout"})
+	if msg := readSocket(t, conn); msg.Type != apiclient.SocketResult || msg.Status != http.StatusNoContent {
+		t.Fatalf("Expected to log out, got %+v", msg)
+	}
+	conn.WriteJSON(apiclient.SocketMessage{Type: apiclient.SocketCall, ID: "me", Path: "/api/v1/users/" + created.ID})
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Errorf("Expected the connection to close once logged out, got %v", err)
+	}
+}
+
+// TestWebSocketSlowClient checks that clients falling behind are
+// disconnected rather than sent partial streams
+func TestWebSocketSlowClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		s := &socket{conn: conn, ctx: ctx, cancel: cancel, out: make(chan apiclient.SocketMessage, 1)}
+		s.send(apiclient.SocketMessage{Type: apiclient.SocketEvent})
+		s.send(apiclient.SocketMessage{Type: apiclient.SocketEvent})
+		if ctx.Err() == nil {
+			t.Error("Expected the socket to close")
+		}
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseTryAgainLater {
+		t.Errorf("Expected to be closed with %d, got %v", websocket.CloseTryAgainLater, err)
+	}
+}
+
+// TestSocketSessionActive checks that sockets only keep going while their
+// session is known to exist
+func TestSocketSessionActive(t *testing.T) {
+	_, _, client := newTestDB(t)
+	userID := newTestAccount(t, client, models.User{Name: "Ada", Email: "ada@example.com", Role: models.RoleUser}, "correct horse battery")
+	session, err := startSession(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/auth/login", nil), client, userID, models.RoleUser, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &socket{client: client, session: session, ctx: context.Background()}
+	if !s.sessionActive() {
+		t.Error("Expected the session to be active")
+	}
+
+	// etcd cannot answer once the socket is closing
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if (&socket{client: client, session: session, ctx: ctx}).sessionActive() {
+		t.Error("Expected the session to be taken as ended when etcd cannot tell")
+	}
+
+	client.Delete(context.Background(), "sessions", session.ID)
+	if s.sessionActive() {
+		t.Error("Expected the session to have ended")
+	}
+}
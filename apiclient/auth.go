@@ -0,0 +1,59 @@
+package apiclient
+
+import (
+	"context"
+	"net/http"
+)
+
+// SendVerification emails a link confirming the address of a user
+func (c *Client) SendVerification(ctx context.Context, userID string) error {
+	return c.do(ctx, request{method: http.MethodPost, path: "/account/verification", body: VerificationRequest{UserID: userID}, expected: []int{http.StatusAccepted}}, nil)
+}
+
+// VerifyEmail confirms an email address with the token of its link
+func (c *Client) VerifyEmail(ctx context.Context, token string) error {
+	return c.do(ctx, request{method: http.MethodPost, path: "/account/verify", body: TokenRequest{Token: token}, expected: []int{http.StatusNoContent}}, nil)
+}
+
+// RequestPasswordReset emails a password reset link to the account with an
+// address. It succeeds whether or not there is one.
+func (c *Client) RequestPasswordReset(ctx context.Context, email string) error {
+	return c.do(ctx, request{method: http.MethodPost, path: "/account/password-reset", body: PasswordResetRequest{Email: email}, expected: []int{http.StatusAccepted}}, nil)
+}
+
+// ResetPassword sets a new password with the token of a reset link
+func (c *Client) ResetPassword(ctx context.Context, token string, password string) error {
+	return c.do(ctx, request{method: http.MethodPost, path: "/account/password", body: PasswordRequest{Token: token, Password: password}, expected: []int{http.StatusNoContent}}, nil)
+}
+
+// Login signs in with an email address and password. If the account has
+// two-factor authentication, the result is a challenge to complete with
+// LoginTOTP instead of a session.
+func (c *Client) Login(ctx context.Context, email string, password string) (*LoginResult, error) {
+	return call[LoginResult](ctx, c, request{method: http.MethodPost, path: "/auth/login", body: LoginRequest{Email: email, Password: password}})
+}
+
+// LoginTOTP completes a login with a one-time password or a recovery code
+func (c *Client) LoginTOTP(ctx context.Context, mfaToken string, code string) (*Session, error) {
+	return call[Session](ctx, c, request{method: http.MethodPost, path: "/auth/login/totp", body: TOTPLoginRequest{MFAToken: mfaToken, Code: code}})
+}
+
+// Logout ends the session
+func (c *Client) Logout(ctx context.Context) error {
+	return c.do(ctx, request{method: http.MethodPost, path: "/auth/logout", expected: []int{http.StatusNoContent}}, nil)
+}
+
+// EnrollTOTP starts two-factor enrollment for the signed-in user
+func (c *Client) EnrollTOTP(ctx context.Context) (*TOTPEnrollment, error) {
+	return call[TOTPEnrollment](ctx, c, request{method: http.MethodPost, path: "/auth/totp/enroll"})
+}
+
+// ConfirmTOTP completes an enrollment with a code of the authenticator app
+// and returns the recovery codes, which are only shown once
+func (c *Client) ConfirmTOTP(ctx context.Context, code string) ([]string, error) {
+	codes, err := call[RecoveryCodes](ctx, c, request{method: http.MethodPost, path: "/auth/totp/confirm", body: CodeRequest{Code: code}})
+	if err != nil {
+		return nil, err
+	}
+	return codes.RecoveryCodes, nil
+}
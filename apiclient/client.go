@@ -0,0 +1,246 @@
+// Package apiclient is a typed client of the v1 API. It builds for both
+// WebAssembly, where the views use it, and native programs such as
+// command-line tools.
+//
+// Its request and response types are those the server documents in its
+// OpenAPI document, and the server's tests check real responses against that
+// document, so a handler cannot drift from what the client decodes.
+package apiclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+
+	"assette/codec"
+	"assette/models"
+)
+
+// Prefix is the path the endpoints of the version are served under
+const Prefix = "/api/v1"
+
+// Client calls the API of a server
+type Client struct {
+	// BaseURL is the scheme and host of the server, such as
+	// https://example.com. Empty in the browser, where requests go to the
+	// origin of the page.
+	BaseURL string
+
+	// HTTPClient sends the requests, http.DefaultClient if nil. New gives it
+	// a cookie jar so that native programs send back the session cookie set
+	// by Login; browsers keep it themselves.
+	HTTPClient *http.Client
+
+	// MediaType is the format bodies are sent and asked for in, such as
+	// codec.MessagePack. JSON if empty.
+	MediaType string
+}
+
+// New returns a client of the server at baseURL, keeping the cookies it sets
+func New(baseURL string) *Client {
+	jar, _ := cookiejar.New(nil)
+	return &Client{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		HTTPClient: &http.Client{Jar: jar},
+	}
+}
+
+// Option adds headers to a request
+type Option func(h http.Header)
+
+// IdempotencyKey lets the request be retried without running twice: the
+// server answers retries with the same key with the first response
+func IdempotencyKey(key string) Option {
+	return func(h http.Header) {
+		h.Set("Idempotency-Key", key)
+	}
+}
+
+// IfVersion makes an update or delete fail with 412 Precondition Failed if
+// the user is no longer at the given version, as returned in User.Version
+func IfVersion(version int64) Option {
+	return func(h http.Header) {
+		h.Set("If-Match", fmt.Sprintf(`"%d"`, version))
+	}
+}
+
+// Error is an error response of the API, an RFC 9457 problem
+type Error struct {
+	Type      string                  `json:"type"`
+	Title     string                  `json:"title"`
+	Status    int                     `json:"status"`
+	Detail    string                  `json:"detail,omitempty"`
+	Instance  string                  `json:"instance,omitempty"`
+	Code      string                  `json:"code"`
+	RequestID string                  `json:"requestId,omitempty"`
+	Errors    models.ValidationErrors `json:"errors,omitempty"`
+}
+
+func (e *Error) Error() string {
+	switch {
+	case len(e.Errors) > 0:
+		return e.Errors.Error()
+	case e.Detail != "":
+		return e.Detail
+	case e.Title != "":
+		return e.Title
+	}
+	return fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status))
+}
+
+// Unwrap returns the field errors of a validation failure, so that
+// errors.As finds them as models.ValidationErrors for forms to show next to
+// their inputs
+func (e *Error) Unwrap() error {
+	if len(e.Errors) == 0 {
+		return nil
+	}
+	return e.Errors
+}
+
+// responseError turns an unexpected response into an *Error, from its
+// problem details if it has some
+func responseError(resp *http.Response) error {
+	// Bodies that are not problems, such as from a proxy, leave the status
+	e := &Error{}
+	if data, err := io.ReadAll(resp.Body); err == nil {
+		json.Unmarshal(data, e)
+	}
+	e.Status = resp.StatusCode
+	return e
+}
+
+// request describes a call to the API
+type request struct {
+	method   string
+	path     string // Relative to Prefix
+	query    url.Values
+	body     interface{}
+	raw      []byte // Sent as is with contentType instead of body
+	expected []int  // Statuses of success, 200 if none
+	options  []Option
+
+	// contentType is the media type of raw, or of a body sent as JSON
+	// whatever the codec of the client, such as a merge patch
+	contentType string
+}
+
+// do sends a request and decodes the response into out, if not nil
+func (c *Client) do(ctx context.Context, r request, out interface{}) error {
+	resp, err := c.send(ctx, r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		return nil
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	decoder, err := codec.ForContentType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return fmt.Errorf("%s %s: %w: %s", r.method, r.path, err, resp.Header.Get("Content-Type"))
+	}
+	return decoder.Unmarshal(data, out)
+}
+
+// call sends a request and returns the response decoded as a T
+func call[T any](ctx context.Context, c *Client, r request) (*T, error) {
+	var out T
+	if err := c.do(ctx, r, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// send sends a request and returns the response if its status is one of
+// the expected ones, and an *Error otherwise
+func (c *Client) send(ctx context.Context, r request) (*http.Response, error) {
+	mediaType := c.MediaType
+	if mediaType == "" {
+		mediaType = codec.JSON
+	}
+	encoder, ok := codec.Lookup(mediaType)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", codec.ErrUnsupported, mediaType)
+	}
+
+	var body io.Reader
+	contentType := r.contentType
+	switch {
+	case r.raw != nil:
+		body = bytes.NewReader(r.raw)
+	case r.body != nil:
+		bodyEncoder := encoder
+		if contentType == "" {
+			contentType = encoder.MediaType
+		} else {
+			bodyEncoder = codec.Default()
+		}
+		data, err := bodyEncoder.Marshal(r.body)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	target := c.BaseURL + Prefix + r.path
+	if len(r.query) > 0 {
+		target += "?" + r.query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, r.method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", encoder.MediaType)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	for _, option := range r.options {
+		option(req.Header)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	expected := r.expected
+	if len(expected) == 0 {
+		expected = []int{http.StatusOK}
+	}
+	for _, status := range expected {
+		if resp.StatusCode == status {
+			return resp, nil
+		}
+	}
+	defer resp.Body.Close()
+	return nil, responseError(resp)
+}
+
+// userPath returns the path of a user, or of one of its sub-resources
+func userPath(id string, elem ...string) string {
+	return "/users/" + url.PathEscape(id) + strings.Join(append([]string{""}, elem...), "/")
+}
+
+// Message returns the sample message of the home page
+func (c *Client) Message(ctx context.Context) (string, error) {
+	message, err := call[Message](ctx, c, request{method: http.MethodGet, path: "/message"})
+	if err != nil {
+		return "", err
+	}
+	return message.Text, nil
+}
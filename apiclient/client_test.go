@@ -0,0 +1,97 @@
+package apiclient
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"assette/codec"
+	"assette/models"
+)
+
+func TestErrorResponses(t *testing.T) {
+	responses := map[string]struct {
+		status      int
+		contentType string
+		body        string
+	}{
+		"/invalid":  {http.StatusBadRequest, "application/problem+json", `{"status":400,"code":"validation_failed","detail":"Invalid fields","errors":[{"field":"email","code":"invalid_email","message":"Must be a valid email address"}]}`},
+		"/conflict": {http.StatusConflict, "application/problem+json", `{"status":409,"code":"conflict","detail":"Email already verified"}`},
+		"/proxy":    {http.StatusBadGateway, "text/plain", "upstream down"},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response := responses[r.URL.Path[len(Prefix):]]
+		w.Header().Set("Content-Type", response.contentType)
+		w.WriteHeader(response.status)
+		io.WriteString(w, response.body)
+	}))
+	defer server.Close()
+	c := New(server.URL)
+	ctx := context.Background()
+
+	err := c.do(ctx, request{method: http.MethodGet, path: "/invalid"}, nil)
+	var invalid models.ValidationErrors
+	if !errors.As(err, &invalid) || invalid.ByField()["email"] != "Must be a valid email address" {
+		t.Errorf("Expected email field error, got %v", err)
+	}
+
+	err = c.do(ctx, request{method: http.MethodGet, path: "/conflict"}, nil)
+	var problem *Error
+	if !errors.As(err, &problem) || problem.Code != "conflict" || err.Error() != "Email already verified" {
+		t.Errorf("Expected problem detail as error, got %v", err)
+	}
+	if errors.As(err, &invalid) {
+		t.Error("Expected no field errors without errors in the problem")
+	}
+
+	err = c.do(ctx, request{method: http.MethodGet, path: "/proxy"}, nil)
+	if !errors.As(err, &problem) || problem.Status != http.StatusBadGateway || err.Error() != "502 Bad Gateway" {
+		t.Errorf("Expected status as error for non-JSON bodies, got %v", err)
+	}
+}
+
+func TestMediaType(t *testing.T) {
+	var contentType, accept, ifMatch string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType, accept, ifMatch = r.Header.Get("Content-Type"), r.Header.Get("Accept"), r.Header.Get("If-Match")
+
+		body, _ := io.ReadAll(r.Body)
+		decoder, err := codec.ForContentType(contentType)
+		if err != nil {
+			decoder = codec.Default() // A merge patch
+		}
+		var user models.User
+		if err := decoder.Unmarshal(body, &user); err != nil {
+			t.Errorf("Invalid %s body: %v", contentType, err)
+		}
+
+		data, _ := codec.Negotiate(accept).Marshal(User{ID: "user:1", User: user, Version: 2})
+		w.Header().Set("Content-Type", codec.Negotiate(accept).MediaType)
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	c := New(server.URL)
+	c.MediaType = codec.MessagePack
+	user, err := c.UpdateUser(context.Background(), "user:1", models.User{Name: "Ada", Email: "ada@example.com"}, IfVersion(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentType != codec.MessagePack || accept != codec.MessagePack || ifMatch != `"1"` {
+		t.Errorf("Unexpected headers %q, %q and %q", contentType, accept, ifMatch)
+	}
+	if user.ID != "user:1" || user.Name != "Ada" || user.Version != 2 {
+		t.Errorf("Unexpected user %+v", user)
+	}
+
+	// Merge patches are JSON whatever the codec
+	if _, err := c.PatchUser(context.Background(), "user:1", map[string]interface{}{"name": "Ada"}); err != nil {
+		t.Fatal(err)
+	}
+	if contentType != MergePatchType {
+		t.Errorf("Expected a merge patch, got %q", contentType)
+	}
+}
@@ -0,0 +1,54 @@
+package apiclient
+
+import "encoding/json"
+
+// SocketPath is where the WebSocket endpoint of the API is served
+const SocketPath = "/api/ws"
+
+// Types of the messages exchanged over the WebSocket endpoint
+const (
+	// Sent by clients
+	SocketSubscribe   = "subscribe"   // Follow the changes to Namespace, or to Key in it
+	SocketUnsubscribe = "unsubscribe" // Stop the subscription ID
+	SocketCall        = "call"        // Send Method Path with Body and Headers to the API
+
+	// Sent by the server, with the ID of the message they answer
+	SocketSubscribed   = "subscribed"
+	SocketUnsubscribed = "unsubscribed"
+	SocketEvent        = "event" // A change followed by the subscription ID
+	SocketResult       = "result"
+	SocketError        = "error" // A message that failed, or a subscription that ended
+)
+
+// SocketMessage is a message of the WebSocket endpoint, in either direction,
+// sent as a JSON text frame. Clients pick the ID of their subscribe and call
+// messages, which the server repeats on the messages answering them.
+type SocketMessage struct {
+	Type string `json:"type"`
+	ID   string `json:"id,omitempty"`
+
+	// Of subscribe messages. After resumes a subscription from the changes
+	// following a revision, such as the last Change.Revision received.
+	Namespace string `json:"namespace,omitempty"`
+	Key       string `json:"key,omitempty"`
+	After     int64  `json:"after,omitempty"`
+
+	// Of call messages, Status and Headers also of their results
+	Method  string            `json:"method,omitempty"`
+	Path    string            `json:"path,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    json.RawMessage   `json:"body,omitempty"`
+	Status  int               `json:"status,omitempty"`
+
+	Event *Change `json:"event,omitempty"`
+	Error *Error  `json:"error,omitempty"`
+}
+
+// Change is a change to a record, with the record as returned by the API.
+// Data is the last version of the record for a delete.
+type Change struct {
+	Type     string          `json:"type"` // create, update or delete
+	Key      string          `json:"key"`
+	Revision int64           `json:"revision"`
+	Data     json.RawMessage `json:"data"`
+}
@@ -0,0 +1,197 @@
+package apiclient
+
+import (
+	"time"
+
+	"assette/models"
+)
+
+// Message is the body of the message endpoint
+type Message struct {
+	Text string `json:"text"`
+}
+
+// User is a user as returned by the API, with the metadata of its version
+type User struct {
+	ID string `json:"id"`
+	models.User
+
+	// Version increases with every change, and is sent back with IfVersion
+	// to detect concurrent changes
+	Version   int64     `json:"version"`
+	CreatedAt time.Time `json:"createdAt,omitempty"`
+	CreatedBy string    `json:"createdBy,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt,omitempty"`
+	UpdatedBy string    `json:"updatedBy,omitempty"`
+
+	// Set on trashed users and their past versions
+	DeletedAt time.Time `json:"deletedAt,omitempty"`
+	DeletedBy string    `json:"deletedBy,omitempty"`
+}
+
+// UserList is a page of users
+type UserList struct {
+	Users []User `json:"users"`
+	Count int    `json:"count"`
+}
+
+// UserVersions lists past versions of a user, most recent first
+type UserVersions struct {
+	Versions []User `json:"versions"`
+	Count    int    `json:"count"`
+}
+
+// RevertRequest is the body reverting a user to a past version
+type RevertRequest struct {
+	Version int64 `json:"version"`
+}
+
+// Operations of a BulkRequest
+const (
+	BulkCreate = "create"
+	BulkUpdate = "update"
+	BulkDelete = "delete"
+)
+
+// BulkRequest creates, updates and deletes users in one request
+type BulkRequest struct {
+	// Atomic applies every operation or none
+	Atomic bool `json:"atomic"`
+
+	// DryRun checks the operations without applying them
+	DryRun bool `json:"dryRun"`
+
+	Operations []BulkOperation `json:"operations"`
+}
+
+// BulkOperation is one operation of a BulkRequest
+type BulkOperation struct {
+	Op   string       `json:"op"`
+	ID   string       `json:"id,omitempty"`
+	User *models.User `json:"user,omitempty"`
+
+	// Version the user must be at for updates and deletes. Any version if
+	// zero.
+	Version int64 `json:"version,omitempty"`
+}
+
+// BulkResults is the outcome of a BulkRequest
+type BulkResults struct {
+	DryRun    bool         `json:"dryRun"`
+	Results   []BulkResult `json:"results"`
+	Succeeded int          `json:"succeeded"`
+	Failed    int          `json:"failed"`
+}
+
+// BulkResult is the outcome of an operation, in the order of the request
+type BulkResult struct {
+	Index  int    `json:"index"`
+	Op     string `json:"op"`
+	Status int    `json:"status"`
+	ID     string `json:"id,omitempty"`
+	User   *User  `json:"user,omitempty"`
+	Error  *Error `json:"error,omitempty"`
+}
+
+// ImportResults is the outcome of an import
+type ImportResults struct {
+	DryRun  bool            `json:"dryRun"`
+	Rows    int             `json:"rows"`
+	Created int             `json:"created"`
+	Updated int             `json:"updated"`
+	Failed  int             `json:"failed"`
+	Errors  []ImportFailure `json:"errors"`
+
+	// Ignored lists the columns that match no field
+	Ignored []string `json:"ignored"`
+
+	// Report is the path of a file of the rows that failed, with the reason
+	Report string `json:"report,omitempty"`
+}
+
+// ImportFailure is why a row was not imported
+type ImportFailure struct {
+	Row    int                     `json:"row"`
+	Status int                     `json:"status"`
+	Code   string                  `json:"code"`
+	Detail string                  `json:"detail"`
+	ID     string                  `json:"id,omitempty"`
+	Errors models.ValidationErrors `json:"errors,omitempty"`
+}
+
+// VerificationRequest asks for a link confirming the email of a user
+type VerificationRequest struct {
+	UserID string `json:"userId"`
+}
+
+// TokenRequest confirms an email address with the token of its link
+type TokenRequest struct {
+	Token string `json:"token"`
+}
+
+// PasswordResetRequest asks for a link to reset the password of an account
+type PasswordResetRequest struct {
+	Email string `json:"email"`
+}
+
+// PasswordRequest sets a new password with the token of a reset link
+type PasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// LoginRequest signs in with an email address and password
+type LoginRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// TOTPLoginRequest completes a login with a one-time password or recovery
+// code
+type TOTPLoginRequest struct {
+	MFAToken string `json:"mfaToken"`
+	Code     string `json:"code"`
+}
+
+// Session is the signed-in user
+type Session struct {
+	UserID string `json:"userId"`
+	Role   string `json:"role"`
+
+	// MFA is set once the user passed a second factor
+	MFA bool `json:"mfa"`
+
+	// MFAEnrollmentRequired is set when the role of the user needs a second
+	// factor the user has not enrolled yet
+	MFAEnrollmentRequired bool `json:"mfaEnrollmentRequired"`
+}
+
+// MFAChallenge is returned by a login that needs a second factor, to be
+// completed with LoginTOTP
+type MFAChallenge struct {
+	MFARequired bool   `json:"mfaRequired"`
+	MFAToken    string `json:"mfaToken"`
+}
+
+// LoginResult is a session, or a challenge if MFARequired is set
+type LoginResult struct {
+	MFAChallenge
+	Session
+}
+
+// TOTPEnrollment is the secret of a pending two-factor enrollment
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`    // otpauth:// URI for authenticator apps
+	QRCode string `json:"qrCode"` // URI as a PNG data URI
+}
+
+// CodeRequest confirms a two-factor enrollment
+type CodeRequest struct {
+	Code string `json:"code"`
+}
+
+// RecoveryCodes are the single-use codes of a confirmed enrollment
+type RecoveryCodes struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
@@ -0,0 +1,140 @@
+package apiclient
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"assette/models"
+)
+
+// MergePatchType is the media type of the changes sent by PatchUser
+const MergePatchType = "application/merge-patch+json"
+
+// ListOptions narrows and orders the users returned by ListUsers
+type ListOptions struct {
+	// Filters keeps users whose field matches, by parameter such as
+	// "role" or "name[prefix]"
+	Filters map[string]string
+
+	// Sort lists the fields to sort by, descending with a leading dash
+	Sort []string
+
+	// Fields lists the fields to return besides the ID, all if empty
+	Fields []string
+}
+
+func (o ListOptions) query() url.Values {
+	query := url.Values{}
+	for name, value := range o.Filters {
+		query.Set(name, value)
+	}
+	if len(o.Sort) > 0 {
+		query.Set("sort", strings.Join(o.Sort, ","))
+	}
+	if len(o.Fields) > 0 {
+		query.Set("fields", strings.Join(o.Fields, ","))
+	}
+	return query
+}
+
+// ListUsers returns the users matching opts
+func (c *Client) ListUsers(ctx context.Context, opts ListOptions) (*UserList, error) {
+	return call[UserList](ctx, c, request{method: http.MethodGet, path: "/users", query: opts.query()})
+}
+
+// FindUser returns the user with an email address, ignoring case, or an
+// *Error with status 404 if there is none. Only admins can look users up.
+func (c *Client) FindUser(ctx context.Context, email string) (*User, error) {
+	var list UserList
+	err := c.do(ctx, request{method: http.MethodGet, path: "/users", query: url.Values{"email": {email}}}, &list)
+	if err != nil {
+		return nil, err
+	}
+	if len(list.Users) == 0 {
+		return nil, &Error{Status: http.StatusNotFound, Code: "not_found", Detail: "User not found"}
+	}
+	return &list.Users[0], nil
+}
+
+// GetUser returns a user
+func (c *Client) GetUser(ctx context.Context, id string) (*User, error) {
+	return call[User](ctx, c, request{method: http.MethodGet, path: userPath(id)})
+}
+
+// CreateUser creates a user. New users are unverified with the user role.
+func (c *Client) CreateUser(ctx context.Context, user models.User, opts ...Option) (*User, error) {
+	return call[User](ctx, c, request{method: http.MethodPost, path: "/users", body: user, expected: []int{http.StatusCreated}, options: opts})
+}
+
+// UpdateUser replaces the name and email of a user
+func (c *Client) UpdateUser(ctx context.Context, id string, user models.User, opts ...Option) (*User, error) {
+	return call[User](ctx, c, request{method: http.MethodPut, path: userPath(id), body: user, options: opts})
+}
+
+// PatchUser changes the given fields of a user, such as "name", leaving the
+// others as they are
+func (c *Client) PatchUser(ctx context.Context, id string, changes map[string]interface{}, opts ...Option) (*User, error) {
+	return call[User](ctx, c, request{method: http.MethodPatch, path: userPath(id), body: changes, contentType: MergePatchType, options: opts})
+}
+
+// DeleteUser moves a user to the trash
+func (c *Client) DeleteUser(ctx context.Context, id string, opts ...Option) error {
+	return c.do(ctx, request{method: http.MethodDelete, path: userPath(id), expected: []int{http.StatusNoContent}, options: opts}, nil)
+}
+
+// RestoreUser brings a user back from the trash
+func (c *Client) RestoreUser(ctx context.Context, id string) (*User, error) {
+	return call[User](ctx, c, request{method: http.MethodPost, path: userPath(id, "restore")})
+}
+
+// UserHistory returns past versions of a user, most recent first, at most
+// limit of them unless limit is zero
+func (c *Client) UserHistory(ctx context.Context, id string, limit int) (*UserVersions, error) {
+	query := url.Values{}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	return call[UserVersions](ctx, c, request{method: http.MethodGet, path: userPath(id, "history"), query: query})
+}
+
+// RevertUser writes a past version of a user as its current one
+func (c *Client) RevertUser(ctx context.Context, id string, version int64) (*User, error) {
+	return call[User](ctx, c, request{method: http.MethodPost, path: userPath(id, "revert"), body: RevertRequest{Version: version}})
+}
+
+// BulkUsers runs the operations of a bulk request. Operations that failed
+// are reported in the results rather than as an error.
+func (c *Client) BulkUsers(ctx context.Context, bulk BulkRequest, opts ...Option) (*BulkResults, error) {
+	return call[BulkResults](ctx, c, request{method: http.MethodPost, path: "/users/bulk", body: bulk, expected: []int{http.StatusOK, http.StatusMultiStatus}, options: opts})
+}
+
+// ImportOptions tells how to import a file
+type ImportOptions struct {
+	Format string // csv or xlsx
+	DryRun bool   // Checks the rows without writing them
+	Atomic bool   // Imports every row or none
+
+	// Map maps column headers to the field they hold, for columns not named
+	// after one
+	Map map[string]string
+}
+
+// ImportUsers creates and updates users from a CSV file or XLSX workbook.
+// Rows that failed are reported in the results rather than as an error.
+func (c *Client) ImportUsers(ctx context.Context, file []byte, opts ImportOptions, options ...Option) (*ImportResults, error) {
+	query := url.Values{"format": {opts.Format}}
+	if opts.DryRun {
+		query.Set("dryRun", "true")
+	}
+	if opts.Atomic {
+		query.Set("atomic", "true")
+	}
+	for header, field := range opts.Map {
+		query.Add("map", header+"="+field)
+	}
+
+	return call[ImportResults](ctx, c, request{method: http.MethodPost, path: "/users/import", query: query, raw: file, contentType: "application/octet-stream", options: options})
+}
@@ -0,0 +1,78 @@
+//go:build !js
+
+// Command precompress writes brotli and gzip copies of files next to them,
+// as name.br and name.gz, for api.StaticAssets to serve to clients that
+// accept them. The build runs it on web/app.wasm:
+//
+//	go run ./cmd/precompress web/app.wasm
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/andybalholm/brotli"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, "usage: precompress file...")
+		os.Exit(2)
+	}
+
+	for _, name := range os.Args[1:] {
+		if err := precompress(name); err != nil {
+			fmt.Fprintf(os.Stderr, "precompress %s: %v\n", name, err)
+			os.Exit(1)
+		}
+	}
+}
+
+func precompress(name string) error {
+	if err := encode(name, name+".br", func(w io.Writer) io.WriteCloser {
+		return brotli.NewWriterLevel(w, brotli.BestCompression)
+	}); err != nil {
+		return err
+	}
+	return encode(name, name+".gz", func(w io.Writer) io.WriteCloser {
+		encoder, _ := gzip.NewWriterLevel(w, gzip.BestCompression)
+		return encoder
+	})
+}
+
+// encode writes the content of name compressed into target, replacing it
+// only once complete so that a server never sends a partial file
+func encode(name, target string, newEncoder func(io.Writer) io.WriteCloser) error {
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.CreateTemp(filepath.Dir(target), ".precompress-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+
+	encoder := newEncoder(out)
+	if _, err := io.Copy(encoder, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := encoder.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Chmod(0o644); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), target)
+}
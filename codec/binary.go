@@ -0,0 +1,64 @@
+package codec
+
+import (
+	"bytes"
+	"reflect"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+var messagePackCodec = Codec{
+	MediaType: MessagePack,
+	Aliases:   []string{"application/x-msgpack", "application/vnd.msgpack"},
+	Marshal: func(v interface{}) ([]byte, error) {
+		document, err := toDocument(v)
+		if err != nil {
+			return nil, err
+		}
+
+		var buf bytes.Buffer
+		encoder := msgpack.NewEncoder(&buf)
+		// Sorted keys keep equal documents byte for byte equal
+		encoder.SetSortMapKeys(true)
+		if err := encoder.Encode(document); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	},
+	Unmarshal: func(data []byte, v interface{}) error {
+		var document interface{}
+		if err := msgpack.Unmarshal(data, &document); err != nil {
+			return err
+		}
+		return fromDocument(document, v)
+	},
+}
+
+var (
+	// Core deterministic encoding, RFC 8949 section 4.2
+	cborEncoding, _ = cbor.CoreDetEncOptions().EncMode()
+
+	// Maps decode with string keys, as JSON objects
+	cborDecoding, _ = cbor.DecOptions{
+		DefaultMapType: reflect.TypeOf(map[string]interface{}(nil)),
+	}.DecMode()
+)
+
+var cborCodec = Codec{
+	MediaType: CBOR,
+	Marshal: func(v interface{}) ([]byte, error) {
+		document, err := toDocument(v)
+		if err != nil {
+			return nil, err
+		}
+		return cborEncoding.Marshal(document)
+	},
+	Unmarshal: func(data []byte, v interface{}) error {
+		var document interface{}
+		if err := cborDecoding.Unmarshal(data, &document); err != nil {
+			return err
+		}
+		return fromDocument(document, v)
+	},
+}
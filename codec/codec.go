@@ -0,0 +1,207 @@
+// Package codec encodes and decodes API bodies as JSON, MessagePack or CBOR,
+// chosen from Accept and Content-Type headers. It builds for both the server
+// and WebAssembly so that the frontend can use the same formats.
+//
+// Binary formats carry exactly the document JSON would: values are turned
+// into JSON first and then transcoded, so json struct tags, omitempty and
+// custom MarshalJSON methods apply to every format, and times stay RFC 3339
+// strings. The binary encodings only make the document smaller and faster to
+// parse.
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"mime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Media types of the registered codecs
+const (
+	JSON        = "application/json"
+	MessagePack = "application/msgpack"
+	CBOR        = "application/cbor"
+)
+
+// ErrUnsupported is returned for a Content-Type no codec handles
+var ErrUnsupported = errors.New("unsupported media type")
+
+// Codec encodes and decodes bodies of one media type
+type Codec struct {
+	MediaType string
+	Aliases   []string // Other media types accepted for the same format
+	Marshal   func(v interface{}) ([]byte, error)
+	Unmarshal func(data []byte, v interface{}) error
+}
+
+// registry lists codecs by preference, JSON first as the default
+var registry []*Codec
+
+// Register adds a codec, or replaces the one with the same media type. It is
+// meant to be called from init functions, before requests are served.
+func Register(c Codec) {
+	for i, existing := range registry {
+		if existing.MediaType == c.MediaType {
+			registry[i] = &c
+			return
+		}
+	}
+	registry = append(registry, &c)
+}
+
+// Default returns the JSON codec
+func Default() *Codec {
+	return registry[0]
+}
+
+// MediaTypes returns the media types of the registered codecs by preference
+func MediaTypes() []string {
+	types := make([]string, len(registry))
+	for i, c := range registry {
+		types[i] = c.MediaType
+	}
+	return types
+}
+
+// Lookup returns the codec for a media type or one of its aliases
+func Lookup(mediaType string) (*Codec, bool) {
+	mediaType = strings.ToLower(mediaType)
+	for _, c := range registry {
+		if c.MediaType == mediaType {
+			return c, true
+		}
+		for _, alias := range c.Aliases {
+			if alias == mediaType {
+				return c, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// ForContentType returns the codec of a request body from its Content-Type
+// header, JSON if there is none, or ErrUnsupported
+func ForContentType(contentType string) (*Codec, error) {
+	if contentType == "" {
+		return Default(), nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, ErrUnsupported
+	}
+	if c, ok := Lookup(mediaType); ok {
+		return c, nil
+	}
+	return nil, ErrUnsupported
+}
+
+// Negotiate returns the codec a client prefers according to its Accept
+// header. Wildcards and anything the registry cannot produce fall back to
+// JSON, so that clients always get a body they can at least report.
+func Negotiate(accept string) *Codec {
+	type candidate struct {
+		codec   *Codec
+		quality float64
+		order   int
+	}
+
+	var candidates []candidate
+	for i, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			if quality, err = strconv.ParseFloat(q, 64); err != nil {
+				continue
+			}
+		}
+		if quality <= 0 {
+			continue
+		}
+
+		c, ok := Lookup(mediaType)
+		if !ok {
+			if mediaType != "*/*" && mediaType != "application/*" {
+				continue
+			}
+			c = Default()
+		}
+		candidates = append(candidates, candidate{c, quality, i})
+	}
+
+	if len(candidates) == 0 {
+		return Default()
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].quality > candidates[j].quality
+	})
+	return candidates[0].codec
+}
+
+// toDocument returns v as the generic value its JSON encoding decodes to,
+// with integers kept as int64 rather than float64
+func toDocument(v interface{}) (interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var document interface{}
+	if err := decoder.Decode(&document); err != nil {
+		return nil, err
+	}
+	return numbers(document), nil
+}
+
+func numbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for key, value := range v {
+			v[key] = numbers(value)
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = numbers(value)
+		}
+	}
+	return v
+}
+
+// fromDocument stores document, as decoded from a binary format, into v the
+// way its JSON encoding would be
+func fromDocument(document interface{}, v interface{}) error {
+	data, err := json.Marshal(document)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func init() {
+	Register(Codec{
+		MediaType: JSON,
+		Marshal: func(v interface{}) ([]byte, error) {
+			var buf bytes.Buffer
+			err := json.NewEncoder(&buf).Encode(v)
+			return buf.Bytes(), err
+		},
+		Unmarshal: json.Unmarshal,
+	})
+	Register(messagePackCodec)
+	Register(cborCodec)
+}
@@ -0,0 +1,104 @@
+package codec
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type document struct {
+	Name    string            `json:"name"`
+	Count   int64             `json:"count"`
+	Ratio   float64           `json:"ratio"`
+	Tags    []string          `json:"tags"`
+	Nested  map[string]string `json:"nested"`
+	When    time.Time         `json:"when"`
+	Skipped string            `json:"skipped,omitempty"`
+}
+
+func TestRoundTrip(t *testing.T) {
+	in := document{
+		Name:   "Ada",
+		Count:  1 << 40,
+		Ratio:  0.5,
+		Tags:   []string{"a", "b"},
+		Nested: map[string]string{"key": "value"},
+		When:   time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+	}
+
+	for _, mediaType := range MediaTypes() {
+		c, _ := Lookup(mediaType)
+		data, err := c.Marshal(in)
+		if err != nil {
+			t.Fatalf("%s: failed to marshal: %v", mediaType, err)
+		}
+
+		var out document
+		if err := c.Unmarshal(data, &out); err != nil {
+			t.Fatalf("%s: failed to unmarshal: %v", mediaType, err)
+		}
+		if !reflect.DeepEqual(in, out) {
+			t.Errorf("%s: expected %+v, got %+v", mediaType, in, out)
+		}
+	}
+}
+
+func TestBinaryIsSmaller(t *testing.T) {
+	in := map[string]interface{}{"users": []map[string]interface{}{
+		{"id": "user:1", "emailVerified": true, "version": 123456},
+		{"id": "user:2", "emailVerified": false, "version": 123457},
+	}}
+
+	json, _ := Default().Marshal(in)
+	for _, mediaType := range []string{MessagePack, CBOR} {
+		c, _ := Lookup(mediaType)
+		data, err := c.Marshal(in)
+		if err != nil {
+			t.Fatalf("%s: failed to marshal: %v", mediaType, err)
+		}
+		if len(data) >= len(json) {
+			t.Errorf("%s: expected fewer than %d bytes, got %d", mediaType, len(json), len(data))
+		}
+
+		// Map keys are sorted, so equal documents encode identically
+		again, _ := c.Marshal(in)
+		if string(again) != string(data) {
+			t.Errorf("%s: expected a deterministic encoding", mediaType)
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		accept   string
+		expected string
+	}{
+		{"", JSON},
+		{"*/*", JSON},
+		{"application/cbor", CBOR},
+		{"application/x-msgpack", MessagePack},
+		{"application/json;q=0.5, application/msgpack", MessagePack},
+		{"application/cbor;q=0.9, application/msgpack;q=0.8", CBOR},
+		{"application/cbor;q=0, application/json", JSON},
+		{"text/html", JSON},
+		{"text/html, application/*;q=0.1", JSON},
+	}
+
+	for _, tt := range tests {
+		if c := Negotiate(tt.accept); c.MediaType != tt.expected {
+			t.Errorf("Negotiate(%q) = %s, expected %s", tt.accept, c.MediaType, tt.expected)
+		}
+	}
+}
+
+func TestForContentType(t *testing.T) {
+	if c, err := ForContentType(""); err != nil || c.MediaType != JSON {
+		t.Errorf("Expected JSON without a Content-Type, got %v (%v)", c, err)
+	}
+	if c, err := ForContentType("application/CBOR; charset=binary"); err != nil || c.MediaType != CBOR {
+		t.Errorf("Expected CBOR, got %v (%v)", c, err)
+	}
+	if _, err := ForContentType("text/plain"); err != ErrUnsupported {
+		t.Errorf("Expected ErrUnsupported, got %v", err)
+	}
+}
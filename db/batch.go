@@ -0,0 +1,304 @@
+//go:build !js
+
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// DefaultMaxTxnOps is the number of operations etcd accepts in a single
+// transaction unless started with a different --max-txn-ops
+const DefaultMaxTxnOps = 128
+
+// ErrBatchTooLarge is returned when an operation, or an atomic batch, needs
+// more operations than a transaction allows
+var ErrBatchTooLarge = errors.New("batch exceeds the operations allowed in a transaction")
+
+// ErrBatchConflict is returned for an operation of an atomic batch touching
+// a record or unique value already written by an earlier one
+var ErrBatchConflict = errors.New("written by an earlier operation of the batch")
+
+// ErrBatchAborted is returned for the operations of an atomic batch that
+// were not executed because another one failed
+var ErrBatchAborted = errors.New("not executed because another operation of the batch failed")
+
+// BatchOp is a record write executed by Batch
+type BatchOp struct {
+	Namespace string
+	Key       string
+	Indexes   []Index
+
+	// Value is stored at Key, unless Trash is set
+	Value interface{}
+
+	// Revision the record must be at: AnyRevision to overwrite it whatever
+	// its revision, or 0 if it must not exist yet
+	Revision int64
+
+	// Trash moves the record to the trash with this retention, like Trash,
+	// instead of storing Value
+	Trash time.Duration
+}
+
+// BatchResult is the outcome of a BatchOp: the record as stored, or as
+// trashed, or why the operation failed
+type BatchResult struct {
+	Record Record
+	Err    error
+}
+
+// SetMaxTxnOps sets how many operations Batch puts in a transaction, to
+// match the --max-txn-ops of the etcd cluster. Call it before the client is
+// used.
+func (c *Client) SetMaxTxnOps(n int) {
+	c.maxTxnOps = n
+}
+
+// Batch executes ops, grouped in as few transactions as etcd allows, and
+// returns the result of each. Each operation reads the record it writes
+// just before being grouped, exactly like the single record methods, and
+// those of a transaction that fails because records changed meanwhile are
+// retried one by one.
+//
+// If atomic is set, the operations are committed in a single transaction
+// or not at all. ErrBatchTooLarge is returned if they do not fit in one
+// transaction, and if any of them fails, the others fail with
+// ErrBatchAborted.
+func (c *Client) Batch(ctx context.Context, ops []BatchOp, atomic bool) ([]BatchResult, error) {
+	// Batches read every record they write, allow them more time than single
+	// writes
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	b := &batch{client: c, ops: ops, results: make([]BatchResult, len(ops)), leases: make(map[time.Duration]clientv3.LeaseID)}
+	var err error
+	if atomic {
+		err = b.runAtomic(ctx)
+	} else {
+		err = b.run(ctx)
+	}
+
+	// The history of trashed records expires with them
+	for i, op := range ops {
+		if op.Trash > 0 && b.results[i].Err == nil && b.results[i].Record.Key != "" {
+			c.leaseHistory(ctx, op.Namespace, op.Key, b.leases[op.Trash])
+		}
+	}
+	return b.results, err
+}
+
+func (c *Client) txnLimit() int {
+	if c.maxTxnOps > 0 {
+		return c.maxTxnOps
+	}
+	return DefaultMaxTxnOps
+}
+
+type batch struct {
+	client  *Client
+	ops     []BatchOp
+	results []BatchResult
+
+	// One lease per trash retention, shared by the records trashed with it
+	leases map[time.Duration]clientv3.LeaseID
+
+	// The transaction being filled
+	pending []int
+	plans   []*writePlan
+	written map[string]bool
+	size    int
+}
+
+// plan plans the operation at index i
+func (b *batch) plan(ctx context.Context, i int) (*writePlan, error) {
+	op := b.ops[i]
+	if op.Trash <= 0 {
+		data, err := json.Marshal(op.Value)
+		if err != nil {
+			return nil, err
+		}
+		return b.client.planPut(ctx, op.Namespace, op.Key, data, op.Revision, op.Indexes...)
+	}
+
+	lease, ok := b.leases[op.Trash]
+	if !ok {
+		grant, err := b.client.etcdClient.Grant(ctx, ttlSeconds(op.Trash))
+		if err != nil {
+			return nil, err
+		}
+		lease = grant.ID
+		b.leases[op.Trash] = lease
+	}
+
+	trashKey := fmt.Sprintf("/%s/%s", TrashNamespace(op.Namespace), op.Key)
+	plan, err := b.client.planDelete(ctx, op.Namespace, op.Key, op.Revision, func(value []byte) clientv3.Op {
+		return clientv3.OpPut(trashKey, string(markDeleted(ctx, value)), clientv3.WithLease(lease))
+	}, op.Indexes...)
+	if err == nil && plan == nil {
+		err = ErrKeyNotFound
+	}
+	return plan, err
+}
+
+// fits reports whether plan can join the transaction being filled: it must
+// not exceed its size, nor write a key another plan of the transaction
+// writes, which etcd rejects and which would make plan stale
+func (b *batch) fits(plan *writePlan) bool {
+	if b.size+len(plan.ops) > b.client.txnLimit() {
+		return false
+	}
+	for _, op := range plan.ops {
+		if b.written[string(op.KeyBytes())] {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *batch) add(i int, plan *writePlan) {
+	if b.written == nil {
+		b.written = make(map[string]bool)
+	}
+	for _, op := range plan.ops {
+		b.written[string(op.KeyBytes())] = true
+	}
+	b.pending = append(b.pending, i)
+	b.plans = append(b.plans, plan)
+	b.size += len(plan.ops)
+}
+
+func (b *batch) reset() {
+	b.pending, b.plans, b.written, b.size = nil, nil, nil, 0
+}
+
+// commit commits the transaction being filled and reports whether it
+// succeeded, in which case the results of its operations are set
+func (b *batch) commit(ctx context.Context) (bool, error) {
+	var cmps []clientv3.Cmp
+	var ops []clientv3.Op
+	for _, plan := range b.plans {
+		cmps = append(cmps, plan.cmps...)
+		ops = append(ops, plan.ops...)
+	}
+
+	txn, err := b.client.etcdClient.Txn(ctx).If(cmps...).Then(ops...).Commit()
+	if err != nil || !txn.Succeeded {
+		return false, err
+	}
+
+	for j, i := range b.pending {
+		b.results[i].Record = b.plans[j].committed(txn.Header.Revision)
+	}
+	return true, nil
+}
+
+func (b *batch) run(ctx context.Context) error {
+	flush := func() error {
+		if len(b.pending) == 0 {
+			return nil
+		}
+		pending := b.pending
+		ok, err := b.commit(ctx)
+		b.reset()
+		if err != nil || ok {
+			return err
+		}
+
+		// Records changed since they were read, retry one by one
+		for _, i := range pending {
+			if err := b.runOne(ctx, i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for i := range b.ops {
+		plan, err := b.plan(ctx, i)
+		if err != nil {
+			b.results[i].Err = err
+			continue
+		}
+
+		if !b.fits(plan) {
+			if err := flush(); err != nil {
+				return err
+			}
+			// What the plan read may have just been written
+			if plan, err = b.plan(ctx, i); err != nil {
+				b.results[i].Err = err
+				continue
+			}
+			if !b.fits(plan) {
+				b.results[i].Err = ErrBatchTooLarge
+				continue
+			}
+		}
+		b.add(i, plan)
+	}
+
+	return flush()
+}
+
+// runOne commits the operation at index i in its own transaction
+func (b *batch) runOne(ctx context.Context, i int) error {
+	for {
+		plan, err := b.plan(ctx, i)
+		if err != nil {
+			b.results[i].Err = err
+			return nil
+		}
+
+		b.add(i, plan)
+		ok, err := b.commit(ctx)
+		b.reset()
+		if err != nil || ok {
+			return err
+		}
+	}
+}
+
+func (b *batch) runAtomic(ctx context.Context) error {
+	for {
+		failed := false
+		for i := range b.ops {
+			plan, err := b.plan(ctx, i)
+			if err == nil && !b.fits(plan) {
+				if b.size+len(plan.ops) > b.client.txnLimit() {
+					b.reset()
+					return ErrBatchTooLarge
+				}
+				err = ErrBatchConflict
+			}
+			if err != nil {
+				b.results[i].Err = err
+				failed = true
+				continue
+			}
+			b.add(i, plan)
+		}
+
+		if failed {
+			for i := range b.results {
+				if b.results[i].Err == nil {
+					b.results[i].Err = ErrBatchAborted
+				}
+			}
+			b.reset()
+			return nil
+		}
+
+		ok, err := b.commit(ctx)
+		b.reset()
+		if err != nil || ok {
+			return err
+		}
+		// Records changed since they were read, plan again
+	}
+}
@@ -0,0 +1,122 @@
+//go:build !js
+
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestBatch(t *testing.T) {
+	_, etcdClient := newTestEtcd(t)
+
+	client := NewClient(etcdClient)
+	client.SetMaxTxnOps(5)
+	ctx := context.Background()
+
+	client.PutIndexed(ctx, "test-records", "old", indexedRecord{Email: "old@example.com"}, testEmailIndex)
+
+	// Each create writes the record and its index entry, so the batch needs
+	// several transactions
+	var ops []BatchOp
+	for i := 0; i < 6; i++ {
+		ops = append(ops, BatchOp{
+			Namespace: "test-records",
+			Key:       fmt.Sprintf("r%d", i),
+			Value:     indexedRecord{Email: fmt.Sprintf("r%d@example.com", i)},
+			Indexes:   []Index{testEmailIndex},
+		})
+	}
+	ops = append(ops,
+		BatchOp{Namespace: "test-records", Key: "dup", Value: indexedRecord{Email: "r0@example.com"}, Indexes: []Index{testEmailIndex}},
+		BatchOp{Namespace: "test-records", Key: "r1", Value: indexedRecord{Email: "changed@example.com"}, Revision: AnyRevision, Indexes: []Index{testEmailIndex}},
+		BatchOp{Namespace: "test-records", Key: "old", Trash: time.Hour, Revision: AnyRevision, Indexes: []Index{testEmailIndex}},
+		BatchOp{Namespace: "test-records", Key: "missing", Trash: time.Hour, Revision: AnyRevision, Indexes: []Index{testEmailIndex}},
+		BatchOp{Namespace: "test-records", Key: "r2", Value: indexedRecord{}, Revision: 0},
+	)
+
+	results, err := client.Batch(ctx, ops, false)
+	if err != nil {
+		t.Fatalf("Failed to run batch: %v", err)
+	}
+
+	for i := 0; i < 6; i++ {
+		if results[i].Err != nil || results[i].Record.ModRevision == 0 {
+			t.Errorf("Expected create %d to succeed, got %+v", i, results[i])
+		}
+	}
+	if !errors.Is(results[6].Err, ErrDuplicate) {
+		t.Errorf("Expected ErrDuplicate for a taken email, got %v", results[6].Err)
+	}
+	if results[7].Err != nil {
+		t.Errorf("Expected update to succeed, got %v", results[7].Err)
+	}
+	if results[8].Err != nil || results[8].Record.Key != "old" {
+		t.Errorf("Expected trash to succeed, got %+v", results[8])
+	}
+	if results[9].Err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound trashing a missing record, got %v", results[9].Err)
+	}
+	if results[10].Err != ErrRevisionMismatch {
+		t.Errorf("Expected ErrRevisionMismatch creating an existing record, got %v", results[10].Err)
+	}
+
+	if key, err := client.Lookup(ctx, testEmailIndex, "changed@example.com"); err != nil || key != "r1" {
+		t.Errorf("Expected updated index entry, got %q (%v)", key, err)
+	}
+	if _, err := client.Lookup(ctx, testEmailIndex, "r1@example.com"); err != ErrKeyNotFound {
+		t.Errorf("Expected old index entry to be released, got %v", err)
+	}
+	if _, err := client.Get(ctx, TrashNamespace("test-records"), "old"); err != nil {
+		t.Errorf("Expected trashed record, got %v", err)
+	}
+}
+
+func TestBatchAtomic(t *testing.T) {
+	_, etcdClient := newTestEtcd(t)
+
+	client := NewClient(etcdClient)
+	client.SetMaxTxnOps(5)
+	ctx := context.Background()
+
+	client.PutIndexed(ctx, "test-records", "a", indexedRecord{Email: "a@example.com"}, testEmailIndex)
+
+	create := func(key string, email string) BatchOp {
+		return BatchOp{Namespace: "test-records", Key: key, Value: indexedRecord{Email: email}, Indexes: []Index{testEmailIndex}}
+	}
+
+	results, err := client.Batch(ctx, []BatchOp{create("b", "b@example.com"), create("c", "a@example.com")}, true)
+	if err != nil {
+		t.Fatalf("Failed to run batch: %v", err)
+	}
+	if results[0].Err != ErrBatchAborted || !errors.Is(results[1].Err, ErrDuplicate) {
+		t.Errorf("Expected the batch to abort on a duplicate, got %+v", results)
+	}
+	if _, err := client.Get(ctx, "test-records", "b"); err != ErrKeyNotFound {
+		t.Errorf("Expected nothing written by an aborted batch, got %v", err)
+	}
+
+	results, err = client.Batch(ctx, []BatchOp{create("b", "b@example.com"), create("c", "b@example.com")}, true)
+	if err != nil {
+		t.Fatalf("Failed to run batch: %v", err)
+	}
+	if results[0].Err != ErrBatchAborted || results[1].Err != ErrBatchConflict {
+		t.Errorf("Expected a conflict within the batch, got %+v", results)
+	}
+
+	results, err = client.Batch(ctx, []BatchOp{create("b", "b@example.com"), create("c", "c@example.com")}, true)
+	if err != nil {
+		t.Fatalf("Failed to run batch: %v", err)
+	}
+	if results[0].Err != nil || results[1].Err != nil || results[0].Record.ModRevision != results[1].Record.ModRevision {
+		t.Errorf("Expected both records written in one transaction, got %+v", results)
+	}
+
+	ops := []BatchOp{create("d", "d@example.com"), create("e", "e@example.com"), create("f", "f@example.com")}
+	if _, err := client.Batch(ctx, ops, true); err != ErrBatchTooLarge {
+		t.Errorf("Expected ErrBatchTooLarge, got %v", err)
+	}
+}
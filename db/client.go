@@ -7,13 +7,22 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"sync"
 	"time"
 
+	"go.etcd.io/etcd/api/v3/mvccpb"
 	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
 type Client struct {
 	etcdClient *clientv3.Client
+
+	// Namespaces whose past versions are archived, see KeepHistory
+	historyMu sync.RWMutex
+	history   map[string]bool
+
+	// Operations per transaction in batches, see SetMaxTxnOps
+	maxTxnOps int
 }
 
 func NewClient(etcdClient *clientv3.Client) *Client {
@@ -28,12 +37,121 @@ func (c *Client) Put(ctx context.Context, namespace string, key string, value in
 		return err
 	}
 
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	return c.put(ctx, namespace, key, data)
+}
+
+// CompareAndPut is Put for a record read at revision, as returned in
+// Record.ModRevision, 0 for a record that must not exist yet or AnyRevision.
+// It returns the record as stored, or ErrRevisionMismatch if the record has
+// changed since.
+func (c *Client) CompareAndPut(ctx context.Context, namespace string, key string, value interface{}, revision int64) (Record, error) {
+	return c.putIndexed(ctx, namespace, key, value, revision)
+}
+
+// put writes data over the current value of a record, carrying over its
+// creation metadata and archiving the previous version
+func (c *Client) put(ctx context.Context, namespace string, key string, data []byte, opts ...clientv3.OpOption) error {
 	fullKey := fmt.Sprintf("/%s/%s", namespace, key)
+	for {
+		resp, err := c.etcdClient.Get(ctx, fullKey)
+		if err != nil {
+			return err
+		}
+
+		var previous []byte
+		var revision int64
+		ops := []clientv3.Op{}
+		if len(resp.Kvs) > 0 {
+			previous = resp.Kvs[0].Value
+			revision = resp.Kvs[0].ModRevision
+			ops = append(ops, c.archive(namespace, key, resp.Kvs[0])...)
+		}
+		ops = append(ops, clientv3.OpPut(fullKey, string(stamp(ctx, data, previous)), opts...))
+
+		txn, err := c.etcdClient.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(fullKey), "=", revision)).
+			Then(ops...).
+			Commit()
+		if err != nil {
+			return err
+		}
+		if txn.Succeeded {
+			return nil
+		}
+		// Written concurrently, retry with the new creation metadata
+	}
+}
+
+// Create stores value only if the key does not exist yet, and returns
+// ErrKeyExists otherwise. Used for records that must never be overwritten.
+func (c *Client) Create(ctx context.Context, namespace string, key string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	_, err = c.etcdClient.Put(ctx, fullKey, string(data))
-	return err
+	return c.create(ctx, namespace, key, data)
+}
+
+// CreateWithTTL stores value like Create, attached to a lease so that etcd
+// removes the key once ttl has elapsed. It returns ErrKeyExists if the key
+// exists.
+func (c *Client) CreateWithTTL(ctx context.Context, namespace string, key string, value interface{}, ttl time.Duration) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	lease, err := c.etcdClient.Grant(ctx, ttlSeconds(ttl))
+	if err != nil {
+		return err
+	}
+
+	return c.create(ctx, namespace, key, data, clientv3.WithLease(lease.ID))
+}
+
+func (c *Client) create(ctx context.Context, namespace string, key string, data []byte, opts ...clientv3.OpOption) error {
+	fullKey := fmt.Sprintf("/%s/%s", namespace, key)
+	resp, err := c.etcdClient.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(fullKey), "=", 0)).
+		Then(clientv3.OpPut(fullKey, string(stamp(ctx, data, nil)), opts...)).
+		Commit()
+	if err != nil {
+		return err
+	}
+
+	if !resp.Succeeded {
+		return ErrKeyExists
+	}
+	return nil
+}
+
+// PutWithTTL stores value like Put, attached to a lease so that etcd removes
+// the key once ttl has elapsed.
+func (c *Client) PutWithTTL(ctx context.Context, namespace string, key string, value interface{}, ttl time.Duration) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	lease, err := c.etcdClient.Grant(ctx, ttlSeconds(ttl))
+	if err != nil {
+		return err
+	}
+
+	return c.put(ctx, namespace, key, data, clientv3.WithLease(lease.ID))
 }
 
 func (c *Client) Get(ctx context.Context, namespace string, key string) ([]byte, error) {
@@ -66,6 +184,43 @@ func (c *Client) Delete(ctx context.Context, namespace string, key string) (int6
 	return resp.Deleted, nil
 }
 
+// DeleteAll deletes every record of a namespace and returns how many there
+// were
+func (c *Client) DeleteAll(ctx context.Context, namespace string) (int64, error) {
+	prefix := fmt.Sprintf("/%s/", namespace)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	resp, err := c.etcdClient.Delete(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return 0, err
+	}
+
+	return resp.Deleted, nil
+}
+
+// Take atomically reads and deletes a key, so that only one caller across the
+// cluster can ever obtain its value. Used for single-use tokens.
+func (c *Client) Take(ctx context.Context, namespace string, key string) ([]byte, error) {
+	fullKey := fmt.Sprintf("/%s/%s", namespace, key)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	resp, err := c.etcdClient.Txn(ctx).
+		Then(clientv3.OpDelete(fullKey, clientv3.WithPrevKV())).
+		Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	deleted := resp.Responses[0].GetResponseDeleteRange()
+	if deleted == nil || len(deleted.PrevKvs) == 0 {
+		return nil, ErrKeyNotFound
+	}
+
+	return deleted.PrevKvs[0].Value, nil
+}
+
 func (c *Client) GetAll(ctx context.Context, namespace string) (map[string][]byte, error) {
 	prefix := fmt.Sprintf("/%s/", namespace)
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
@@ -86,6 +241,115 @@ func (c *Client) GetAll(ctx context.Context, namespace string) (map[string][]byt
 	return result, nil
 }
 
+// Record is a stored value along with its metadata and the etcd revisions
+// at which it was created and last modified
+type Record struct {
+	Key            string
+	Value          []byte
+	CreateRevision int64
+	ModRevision    int64
+	Metadata       Metadata
+}
+
+func newRecord(key string, kv *mvccpb.KeyValue) Record {
+	meta := readMetadata(kv.Value)
+	meta.Version = kv.ModRevision
+	return Record{
+		Key:            key,
+		Value:          kv.Value,
+		CreateRevision: kv.CreateRevision,
+		ModRevision:    kv.ModRevision,
+		Metadata:       meta,
+	}
+}
+
+// GetRecord is Get returning the revisions of the record along with its value
+func (c *Client) GetRecord(ctx context.Context, namespace string, key string) (Record, error) {
+	fullKey := fmt.Sprintf("/%s/%s", namespace, key)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	resp, err := c.etcdClient.Get(ctx, fullKey)
+	if err != nil {
+		return Record{}, err
+	}
+
+	if len(resp.Kvs) == 0 {
+		return Record{}, ErrKeyNotFound
+	}
+
+	return newRecord(key, resp.Kvs[0]), nil
+}
+
+// List returns the records of a namespace ordered by key
+func (c *Client) List(ctx context.Context, namespace string) ([]Record, error) {
+	prefix := fmt.Sprintf("/%s/", namespace)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	resp, err := c.etcdClient.Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]Record, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		records = append(records, newRecord(string(kv.Key)[len(prefix):], kv))
+	}
+
+	return records, nil
+}
+
+// Scan calls fn for each record of a namespace in key order, reading them
+// pageSize at a time so that large namespaces need not fit in memory. Every
+// page is read at the revision of the first one, so records written during
+// the scan are seen as they were when it started. Scan stops at the first
+// error returned by fn.
+func (c *Client) Scan(ctx context.Context, namespace string, pageSize int64, fn func(Record) error) error {
+	return c.ScanRange(ctx, namespace, "", "", pageSize, fn)
+}
+
+// ScanRange is Scan for the records with keys from start, included, up to
+// end, excluded. An empty start or end leaves that side of the range open.
+func (c *Client) ScanRange(ctx context.Context, namespace string, start string, end string, pageSize int64, fn func(Record) error) error {
+	prefix := fmt.Sprintf("/%s/", namespace)
+	rangeEnd := clientv3.GetPrefixRangeEnd(prefix)
+	if end != "" {
+		rangeEnd = prefix + end
+	}
+
+	from := prefix + start
+	var revision int64
+	for {
+		opts := []clientv3.OpOption{clientv3.WithRange(rangeEnd), clientv3.WithLimit(pageSize)}
+		if revision > 0 {
+			opts = append(opts, clientv3.WithRev(revision))
+		}
+
+		pageCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		resp, err := c.etcdClient.Get(pageCtx, from, opts...)
+		cancel()
+		if err != nil {
+			return err
+		}
+		if revision == 0 {
+			revision = resp.Header.Revision
+		}
+
+		for _, kv := range resp.Kvs {
+			if err := fn(newRecord(string(kv.Key)[len(prefix):], kv)); err != nil {
+				return err
+			}
+		}
+
+		if !resp.More || len(resp.Kvs) == 0 {
+			return nil
+		}
+		// Continue right after the last key of the page
+		from = string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00"
+	}
+}
+
 func (c *Client) Close() error {
 	return c.etcdClient.Close()
 }
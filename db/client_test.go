@@ -4,10 +4,12 @@ package db
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -124,6 +126,37 @@ func TestPutAndGet(t *testing.T) {
 	}
 }
 
+func TestCompareAndPut(t *testing.T) {
+	_, etcdClient := newTestEtcd(t)
+
+	client := NewClient(etcdClient)
+	ctx := context.Background()
+
+	created, err := client.CompareAndPut(ctx, "test-namespace", "cas-key", "first", 0)
+	if err != nil {
+		t.Fatalf("Failed to create record: %v", err)
+	}
+	if _, err := client.CompareAndPut(ctx, "test-namespace", "cas-key", "again", 0); err != ErrRevisionMismatch {
+		t.Errorf("Expected ErrRevisionMismatch creating an existing record, got %v", err)
+	}
+
+	updated, err := client.CompareAndPut(ctx, "test-namespace", "cas-key", "second", created.ModRevision)
+	if err != nil {
+		t.Fatalf("Failed to update record at its revision: %v", err)
+	}
+	if updated.ModRevision <= created.ModRevision || updated.CreateRevision != created.CreateRevision {
+		t.Errorf("Unexpected revisions %d/%d after %d/%d", updated.CreateRevision, updated.ModRevision, created.CreateRevision, created.ModRevision)
+	}
+
+	// The revision read earlier is now stale
+	if _, err := client.CompareAndPut(ctx, "test-namespace", "cas-key", "third", created.ModRevision); err != ErrRevisionMismatch {
+		t.Errorf("Expected ErrRevisionMismatch, got %v", err)
+	}
+	if data, _ := client.Get(ctx, "test-namespace", "cas-key"); string(data) != `"second"` {
+		t.Errorf("Expected the second value to be kept, got %s", data)
+	}
+}
+
 func TestGetNonExistent(t *testing.T) {
 	_, etcdClient := newTestEtcd(t)
 
@@ -208,4 +241,194 @@ func TestInitializeNamespaces(t *testing.T) {
 	}()
 
 	InitializeNamespaces(client)
-}
\ No newline at end of file
+}
+
+func TestPutWithTTL(t *testing.T) {
+	_, etcdClient := newTestEtcd(t)
+
+	client := NewClient(etcdClient)
+
+	err := client.PutWithTTL(context.Background(), "test-namespace", "ttl-key", "short lived", time.Second)
+	if err != nil {
+		t.Fatalf("Failed to put data: %v", err)
+	}
+
+	if _, err := client.Get(context.Background(), "test-namespace", "ttl-key"); err != nil {
+		t.Fatalf("Failed to get data before expiry: %v", err)
+	}
+
+	time.Sleep(3 * time.Second)
+
+	_, err = client.Get(context.Background(), "test-namespace", "ttl-key")
+	if err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound after ttl elapsed, got: %v", err)
+	}
+}
+
+func TestTake(t *testing.T) {
+	_, etcdClient := newTestEtcd(t)
+
+	client := NewClient(etcdClient)
+
+	err := client.Put(context.Background(), "test-namespace", "take-key", "single use")
+	if err != nil {
+		t.Fatalf("Failed to put data: %v", err)
+	}
+
+	data, err := client.Take(context.Background(), "test-namespace", "take-key")
+	if err != nil {
+		t.Fatalf("Failed to take data: %v", err)
+	}
+
+	if string(data) != `"single use"` {
+		t.Errorf("Unexpected value %s", data)
+	}
+
+	_, err = client.Take(context.Background(), "test-namespace", "take-key")
+	if err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound on second take, got: %v", err)
+	}
+}
+
+func TestCreate(t *testing.T) {
+	_, etcdClient := newTestEtcd(t)
+
+	client := NewClient(etcdClient)
+
+	err := client.Create(context.Background(), "test-namespace", "create-key", "first")
+	if err != nil {
+		t.Fatalf("Failed to create key: %v", err)
+	}
+
+	err = client.Create(context.Background(), "test-namespace", "create-key", "second")
+	if err != ErrKeyExists {
+		t.Errorf("Expected ErrKeyExists, got: %v", err)
+	}
+
+	data, _ := client.Get(context.Background(), "test-namespace", "create-key")
+	if string(data) != `"first"` {
+		t.Errorf("Expected original value to be kept, got %s", data)
+	}
+}
+
+func TestCreateWithTTL(t *testing.T) {
+	_, etcdClient := newTestEtcd(t)
+
+	client := NewClient(etcdClient)
+	ctx := context.Background()
+
+	if err := client.CreateWithTTL(ctx, "test-namespace", "ttl-key", "first", time.Second); err != nil {
+		t.Fatalf("Failed to create key: %v", err)
+	}
+	if err := client.CreateWithTTL(ctx, "test-namespace", "ttl-key", "second", time.Second); err != ErrKeyExists {
+		t.Errorf("Expected ErrKeyExists, got: %v", err)
+	}
+
+	time.Sleep(3 * time.Second)
+
+	if err := client.CreateWithTTL(ctx, "test-namespace", "ttl-key", "third", time.Second); err != nil {
+		t.Errorf("Expected key to be created again after ttl elapsed, got: %v", err)
+	}
+}
+
+func TestScan(t *testing.T) {
+	_, etcdClient := newTestEtcd(t)
+
+	client := NewClient(etcdClient)
+	ctx := context.Background()
+
+	for _, key := range []string{"c", "a", "e", "b", "d"} {
+		client.Put(ctx, "test-scan", key, key)
+	}
+	client.Put(ctx, "test-scan-other", "z", "z")
+
+	var keys []string
+	err := client.Scan(ctx, "test-scan", 2, func(record Record) error {
+		if len(keys) == 0 {
+			// Written after the scan started, so not seen
+			client.Put(ctx, "test-scan", "f", "f")
+		}
+		keys = append(keys, record.Key)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to scan: %v", err)
+	}
+	if strings.Join(keys, ",") != "a,b,c,d,e" {
+		t.Errorf("Expected every record in key order, got %v", keys)
+	}
+
+	stop := errors.New("stop")
+	count := 0
+	err = client.Scan(ctx, "test-scan", 2, func(record Record) error {
+		count++
+		return stop
+	})
+	if err != stop || count != 1 {
+		t.Errorf("Expected the scan to stop at the first error, got %v after %d records", err, count)
+	}
+
+	for _, tt := range []struct{ start, end, expected string }{
+		{"b", "d", "b,c"},
+		{"c", "", "c,d,e,f"},
+		{"", "b", "a"},
+	} {
+		keys = nil
+		err := client.ScanRange(ctx, "test-scan", tt.start, tt.end, 2, func(record Record) error {
+			keys = append(keys, record.Key)
+			return nil
+		})
+		if err != nil || strings.Join(keys, ",") != tt.expected {
+			t.Errorf("Expected %s from %q to %q, got %v (%v)", tt.expected, tt.start, tt.end, keys, err)
+		}
+	}
+}
+
+func TestList(t *testing.T) {
+	_, etcdClient := newTestEtcd(t)
+
+	client := NewClient(etcdClient)
+	ctx := context.Background()
+
+	client.Put(ctx, "test-list", "b", "first")
+	client.Put(ctx, "test-list", "a", "second")
+	client.Put(ctx, "test-list", "b", "updated")
+
+	records, err := client.List(ctx, "test-list")
+	if err != nil {
+		t.Fatalf("Failed to list records: %v", err)
+	}
+	if len(records) != 2 || records[0].Key != "a" || records[1].Key != "b" {
+		t.Fatalf("Expected records a and b in key order, got %+v", records)
+	}
+
+	a, b := records[0], records[1]
+	if b.CreateRevision >= a.CreateRevision {
+		t.Errorf("Expected b to be created before a, got revisions %d and %d", b.CreateRevision, a.CreateRevision)
+	}
+	if b.ModRevision <= a.ModRevision || string(b.Value) != `"updated"` {
+		t.Errorf("Expected b to hold its latest value and revision, got %+v", b)
+	}
+}
+
+func TestGetRecord(t *testing.T) {
+	_, etcdClient := newTestEtcd(t)
+
+	client := NewClient(etcdClient)
+	ctx := context.Background()
+
+	client.Put(ctx, "test-record", "a", "first")
+	client.Put(ctx, "test-record", "a", "second")
+
+	record, err := client.GetRecord(ctx, "test-record", "a")
+	if err != nil {
+		t.Fatalf("Failed to get record: %v", err)
+	}
+	if record.Key != "a" || string(record.Value) != `"second"` || record.ModRevision <= record.CreateRevision {
+		t.Errorf("Unexpected record %+v", record)
+	}
+
+	if _, err := client.GetRecord(ctx, "test-record", "missing"); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,79 @@
+//go:build !js
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// Incr atomically increments the integer counter stored at key and returns
+// the new value. A counter that does not exist yet is created with a lease
+// of the given ttl, so it disappears on its own once the ttl has elapsed.
+// Increments of an existing counter keep its original lease.
+func (c *Client) Incr(ctx context.Context, namespace string, key string, ttl time.Duration) (int64, error) {
+	fullKey := fmt.Sprintf("/%s/%s", namespace, key)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	for {
+		resp, err := c.etcdClient.Get(ctx, fullKey)
+		if err != nil {
+			return 0, err
+		}
+
+		if len(resp.Kvs) == 0 {
+			lease, err := c.etcdClient.Grant(ctx, ttlSeconds(ttl))
+			if err != nil {
+				return 0, err
+			}
+
+			txn, err := c.etcdClient.Txn(ctx).
+				If(clientv3.Compare(clientv3.CreateRevision(fullKey), "=", 0)).
+				Then(clientv3.OpPut(fullKey, "1", clientv3.WithLease(lease.ID))).
+				Commit()
+			if err != nil {
+				return 0, err
+			}
+			if txn.Succeeded {
+				return 1, nil
+			}
+
+			// Another node created the counter first, drop our lease and retry
+			c.etcdClient.Revoke(ctx, lease.ID)
+			continue
+		}
+
+		kv := resp.Kvs[0]
+		current, err := strconv.ParseInt(string(kv.Value), 10, 64)
+		if err != nil {
+			return 0, err
+		}
+
+		next := current + 1
+		txn, err := c.etcdClient.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(fullKey), "=", kv.ModRevision)).
+			Then(clientv3.OpPut(fullKey, strconv.FormatInt(next, 10), clientv3.WithIgnoreLease())).
+			Commit()
+		if err != nil {
+			return 0, err
+		}
+		if txn.Succeeded {
+			return next, nil
+		}
+	}
+}
+
+// ttlSeconds converts a duration into an etcd lease TTL, rounding up to the
+// one second minimum etcd supports.
+func ttlSeconds(ttl time.Duration) int64 {
+	seconds := int64((ttl + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds
+}
@@ -0,0 +1,70 @@
+//go:build !js
+
+package db
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIncr(t *testing.T) {
+	_, etcdClient := newTestEtcd(t)
+
+	client := NewClient(etcdClient)
+
+	for want := int64(1); want <= 3; want++ {
+		got, err := client.Incr(context.Background(), "test-counter", "hits", time.Minute)
+		if err != nil {
+			t.Fatalf("Failed to increment counter: %v", err)
+		}
+		if got != want {
+			t.Errorf("Expected counter value %d, got %d", want, got)
+		}
+	}
+}
+
+func TestIncrConcurrent(t *testing.T) {
+	_, etcdClient := newTestEtcd(t)
+
+	client := NewClient(etcdClient)
+
+	const workers = 10
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := client.Incr(context.Background(), "test-counter", "concurrent", time.Minute); err != nil {
+				t.Errorf("Failed to increment counter: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	got, err := client.Incr(context.Background(), "test-counter", "concurrent", time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to increment counter: %v", err)
+	}
+	if got != workers+1 {
+		t.Errorf("Expected counter value %d, got %d", workers+1, got)
+	}
+}
+
+func TestIncrExpires(t *testing.T) {
+	_, etcdClient := newTestEtcd(t)
+
+	client := NewClient(etcdClient)
+
+	if _, err := client.Incr(context.Background(), "test-counter", "expiring", time.Second); err != nil {
+		t.Fatalf("Failed to increment counter: %v", err)
+	}
+
+	time.Sleep(3 * time.Second)
+
+	_, err := client.Get(context.Background(), "test-counter", "expiring")
+	if err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound after ttl elapsed, got: %v", err)
+	}
+}
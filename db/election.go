@@ -0,0 +1,69 @@
+//go:build !js
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"go.etcd.io/etcd/client/v3/concurrency"
+)
+
+// leaseTTL is how long, in seconds, leadership outlives a node that stopped
+// renewing it, such as after a crash
+const leaseTTL = 10
+
+// Lead runs fn while this node is the leader of the election called name,
+// among every node calling Lead with the same name, so that fn runs on a
+// single node of the cluster at a time. The context of fn is cancelled when
+// leadership is lost, for instance if the node gets cut off from etcd for
+// longer than the lease. Lead then campaigns again, and returns once ctx is
+// done.
+func (c *Client) Lead(ctx context.Context, name string, fn func(ctx context.Context)) {
+	hostname, _ := os.Hostname()
+	candidate := fmt.Sprintf("%s/%d", hostname, os.Getpid())
+
+	for ctx.Err() == nil {
+		if err := c.lead(ctx, name, candidate, fn); err != nil && ctx.Err() == nil {
+			log.Printf("[WARNING] campaigning for %s: %v", name, err)
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+			}
+		}
+	}
+}
+
+// lead campaigns once, and runs fn if elected
+func (c *Client) lead(ctx context.Context, name string, candidate string, fn func(ctx context.Context)) error {
+	session, err := concurrency.NewSession(c.etcdClient, concurrency.WithTTL(leaseTTL), concurrency.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	election := concurrency.NewElection(session, "/elections/"+name)
+	if err := election.Campaign(ctx, candidate); err != nil {
+		return err
+	}
+
+	leaderCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-session.Done():
+			cancel()
+		case <-leaderCtx.Done():
+		}
+	}()
+	fn(leaderCtx)
+
+	// Let another node take over right away rather than once the lease
+	// expires
+	resignCtx, cancelResign := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelResign()
+	return election.Resign(resignCtx)
+}
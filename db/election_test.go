@@ -0,0 +1,50 @@
+//go:build !js
+
+package db
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLead(t *testing.T) {
+	_, etcdClient := newTestEtcd(t)
+
+	client := NewClient(etcdClient)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var leaders, terms atomic.Int32
+	handOver := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client.Lead(ctx, "test", func(ctx context.Context) {
+				if leaders.Add(1) != 1 {
+					t.Error("Expected a single leader at a time")
+				}
+				defer leaders.Add(-1)
+
+				// The first leader steps down, the next one keeps leading
+				if terms.Add(1) == 1 {
+					time.Sleep(100 * time.Millisecond)
+					return
+				}
+				close(handOver)
+				<-ctx.Done()
+			})
+		}()
+	}
+
+	select {
+	case <-handOver:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Expected another candidate to take over")
+	}
+	cancel()
+	wg.Wait()
+}
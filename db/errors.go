@@ -4,4 +4,13 @@ package db
 
 import "errors"
 
-var ErrKeyNotFound = errors.New("key not found")
\ No newline at end of file
+var ErrKeyNotFound = errors.New("key not found")
+
+var ErrKeyExists = errors.New("key already exists")
+
+// ErrDuplicate is returned when a write would give two records the same
+// value in a unique index
+var ErrDuplicate = errors.New("duplicate value in unique index")
+
+// ErrRevisionMismatch is returned when a record changed after it was read
+var ErrRevisionMismatch = errors.New("record has been modified")
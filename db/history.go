@@ -0,0 +1,220 @@
+//go:build !js
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// HistoryNamespace is the namespace archiving past versions of the records
+// of namespace, keyed by record key and revision, e.g.
+// /users-history/user:1/00000000000000000042
+func HistoryNamespace(namespace string) string {
+	return namespace + "-history"
+}
+
+// KeepHistory makes writes to the given namespaces archive the version they
+// replace or delete in the history namespace, in the same transaction, so
+// that History and GetVersion can return it after etcd has compacted its
+// revisions. It applies to Put, PutWithTTL, CompareAndPut, PutIndexed,
+// CompareAndPutIndexed, DeleteIndexed, Trash and Batch.
+func (c *Client) KeepHistory(namespaces ...string) {
+	c.historyMu.Lock()
+	defer c.historyMu.Unlock()
+
+	if c.history == nil {
+		c.history = make(map[string]bool)
+	}
+	for _, namespace := range namespaces {
+		c.history[namespace] = true
+	}
+}
+
+func (c *Client) keepsHistory(namespace string) bool {
+	c.historyMu.RLock()
+	defer c.historyMu.RUnlock()
+	return c.history[namespace]
+}
+
+// archive returns the operation copying kv, the version of a record about to
+// be replaced or deleted, to the history namespace, if namespace keeps history
+func (c *Client) archive(namespace string, key string, kv *mvccpb.KeyValue) []clientv3.Op {
+	if !c.keepsHistory(namespace) {
+		return nil
+	}
+	return []clientv3.Op{clientv3.OpPut(historyKey(namespace, key, kv.ModRevision), string(kv.Value))}
+}
+
+func historyKey(namespace string, key string, revision int64) string {
+	// Zero-padded so that versions sort by revision
+	return fmt.Sprintf("/%s/%s/%020d", HistoryNamespace(namespace), key, revision)
+}
+
+// History returns the versions of a record, most recent first and at most
+// limit of them unless limit is zero. Versions are read from etcd revisions,
+// back to when the record was last created or until etcd compacted them,
+// and from the history namespace for namespaces that keep history. Versions
+// from the history namespace have no CreateRevision. It returns
+// ErrKeyNotFound if no version is known.
+func (c *Client) History(ctx context.Context, namespace string, key string, limit int) ([]Record, error) {
+	fullKey := fmt.Sprintf("/%s/%s", namespace, key)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	versions := make(map[int64]Record)
+
+	var opts []clientv3.OpOption
+	for limit == 0 || len(versions) < limit {
+		resp, err := c.etcdClient.Get(ctx, fullKey, opts...)
+		if err == rpctypes.ErrCompacted {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(resp.Kvs) == 0 {
+			break // Deleted or not created yet at this revision
+		}
+
+		kv := resp.Kvs[0]
+		versions[kv.ModRevision] = newRecord(key, kv)
+		if kv.ModRevision <= 1 {
+			break
+		}
+		opts = []clientv3.OpOption{clientv3.WithRev(kv.ModRevision - 1)}
+	}
+
+	if c.keepsHistory(namespace) {
+		prefix := fmt.Sprintf("/%s/%s/", HistoryNamespace(namespace), key)
+		resp, err := c.etcdClient.Get(ctx, prefix, clientv3.WithPrefix(),
+			clientv3.WithSort(clientv3.SortByKey, clientv3.SortDescend), clientv3.WithLimit(int64(limit)))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, kv := range resp.Kvs {
+			revision, err := strconv.ParseInt(strings.TrimPrefix(string(kv.Key), prefix), 10, 64)
+			if err != nil {
+				continue
+			}
+			if _, ok := versions[revision]; !ok {
+				versions[revision] = archivedRecord(key, kv.Value, revision)
+			}
+		}
+	}
+
+	if len(versions) == 0 {
+		return nil, ErrKeyNotFound
+	}
+
+	records := make([]Record, 0, len(versions))
+	for _, record := range versions {
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].ModRevision > records[j].ModRevision
+	})
+	if limit > 0 && len(records) > limit {
+		records = records[:limit]
+	}
+	return records, nil
+}
+
+// GetVersion returns the version of a record written at revision, as listed
+// by History, or ErrKeyNotFound
+func (c *Client) GetVersion(ctx context.Context, namespace string, key string, revision int64) (Record, error) {
+	fullKey := fmt.Sprintf("/%s/%s", namespace, key)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	resp, err := c.etcdClient.Get(ctx, fullKey, clientv3.WithRev(revision))
+	switch {
+	case err == nil:
+		if len(resp.Kvs) > 0 && resp.Kvs[0].ModRevision == revision {
+			return newRecord(key, resp.Kvs[0]), nil
+		}
+	case err == rpctypes.ErrCompacted, err == rpctypes.ErrFutureRev:
+		// Only the history namespace may have it
+	default:
+		return Record{}, err
+	}
+
+	if !c.keepsHistory(namespace) {
+		return Record{}, ErrKeyNotFound
+	}
+
+	archived, err := c.etcdClient.Get(ctx, historyKey(namespace, key, revision))
+	if err != nil {
+		return Record{}, err
+	}
+	if len(archived.Kvs) == 0 {
+		return Record{}, ErrKeyNotFound
+	}
+	return archivedRecord(key, archived.Kvs[0].Value, revision), nil
+}
+
+// DeleteHistory deletes the archived versions of a record
+func (c *Client) DeleteHistory(ctx context.Context, namespace string, key string) (int64, error) {
+	prefix := fmt.Sprintf("/%s/%s/", HistoryNamespace(namespace), key)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	resp, err := c.etcdClient.Delete(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return 0, err
+	}
+	return resp.Deleted, nil
+}
+
+// leaseHistory attaches the archived versions of a record to lease, so that
+// etcd deletes them along with a trashed record, or detaches them with
+// clientv3.NoLease when the record is restored. Failures are only logged: the
+// versions are then kept until the history is deleted, as before trashing.
+func (c *Client) leaseHistory(ctx context.Context, namespace string, key string, lease clientv3.LeaseID) {
+	if !c.keepsHistory(namespace) {
+		return
+	}
+
+	prefix := fmt.Sprintf("/%s/%s/", HistoryNamespace(namespace), key)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	resp, err := c.etcdClient.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		log.Printf("[WARNING] leasing the history of %s/%s: %v", namespace, key, err)
+		return
+	}
+
+	for start := 0; start < len(resp.Kvs); start += c.txnLimit() {
+		end := min(start+c.txnLimit(), len(resp.Kvs))
+
+		var cmps []clientv3.Cmp
+		var ops []clientv3.Op
+		for _, kv := range resp.Kvs[start:end] {
+			cmps = append(cmps, clientv3.Compare(clientv3.CreateRevision(string(kv.Key)), ">", 0))
+			ops = append(ops, clientv3.OpPut(string(kv.Key), "", clientv3.WithIgnoreValue(), clientv3.WithLease(lease)))
+		}
+
+		// A failed comparison means the history is being deleted meanwhile
+		if _, err := c.etcdClient.Txn(ctx).If(cmps...).Then(ops...).Commit(); err != nil {
+			log.Printf("[WARNING] leasing the history of %s/%s: %v", namespace, key, err)
+			return
+		}
+	}
+}
+
+func archivedRecord(key string, value []byte, revision int64) Record {
+	meta := readMetadata(value)
+	meta.Version = revision
+	return Record{Key: key, Value: value, ModRevision: revision, Metadata: meta}
+}
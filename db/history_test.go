@@ -0,0 +1,101 @@
+//go:build !js
+
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func historyNames(t *testing.T, records []Record) []string {
+	t.Helper()
+
+	names := make([]string, len(records))
+	for i, record := range records {
+		var value map[string]interface{}
+		json.Unmarshal(record.Value, &value)
+		names[i], _ = value["name"].(string)
+	}
+	return names
+}
+
+func TestHistory(t *testing.T) {
+	_, etcdClient := newTestEtcd(t)
+
+	client := NewClient(etcdClient)
+	ctx := context.Background()
+
+	for _, name := range []string{"first", "second", "third"} {
+		client.Put(ctx, "test-history", "a", map[string]string{"name": name})
+	}
+	client.Put(ctx, "test-history", "b", map[string]string{"name": "other"})
+
+	records, err := client.History(ctx, "test-history", "a", 0)
+	if err != nil {
+		t.Fatalf("Failed to get history: %v", err)
+	}
+	if names := historyNames(t, records); len(names) != 3 || names[0] != "third" || names[2] != "first" {
+		t.Fatalf("Expected third, second, first, got %v", names)
+	}
+	if records[0].Metadata.Version <= records[1].Metadata.Version || records[0].Metadata.UpdatedAt.Before(records[1].Metadata.UpdatedAt) {
+		t.Errorf("Expected versions in reverse order, got %+v", records)
+	}
+
+	if limited, _ := client.History(ctx, "test-history", "a", 2); len(limited) != 2 {
+		t.Errorf("Expected 2 versions, got %d", len(limited))
+	}
+
+	first, err := client.GetVersion(ctx, "test-history", "a", records[2].ModRevision)
+	if err != nil || historyNames(t, []Record{first})[0] != "first" {
+		t.Errorf("Expected the first version, got %s (%v)", first.Value, err)
+	}
+	// Revisions that are not versions of the record
+	other, _ := client.GetRecord(ctx, "test-history", "b")
+	for _, revision := range []int64{other.ModRevision, other.ModRevision + 100} {
+		if _, err := client.GetVersion(ctx, "test-history", "a", revision); err != ErrKeyNotFound {
+			t.Errorf("Expected ErrKeyNotFound at revision %d, got %v", revision, err)
+		}
+	}
+
+	if _, err := client.History(ctx, "test-history", "missing", 0); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+}
+
+func TestHistoryAfterCompaction(t *testing.T) {
+	_, etcdClient := newTestEtcd(t)
+
+	client := NewClient(etcdClient)
+	client.KeepHistory("test-kept")
+	ctx := context.Background()
+
+	for _, name := range []string{"first", "second", "third"} {
+		client.Put(ctx, "test-kept", "a", map[string]string{"name": name})
+		client.Put(ctx, "test-lost", "a", map[string]string{"name": name})
+	}
+	client.Trash(ctx, "test-kept", "a", time.Hour)
+
+	resp, _ := etcdClient.Get(ctx, "/")
+	if _, err := etcdClient.Compact(ctx, resp.Header.Revision); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+
+	kept, err := client.History(ctx, "test-kept", "a", 0)
+	if names := historyNames(t, kept); err != nil || len(names) != 3 || names[0] != "third" {
+		t.Errorf("Expected archived versions to survive compaction, got %v (%v)", names, err)
+	}
+	if _, err := client.GetVersion(ctx, "test-kept", "a", kept[2].ModRevision); err != nil {
+		t.Errorf("Expected archived version, got %v", err)
+	}
+
+	lost, err := client.History(ctx, "test-lost", "a", 0)
+	if names := historyNames(t, lost); err != nil || len(names) != 1 || names[0] != "third" {
+		t.Errorf("Expected only the current version without archiving, got %v (%v)", names, err)
+	}
+
+	if deleted, err := client.DeleteHistory(ctx, "test-kept", "a"); err != nil || deleted != 3 {
+		t.Errorf("Expected 3 archived versions deleted, got %d (%v)", deleted, err)
+	}
+}
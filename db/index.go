@@ -0,0 +1,345 @@
+//go:build !js
+
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// Index is a unique secondary index over the records of a namespace. Entries
+// live in their own namespace, mapping an indexed value to the key of the
+// record holding it, e.g. /users-email/ada@example.com -> user:1.
+type Index struct {
+	Namespace string
+
+	// Value extracts the indexed value from a stored record. Records for
+	// which it returns an empty string are left out of the index.
+	Value func(data []byte) string
+}
+
+func (index Index) key(value string) string {
+	return fmt.Sprintf("/%s/%s", index.Namespace, value)
+}
+
+// PutIndexed stores value like Put and updates the given indexes in the same
+// transaction. It returns ErrDuplicate, without storing anything, when another
+// record already holds one of the indexed values.
+func (c *Client) PutIndexed(ctx context.Context, namespace string, key string, value interface{}, indexes ...Index) error {
+	_, err := c.putIndexed(ctx, namespace, key, value, AnyRevision, indexes...)
+	return err
+}
+
+// CompareAndPutIndexed is PutIndexed for a record read at revision, as
+// returned in Record.ModRevision, 0 for a record that must not exist yet or
+// AnyRevision.
+// It returns the record as stored, or ErrRevisionMismatch if the record has
+// changed since.
+func (c *Client) CompareAndPutIndexed(ctx context.Context, namespace string, key string, value interface{}, revision int64, indexes ...Index) (Record, error) {
+	return c.putIndexed(ctx, namespace, key, value, revision, indexes...)
+}
+
+// AnyRevision makes CompareAndPut, CompareAndPutIndexed and Batch overwrite a
+// record
+// whatever its revision, like PutIndexed
+const AnyRevision = -1
+
+// writePlan is a record write ready to be committed: the comparisons it
+// relies on and the operations performing it, which can be committed alone
+// or along with other plans in a batch
+type writePlan struct {
+	cmps []clientv3.Cmp
+	ops  []clientv3.Op
+
+	// The record as written, or as deleted for deletions
+	record  Record
+	deleted bool
+}
+
+// committed returns the record written by the plan once committed at
+// revision
+func (p *writePlan) committed(revision int64) Record {
+	if p.deleted {
+		return p.record
+	}
+
+	record := p.record
+	if record.CreateRevision == 0 {
+		record.CreateRevision = revision
+	}
+	record.ModRevision = revision
+	record.Metadata = readMetadata(record.Value)
+	record.Metadata.Version = revision
+	return record
+}
+
+func (c *Client) putIndexed(ctx context.Context, namespace string, key string, value interface{}, expected int64, indexes ...Index) (Record, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return Record{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	for {
+		plan, err := c.planPut(ctx, namespace, key, data, expected, indexes...)
+		if err != nil {
+			return Record{}, err
+		}
+
+		txn, err := c.etcdClient.Txn(ctx).If(plan.cmps...).Then(plan.ops...).Commit()
+		if err != nil {
+			return Record{}, err
+		}
+		if txn.Succeeded {
+			return plan.committed(txn.Header.Revision), nil
+		}
+		// The record or an index entry changed since it was read, retry
+	}
+}
+
+// planPut plans writing data at key and updating its index entries, if the
+// record is at the expected revision
+func (c *Client) planPut(ctx context.Context, namespace string, key string, data []byte, expected int64, indexes ...Index) (*writePlan, error) {
+	fullKey := fmt.Sprintf("/%s/%s", namespace, key)
+	resp, err := c.etcdClient.Get(ctx, fullKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var previous []byte
+	var revision, createRevision int64
+	var archive []clientv3.Op
+	if len(resp.Kvs) > 0 {
+		previous = resp.Kvs[0].Value
+		revision = resp.Kvs[0].ModRevision
+		createRevision = resp.Kvs[0].CreateRevision
+		archive = c.archive(namespace, key, resp.Kvs[0])
+	}
+	if expected != AnyRevision && revision != expected {
+		return nil, ErrRevisionMismatch
+	}
+
+	stamped := stamp(ctx, data, previous)
+	plan := &writePlan{
+		cmps:   []clientv3.Cmp{clientv3.Compare(clientv3.ModRevision(fullKey), "=", revision)},
+		ops:    append(archive, clientv3.OpPut(fullKey, string(stamped))),
+		record: Record{Key: key, Value: stamped, CreateRevision: createRevision},
+	}
+
+	for _, index := range indexes {
+		newValue := index.Value(data)
+		oldValue := ""
+		if previous != nil {
+			oldValue = index.Value(previous)
+		}
+
+		if oldValue != "" && oldValue != newValue {
+			// Only drop the entry if it still points to this record
+			cmp, op, err := c.releaseIndexEntry(ctx, index.key(oldValue), key)
+			if err != nil {
+				return nil, err
+			}
+			if op != nil {
+				plan.cmps = append(plan.cmps, cmp)
+				plan.ops = append(plan.ops, *op)
+			}
+		}
+
+		if newValue != "" {
+			cmp, op, err := c.claimIndexEntry(ctx, index, newValue, key)
+			if err != nil {
+				return nil, err
+			}
+			plan.cmps = append(plan.cmps, cmp)
+			plan.ops = append(plan.ops, op)
+		}
+	}
+
+	return plan, nil
+}
+
+// DeleteIndexed deletes a record like Delete along with its index entries
+func (c *Client) DeleteIndexed(ctx context.Context, namespace string, key string, indexes ...Index) (int64, error) {
+	deleted, err := c.deleteIndexed(ctx, namespace, key, nil, indexes...)
+	if err != nil || deleted == nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+// deleteIndexed deletes a record and its index entries, along with the
+// operation returned by then for the deleted value, if any. It returns the
+// deleted record, or nil if there was none.
+func (c *Client) deleteIndexed(ctx context.Context, namespace string, key string, then func(value []byte) clientv3.Op, indexes ...Index) (*Record, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	for {
+		plan, err := c.planDelete(ctx, namespace, key, AnyRevision, then, indexes...)
+		if err != nil || plan == nil {
+			return nil, err
+		}
+
+		txn, err := c.etcdClient.Txn(ctx).If(plan.cmps...).Then(plan.ops...).Commit()
+		if err != nil {
+			return nil, err
+		}
+		if txn.Succeeded {
+			return &plan.record, nil
+		}
+	}
+}
+
+// planDelete plans deleting a record and releasing its index entries, if it
+// is at the expected revision. It returns no plan if the record does not
+// exist.
+func (c *Client) planDelete(ctx context.Context, namespace string, key string, expected int64, then func(value []byte) clientv3.Op, indexes ...Index) (*writePlan, error) {
+	fullKey := fmt.Sprintf("/%s/%s", namespace, key)
+	resp, err := c.etcdClient.Get(ctx, fullKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+
+	kv := resp.Kvs[0]
+	if expected != AnyRevision && kv.ModRevision != expected {
+		return nil, ErrRevisionMismatch
+	}
+
+	plan := &writePlan{
+		cmps:    []clientv3.Cmp{clientv3.Compare(clientv3.ModRevision(fullKey), "=", kv.ModRevision)},
+		ops:     append(c.archive(namespace, key, kv), clientv3.OpDelete(fullKey)),
+		record:  newRecord(key, kv),
+		deleted: true,
+	}
+	if then != nil {
+		plan.ops = append(plan.ops, then(kv.Value))
+	}
+
+	for _, index := range indexes {
+		value := index.Value(kv.Value)
+		if value == "" {
+			continue
+		}
+
+		cmp, op, err := c.releaseIndexEntry(ctx, index.key(value), key)
+		if err != nil {
+			return nil, err
+		}
+		if op != nil {
+			plan.cmps = append(plan.cmps, cmp)
+			plan.ops = append(plan.ops, *op)
+		}
+	}
+
+	return plan, nil
+}
+
+// claimIndexEntry returns the operation pointing the entry of value to key,
+// guarded by the current revision of the entry, or ErrDuplicate if another
+// record holds value
+func (c *Client) claimIndexEntry(ctx context.Context, index Index, value string, key string) (clientv3.Cmp, clientv3.Op, error) {
+	entryKey := index.key(value)
+	entry, err := c.etcdClient.Get(ctx, entryKey)
+	if err != nil {
+		return clientv3.Cmp{}, clientv3.Op{}, err
+	}
+
+	var entryRevision int64
+	if len(entry.Kvs) > 0 {
+		if string(entry.Kvs[0].Value) != key {
+			return clientv3.Cmp{}, clientv3.Op{}, fmt.Errorf("%w: %s", ErrDuplicate, index.Namespace)
+		}
+		entryRevision = entry.Kvs[0].ModRevision
+	}
+	return clientv3.Compare(clientv3.ModRevision(entryKey), "=", entryRevision), clientv3.OpPut(entryKey, key), nil
+}
+
+// releaseIndexEntry returns the operation deleting an index entry, guarded
+// by its current revision, or no operation if the entry does not point to key
+func (c *Client) releaseIndexEntry(ctx context.Context, entryKey string, key string) (clientv3.Cmp, *clientv3.Op, error) {
+	entry, err := c.etcdClient.Get(ctx, entryKey)
+	if err != nil {
+		return clientv3.Cmp{}, nil, err
+	}
+	if len(entry.Kvs) == 0 || string(entry.Kvs[0].Value) != key {
+		return clientv3.Cmp{}, nil, nil
+	}
+
+	op := clientv3.OpDelete(entryKey)
+	return clientv3.Compare(clientv3.ModRevision(entryKey), "=", entry.Kvs[0].ModRevision), &op, nil
+}
+
+// Lookup returns the key of the record holding value in index, or
+// ErrKeyNotFound
+func (c *Client) Lookup(ctx context.Context, index Index, value string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	resp, err := c.etcdClient.Get(ctx, index.key(value))
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Kvs) == 0 {
+		return "", ErrKeyNotFound
+	}
+	return string(resp.Kvs[0].Value), nil
+}
+
+// RebuildIndex adds missing index entries for the records of namespace, such
+// as records written before the index existed. Existing entries are kept.
+// When several records share a value, the first one by key is indexed and
+// ErrDuplicate is returned once the rest of the index has been rebuilt.
+func (c *Client) RebuildIndex(ctx context.Context, namespace string, index Index) error {
+	records, err := c.GetAll(ctx, namespace)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(records))
+	for key := range records {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var duplicates []string
+	for _, key := range keys {
+		value := index.Value(records[key])
+		if value == "" {
+			continue
+		}
+
+		entryKey := index.key(value)
+		txnCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		txn, err := c.etcdClient.Txn(txnCtx).
+			If(clientv3.Compare(clientv3.CreateRevision(entryKey), "=", 0)).
+			Then(clientv3.OpPut(entryKey, key)).
+			Else(clientv3.OpGet(entryKey)).
+			Commit()
+		cancel()
+		if err != nil {
+			return err
+		}
+
+		if !txn.Succeeded {
+			existing := txn.Responses[0].GetResponseRange().Kvs
+			if len(existing) > 0 && string(existing[0].Value) != key {
+				duplicates = append(duplicates, key)
+			}
+		}
+	}
+
+	if len(duplicates) > 0 {
+		return fmt.Errorf("%w: %s: records %v share a value with another record", ErrDuplicate, index.Namespace, duplicates)
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+//go:build !js
+
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type indexedRecord struct {
+	Email string `json:"email"`
+}
+
+var testEmailIndex = Index{
+	Namespace: "test-email",
+	Value: func(data []byte) string {
+		var record indexedRecord
+		json.Unmarshal(data, &record)
+		return strings.ToLower(record.Email)
+	},
+}
+
+func TestPutIndexed(t *testing.T) {
+	_, etcdClient := newTestEtcd(t)
+
+	client := NewClient(etcdClient)
+	ctx := context.Background()
+
+	if err := client.PutIndexed(ctx, "test-records", "a", indexedRecord{Email: "Ada@example.com"}, testEmailIndex); err != nil {
+		t.Fatalf("Failed to put indexed record: %v", err)
+	}
+
+	key, err := client.Lookup(ctx, testEmailIndex, "ada@example.com")
+	if err != nil || key != "a" {
+		t.Fatalf("Expected lookup to return a, got %q (%v)", key, err)
+	}
+
+	// Another record cannot take the same value
+	err = client.PutIndexed(ctx, "test-records", "b", indexedRecord{Email: "ada@example.com"}, testEmailIndex)
+	if !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("Expected ErrDuplicate, got %v", err)
+	}
+	if _, err := client.Get(ctx, "test-records", "b"); err != ErrKeyNotFound {
+		t.Errorf("Expected rejected record not to be stored, got %v", err)
+	}
+
+	// Rewriting the same record with the same value is fine
+	if err := client.PutIndexed(ctx, "test-records", "a", indexedRecord{Email: "ada@example.com"}, testEmailIndex); err != nil {
+		t.Fatalf("Failed to rewrite indexed record: %v", err)
+	}
+
+	// Changing the value frees the old one
+	if err := client.PutIndexed(ctx, "test-records", "a", indexedRecord{Email: "lovelace@example.com"}, testEmailIndex); err != nil {
+		t.Fatalf("Failed to change indexed value: %v", err)
+	}
+	if _, err := client.Lookup(ctx, testEmailIndex, "ada@example.com"); err != ErrKeyNotFound {
+		t.Errorf("Expected old value to be removed from the index, got %v", err)
+	}
+	if err := client.PutIndexed(ctx, "test-records", "b", indexedRecord{Email: "ada@example.com"}, testEmailIndex); err != nil {
+		t.Errorf("Expected freed value to be available, got %v", err)
+	}
+}
+
+func TestPutIndexedConcurrent(t *testing.T) {
+	_, etcdClient := newTestEtcd(t)
+
+	client := NewClient(etcdClient)
+
+	const workers = 10
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	stored := 0
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := string(rune('a' + i))
+			err := client.PutIndexed(context.Background(), "test-records", key, indexedRecord{Email: "same@example.com"}, testEmailIndex)
+			if err == nil {
+				mu.Lock()
+				stored++
+				mu.Unlock()
+			} else if !errors.Is(err, ErrDuplicate) {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if stored != 1 {
+		t.Errorf("Expected exactly one record to claim the value, got %d", stored)
+	}
+}
+
+func TestDeleteIndexed(t *testing.T) {
+	_, etcdClient := newTestEtcd(t)
+
+	client := NewClient(etcdClient)
+	ctx := context.Background()
+
+	client.PutIndexed(ctx, "test-records", "a", indexedRecord{Email: "ada@example.com"}, testEmailIndex)
+
+	deleted, err := client.DeleteIndexed(ctx, "test-records", "a", testEmailIndex)
+	if err != nil || deleted != 1 {
+		t.Fatalf("Expected one record deleted, got %d (%v)", deleted, err)
+	}
+	if _, err := client.Lookup(ctx, testEmailIndex, "ada@example.com"); err != ErrKeyNotFound {
+		t.Errorf("Expected index entry to be deleted, got %v", err)
+	}
+
+	if deleted, err := client.DeleteIndexed(ctx, "test-records", "a", testEmailIndex); err != nil || deleted != 0 {
+		t.Errorf("Expected nothing to delete, got %d (%v)", deleted, err)
+	}
+}
+
+func TestRebuildIndex(t *testing.T) {
+	_, etcdClient := newTestEtcd(t)
+
+	client := NewClient(etcdClient)
+	ctx := context.Background()
+
+	// Records written without maintaining the index
+	client.Put(ctx, "test-records", "a", indexedRecord{Email: "ada@example.com"})
+	client.Put(ctx, "test-records", "b", indexedRecord{Email: "ADA@example.com"})
+	client.Put(ctx, "test-records", "c", indexedRecord{Email: "grace@example.com"})
+
+	err := client.RebuildIndex(ctx, "test-records", testEmailIndex)
+	if !errors.Is(err, ErrDuplicate) || !strings.Contains(err.Error(), "[b]") {
+		t.Errorf("Expected ErrDuplicate naming b, got %v", err)
+	}
+
+	for value, want := range map[string]string{"ada@example.com": "a", "grace@example.com": "c"} {
+		if key, err := client.Lookup(ctx, testEmailIndex, value); err != nil || key != want {
+			t.Errorf("Expected %s to be indexed to %s, got %q (%v)", value, want, key, err)
+		}
+	}
+}
+
+func TestCompareAndPutIndexed(t *testing.T) {
+	_, etcdClient := newTestEtcd(t)
+
+	client := NewClient(etcdClient)
+	ctx := context.Background()
+
+	if _, err := client.CompareAndPutIndexed(ctx, "test-records", "a", indexedRecord{Email: "ada@example.com"}, 0, testEmailIndex); err != nil {
+		t.Fatalf("Failed to create record: %v", err)
+	}
+	if _, err := client.CompareAndPutIndexed(ctx, "test-records", "a", indexedRecord{Email: "ada@example.com"}, 0, testEmailIndex); err != ErrRevisionMismatch {
+		t.Errorf("Expected ErrRevisionMismatch creating an existing record, got %v", err)
+	}
+
+	record, err := client.GetRecord(ctx, "test-records", "a")
+	if err != nil {
+		t.Fatalf("Failed to get record: %v", err)
+	}
+
+	stored, err := client.CompareAndPutIndexed(ctx, "test-records", "a", indexedRecord{Email: "lovelace@example.com"}, record.ModRevision, testEmailIndex)
+	if err != nil {
+		t.Fatalf("Failed to update record at its revision: %v", err)
+	}
+	if updated, _ := client.GetRecord(ctx, "test-records", "a"); updated.ModRevision != stored.ModRevision || updated.CreateRevision != stored.CreateRevision {
+		t.Errorf("Expected revisions %d/%d, got %d/%d", updated.CreateRevision, updated.ModRevision, stored.CreateRevision, stored.ModRevision)
+	}
+
+	// The revision read earlier is now stale
+	_, err = client.CompareAndPutIndexed(ctx, "test-records", "a", indexedRecord{Email: "grace@example.com"}, record.ModRevision, testEmailIndex)
+	if err != ErrRevisionMismatch {
+		t.Errorf("Expected ErrRevisionMismatch, got %v", err)
+	}
+	if _, err := client.Lookup(ctx, testEmailIndex, "grace@example.com"); err != ErrKeyNotFound {
+		t.Errorf("Expected rejected value not to be indexed, got %v", err)
+	}
+}
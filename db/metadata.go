@@ -0,0 +1,85 @@
+//go:build !js
+
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// Metadata is maintained by the client for every record stored as a JSON
+// object, under the _meta member of the object. Records that are not
+// objects, such as counters, have none.
+type Metadata struct {
+	CreatedAt time.Time `json:"createdAt"`
+	CreatedBy string    `json:"createdBy,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	UpdatedBy string    `json:"updatedBy,omitempty"`
+
+	// Set on records in a trash namespace
+	DeletedAt time.Time `json:"deletedAt,omitzero"`
+	DeletedBy string    `json:"deletedBy,omitempty"`
+
+	// Version is the etcd revision of the last write to the record. It is
+	// read from etcd rather than stored.
+	Version int64 `json:"-"`
+}
+
+// MetadataField is the member of stored objects holding their Metadata
+const MetadataField = "_meta"
+
+type contextKey int
+
+const actorKey contextKey = iota
+
+// WithActor returns a copy of ctx whose writes are recorded as made by
+// actor, usually the ID of the authenticated user
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey, actor)
+}
+
+func actorFromContext(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey).(string)
+	return actor
+}
+
+// stamp adds metadata to data, a record about to be written over previous,
+// keeping the creation time and author of previous if it had any
+func stamp(ctx context.Context, data []byte, previous []byte) []byte {
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(data, &object); err != nil || object == nil {
+		return data
+	}
+
+	now := time.Now().UTC()
+	actor := actorFromContext(ctx)
+	meta := Metadata{CreatedAt: now, CreatedBy: actor, UpdatedAt: now, UpdatedBy: actor}
+	if old := readMetadata(previous); !old.CreatedAt.IsZero() {
+		meta.CreatedAt, meta.CreatedBy = old.CreatedAt, old.CreatedBy
+	}
+
+	encoded, err := json.Marshal(meta)
+	if err != nil {
+		return data
+	}
+	object[MetadataField] = encoded
+
+	stamped, err := json.Marshal(object)
+	if err != nil {
+		return data
+	}
+	return stamped
+}
+
+// readMetadata returns the metadata stored in data, or zero metadata for
+// records written before metadata was maintained
+func readMetadata(data []byte) Metadata {
+	var record struct {
+		Meta Metadata `json:"_meta"`
+	}
+	if len(data) == 0 || json.Unmarshal(data, &record) != nil {
+		return Metadata{}
+	}
+	return record.Meta
+}
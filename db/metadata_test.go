@@ -0,0 +1,61 @@
+//go:build !js
+
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestMetadata(t *testing.T) {
+	_, etcdClient := newTestEtcd(t)
+
+	client := NewClient(etcdClient)
+	ctx := WithActor(context.Background(), "user:1")
+
+	before := time.Now()
+	if err := client.Put(ctx, "test-meta", "a", map[string]string{"name": "Ada"}); err != nil {
+		t.Fatalf("Failed to put record: %v", err)
+	}
+
+	created, err := client.GetRecord(ctx, "test-meta", "a")
+	if err != nil {
+		t.Fatalf("Failed to get record: %v", err)
+	}
+	meta := created.Metadata
+	if meta.CreatedAt.Before(before) || !meta.UpdatedAt.Equal(meta.CreatedAt) || meta.CreatedBy != "user:1" || meta.Version != created.ModRevision {
+		t.Errorf("Unexpected metadata on creation: %+v", meta)
+	}
+
+	// Metadata is stored alongside the fields, which decode as before
+	var value map[string]interface{}
+	json.Unmarshal(created.Value, &value)
+	if value["name"] != "Ada" || value[MetadataField] == nil {
+		t.Errorf("Expected the name and metadata to be stored, got %s", created.Value)
+	}
+
+	// Updates keep the creation metadata, even with a client-supplied one
+	time.Sleep(10 * time.Millisecond)
+	other := WithActor(context.Background(), "user:2")
+	if err := client.Put(other, "test-meta", "a", json.RawMessage(created.Value)); err != nil {
+		t.Fatalf("Failed to update record: %v", err)
+	}
+
+	updated, _ := client.GetRecord(ctx, "test-meta", "a")
+	meta = updated.Metadata
+	if !meta.CreatedAt.Equal(created.Metadata.CreatedAt) || meta.CreatedBy != "user:1" {
+		t.Errorf("Expected creation metadata to be kept, got %+v", meta)
+	}
+	if !meta.UpdatedAt.After(meta.CreatedAt) || meta.UpdatedBy != "user:2" || meta.Version <= created.Metadata.Version {
+		t.Errorf("Expected update metadata to change, got %+v", meta)
+	}
+
+	// Values that are not objects are stored as is
+	client.Put(ctx, "test-meta", "b", "plain")
+	plain, _ := client.GetRecord(ctx, "test-meta", "b")
+	if string(plain.Value) != `"plain"` || !plain.Metadata.CreatedAt.IsZero() {
+		t.Errorf("Expected a plain value without metadata, got %s", plain.Value)
+	}
+}
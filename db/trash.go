@@ -0,0 +1,139 @@
+//go:build !js
+
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// TrashNamespace is the namespace holding the records trashed from namespace.
+// Trashed records keep their key and can be listed, read and purged there
+// with the usual methods.
+func TrashNamespace(namespace string) string {
+	return namespace + "-trash"
+}
+
+// Trash moves a record to the trash namespace, in the same transaction as
+// releasing its index entries. The trashed record is marked as deleted in its
+// metadata and removed by etcd once retention has elapsed, unless restored,
+// along with its versions in the history namespace. It returns
+// ErrKeyNotFound if the record does not exist.
+func (c *Client) Trash(ctx context.Context, namespace string, key string, retention time.Duration, indexes ...Index) error {
+	trashKey := fmt.Sprintf("/%s/%s", TrashNamespace(namespace), key)
+
+	leaseCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	lease, err := c.etcdClient.Grant(leaseCtx, ttlSeconds(retention))
+	cancel()
+	if err != nil {
+		return err
+	}
+
+	deleted, err := c.deleteIndexed(ctx, namespace, key, func(value []byte) clientv3.Op {
+		return clientv3.OpPut(trashKey, string(markDeleted(ctx, value)), clientv3.WithLease(lease.ID))
+	}, indexes...)
+	if err != nil {
+		return err
+	}
+	if deleted == nil {
+		return ErrKeyNotFound
+	}
+	c.leaseHistory(ctx, namespace, key, lease.ID)
+	return nil
+}
+
+// Restore moves a record back from the trash namespace and claims its index
+// entries again. It returns ErrKeyNotFound if the record is not in the trash,
+// ErrKeyExists if a record with the same key has been created since, and
+// ErrDuplicate if another record now holds one of its indexed values.
+func (c *Client) Restore(ctx context.Context, namespace string, key string, indexes ...Index) (Record, error) {
+	fullKey := fmt.Sprintf("/%s/%s", namespace, key)
+	trashKey := fmt.Sprintf("/%s/%s", TrashNamespace(namespace), key)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	for {
+		resp, err := c.etcdClient.Txn(ctx).Then(clientv3.OpGet(trashKey), clientv3.OpGet(fullKey)).Commit()
+		if err != nil {
+			return Record{}, err
+		}
+
+		trashed := resp.Responses[0].GetResponseRange().Kvs
+		if len(trashed) == 0 {
+			return Record{}, ErrKeyNotFound
+		}
+		if len(resp.Responses[1].GetResponseRange().Kvs) > 0 {
+			return Record{}, ErrKeyExists
+		}
+
+		// Restoring counts as an update, which also clears the deletion
+		restored := stamp(ctx, trashed[0].Value, trashed[0].Value)
+		cmps := []clientv3.Cmp{
+			clientv3.Compare(clientv3.ModRevision(trashKey), "=", trashed[0].ModRevision),
+			clientv3.Compare(clientv3.CreateRevision(fullKey), "=", 0),
+		}
+		ops := []clientv3.Op{clientv3.OpDelete(trashKey), clientv3.OpPut(fullKey, string(restored))}
+
+		for _, index := range indexes {
+			value := index.Value(restored)
+			if value == "" {
+				continue
+			}
+
+			cmp, op, err := c.claimIndexEntry(ctx, index, value, key)
+			if err != nil {
+				return Record{}, err
+			}
+			cmps = append(cmps, cmp)
+			ops = append(ops, op)
+		}
+
+		txn, err := c.etcdClient.Txn(ctx).If(cmps...).Then(ops...).Commit()
+		if err != nil {
+			return Record{}, err
+		}
+		if txn.Succeeded {
+			c.leaseHistory(ctx, namespace, key, clientv3.NoLease)
+
+			meta := readMetadata(restored)
+			meta.Version = txn.Header.Revision
+			return Record{
+				Key:            key,
+				Value:          restored,
+				CreateRevision: txn.Header.Revision,
+				ModRevision:    txn.Header.Revision,
+				Metadata:       meta,
+			}, nil
+		}
+		// Restored, purged or recreated concurrently, check again
+	}
+}
+
+// markDeleted records in the metadata of data when and by whom it was
+// deleted. Values that are not JSON objects are returned as is.
+func markDeleted(ctx context.Context, data []byte) []byte {
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(data, &object); err != nil || object == nil {
+		return data
+	}
+
+	meta := readMetadata(data)
+	meta.DeletedAt = time.Now().UTC()
+	meta.DeletedBy = actorFromContext(ctx)
+
+	encoded, err := json.Marshal(meta)
+	if err != nil {
+		return data
+	}
+	object[MetadataField] = encoded
+
+	marked, err := json.Marshal(object)
+	if err != nil {
+		return data
+	}
+	return marked
+}
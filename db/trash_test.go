@@ -0,0 +1,132 @@
+//go:build !js
+
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func TestTrashAndRestore(t *testing.T) {
+	_, etcdClient := newTestEtcd(t)
+
+	client := NewClient(etcdClient)
+	ctx := WithActor(context.Background(), "user:admin")
+
+	client.PutIndexed(ctx, "test-records", "a", indexedRecord{Email: "ada@example.com"}, testEmailIndex)
+
+	if err := client.Trash(ctx, "test-records", "a", time.Hour, testEmailIndex); err != nil {
+		t.Fatalf("Failed to trash record: %v", err)
+	}
+	if _, err := client.Get(ctx, "test-records", "a"); err != ErrKeyNotFound {
+		t.Errorf("Expected trashed record to be gone, got %v", err)
+	}
+	if _, err := client.Lookup(ctx, testEmailIndex, "ada@example.com"); err != ErrKeyNotFound {
+		t.Errorf("Expected index entry to be released, got %v", err)
+	}
+
+	trashed, err := client.GetRecord(ctx, TrashNamespace("test-records"), "a")
+	if err != nil {
+		t.Fatalf("Expected record in the trash, got %v", err)
+	}
+	if trashed.Metadata.DeletedAt.IsZero() || trashed.Metadata.DeletedBy != "user:admin" || trashed.Metadata.CreatedAt.IsZero() {
+		t.Errorf("Expected deletion metadata, got %+v", trashed.Metadata)
+	}
+
+	if err := client.Trash(ctx, "test-records", "a", time.Hour, testEmailIndex); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound trashing twice, got %v", err)
+	}
+
+	restored, err := client.Restore(ctx, "test-records", "a", testEmailIndex)
+	if err != nil {
+		t.Fatalf("Failed to restore record: %v", err)
+	}
+	if !restored.Metadata.DeletedAt.IsZero() || !restored.Metadata.CreatedAt.Equal(trashed.Metadata.CreatedAt) {
+		t.Errorf("Expected deletion to be cleared and creation kept, got %+v", restored.Metadata)
+	}
+	if key, err := client.Lookup(ctx, testEmailIndex, "ada@example.com"); err != nil || key != "a" {
+		t.Errorf("Expected index entry to be claimed again, got %q (%v)", key, err)
+	}
+	if _, err := client.Get(ctx, TrashNamespace("test-records"), "a"); err != ErrKeyNotFound {
+		t.Errorf("Expected record to leave the trash, got %v", err)
+	}
+
+	if _, err := client.Restore(ctx, "test-records", "a", testEmailIndex); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound restoring twice, got %v", err)
+	}
+}
+
+func TestRestoreConflicts(t *testing.T) {
+	_, etcdClient := newTestEtcd(t)
+
+	client := NewClient(etcdClient)
+	ctx := context.Background()
+
+	client.PutIndexed(ctx, "test-records", "a", indexedRecord{Email: "ada@example.com"}, testEmailIndex)
+	client.Trash(ctx, "test-records", "a", time.Hour, testEmailIndex)
+
+	// Another record took the value meanwhile
+	client.PutIndexed(ctx, "test-records", "b", indexedRecord{Email: "ada@example.com"}, testEmailIndex)
+	if _, err := client.Restore(ctx, "test-records", "a", testEmailIndex); !errors.Is(err, ErrDuplicate) {
+		t.Errorf("Expected ErrDuplicate, got %v", err)
+	}
+
+	// A record was created with the same key
+	client.Put(ctx, "test-records", "a", indexedRecord{Email: "other@example.com"})
+	if _, err := client.Restore(ctx, "test-records", "a", testEmailIndex); err != ErrKeyExists {
+		t.Errorf("Expected ErrKeyExists, got %v", err)
+	}
+
+	if _, err := client.Get(ctx, TrashNamespace("test-records"), "a"); err != nil {
+		t.Errorf("Expected record to stay in the trash, got %v", err)
+	}
+}
+
+func TestTrashRetention(t *testing.T) {
+	_, etcdClient := newTestEtcd(t)
+
+	client := NewClient(etcdClient)
+	client.KeepHistory("test-records")
+	ctx := context.Background()
+
+	for _, key := range []string{"a", "b"} {
+		client.Put(ctx, "test-records", key, indexedRecord{Email: "ada@example.com"})
+		client.Put(ctx, "test-records", key, indexedRecord{Email: "lovelace@example.com"})
+		client.Trash(ctx, "test-records", key, time.Second)
+	}
+
+	// Restored records keep their history for good
+	if _, err := client.Restore(ctx, "test-records", "b"); err != nil {
+		t.Fatalf("Failed to restore record: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := client.Get(ctx, TrashNamespace("test-records"), "a"); err == ErrKeyNotFound {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if _, err := client.Get(ctx, TrashNamespace("test-records"), "a"); err != ErrKeyNotFound {
+		t.Fatal("Expected trashed record to expire")
+	}
+
+	resp, err := etcdClient.Get(ctx, "/"+HistoryNamespace("test-records")+"/a/", clientv3.WithPrefix(), clientv3.WithCountOnly())
+	if err != nil || resp.Count != 0 {
+		t.Errorf("Expected the history to expire with the record, got %d versions (%v)", resp.Count, err)
+	}
+
+	resp, err = etcdClient.Get(ctx, "/"+HistoryNamespace("test-records")+"/b/", clientv3.WithPrefix())
+	if err != nil || len(resp.Kvs) != 2 {
+		t.Fatalf("Expected the history of the restored record to stay, got %d versions (%v)", len(resp.Kvs), err)
+	}
+	for _, kv := range resp.Kvs {
+		if kv.Lease != int64(clientv3.NoLease) {
+			t.Errorf("Expected %s to be detached from the lease", kv.Key)
+		}
+	}
+}
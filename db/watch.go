@@ -0,0 +1,94 @@
+//go:build !js
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// EventType is the kind of change reported by Watch
+type EventType string
+
+const (
+	EventCreate EventType = "create"
+	EventUpdate EventType = "update"
+	EventDelete EventType = "delete"
+)
+
+// Event is a change to a record of a watched namespace. The record of a
+// delete is the last version of the deleted record, with the revision of the
+// delete as its ModRevision.
+type Event struct {
+	Type   EventType
+	Record Record
+}
+
+// Watch reports the changes to the records of a namespace in the order they
+// were made: those made after revision after, or from now on if after is
+// zero. If etcd has compacted the revisions following after, the changes
+// they held are lost and Watch starts from the oldest revision left. The
+// channel is closed once ctx is done, or if etcd ends the watch, such as
+// when the cluster has no leader.
+func (c *Client) Watch(ctx context.Context, namespace string, after int64) <-chan Event {
+	ctx, cancel := context.WithCancel(ctx)
+	prefix := fmt.Sprintf("/%s/", namespace)
+	watchFrom := func(revision int64) clientv3.WatchChan {
+		opts := []clientv3.OpOption{clientv3.WithPrefix(), clientv3.WithPrevKV()}
+		if revision > 0 {
+			opts = append(opts, clientv3.WithRev(revision))
+		}
+		return c.etcdClient.Watch(clientv3.WithRequireLeader(ctx), prefix, opts...)
+	}
+
+	var next int64
+	if after > 0 {
+		next = after + 1
+	}
+	watch := watchFrom(next)
+
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+		defer cancel()
+
+		for {
+			resp, ok := <-watch
+			if !ok {
+				return
+			}
+			if resp.CompactRevision > 0 {
+				log.Printf("[WARNING] watching %s: revisions up to %d were compacted", namespace, resp.CompactRevision)
+				watch = watchFrom(resp.CompactRevision)
+				continue
+			}
+			if resp.Err() != nil {
+				return
+			}
+			for _, ev := range resp.Events {
+				key := string(ev.Kv.Key)[len(prefix):]
+				event := Event{Type: EventUpdate, Record: newRecord(key, ev.Kv)}
+				switch {
+				case ev.Type == clientv3.EventTypeDelete:
+					event.Type = EventDelete
+					if ev.PrevKv != nil {
+						event.Record = newRecord(key, ev.PrevKv)
+					}
+					event.Record.ModRevision = ev.Kv.ModRevision
+				case ev.IsCreate():
+					event.Type = EventCreate
+				}
+
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return events
+}
@@ -0,0 +1,88 @@
+//go:build !js
+
+package db
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWatch(t *testing.T) {
+	_, etcdClient := newTestEtcd(t)
+
+	client := NewClient(etcdClient)
+	ctx := context.Background()
+
+	client.Put(ctx, "test-records", "a", map[string]string{"name": "Ada"})
+	created, err := client.GetRecord(ctx, "test-records", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Put(ctx, "test-records-other", "a", map[string]string{"name": "Other"})
+	client.Put(ctx, "test-records", "a", map[string]string{"name": "Ada Lovelace"})
+	client.Delete(ctx, "test-records", "a")
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	events := client.Watch(watchCtx, "test-records", created.ModRevision-1)
+
+	expected := []struct {
+		eventType EventType
+		name      string
+	}{{EventCreate, "Ada"}, {EventUpdate, "Ada Lovelace"}, {EventDelete, "Ada Lovelace"}}
+	revision := int64(0)
+	for _, want := range expected {
+		select {
+		case event := <-events:
+			if event.Type != want.eventType || event.Record.Key != "a" || !strings.Contains(string(event.Record.Value), `"name":"`+want.name+`"`) {
+				t.Errorf("Expected %s of %s, got %s %s", want.eventType, want.name, event.Type, event.Record.Value)
+			}
+			if event.Record.ModRevision <= revision {
+				t.Errorf("Expected revisions in order, got %d after %d", event.Record.ModRevision, revision)
+			}
+			revision = event.Record.ModRevision
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for the %s event", want.eventType)
+		}
+	}
+
+	cancel()
+	select {
+	case _, open := <-events:
+		if open {
+			t.Error("Expected no event from other namespaces")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the channel to be closed once the context is done")
+	}
+}
+
+func TestWatchAfterCompaction(t *testing.T) {
+	_, etcdClient := newTestEtcd(t)
+
+	client := NewClient(etcdClient)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client.Put(ctx, "test-records", "a", map[string]string{"name": "Ada"})
+	client.Put(ctx, "test-records", "b", map[string]string{"name": "Alan"})
+	resp, _ := etcdClient.Get(ctx, "/")
+	if _, err := etcdClient.Compact(ctx, resp.Header.Revision); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+	client.Put(ctx, "test-records", "c", map[string]string{"name": "Grace"})
+
+	// Changes before the compaction revision are lost, the others still come
+	events := client.Watch(ctx, "test-records", 1)
+	for _, want := range []string{"b", "c"} {
+		select {
+		case event := <-events:
+			if event.Record.Key != want {
+				t.Errorf("Expected the change of %s, got %s", want, event.Record.Key)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for the change of %s", want)
+		}
+	}
+}
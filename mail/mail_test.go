@@ -0,0 +1,142 @@
+//go:build !js
+
+package mail
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestFileSender(t *testing.T) {
+	dir := t.TempDir()
+	sender := &FileSender{Dir: dir, From: "noreply@example.com"}
+
+	err := sender.Send(context.Background(), Message{
+		To:      "john@example.com",
+		Subject: "Hello",
+		Body:    "Line one\nLine two",
+	})
+	if err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Failed to read mail directory: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 message file, got %d", len(entries))
+	}
+
+	data, err := os.ReadFile(dir + "/" + entries[0].Name())
+	if err != nil {
+		t.Fatalf("Failed to read message file: %v", err)
+	}
+
+	for _, want := range []string{"From: noreply@example.com", "To: john@example.com", "Subject: Hello", "Line one\r\nLine two"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("Expected message to contain %q, got:\n%s", want, data)
+		}
+	}
+}
+
+func TestFormatStripsHeaderInjection(t *testing.T) {
+	data := string(format("noreply@example.com", Message{
+		To:      "john@example.com",
+		Subject: "Hello\r\nBcc: victim@example.com",
+	}))
+
+	if strings.Contains(data, "\r\nBcc:") {
+		t.Errorf("Expected line breaks in headers to be stripped, got:\n%s", data)
+	}
+}
+
+func TestLogSender(t *testing.T) {
+	sender := &LogSender{}
+	if err := sender.Send(context.Background(), Message{To: "john@example.com"}); err != nil {
+		t.Errorf("LogSender returned error: %v", err)
+	}
+}
+
+// fakeSMTP accepts a single message and returns its DATA section
+func fakeSMTP(t *testing.T) (string, <-chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		conn.Write([]byte("220 localhost ESMTP\r\n"))
+
+		var data strings.Builder
+		inData := false
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			if inData {
+				if line == ".\r\n" {
+					inData = false
+					received <- data.String()
+					conn.Write([]byte("250 OK\r\n"))
+					continue
+				}
+				data.WriteString(line)
+				continue
+			}
+
+			switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				conn.Write([]byte("250 localhost\r\n"))
+			case cmd == "DATA":
+				inData = true
+				conn.Write([]byte("354 Go ahead\r\n"))
+			case cmd == "QUIT":
+				conn.Write([]byte("221 Bye\r\n"))
+				return
+			default:
+				conn.Write([]byte("250 OK\r\n"))
+			}
+		}
+	}()
+
+	return listener.Addr().String(), received
+}
+
+func TestSMTPSender(t *testing.T) {
+	addr, received := fakeSMTP(t)
+
+	host, portString, _ := net.SplitHostPort(addr)
+	port, _ := strconv.Atoi(portString)
+	sender := &SMTPSender{Host: host, Port: port, From: "noreply@example.com"}
+
+	err := sender.Send(context.Background(), Message{
+		To:      "john@example.com",
+		Subject: "Verify your email",
+		Body:    "Click the link",
+	})
+	if err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+
+	data := <-received
+	if !strings.Contains(data, "Subject: Verify your email") || !strings.Contains(data, "Click the link") {
+		t.Errorf("Unexpected message data:\n%s", data)
+	}
+}
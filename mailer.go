@@ -0,0 +1,47 @@
+//go:build !js
+
+package main
+
+import (
+	"assette/mail"
+	"log"
+	"os"
+	"strconv"
+)
+
+// mailer configures outgoing email from the environment. Without SMTP_HOST,
+// messages are written to MAIL_DIR, or to the log when that is unset too.
+func mailer() (mail.Sender, string) {
+	baseURL := os.Getenv("PUBLIC_URL")
+	if baseURL == "" {
+		baseURL = "http://localhost:8000"
+	}
+
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "noreply@localhost"
+	}
+
+	if host := os.Getenv("SMTP_HOST"); host != "" {
+		port, err := strconv.Atoi(os.Getenv("SMTP_PORT"))
+		if err != nil {
+			port = 587
+		}
+
+		return &mail.SMTPSender{
+			Host:     host,
+			Port:     port,
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     from,
+		}, baseURL
+	}
+
+	if dir := os.Getenv("MAIL_DIR"); dir != "" {
+		log.Printf("[INFO] Writing outgoing email to %s", dir)
+		return &mail.FileSender{Dir: dir, From: from}, baseURL
+	}
+
+	log.Println("[INFO] SMTP_HOST not set, logging outgoing email")
+	return &mail.LogSender{From: from}, baseURL
+}
@@ -0,0 +1,46 @@
+//go:build !js
+
+package main
+
+import (
+	"assette/mail"
+	"testing"
+)
+
+func TestMailerDefaultsToLog(t *testing.T) {
+	t.Setenv("SMTP_HOST", "")
+	t.Setenv("MAIL_DIR", "")
+	t.Setenv("PUBLIC_URL", "")
+
+	sender, baseURL := mailer()
+	if _, ok := sender.(*mail.LogSender); !ok {
+		t.Errorf("Expected *mail.LogSender, got %T", sender)
+	}
+	if baseURL != "http://localhost:8000" {
+		t.Errorf("Expected default base URL, got %q", baseURL)
+	}
+}
+
+func TestMailerSMTP(t *testing.T) {
+	t.Setenv("SMTP_HOST", "smtp.example.com")
+	t.Setenv("SMTP_PORT", "2525")
+
+	sender, _ := mailer()
+	smtpSender, ok := sender.(*mail.SMTPSender)
+	if !ok {
+		t.Fatalf("Expected *mail.SMTPSender, got %T", sender)
+	}
+	if smtpSender.Host != "smtp.example.com" || smtpSender.Port != 2525 {
+		t.Errorf("Unexpected SMTP configuration %+v", smtpSender)
+	}
+}
+
+func TestMailerFile(t *testing.T) {
+	t.Setenv("SMTP_HOST", "")
+	t.Setenv("MAIL_DIR", t.TempDir())
+
+	sender, _ := mailer()
+	if _, ok := sender.(*mail.FileSender); !ok {
+		t.Errorf("Expected *mail.FileSender, got %T", sender)
+	}
+}
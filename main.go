@@ -5,11 +5,15 @@ package main
 import (
 	"assette/api"
 	"assette/views"
+	"assette/webhook"
+	"context"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/maxence-charriere/go-app/v10/pkg/app"
 )
@@ -17,26 +21,66 @@ import (
 func main() {
 	embeddedEtcd, etcdClient, client := database()
 
+	// Keep past versions of users once etcd compacts its revisions
+	client.KeepHistory("users")
+
+	// Index users stored before emails had to be unique
+	if err := client.RebuildIndex(context.Background(), "users", api.UsersByEmail); err != nil {
+		log.Printf("[WARNING] rebuilding the users email index: %v", err)
+	}
+
 	app.Route("/", func() app.Composer { return &views.Home{} })
 	app.Route("/profile", func() app.Composer { return &views.Profile{} })
+	app.Route("/verify", func() app.Composer { return &views.VerifyEmail{} })
+	app.Route("/reset", func() app.Composer { return &views.ResetPassword{} })
+	app.Route("/login", func() app.Composer { return &views.Login{} })
+	app.Route("/2fa", func() app.Composer { return &views.TwoFactor{} })
+	app.Route("/import", func() app.Composer { return &views.ImportUsers{} })
+
+	sender, baseURL := mailer()
+	apiHandler := api.NewHandler(api.Config{
+		Client:     client,
+		Mailer:     sender,
+		BaseURL:    baseURL,
+		Issuer:     "Go PWA",
+		RateLimits: api.DefaultRateLimits(os.Getenv("TRUST_PROXY") == "true"),
+		CORS:       api.CORSConfig{AllowedOrigins: corsOrigins(), ExposedHeaders: []string{"ETag", "Idempotent-Replayed", "Deprecation", "Sunset", "Link"}, AllowCredentials: true, MaxAge: time.Hour},
+		Timeout:    10 * time.Second,
+	})
 
-	http.HandleFunc("/api/users", api.UserRouter(client))
-	http.HandleFunc("/api/users/", api.UserRouter(client))
-	http.HandleFunc("/api/message", api.GetMessage())
-	http.Handle("/", &app.Handler{
+	// Delivered by one node of the cluster at a time
+	ctx, stop := context.WithCancel(context.Background())
+	go (&webhook.Dispatcher{Client: client, Sources: []webhook.Source{api.UserWebhooks}}).Run(ctx)
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/", apiHandler)
+	mux.Handle("/", api.Compress(api.SecurityHeaders(api.PWASecurityPolicy())(api.StaticAssets("web")(&app.Handler{
 		Name:        "Go PWA",
 		Description: "A Go PWA template",
-	})
+	}))))
 
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
 
 	go func() {
-		if err := http.ListenAndServe(":8000", nil); err != nil {
+		if err := http.ListenAndServe(":8000", mux); err != nil {
 			log.Fatal(err)
 		}
 	}()
 
 	<-signalChan
+	stop()
 	shutdown(embeddedEtcd, etcdClient)
 }
+
+// corsOrigins reads the origins allowed to call the API from another site
+// from CORS_ORIGINS, a comma-separated list
+func corsOrigins() []string {
+	var origins []string
+	for _, origin := range strings.Split(os.Getenv("CORS_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
\ No newline at end of file
@@ -11,6 +11,11 @@ import (
 func main() {
 	app.Route("/", func() app.Composer { return &views.Home{} })
 	app.Route("/profile", func() app.Composer { return &views.Profile{} })
+	app.Route("/verify", func() app.Composer { return &views.VerifyEmail{} })
+	app.Route("/reset", func() app.Composer { return &views.ResetPassword{} })
+	app.Route("/login", func() app.Composer { return &views.Login{} })
+	app.Route("/2fa", func() app.Composer { return &views.TwoFactor{} })
+	app.Route("/import", func() app.Composer { return &views.ImportUsers{} })
 
 	app.RunWhenOnBrowser()
 }
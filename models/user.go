@@ -1,6 +1,35 @@
 package models
 
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
 type User struct {
-	Name  string `json:"name"`
-	Email string `json:"email"`
+	Name          string `json:"name"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"emailVerified"`
+	Role          string `json:"role,omitempty"`
+}
+
+// RequiresMFA reports whether accounts with the given role must sign in with
+// a second factor before using role-restricted features
+func RequiresMFA(role string) bool {
+	return role == RoleAdmin
+}
+
+// MinPasswordLength is the shortest password accepted
+const MinPasswordLength = 8
+
+// Validate checks the fields a client can set
+func (u User) Validate() error {
+	return Validate(
+		Check("name", u.Name, Required(), MaxLength(100)),
+		Check("email", u.Email, Required(), MaxLength(254), Email()),
+	)
+}
+
+// ValidatePassword checks a new password
+func ValidatePassword(password string) error {
+	return Validate(Check("password", password, Required(), MinLength(MinPasswordLength)))
 }
@@ -58,4 +58,34 @@ func TestUserEmptyValues(t *testing.T) {
 	if user.Email != "" {
 		t.Errorf("Expected empty email for zero value User, got %q", user.Email)
 	}
-}
\ No newline at end of file
+}
+
+func TestRequiresMFA(t *testing.T) {
+	if !RequiresMFA(RoleAdmin) {
+		t.Error("Expected admins to require MFA")
+	}
+	if RequiresMFA(RoleUser) || RequiresMFA("") {
+		t.Error("Expected regular users not to require MFA")
+	}
+}
+
+func TestUserValidate(t *testing.T) {
+	if err := (User{Name: "Jane", Email: "jane@example.com"}).Validate(); err != nil {
+		t.Errorf("Expected valid user, got %v", err)
+	}
+
+	err := User{Name: " ", Email: "not-an-email"}.Validate()
+	fields := err.(ValidationErrors).ByField()
+	if len(fields) != 2 || fields["name"] == "" || fields["email"] == "" {
+		t.Errorf("Expected name and email errors, got %v", err)
+	}
+}
+
+func TestValidatePassword(t *testing.T) {
+	if err := ValidatePassword("short"); err == nil {
+		t.Error("Expected short password to be rejected")
+	}
+	if err := ValidatePassword("long enough"); err != nil {
+		t.Errorf("Expected password to be accepted, got %v", err)
+	}
+}
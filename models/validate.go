@@ -0,0 +1,150 @@
+package models
+
+import (
+	"fmt"
+	"net/mail"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+// FieldError describes why a single field failed validation. The API sends
+// it as is in problem details, so the server and the PWA show the same
+// messages.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ValidationErrors is returned by Validate when at least one field is invalid
+type ValidationErrors []FieldError
+
+func (e ValidationErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, fe := range e {
+		messages[i] = fe.Field + ": " + fe.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+// ByField returns the message for each invalid field
+func (e ValidationErrors) ByField() map[string]string {
+	fields := make(map[string]string, len(e))
+	for _, fe := range e {
+		if _, ok := fields[fe.Field]; !ok {
+			fields[fe.Field] = fe.Message
+		}
+	}
+	return fields
+}
+
+// Rule checks a value and returns an error code and message, or an empty
+// code when the value is valid. Any function with this signature can be used
+// as a custom rule.
+type Rule func(value string) (code string, message string)
+
+// Field pairs a value with the rules it must satisfy
+type Field struct {
+	Name  string
+	Value string
+	Rules []Rule
+}
+
+// Check declares the rules for a field, to be passed to Validate
+func Check(name string, value string, rules ...Rule) Field {
+	return Field{Name: name, Value: value, Rules: rules}
+}
+
+// Validate runs the rules of every field and reports the first failing rule
+// of each. It returns nil when all fields are valid.
+func Validate(fields ...Field) error {
+	var errs ValidationErrors
+	for _, field := range fields {
+		for _, rule := range field.Rules {
+			if code, message := rule(field.Value); code != "" {
+				errs = append(errs, FieldError{Field: field.Name, Code: code, Message: message})
+				break
+			}
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// Required rejects empty and blank values
+func Required() Rule {
+	return func(value string) (string, string) {
+		if strings.TrimSpace(value) == "" {
+			return "required", "This field is required"
+		}
+		return "", ""
+	}
+}
+
+// MinLength rejects non-empty values shorter than n characters. Combine it
+// with Required to also reject empty values.
+func MinLength(n int) Rule {
+	return func(value string) (string, string) {
+		if value != "" && utf8.RuneCountInString(value) < n {
+			return "too_short", fmt.Sprintf("Must be at least %d characters", n)
+		}
+		return "", ""
+	}
+}
+
+// MaxLength rejects values longer than n characters
+func MaxLength(n int) Rule {
+	return func(value string) (string, string) {
+		if utf8.RuneCountInString(value) > n {
+			return "too_long", fmt.Sprintf("Must be at most %d characters", n)
+		}
+		return "", ""
+	}
+}
+
+// Email rejects non-empty values that are not a bare email address
+func Email() Rule {
+	return func(value string) (string, string) {
+		if value == "" {
+			return "", ""
+		}
+		addr, err := mail.ParseAddress(value)
+		if err != nil || addr.Address != value || !strings.Contains(value[strings.LastIndex(value, "@"):], ".") {
+			return "invalid_email", "Must be a valid email address"
+		}
+		return "", ""
+	}
+}
+
+// OneOf rejects non-empty values other than the given ones
+func OneOf(values ...string) Rule {
+	return func(value string) (string, string) {
+		if value == "" {
+			return "", ""
+		}
+		for _, v := range values {
+			if value == v {
+				return "", ""
+			}
+		}
+		return "invalid_choice", "Must be one of " + strings.Join(values, ", ")
+	}
+}
+
+// URL rejects non-empty values that are not an absolute http or https URL
+func URL() Rule {
+	return func(value string) (string, string) {
+		if value == "" {
+			return "", ""
+		}
+		u, err := url.Parse(value)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return "invalid_url", "Must be an http or https URL"
+		}
+		return "", ""
+	}
+}
@@ -0,0 +1,78 @@
+package models
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRules(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  Rule
+		value string
+		code  string
+	}{
+		{"required empty", Required(), "", "required"},
+		{"required blank", Required(), "   ", "required"},
+		{"required set", Required(), "x", ""},
+		{"min length short", MinLength(3), "ab", "too_short"},
+		{"min length empty", MinLength(3), "", ""},
+		{"min length runes", MinLength(3), "héé", ""},
+		{"max length long", MaxLength(3), "abcd", "too_long"},
+		{"max length runes", MaxLength(3), "ééé", ""},
+		{"email valid", Email(), "jane@example.com", ""},
+		{"email empty", Email(), "", ""},
+		{"email no at", Email(), "jane.example.com", "invalid_email"},
+		{"email no domain dot", Email(), "jane@example", "invalid_email"},
+		{"email display name", Email(), "Jane <jane@example.com>", "invalid_email"},
+		{"one of valid", OneOf("a", "b"), "b", ""},
+		{"one of invalid", OneOf("a", "b"), "c", "invalid_choice"},
+		{"url valid", URL(), "https://example.com/hooks", ""},
+		{"url empty", URL(), "", ""},
+		{"url relative", URL(), "/hooks", "invalid_url"},
+		{"url other scheme", URL(), "ftp://example.com", "invalid_url"},
+	}
+
+	for _, tt := range tests {
+		code, message := tt.rule(tt.value)
+		if code != tt.code {
+			t.Errorf("%s: expected code %q, got %q", tt.name, tt.code, code)
+		}
+		if code != "" && message == "" {
+			t.Errorf("%s: expected a message with code %q", tt.name, code)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	noDashes := func(value string) (string, string) {
+		if strings.Contains(value, "-") {
+			return "no_dashes", "Must not contain dashes"
+		}
+		return "", ""
+	}
+
+	err := Validate(
+		Check("a", "", Required(), noDashes),
+		Check("b", "x-y", Required(), noDashes),
+		Check("c", "ok", Required(), noDashes),
+	)
+
+	invalid, ok := err.(ValidationErrors)
+	if !ok {
+		t.Fatalf("Expected ValidationErrors, got %v", err)
+	}
+	if len(invalid) != 2 {
+		t.Fatalf("Expected 2 field errors, got %+v", invalid)
+	}
+	if invalid[0] != (FieldError{Field: "a", Code: "required", Message: "This field is required"}) {
+		t.Errorf("Expected only the first failing rule for a, got %+v", invalid[0])
+	}
+	if invalid[1].Field != "b" || invalid[1].Code != "no_dashes" {
+		t.Errorf("Expected custom rule to fail for b, got %+v", invalid[1])
+	}
+
+	if err := Validate(Check("c", "ok", Required())); err != nil {
+		t.Errorf("Expected nil error for valid fields, got %v", err)
+	}
+}
@@ -0,0 +1,43 @@
+package models
+
+import "fmt"
+
+// Events sent to webhooks
+const (
+	EventUserCreated = "user.created"
+	EventUserUpdated = "user.updated"
+	EventUserDeleted = "user.deleted"
+)
+
+// WebhookEvents lists the events a webhook can subscribe to
+var WebhookEvents = []string{EventUserCreated, EventUserUpdated, EventUserDeleted}
+
+// Webhook is a URL receiving the events it subscribes to
+type Webhook struct {
+	URL string `json:"url"`
+
+	// Events lists the events sent to the URL, every one if empty
+	Events []string `json:"events,omitempty"`
+}
+
+// Validate checks the fields a client can set
+func (w Webhook) Validate() error {
+	fields := []Field{Check("url", w.URL, Required(), MaxLength(2048), URL())}
+	for i, event := range w.Events {
+		fields = append(fields, Check(fmt.Sprintf("events[%d]", i), event, Required(), OneOf(WebhookEvents...)))
+	}
+	return Validate(fields...)
+}
+
+// Subscribes reports whether the webhook receives event
+func (w Webhook) Subscribes(event string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, e := range w.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,25 @@
+package models
+
+import "testing"
+
+func TestWebhookValidate(t *testing.T) {
+	if err := (Webhook{URL: "https://example.com/hooks", Events: []string{EventUserCreated}}).Validate(); err != nil {
+		t.Errorf("Expected a valid webhook, got %v", err)
+	}
+
+	err := Webhook{URL: "example.com", Events: []string{EventUserDeleted, "user.renamed"}}.Validate()
+	fields := err.(ValidationErrors).ByField()
+	if len(fields) != 2 || fields["url"] == "" || fields["events[1]"] == "" {
+		t.Errorf("Expected url and events[1] errors, got %v", err)
+	}
+}
+
+func TestWebhookSubscribes(t *testing.T) {
+	if !(Webhook{}).Subscribes(EventUserDeleted) {
+		t.Error("Expected a webhook without events to receive every one")
+	}
+	webhook := Webhook{Events: []string{EventUserCreated}}
+	if !webhook.Subscribes(EventUserCreated) || webhook.Subscribes(EventUserDeleted) {
+		t.Errorf("Expected %v to receive only its events", webhook.Events)
+	}
+}
@@ -0,0 +1,139 @@
+package patch
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+// sameJSON compares documents regardless of member order
+func sameJSON(t *testing.T, got []byte, want string) bool {
+	t.Helper()
+
+	var g, w interface{}
+	if err := decode(got, &g); err != nil {
+		t.Fatalf("Failed to decode result %s: %v", got, err)
+	}
+	if err := decode([]byte(want), &w); err != nil {
+		t.Fatalf("Failed to decode expected %s: %v", want, err)
+	}
+	return equal(g, w)
+}
+
+func TestMerge(t *testing.T) {
+	// Examples from RFC 7386, appendix A
+	tests := []struct {
+		document string
+		patch    string
+		want     string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+
+	for _, tt := range tests {
+		got, err := Merge([]byte(tt.document), []byte(tt.patch))
+		if err != nil {
+			t.Errorf("%s + %s: unexpected error %v", tt.document, tt.patch, err)
+			continue
+		}
+		if !sameJSON(t, got, tt.want) {
+			t.Errorf("%s + %s: expected %s, got %s", tt.document, tt.patch, tt.want, got)
+		}
+	}
+
+	if _, err := Merge([]byte(`{}`), []byte(`{`)); !errors.Is(err, ErrInvalid) {
+		t.Errorf("Expected ErrInvalid for malformed patch, got %v", err)
+	}
+}
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		document string
+		patch    string
+		want     string
+	}{
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"foo":"bar","baz":"qux"}`},
+		{`{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`},
+		{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":["abc"]}]`, `{"foo":["bar",["abc"]]}`},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`},
+		{`{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo","foo":"bar"}`},
+		{`{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`, `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`, `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`},
+		{`{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, `{"foo":["all","cows","eat","grass"]}`},
+		{`{"foo":{"bar":1}}`, `[{"op":"copy","from":"/foo","path":"/baz"},{"op":"replace","path":"/baz/bar","value":2}]`, `{"foo":{"bar":1},"baz":{"bar":2}}`},
+		{`{"a/b":1,"m~n":2}`, `[{"op":"test","path":"/a~1b","value":1.0},{"op":"remove","path":"/m~0n"}]`, `{"a/b":1}`},
+		{`{"foo":"bar"}`, `[{"op":"replace","path":"","value":[1]}]`, `[1]`},
+	}
+
+	for _, tt := range tests {
+		got, err := Apply([]byte(tt.document), []byte(tt.patch))
+		if err != nil {
+			t.Errorf("%s + %s: unexpected error %v", tt.document, tt.patch, err)
+			continue
+		}
+		if !sameJSON(t, got, tt.want) {
+			t.Errorf("%s + %s: expected %s, got %s", tt.document, tt.patch, tt.want, got)
+		}
+	}
+}
+
+func TestApplyErrors(t *testing.T) {
+	tests := []struct {
+		patch string
+		index int
+		is    error
+	}{
+		{`[{"op":"test","path":"/name","value":"Grace"}]`, 0, ErrTestFailed},
+		{`[{"op":"add","path":"/age","value":1},{"op":"remove","path":"/missing"}]`, 1, nil},
+		{`[{"op":"replace","path":"/tags/5","value":"x"}]`, 0, nil},
+		{`[{"op":"add","path":"/tags/01","value":"x"}]`, 0, ErrInvalid},
+		{`[{"op":"move","from":"/tags","path":"/tags/0"}]`, 0, ErrInvalid},
+		{`[{"op":"rename","path":"/name"}]`, 0, ErrInvalid},
+		{`[{"op":"add","path":"name","value":"x"}]`, 0, ErrInvalid},
+		{`[{"op":"add","path":"/name"}]`, 0, ErrInvalid},
+	}
+
+	document := []byte(`{"name":"Ada","tags":["a"]}`)
+	for _, tt := range tests {
+		_, err := Apply(document, []byte(tt.patch))
+
+		var patchErr *Error
+		if !errors.As(err, &patchErr) || patchErr.Index != tt.index {
+			t.Errorf("%s: expected error at operation %d, got %v", tt.patch, tt.index, err)
+			continue
+		}
+		if tt.is != nil && !errors.Is(err, tt.is) {
+			t.Errorf("%s: expected %v, got %v", tt.patch, tt.is, err)
+		}
+	}
+
+	if _, err := Apply(document, []byte(`{"op":"add"}`)); !errors.Is(err, ErrInvalid) {
+		t.Errorf("Expected ErrInvalid for a patch that is not an array, got %v", err)
+	}
+}
+
+func TestApplyKeepsDocumentOnFailure(t *testing.T) {
+	document := []byte(`{"name":"Ada"}`)
+	_, err := Apply(document, []byte(`[{"op":"replace","path":"/name","value":"Grace"},{"op":"test","path":"/name","value":"Ada"}]`))
+	if !errors.Is(err, ErrTestFailed) {
+		t.Fatalf("Expected ErrTestFailed, got %v", err)
+	}
+
+	var doc map[string]string
+	json.Unmarshal(document, &doc)
+	if doc["name"] != "Ada" {
+		t.Errorf("Expected the original document to be unchanged, got %v", doc)
+	}
+}
@@ -0,0 +1,313 @@
+//go:build !js
+
+// Package query filters, sorts and trims lists of records according to URL
+// query parameters, so that every list endpoint supports the same syntax:
+//
+//	name=Ada                exact match
+//	name[prefix]=Ad         case-insensitive prefix
+//	email[contains]=exam    case-insensitive substring
+//	sort=name,-createdAt    ascending, or descending with a leading dash
+//	fields=name,email       sparse fieldset, the id is always kept
+package query
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"assette/db"
+)
+
+const (
+	OpEq       = "eq"
+	OpPrefix   = "prefix"
+	OpContains = "contains"
+)
+
+// CreatedAt sorts documents by their createdAt field, or in the order their
+// records were created for documents without one
+const CreatedAt = "createdAt"
+
+// Options lists what a resource allows clients to query
+type Options struct {
+	Filterable []string
+	Sortable   []string // CreatedAt is always sortable
+	Selectable []string
+	// Parameters handled by the endpoint itself, which Parse leaves alone
+	Reserved []string
+	// Sort order used when the request has none, ties broken by creation order
+	DefaultSort []Sort
+}
+
+// Filter keeps documents whose field matches Value using Op
+type Filter struct {
+	Field string
+	Op    string
+	Value string
+}
+
+// Sort orders documents by a field
+type Sort struct {
+	Field string
+	Desc  bool
+}
+
+// Query is a parsed set of query parameters
+type Query struct {
+	Filters []Filter
+	Sort    []Sort
+	Fields  []string
+}
+
+// Error reports an invalid query parameter
+type Error struct {
+	Parameter string
+	Message   string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("query parameter %s: %s", e.Parameter, e.Message)
+}
+
+// Document is a record as seen by queries: the fields returned to clients,
+// including its ID, and the revision at which it was created
+type Document struct {
+	Fields         map[string]interface{}
+	CreateRevision int64
+}
+
+// Documents turns records into documents using fields, skipping records for
+// which it fails
+func Documents(records []db.Record, fields func(record db.Record) (map[string]interface{}, error)) []Document {
+	documents := make([]Document, 0, len(records))
+	for _, record := range records {
+		f, err := fields(record)
+		if err != nil {
+			continue // Skip malformed records
+		}
+		documents = append(documents, Document{Fields: f, CreateRevision: record.CreateRevision})
+	}
+	return documents
+}
+
+// Parse reads filters, sort order and fields from values. Parameters that are
+// neither reserved nor refer to a filterable field are rejected.
+func Parse(values url.Values, options Options) (Query, error) {
+	var q Query
+
+	for param, vals := range values {
+		if contains(options.Reserved, param) {
+			continue
+		}
+
+		switch param {
+		case "sort":
+			for _, field := range splitList(vals) {
+				s := Sort{Field: field}
+				if strings.HasPrefix(field, "-") {
+					s = Sort{Field: field[1:], Desc: true}
+				}
+				if s.Field != CreatedAt && !contains(options.Sortable, s.Field) {
+					return Query{}, &Error{Parameter: "sort", Message: "cannot sort by " + s.Field}
+				}
+				q.Sort = append(q.Sort, s)
+			}
+
+		case "fields":
+			for _, field := range splitList(vals) {
+				if !contains(options.Selectable, field) {
+					return Query{}, &Error{Parameter: "fields", Message: "unknown field " + field}
+				}
+				q.Fields = append(q.Fields, field)
+			}
+
+		default:
+			field, op := param, OpEq
+			if i := strings.Index(param, "["); i > 0 && strings.HasSuffix(param, "]") {
+				field, op = param[:i], param[i+1:len(param)-1]
+			}
+
+			if !contains(options.Filterable, field) {
+				return Query{}, &Error{Parameter: param, Message: "unknown filter"}
+			}
+			if op != OpEq && op != OpPrefix && op != OpContains {
+				return Query{}, &Error{Parameter: param, Message: "unknown operator " + op}
+			}
+
+			for _, value := range vals {
+				q.Filters = append(q.Filters, Filter{Field: field, Op: op, Value: value})
+			}
+		}
+	}
+
+	// Map iteration order is random, keep filters deterministic
+	sort.SliceStable(q.Filters, func(i, j int) bool {
+		return q.Filters[i].Field < q.Filters[j].Field
+	})
+
+	if len(q.Sort) == 0 {
+		q.Sort = options.DefaultSort
+	}
+
+	return q, nil
+}
+
+// Apply returns the fields of the documents matching every filter, sorted and
+// trimmed to the requested fields
+func (q Query) Apply(documents []Document) []map[string]interface{} {
+	matched := make([]Document, 0, len(documents))
+	for _, doc := range documents {
+		if q.matches(doc) {
+			matched = append(matched, doc)
+		}
+	}
+
+	sort.SliceStable(matched, func(i, j int) bool {
+		for _, s := range q.Sort {
+			c := compareField(matched[i], matched[j], s.Field)
+			if c != 0 {
+				return (c < 0) != s.Desc
+			}
+		}
+		return matched[i].CreateRevision < matched[j].CreateRevision
+	})
+
+	results := make([]map[string]interface{}, len(matched))
+	for i, doc := range matched {
+		results[i] = q.project(doc.Fields)
+	}
+	return results
+}
+
+func (q Query) matches(doc Document) bool {
+	for _, f := range q.Filters {
+		value, ok := doc.Fields[f.Field]
+		if !ok || value == nil {
+			return false
+		}
+
+		text := fmt.Sprint(value)
+		switch f.Op {
+		case OpEq:
+			if text != f.Value {
+				return false
+			}
+		case OpPrefix:
+			if !strings.HasPrefix(strings.ToLower(text), strings.ToLower(f.Value)) {
+				return false
+			}
+		case OpContains:
+			if !strings.Contains(strings.ToLower(text), strings.ToLower(f.Value)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (q Query) project(fields map[string]interface{}) map[string]interface{} {
+	if len(q.Fields) == 0 {
+		return fields
+	}
+
+	projected := map[string]interface{}{"id": fields["id"]}
+	for _, field := range q.Fields {
+		if value, ok := fields[field]; ok {
+			projected[field] = value
+		}
+	}
+	return projected
+}
+
+// compareField compares a field of two documents. Documents without a
+// createdAt field are older than those with one, and ordered among
+// themselves by creation revision.
+func compareField(a Document, b Document, field string) int {
+	x, y := a.Fields[field], b.Fields[field]
+	if field == CreatedAt && x == nil && y == nil {
+		return compare(a.CreateRevision, b.CreateRevision)
+	}
+	return compare(x, y)
+}
+
+// compare orders missing values first, numbers and times by value, false
+// before true and everything else as case-insensitive text
+func compare(a interface{}, b interface{}) int {
+	if a == nil || b == nil {
+		switch {
+		case a == nil && b == nil:
+			return 0
+		case a == nil:
+			return -1
+		default:
+			return 1
+		}
+	}
+
+	if x, ok := number(a); ok {
+		if y, ok := number(b); ok {
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+			return 0
+		}
+	}
+
+	if x, ok := a.(time.Time); ok {
+		if y, ok := b.(time.Time); ok {
+			return x.Compare(y)
+		}
+	}
+
+	if x, ok := a.(bool); ok {
+		if y, ok := b.(bool); ok {
+			switch {
+			case x == y:
+				return 0
+			case !x:
+				return -1
+			}
+			return 1
+		}
+	}
+
+	return strings.Compare(strings.ToLower(fmt.Sprint(a)), strings.ToLower(fmt.Sprint(b)))
+}
+
+func number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+func splitList(values []string) []string {
+	var list []string
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+	return list
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,144 @@
+//go:build !js
+
+package query
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+
+	"assette/db"
+)
+
+var testOptions = Options{
+	Filterable:  []string{"name", "email", "verified"},
+	Sortable:    []string{"name", "age"},
+	Selectable:  []string{"name", "email"},
+	Reserved:    []string{"page"},
+	DefaultSort: []Sort{{Field: "name"}},
+}
+
+func testDocuments() []Document {
+	return []Document{
+		{Fields: map[string]interface{}{"id": "1", "name": "grace", "email": "grace@navy.mil", "age": 85.0, "verified": true}, CreateRevision: 10},
+		{Fields: map[string]interface{}{"id": "2", "name": "Ada", "email": "ada@example.com", "age": 36.0, "verified": false}, CreateRevision: 20},
+		{Fields: map[string]interface{}{"id": "3", "name": "alan", "email": "alan@example.com", "age": 41.0, "verified": true}, CreateRevision: 5},
+	}
+}
+
+func ids(results []map[string]interface{}) []string {
+	list := make([]string, len(results))
+	for i, result := range results {
+		list[i], _ = result["id"].(string)
+	}
+	return list
+}
+
+func run(t *testing.T, rawQuery string) []string {
+	t.Helper()
+
+	values, _ := url.ParseQuery(rawQuery)
+	q, err := Parse(values, testOptions)
+	if err != nil {
+		t.Fatalf("%s: failed to parse: %v", rawQuery, err)
+	}
+	return ids(q.Apply(testDocuments()))
+}
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		query string
+		ids   string
+	}{
+		{"", "[2 3 1]"},
+		{"page=2", "[2 3 1]"},
+		{"name=Ada", "[2]"},
+		{"name=ada", "[]"},
+		{"name[prefix]=A", "[2 3]"},
+		{"email[contains]=EXAMPLE", "[2 3]"},
+		{"email[contains]=example&verified=true", "[3]"},
+		{"name[prefix]=a&name[prefix]=al", "[3]"},
+		{"sort=-name", "[1 3 2]"},
+		{"sort=age", "[2 3 1]"},
+		{"sort=createdAt", "[3 1 2]"},
+		{"sort=-createdAt", "[2 1 3]"},
+	}
+
+	for _, tt := range tests {
+		if got := run(t, tt.query); fmt.Sprint(got) != tt.ids {
+			t.Errorf("%q: expected %s, got %v", tt.query, tt.ids, got)
+		}
+	}
+}
+
+func TestApplyFields(t *testing.T) {
+	values, _ := url.ParseQuery("fields=name&sort=name")
+	q, err := Parse(values, testOptions)
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+
+	results := q.Apply(testDocuments())
+	if len(results[0]) != 2 || results[0]["id"] != "2" || results[0]["name"] != "Ada" {
+		t.Errorf("Expected only id and name, got %v", results[0])
+	}
+}
+
+func TestApplyTimes(t *testing.T) {
+	q := Query{Sort: []Sort{{Field: CreatedAt}}}
+	later := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	earlier := later.Add(-time.Hour)
+
+	results := q.Apply([]Document{
+		{Fields: map[string]interface{}{"id": "1", "createdAt": later}, CreateRevision: 1},
+		{Fields: map[string]interface{}{"id": "2", "createdAt": earlier}, CreateRevision: 2},
+		{Fields: map[string]interface{}{"id": "3"}, CreateRevision: 3},
+	})
+
+	// Documents without a creation time come first
+	if got := fmt.Sprint(ids(results)); got != "[3 2 1]" {
+		t.Errorf("Expected [3 2 1], got %s", got)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		query     string
+		parameter string
+	}{
+		{"nme=Ada", "nme"},
+		{"name[like]=Ada", "name[like]"},
+		{"sort=email", "sort"},
+		{"fields=age", "fields"},
+	}
+
+	for _, tt := range tests {
+		values, _ := url.ParseQuery(tt.query)
+		_, err := Parse(values, testOptions)
+
+		var queryErr *Error
+		if !errors.As(err, &queryErr) || queryErr.Parameter != tt.parameter {
+			t.Errorf("%q: expected error for %s, got %v", tt.query, tt.parameter, err)
+		}
+	}
+}
+
+func TestDocuments(t *testing.T) {
+	records := []db.Record{
+		{Key: "a", Value: []byte(`{"name":"Ada"}`), CreateRevision: 3},
+		{Key: "b", Value: []byte(`not json`), CreateRevision: 4},
+	}
+
+	documents := Documents(records, func(record db.Record) (map[string]interface{}, error) {
+		if record.Key == "b" {
+			return nil, errors.New("malformed")
+		}
+		return map[string]interface{}{"id": record.Key}, nil
+	})
+
+	if len(documents) != 1 || documents[0].Fields["id"] != "a" || documents[0].CreateRevision != 3 {
+		t.Errorf("Expected only document a, got %+v", documents)
+	}
+}
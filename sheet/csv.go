@@ -0,0 +1,108 @@
+package sheet
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// utf8BOM starts CSV files so that spreadsheet applications read them as
+// UTF-8 rather than in the local encoding
+const utf8BOM = "\ufeff"
+
+type csvWriter struct {
+	w      io.Writer
+	csv    *csv.Writer
+	header bool
+}
+
+func newCSVWriter(w io.Writer) *csvWriter {
+	return &csvWriter{w: w, csv: csv.NewWriter(w)}
+}
+
+func (w *csvWriter) Write(row []string) error {
+	if !w.header {
+		if _, err := io.WriteString(w.w, utf8BOM); err != nil {
+			return err
+		}
+		w.header = true
+	}
+
+	// Spreadsheet applications evaluate cells starting like a formula, which
+	// must not happen to values users control
+	escaped := make([]string, len(row))
+	for i, value := range row {
+		if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+			value = "'" + value
+		}
+		escaped[i] = value
+	}
+
+	if err := w.csv.Write(escaped); err != nil {
+		return err
+	}
+	// Flush every row so that rows reach the client as they are written
+	w.csv.Flush()
+	return w.csv.Error()
+}
+
+func (w *csvWriter) Close() error {
+	if !w.header {
+		if _, err := io.WriteString(w.w, utf8BOM); err != nil {
+			return err
+		}
+	}
+	w.csv.Flush()
+	return w.csv.Error()
+}
+
+func readCSV(data []byte, l *limiter) ([][]string, error) {
+	r := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(data, []byte(utf8BOM))))
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+
+	var rows [][]string
+	lastLine := 0
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+		}
+		// The reader skips empty lines, which spreadsheets count as rows
+		line, _ := r.FieldPos(0)
+		for i := lastLine + 1; i < line; i++ {
+			rows = append(rows, nil)
+		}
+		lastLine = line
+
+		for i, value := range row {
+			lastLine += strings.Count(value, "\n")
+			row[i] = unescapeFormula(value)
+		}
+		last := len(row) - 1
+		for last > 0 && row[last] == "" {
+			last--
+		}
+		if err := l.column(last); err != nil {
+			return nil, err
+		}
+		if err := l.row(row); err != nil {
+			return nil, err
+		}
+		rows = append(rows, row)
+	}
+}
+
+// unescapeFormula removes the quote added by the CSV writer in front of
+// values that look like formulas
+func unescapeFormula(value string) string {
+	if len(value) > 1 && value[0] == '\'' && strings.ContainsRune("=+-@\t\r", rune(value[1])) {
+		return value[1:]
+	}
+	return value
+}
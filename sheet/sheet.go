@@ -0,0 +1,166 @@
+// Package sheet reads and writes tables of strings as CSV or as XLSX
+// workbooks, enough for spreadsheet imports and exports without depending on
+// a full spreadsheet library. Only the first worksheet of a workbook is read,
+// and cells are read as the text they hold: formulas as their cached value,
+// numbers and dates as stored.
+package sheet
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+)
+
+// Format is a file format handled by the package
+type Format string
+
+const (
+	CSV  Format = "csv"
+	XLSX Format = "xlsx"
+)
+
+// ErrUnknownFormat is returned for formats other than CSV and XLSX
+var ErrUnknownFormat = errors.New("unknown spreadsheet format")
+
+// ErrInvalid is returned for files that cannot be read in their format
+var ErrInvalid = errors.New("invalid spreadsheet")
+
+// ErrTooManyRows and ErrTooManyColumns are returned by ReadLimited for files
+// exceeding its limits
+var (
+	ErrTooManyRows    = errors.New("too many rows")
+	ErrTooManyColumns = errors.New("too many columns")
+)
+
+// Limits bound the tables read by ReadLimited, which stops reading as soon
+// as a file exceeds them, so that a small file cannot take much memory. The
+// header is the first non-empty row. Rows bounds the non-empty rows below
+// it, and Columns its cells, in which case the cells of the other rows must
+// also be within the columns of the header. Zero leaves a bound off.
+type Limits struct {
+	Rows    int
+	Columns int
+}
+
+// ParseFormat returns the format named name, a file extension with or
+// without its dot, ignoring case
+func ParseFormat(name string) (Format, error) {
+	switch Format(strings.ToLower(strings.TrimPrefix(name, "."))) {
+	case CSV:
+		return CSV, nil
+	case XLSX:
+		return XLSX, nil
+	}
+	return "", ErrUnknownFormat
+}
+
+// FormatOf returns the format of a Content-Type header value
+func FormatOf(contentType string) (Format, error) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", ErrUnknownFormat
+	}
+	for format, t := range contentTypes {
+		if mediaType == t {
+			return format, nil
+		}
+	}
+	if mediaType == "application/csv" {
+		return CSV, nil
+	}
+	return "", ErrUnknownFormat
+}
+
+var contentTypes = map[Format]string{
+	CSV:  "text/csv",
+	XLSX: "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+}
+
+// ContentType returns the media type of files in format f
+func (f Format) ContentType() string {
+	if f == CSV {
+		return contentTypes[CSV] + "; charset=utf-8"
+	}
+	return contentTypes[f]
+}
+
+// Writer writes rows one at a time, so that large tables can be streamed.
+// Close must be called once all rows are written to complete the file.
+type Writer interface {
+	Write(row []string) error
+	Close() error
+}
+
+// NewWriter returns a writer of rows to w in format f
+func NewWriter(w io.Writer, f Format) (Writer, error) {
+	switch f {
+	case CSV:
+		return newCSVWriter(w), nil
+	case XLSX:
+		return newXLSXWriter(w), nil
+	}
+	return nil, ErrUnknownFormat
+}
+
+// ReadAll reads the rows of data, a file in format f. Rows are returned at
+// their position in the file, so that a row's index plus one is its row
+// number, with empty rows as nil.
+func ReadAll(data []byte, f Format) ([][]string, error) {
+	return ReadLimited(data, f, Limits{})
+}
+
+// ReadLimited is ReadAll for files that must fit within limits
+func ReadLimited(data []byte, f Format, limits Limits) ([][]string, error) {
+	l := &limiter{Limits: limits, width: -1}
+	switch f {
+	case CSV:
+		return readCSV(data, l)
+	case XLSX:
+		return readXLSX(data, l)
+	}
+	return nil, ErrUnknownFormat
+}
+
+// limiter checks the rows of a file against Limits as they are read
+type limiter struct {
+	Limits
+	width int // Of the header, -1 until read
+	rows  int // Non-empty rows below the header
+}
+
+// column checks that a row can have a cell at the zero-based column i,
+// before it is added
+func (l *limiter) column(i int) error {
+	switch {
+	case l.Columns <= 0:
+	case l.width < 0 && i >= l.Columns:
+		return fmt.Errorf("%w: the header has more than %d columns", ErrTooManyColumns, l.Columns)
+	case l.width >= 0 && i >= l.width:
+		return fmt.Errorf("%w: column %d is beyond the %d of the header", ErrTooManyColumns, i+1, l.width)
+	}
+	return nil
+}
+
+// row counts a row once read
+func (l *limiter) row(row []string) error {
+	empty := true
+	for _, cell := range row {
+		if strings.TrimSpace(cell) != "" {
+			empty = false
+			break
+		}
+	}
+	switch {
+	case empty:
+	case l.width < 0:
+		l.width = len(row)
+	default:
+		l.rows++
+		if l.Rows > 0 && l.rows > l.Rows {
+			return fmt.Errorf("%w: more than %d below the header", ErrTooManyRows, l.Rows)
+		}
+	}
+	return nil
+}
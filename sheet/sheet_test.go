@@ -0,0 +1,143 @@
+package sheet
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	rows := [][]string{
+		{"id", "name", "email"},
+		{"user:1", "Ada <Lovelace> & co", "ada@example.com"},
+		{"user:2", "=1+1", "line\nbreak"},
+		{"user:3", "", "  spaced  "},
+	}
+
+	for _, format := range []Format{CSV, XLSX} {
+		var buf bytes.Buffer
+		w, err := NewWriter(&buf, format)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		for _, row := range rows {
+			if err := w.Write(row); err != nil {
+				t.Fatalf("%s: failed to write row: %v", format, err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("%s: failed to close: %v", format, err)
+		}
+
+		read, err := ReadAll(buf.Bytes(), format)
+		if err != nil {
+			t.Fatalf("%s: failed to read: %v", format, err)
+		}
+		if !reflect.DeepEqual(read, rows) {
+			t.Errorf("%s: expected %q, got %q", format, rows, read)
+		}
+	}
+}
+
+func TestCSVFormulas(t *testing.T) {
+	var buf bytes.Buffer
+	w, _ := NewWriter(&buf, CSV)
+	w.Write([]string{"=HYPERLINK(\"http://evil\")", "@SUM(A1)", "plain"})
+	w.Close()
+
+	if !strings.HasPrefix(buf.String(), "\ufeff") {
+		t.Error("Expected CSV to start with a byte order mark")
+	}
+	if !strings.Contains(buf.String(), `"'=HYPERLINK(""http://evil"")",'@SUM(A1),plain`) {
+		t.Errorf("Expected formulas to be escaped, got %q", buf.String())
+	}
+}
+
+func TestReadCSVRowNumbers(t *testing.T) {
+	rows, err := ReadAll([]byte("name,email\n\nAda,ada@example.com\n"), CSV)
+	if err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	if len(rows) != 3 || rows[1] != nil || rows[2][0] != "Ada" {
+		t.Errorf("Expected rows at their line, got %q", rows)
+	}
+}
+
+func TestReadLimited(t *testing.T) {
+	limits := Limits{Rows: 2, Columns: 3}
+	tests := []struct {
+		name string
+		data string
+		err  error
+	}{
+		{"within", "\nname,email\nAda,ada@example.com\n\nAlan,alan@example.com,,\n", nil},
+		{"too many rows", "name,email\nAda,ada@example.com\nAlan,alan@example.com\nGrace,grace@example.com\n", ErrTooManyRows},
+		{"wide header", "name,email,role,notes\n", ErrTooManyColumns},
+		{"beyond the header", "name,email\nAda,ada@example.com,admin\n", ErrTooManyColumns},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ReadLimited([]byte(tt.data), CSV, limits); !errors.Is(err, tt.err) {
+				t.Errorf("Expected %v, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestReadXLSX(t *testing.T) {
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	files := map[string]string{
+		"xl/workbook.xml": `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+			`<sheets><sheet name="Users" sheetId="1" r:id="rId7"/></sheets></workbook>`,
+		"xl/_rels/workbook.xml.rels": `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId7" Target="/xl/worksheets/users.xml"/></Relationships>`,
+		"xl/sharedStrings.xml": `<sst xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+			`<si><t>name</t></si><si><t>email</t></si><si><r><t>Ada </t></r><r><t>Lovelace</t></r></si></sst>`,
+		"xl/worksheets/users.xml": `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>` +
+			`<row r="1"><c r="A1" t="s"><v>0</v></c><c r="C1" t="s"><v>1</v></c></row>` +
+			`<row r="3"><c r="A3" t="s"><v>2</v></c><c r="B3"><v>42</v></c><c r="C3" t="str"><v>ada@example.com</v></c><c r="D3" t="b"><v>1</v></c></row>` +
+			`</sheetData></worksheet>`,
+	}
+	for name, content := range files {
+		f, _ := archive.Create(name)
+		f.Write([]byte(content))
+	}
+	archive.Close()
+
+	rows, err := ReadAll(buf.Bytes(), XLSX)
+	if err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	expected := [][]string{
+		{"name", "", "email"},
+		nil,
+		{"Ada Lovelace", "42", "ada@example.com", "TRUE"},
+	}
+	if !reflect.DeepEqual(rows, expected) {
+		t.Errorf("Expected %q, got %q", expected, rows)
+	}
+
+	if _, err := ReadAll([]byte("not a zip"), XLSX); !errors.Is(err, ErrInvalid) {
+		t.Errorf("Expected ErrInvalid, got %v", err)
+	}
+}
+
+func TestFormats(t *testing.T) {
+	if f, err := ParseFormat(".XLSX"); err != nil || f != XLSX {
+		t.Errorf("Expected XLSX, got %q (%v)", f, err)
+	}
+	if _, err := ParseFormat("ods"); err != ErrUnknownFormat {
+		t.Errorf("Expected ErrUnknownFormat, got %v", err)
+	}
+	if f, err := FormatOf("text/csv; charset=utf-8"); err != nil || f != CSV {
+		t.Errorf("Expected CSV, got %q (%v)", f, err)
+	}
+	if f, err := FormatOf(XLSX.ContentType()); err != nil || f != XLSX {
+		t.Errorf("Expected XLSX, got %q (%v)", f, err)
+	}
+}
@@ -0,0 +1,318 @@
+package sheet
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// The parts of a workbook with a single worksheet, besides the worksheet
+var xlsxParts = []struct{ name, content string }{
+	{"[Content_Types].xml", xml.Header + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+		`<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>` +
+		`</Types>`},
+	{"_rels/.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+		`</Relationships>`},
+	{"xl/workbook.xml", xml.Header + `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+		`<sheets><sheet name="Sheet1" sheetId="1" r:id="rId1"/></sheets>` +
+		`</workbook>`},
+	{"xl/_rels/workbook.xml.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+		`<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>` +
+		`</Relationships>`},
+	{"xl/styles.xml", xml.Header + `<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+		`<fonts count="1"><font/></fonts><fills count="1"><fill/></fills><borders count="1"><border/></borders>` +
+		`<cellStyleXfs count="1"><xf/></cellStyleXfs><cellXfs count="1"><xf/></cellXfs>` +
+		`</styleSheet>`},
+}
+
+// xlsxWriter streams rows into the worksheet of a workbook, as inline
+// strings so that no shared string table has to be kept in memory
+type xlsxWriter struct {
+	w     io.Writer
+	zip   *zip.Writer
+	sheet *bufio.Writer
+	err   error
+}
+
+func newXLSXWriter(w io.Writer) *xlsxWriter {
+	return &xlsxWriter{w: w}
+}
+
+// start writes the parts preceding the rows
+func (w *xlsxWriter) start() error {
+	if w.zip != nil || w.err != nil {
+		return w.err
+	}
+
+	w.zip = zip.NewWriter(w.w)
+	for _, part := range xlsxParts {
+		f, err := w.zip.Create(part.name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(f, part.content); err != nil {
+			return err
+		}
+	}
+
+	f, err := w.zip.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return err
+	}
+	w.sheet = bufio.NewWriter(f)
+	_, err = w.sheet.WriteString(xml.Header + `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	return err
+}
+
+func (w *xlsxWriter) Write(row []string) error {
+	if err := w.start(); err != nil {
+		w.err = err
+		return err
+	}
+
+	w.sheet.WriteString("<row>")
+	for _, value := range row {
+		w.sheet.WriteString(`<c t="inlineStr"><is><t xml:space="preserve">`)
+		xml.EscapeText(w.sheet, []byte(value))
+		w.sheet.WriteString("</t></is></c>")
+	}
+	if _, err := w.sheet.WriteString("</row>"); err != nil {
+		w.err = err
+		return err
+	}
+	return nil
+}
+
+func (w *xlsxWriter) Close() error {
+	if err := w.start(); err != nil {
+		return err
+	}
+	w.sheet.WriteString("</sheetData></worksheet>")
+	if err := w.sheet.Flush(); err != nil {
+		return err
+	}
+	return w.zip.Close()
+}
+
+// maxXLSXPart bounds the uncompressed size of a part read from a workbook,
+// so that a small file cannot expand without limit
+const maxXLSXPart = 64 << 20
+
+// The last column, XFD, and row of a worksheet
+const (
+	maxXLSXColumn = 16384
+	maxXLSXRow    = 1048576
+)
+
+func readXLSX(data []byte, l *limiter) ([][]string, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+
+	parts := make(map[string]*zip.File)
+	for _, f := range archive.File {
+		parts[strings.TrimPrefix(f.Name, "/")] = f
+	}
+
+	sheetPath, err := firstSheet(parts)
+	if err != nil {
+		return nil, err
+	}
+
+	var shared []string
+	if f, ok := parts["xl/sharedStrings.xml"]; ok {
+		var sst struct {
+			Items []richText `xml:"si"`
+		}
+		if err := decodePart(f, &sst); err != nil {
+			return nil, err
+		}
+		for _, item := range sst.Items {
+			shared = append(shared, item.String())
+		}
+	}
+
+	f, ok := parts[sheetPath]
+	if !ok {
+		return nil, fmt.Errorf("%w: missing worksheet %s", ErrInvalid, sheetPath)
+	}
+	var worksheet struct {
+		Rows []struct {
+			Number int `xml:"r,attr"`
+			Cells  []struct {
+				Ref    string   `xml:"r,attr"`
+				Type   string   `xml:"t,attr"`
+				Value  string   `xml:"v"`
+				Inline richText `xml:"is"`
+			} `xml:"c"`
+		} `xml:"sheetData>row"`
+	}
+	if err := decodePart(f, &worksheet); err != nil {
+		return nil, err
+	}
+
+	var rows [][]string
+	for _, r := range worksheet.Rows {
+		number := r.Number
+		if number <= 0 {
+			number = len(rows) + 1
+		}
+		if number < len(rows)+1 || number > maxXLSXRow {
+			return nil, fmt.Errorf("%w: row %d out of order", ErrInvalid, number)
+		}
+		var row []string
+		next := 0
+		for _, c := range r.Cells {
+			column := next
+			if c.Ref != "" {
+				if column, err = columnIndex(c.Ref); err != nil {
+					return nil, err
+				}
+			}
+			next = column + 1
+
+			var value string
+			switch c.Type {
+			case "s":
+				i, err := strconv.Atoi(c.Value)
+				if err != nil || i < 0 || i >= len(shared) {
+					return nil, fmt.Errorf("%w: shared string %q in %s", ErrInvalid, c.Value, c.Ref)
+				}
+				value = shared[i]
+			case "inlineStr":
+				value = c.Inline.String()
+			case "b":
+				value = map[string]string{"0": "FALSE", "1": "TRUE"}[c.Value]
+			default:
+				value = c.Value
+			}
+			if value == "" {
+				continue // Rows are only as long as their last value
+			}
+
+			if err := l.column(column); err != nil {
+				return nil, err
+			}
+			for len(row) <= column {
+				row = append(row, "")
+			}
+			row[column] = value
+		}
+		if err := l.row(row); err != nil {
+			return nil, err
+		}
+		for len(rows) < number-1 {
+			rows = append(rows, nil)
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// firstSheet returns the path of the first worksheet of a workbook
+func firstSheet(parts map[string]*zip.File) (string, error) {
+	const fallback = "xl/worksheets/sheet1.xml"
+
+	workbookFile, ok := parts["xl/workbook.xml"]
+	if !ok {
+		return "", fmt.Errorf("%w: not a workbook", ErrInvalid)
+	}
+	var workbook struct {
+		Sheets []struct {
+			ID string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+		} `xml:"sheets>sheet"`
+	}
+	if err := decodePart(workbookFile, &workbook); err != nil {
+		return "", err
+	}
+
+	relsFile, ok := parts["xl/_rels/workbook.xml.rels"]
+	if !ok || len(workbook.Sheets) == 0 {
+		return fallback, nil
+	}
+	var rels struct {
+		Relationships []struct {
+			ID     string `xml:"Id,attr"`
+			Target string `xml:"Target,attr"`
+		} `xml:"Relationship"`
+	}
+	if err := decodePart(relsFile, &rels); err != nil {
+		return "", err
+	}
+
+	for _, rel := range rels.Relationships {
+		if rel.ID != workbook.Sheets[0].ID {
+			continue
+		}
+		// Targets are relative to xl/ unless absolute
+		if strings.HasPrefix(rel.Target, "/") {
+			return strings.TrimPrefix(rel.Target, "/"), nil
+		}
+		return path.Join("xl", rel.Target), nil
+	}
+	return fallback, nil
+}
+
+func decodePart(f *zip.File, v interface{}) error {
+	r, err := f.Open()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	defer r.Close()
+
+	if err := xml.NewDecoder(io.LimitReader(r, maxXLSXPart)).Decode(v); err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrInvalid, f.Name, err)
+	}
+	return nil
+}
+
+// richText is a string of a workbook, either plain or made of formatted runs
+type richText struct {
+	Text string `xml:"t"`
+	Runs []struct {
+		Text string `xml:"t"`
+	} `xml:"r"`
+}
+
+func (t richText) String() string {
+	if len(t.Runs) == 0 {
+		return t.Text
+	}
+	var b strings.Builder
+	b.WriteString(t.Text)
+	for _, run := range t.Runs {
+		b.WriteString(run.Text)
+	}
+	return b.String()
+}
+
+// columnIndex returns the zero-based column of a cell reference such as B7
+func columnIndex(ref string) (int, error) {
+	column := 0
+	for _, c := range ref {
+		if c < 'A' || c > 'Z' {
+			break
+		}
+		column = column*26 + int(c-'A'+1)
+		if column > maxXLSXColumn {
+			break
+		}
+	}
+	if column == 0 || column > maxXLSXColumn {
+		return 0, fmt.Errorf("%w: cell reference %q", ErrInvalid, ref)
+	}
+	return column - 1, nil
+}
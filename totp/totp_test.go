@@ -0,0 +1,79 @@
+//go:build !js
+
+package totp
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+// RFC 6238 appendix B test secret for SHA1
+var rfcSecret = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+
+func TestCodeRFCVectors(t *testing.T) {
+	vectors := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+
+	for _, v := range vectors {
+		code, err := Code(rfcSecret, Counter(time.Unix(v.unix, 0)))
+		if err != nil {
+			t.Fatalf("Code returned error: %v", err)
+		}
+		if code != v.code {
+			t.Errorf("At %d: expected %s, got %s", v.unix, v.code, code)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+
+	now := time.Now()
+	code, _ := Code(secret, Counter(now))
+
+	counter, ok := Validate(secret, code, now)
+	if !ok {
+		t.Fatal("Expected current code to validate")
+	}
+	if counter != Counter(now) {
+		t.Errorf("Expected counter %d, got %d", Counter(now), counter)
+	}
+
+	if _, ok := Validate(secret, code, now.Add(Period)); !ok {
+		t.Error("Expected code from previous period to validate within skew")
+	}
+
+	if _, ok := Validate(secret, code, now.Add(5*Period)); ok {
+		t.Error("Expected old code to be rejected")
+	}
+
+	if _, ok := Validate(secret, "12345", now); ok {
+		t.Error("Expected code with wrong length to be rejected")
+	}
+}
+
+func TestProvisioningURI(t *testing.T) {
+	uri := ProvisioningURI("Go PWA", "john@example.com", "JBSWY3DPEHPK3PXP")
+
+	if !strings.HasPrefix(uri, "otpauth://totp/Go%20PWA:john@example.com?") {
+		t.Errorf("Unexpected URI label: %s", uri)
+	}
+	for _, want := range []string{"secret=JBSWY3DPEHPK3PXP", "issuer=Go+PWA", "digits=6", "period=30"} {
+		if !strings.Contains(uri, want) {
+			t.Errorf("Expected URI to contain %q, got %s", want, uri)
+		}
+	}
+}
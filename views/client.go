@@ -0,0 +1,10 @@
+package views
+
+import (
+	"assette/apiclient"
+	"assette/codec"
+)
+
+// client calls the API of the server the app was loaded from. Bodies are
+// MessagePack, which is smaller to transfer than JSON.
+var client = &apiclient.Client{MediaType: codec.MessagePack}
@@ -2,8 +2,6 @@ package views
 
 import (
 	"assette/widgets"
-	"encoding/json"
-	"net/http"
 
 	"github.com/maxence-charriere/go-app/v10/pkg/app"
 )
@@ -25,23 +23,14 @@ func (h *Home) Render() app.UI {
 
 func (h *Home) OnMount(ctx app.Context) {
 	ctx.Async(func() {
-		resp, err := http.Get("/api/message")
+		message, err := client.Message(ctx)
 		if err != nil {
 			app.Log(err)
 			return
 		}
-		defer resp.Body.Close()
-
-		var data struct {
-			Text string `json:"text"`
-		}
-		if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
-			app.Log(err)
-			return
-		}
 
 		ctx.Dispatch(func(ctx app.Context) {
-			h.message = data.Text
+			h.message = message
 		})
 	})
 }
@@ -0,0 +1,142 @@
+package views
+
+import (
+	"assette/apiclient"
+	"assette/widgets"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/maxence-charriere/go-app/v10/pkg/app"
+)
+
+// ImportUsers uploads a CSV file or XLSX workbook of users to the import
+// API, optionally as a dry run, and lists the rows that failed with a link to
+// download them for fixing
+type ImportUsers struct {
+	app.Compo
+	file     app.Value
+	fileName string
+	dryRun   bool
+	busy     bool
+
+	result *apiclient.ImportResults
+	status string
+}
+
+func (p *ImportUsers) Render() app.UI {
+	return app.Section().Body(
+		&widgets.Header{},
+		app.H1().Text("Import users"),
+		app.P().Body(
+			app.Text("Upload a CSV file or an Excel workbook with name and email columns, and an id column to update existing users. "),
+			app.A().Href("/api/v1/users/export?format=xlsx").Text("Export the current users"),
+			app.Text(" to start from them."),
+		),
+		app.Form().OnSubmit(p.handleSubmit).Body(
+			app.Input().
+				Type("file").
+				Accept(".csv,.xlsx,text/csv,application/vnd.openxmlformats-officedocument.spreadsheetml.sheet").
+				OnChange(p.handleFile),
+			app.Label().Body(
+				app.Input().
+					Type("checkbox").
+					Checked(p.dryRun).
+					OnChange(p.handleDryRun),
+				app.Text(" Only check the file, without importing it"),
+			),
+			app.Button().
+				Type("submit").
+				Disabled(p.busy).
+				Text("Import"),
+		),
+		app.P().Text(p.status),
+		app.If(p.result != nil, p.renderResult),
+	)
+}
+
+func (p *ImportUsers) renderResult() app.UI {
+	r := p.result
+	summary := fmt.Sprintf("%d rows: %d created, %d updated, %d failed.", r.Rows, r.Created, r.Updated, r.Failed)
+	if r.DryRun {
+		summary = fmt.Sprintf("%d rows checked: %d would be created, %d updated, %d would fail.", r.Rows, r.Created, r.Updated, r.Failed)
+	}
+
+	return app.Div().Body(
+		app.P().Text(summary),
+		app.If(r.Report != "", func() app.UI {
+			return app.P().Body(
+				app.Text("Download the failed rows to fix them: "),
+				app.A().Href(r.Report+"?format=csv").Text("CSV"),
+				app.Text(" "),
+				app.A().Href(r.Report+"?format=xlsx").Text("Excel"),
+			)
+		}),
+		app.Ul().Body(
+			app.Range(r.Errors).Slice(func(i int) app.UI {
+				e := r.Errors[i]
+				message := e.Detail
+				if len(e.Errors) > 0 {
+					var fields []string
+					for _, f := range e.Errors {
+						fields = append(fields, f.Field+": "+f.Message)
+					}
+					message = strings.Join(fields, "; ")
+				}
+				return app.Li().Text(fmt.Sprintf("Row %d: %s", e.Row, message))
+			}),
+		),
+	)
+}
+
+func (p *ImportUsers) handleFile(ctx app.Context, e app.Event) {
+	files := ctx.JSSrc().Get("files")
+	if files.Get("length").Int() == 0 {
+		p.file, p.fileName = nil, ""
+		return
+	}
+	p.file = files.Index(0)
+	p.fileName = p.file.Get("name").String()
+}
+
+func (p *ImportUsers) handleDryRun(ctx app.Context, e app.Event) {
+	p.dryRun = ctx.JSSrc().Get("checked").Bool()
+}
+
+func (p *ImportUsers) handleSubmit(ctx app.Context, e app.Event) {
+	e.PreventDefault()
+
+	if p.file == nil {
+		p.status = "Choose a file to import."
+		return
+	}
+
+	format := strings.TrimPrefix(strings.ToLower(path.Ext(p.fileName)), ".")
+	if format != "csv" && format != "xlsx" {
+		p.status = "Only .csv and .xlsx files can be imported."
+		return
+	}
+
+	p.busy, p.status, p.result = true, "Importing…", nil
+	dryRun := p.dryRun
+	p.file.Call("arrayBuffer").Then(func(buffer app.Value) {
+		array := app.Window().Get("Uint8Array").New(buffer)
+		data := make([]byte, array.Get("length").Int())
+		app.CopyBytesToGo(data, array)
+
+		ctx.Async(func() {
+			options := apiclient.ImportOptions{Format: format, DryRun: dryRun}
+			result, err := client.ImportUsers(ctx, data, options, apiclient.IdempotencyKey(newIdempotencyKey()))
+
+			ctx.Dispatch(func(ctx app.Context) {
+				p.busy = false
+				if err != nil {
+					app.Log(err)
+					p.status = "Could not import the file: " + err.Error()
+					return
+				}
+				p.status, p.result = "", result
+			})
+		})
+	})
+}
@@ -0,0 +1,25 @@
+package views
+
+import (
+	"assette/apiclient"
+	"testing"
+
+	"github.com/maxence-charriere/go-app/v10/pkg/app"
+)
+
+func TestImportUsersRender(t *testing.T) {
+	page := &ImportUsers{}
+
+	ui := page.Render()
+	if _, ok := ui.(app.HTMLSection); !ok {
+		t.Error("ImportUsers.Render() should return app.HTMLSection")
+	}
+}
+
+func TestImportUsersRenderResult(t *testing.T) {
+	page := &ImportUsers{result: &apiclient.ImportResults{Rows: 2, Created: 1, Failed: 1, Report: "/api/v1/users/import/reports/r"}}
+	page.result.Errors = []apiclient.ImportFailure{{Row: 3, Detail: "Email is already in use"}}
+	if _, ok := page.Render().(app.HTMLSection); !ok {
+		t.Error("ImportUsers.Render() should return app.HTMLSection")
+	}
+}
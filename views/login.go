@@ -0,0 +1,111 @@
+package views
+
+import (
+	"assette/apiclient"
+	"assette/widgets"
+
+	"github.com/maxence-charriere/go-app/v10/pkg/app"
+)
+
+// Login signs a user in with email and password, then asks for a one-time
+// password or recovery code when two-factor authentication is enabled
+type Login struct {
+	app.Compo
+	email    string
+	password string
+	mfaToken string
+	code     string
+	status   string
+}
+
+func (l *Login) Render() app.UI {
+	if l.mfaToken != "" {
+		return app.Section().Body(
+			&widgets.Header{},
+			app.H1().Text("Two-factor authentication"),
+			app.Form().OnSubmit(l.handleCode).Body(
+				app.Input().
+					Type("text").
+					Value(l.code).
+					Placeholder("Code or recovery code").
+					AutoComplete(false).
+					OnInput(l.ValueTo(&l.code)),
+				app.Button().
+					Type("submit").
+					Text("Verify"),
+			),
+			app.P().Text(l.status),
+		)
+	}
+
+	return app.Section().Body(
+		&widgets.Header{},
+		app.H1().Text("Login"),
+		app.Form().OnSubmit(l.handleLogin).Body(
+			app.Input().
+				Type("email").
+				Value(l.email).
+				Placeholder("Email").
+				OnInput(l.ValueTo(&l.email)),
+			app.Input().
+				Type("password").
+				Value(l.password).
+				Placeholder("Password").
+				OnInput(l.ValueTo(&l.password)),
+			app.Button().
+				Type("submit").
+				Text("Login"),
+		),
+		app.A().Href("/reset").Text("Forgot password?"),
+		app.P().Text(l.status),
+	)
+}
+
+func (l *Login) handleLogin(ctx app.Context, e app.Event) {
+	e.PreventDefault()
+
+	email, password := l.email, l.password
+	ctx.Async(func() {
+		result, err := client.Login(ctx, email, password)
+
+		ctx.Dispatch(func(ctx app.Context) {
+			l.password = ""
+			l.complete(ctx, result, err)
+		})
+	})
+}
+
+func (l *Login) handleCode(ctx app.Context, e app.Event) {
+	e.PreventDefault()
+
+	mfaToken, code := l.mfaToken, l.code
+	ctx.Async(func() {
+		var result *apiclient.LoginResult
+		session, err := client.LoginTOTP(ctx, mfaToken, code)
+		if err == nil {
+			result = &apiclient.LoginResult{Session: *session}
+		}
+
+		ctx.Dispatch(func(ctx app.Context) {
+			l.code = ""
+			l.complete(ctx, result, err)
+		})
+	})
+}
+
+func (l *Login) complete(ctx app.Context, result *apiclient.LoginResult, err error) {
+	switch {
+	case err != nil:
+		l.status = err.Error()
+
+	case result.MFARequired:
+		l.mfaToken = result.MFAToken
+		l.status = "Enter the code from your authenticator app."
+
+	case result.MFAEnrollmentRequired:
+		ctx.Navigate("/2fa")
+
+	default:
+		ctx.Navigate("/")
+	}
+}
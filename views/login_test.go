@@ -0,0 +1,31 @@
+package views
+
+import (
+	"testing"
+
+	"github.com/maxence-charriere/go-app/v10/pkg/app"
+)
+
+func TestLoginRender(t *testing.T) {
+	page := &Login{email: "john@example.com"}
+
+	if _, ok := page.Render().(app.HTMLSection); !ok {
+		t.Error("Login.Render() should return app.HTMLSection")
+	}
+}
+
+func TestLoginRenderSecondStep(t *testing.T) {
+	page := &Login{mfaToken: "pending-token"}
+
+	if _, ok := page.Render().(app.HTMLSection); !ok {
+		t.Error("Login.Render() should return app.HTMLSection on the second step")
+	}
+}
+
+func TestLoginInitialState(t *testing.T) {
+	page := &Login{}
+
+	if page.mfaToken != "" || page.password != "" {
+		t.Errorf("Expected empty initial state, got %+v", page)
+	}
+}
@@ -1,11 +1,14 @@
 package views
 
 import (
+	"assette/apiclient"
 	"assette/models"
 	"assette/widgets"
-	"bytes"
-	"encoding/json"
-	"net/http"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
 
 	"github.com/maxence-charriere/go-app/v10/pkg/app"
 )
@@ -13,6 +16,19 @@ import (
 type Profile struct {
 	app.Compo
 	user models.User
+
+	// The user as last saved, so that later saves only send what changed
+	userID string
+	saved  models.User
+
+	// Idempotency key of the user being created, kept until the creation
+	// succeeds so that submitting the same user again cannot create it twice
+	createKey  string
+	createUser models.User
+
+	// Validation messages by field, checked with the same rules as the API
+	fieldErrors map[string]string
+	status      string
 }
 
 func (p *Profile) Render() app.UI {
@@ -25,39 +41,132 @@ func (p *Profile) Render() app.UI {
 				Value(p.user.Name).
 				Placeholder("Name").
 				OnInput(p.ValueTo(&p.user.Name)),
+			p.fieldError("name"),
 			app.Input().
 				Type("email").
 				Value(p.user.Email).
 				Placeholder("Email").
 				OnInput(p.ValueTo(&p.user.Email)),
+			p.fieldError("email"),
 			app.Button().
 				Type("submit").
 				Text("Update Profile"),
 		),
+		app.P().Text(p.status),
 	)
 }
 
+// fieldError shows the validation message of a field, if any
+func (p *Profile) fieldError(field string) app.UI {
+	return app.If(p.fieldErrors[field] != "", func() app.UI {
+		return app.Span().Class("field-error").Text(p.fieldErrors[field])
+	})
+}
+
 func (p *Profile) handleSubmit(ctx app.Context, e app.Event) {
 	e.PreventDefault()
 
+	p.status = ""
+	p.fieldErrors = nil
+	if err := p.user.Validate(); err != nil {
+		p.fieldErrors = err.(models.ValidationErrors).ByField()
+		return
+	}
+
+	if p.userID == "" && (p.createKey == "" || p.createUser != p.user) {
+		p.createKey, p.createUser = newIdempotencyKey(), p.user
+	}
+
+	userID, saved, user, key := p.userID, p.saved, p.user, p.createKey
 	ctx.Async(func() {
-		var buf bytes.Buffer
-		if err := json.NewEncoder(&buf).Encode(p.user); err != nil {
-			app.Log(err)
-			return
+		var err error
+		if userID == "" {
+			userID, err = createProfile(ctx, user, key)
+		} else {
+			err = updateProfile(ctx, userID, saved, user)
 		}
 
-		// For demo, we'll create a new user
-		// In a real app, you'd track the user ID and use PUT for updates
-		resp, err := http.Post("/api/users", "application/json", &buf)
-		if err != nil {
-			app.Log(err)
-			return
-		}
-		defer resp.Body.Close()
+		ctx.Dispatch(func(ctx app.Context) {
+			var invalid models.ValidationErrors
+			if errors.As(err, &invalid) {
+				p.fieldErrors = invalid.ByField()
+				return
+			}
+			if err != nil {
+				app.Log(err)
+				p.status = "Could not save the profile: " + err.Error()
+				return
+			}
 
-		if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
-			app.Log("failed to save user profile")
-		}
+			p.userID, p.saved = userID, user
+			p.createKey = ""
+			if user.Email != saved.Email {
+				p.status = "Profile saved, check your inbox to verify your email address."
+			} else {
+				p.status = "Profile saved."
+			}
+		})
 	})
 }
+
+// createAttempts bounds how many times createProfile sends the request when
+// it gets no response
+const createAttempts = 3
+
+// createProfile creates the user and returns its ID. The request is retried
+// with the same idempotency key if the network fails, so that a user created
+// by a request whose response was lost is returned rather than created again.
+func createProfile(ctx context.Context, user models.User, key string) (string, error) {
+	var created *apiclient.User
+	for attempt := 1; ; attempt++ {
+		var err error
+		created, err = client.CreateUser(ctx, user, apiclient.IdempotencyKey(key))
+		if err == nil {
+			break
+		}
+		var problem *apiclient.Error
+		if errors.As(err, &problem) || attempt == createAttempts {
+			return "", err
+		}
+		time.Sleep(time.Duration(attempt) * 500 * time.Millisecond)
+	}
+
+	// Send the link confirming the email address
+	return created.ID, client.SendVerification(ctx, created.ID)
+}
+
+// updateProfile sends the fields that differ from the saved user as a merge
+// patch, leaving the others as they are on the server
+func updateProfile(ctx context.Context, userID string, saved models.User, user models.User) error {
+	changes := profileChanges(saved, user)
+	if len(changes) == 0 {
+		return nil
+	}
+
+	if _, err := client.PatchUser(ctx, userID, changes); err != nil {
+		return err
+	}
+	if _, ok := changes["email"]; ok {
+		return client.SendVerification(ctx, userID)
+	}
+	return nil
+}
+
+// profileChanges returns the merge patch turning saved into user
+func profileChanges(saved models.User, user models.User) map[string]interface{} {
+	changes := map[string]interface{}{}
+	if user.Name != saved.Name {
+		changes["name"] = user.Name
+	}
+	if user.Email != saved.Email {
+		changes["email"] = user.Email
+	}
+	return changes
+}
+
+// newIdempotencyKey returns a random key for the Idempotency-Key header
+func newIdempotencyKey() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -63,4 +63,29 @@ func TestProfileHandleSubmit(t *testing.T) {
 	
 	// The actual test would require mocking app.Context and app.Event
 	// which is complex without the browser environment
-}
\ No newline at end of file
+}
+func TestProfileFieldErrors(t *testing.T) {
+	profile := &Profile{
+		fieldErrors: map[string]string{"email": "Must be a valid email address"},
+	}
+
+	if profile.fieldError("email") == nil {
+		t.Error("Expected an inline error for email")
+	}
+	if profile.Render() == nil {
+		t.Error("Profile.Render() returned nil")
+	}
+}
+
+func TestProfileChanges(t *testing.T) {
+	saved := models.User{Name: "Ada", Email: "ada@example.com"}
+
+	changes := profileChanges(saved, models.User{Name: "Ada Lovelace", Email: "ada@example.com"})
+	if len(changes) != 1 || changes["name"] != "Ada Lovelace" {
+		t.Errorf("Expected only the name to be sent, got %v", changes)
+	}
+
+	if changes := profileChanges(saved, saved); len(changes) != 0 {
+		t.Errorf("Expected no changes, got %v", changes)
+	}
+}
@@ -0,0 +1,100 @@
+package views
+
+import (
+	"assette/models"
+	"assette/widgets"
+
+	"github.com/maxence-charriere/go-app/v10/pkg/app"
+)
+
+var _ app.Mounter = (*ResetPassword)(nil)
+
+// ResetPassword asks for an email address to send a reset link to, or for a
+// new password when opened from that link
+type ResetPassword struct {
+	app.Compo
+	token    string
+	email    string
+	password string
+	status   string
+}
+
+func (p *ResetPassword) Render() app.UI {
+	if p.token == "" {
+		return app.Section().Body(
+			&widgets.Header{},
+			app.H1().Text("Reset password"),
+			app.Form().OnSubmit(p.handleRequest).Body(
+				app.Input().
+					Type("email").
+					Value(p.email).
+					Placeholder("Email").
+					OnInput(p.ValueTo(&p.email)),
+				app.Button().
+					Type("submit").
+					Text("Send reset link"),
+			),
+			app.P().Text(p.status),
+		)
+	}
+
+	return app.Section().Body(
+		&widgets.Header{},
+		app.H1().Text("Reset password"),
+		app.Form().OnSubmit(p.handleReset).Body(
+			app.Input().
+				Type("password").
+				Value(p.password).
+				Placeholder("New password").
+				OnInput(p.ValueTo(&p.password)),
+			app.Button().
+				Type("submit").
+				Text("Set password"),
+		),
+		app.P().Text(p.status),
+	)
+}
+
+func (p *ResetPassword) OnMount(ctx app.Context) {
+	p.token = ctx.Page().URL().Query().Get("token")
+}
+
+func (p *ResetPassword) handleRequest(ctx app.Context, e app.Event) {
+	e.PreventDefault()
+
+	email := p.email
+	ctx.Async(func() {
+		status := "If an account uses this address, a reset link is on its way."
+		if err := client.RequestPasswordReset(ctx, email); err != nil {
+			app.Log(err)
+			status = "Could not send the reset link, please try again later."
+		}
+
+		ctx.Dispatch(func(ctx app.Context) {
+			p.status = status
+		})
+	})
+}
+
+func (p *ResetPassword) handleReset(ctx app.Context, e app.Event) {
+	e.PreventDefault()
+
+	if err := models.ValidatePassword(p.password); err != nil {
+		p.status = err.(models.ValidationErrors).ByField()["password"]
+		return
+	}
+
+	token, password := p.token, p.password
+	ctx.Async(func() {
+		status := "Your password has been changed."
+		if err := client.ResetPassword(ctx, token, password); err != nil {
+			app.Log(err)
+			status = "Could not change the password: " + err.Error()
+		}
+
+		ctx.Dispatch(func(ctx app.Context) {
+			p.status = status
+			p.password = ""
+		})
+	})
+}
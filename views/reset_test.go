@@ -0,0 +1,35 @@
+package views
+
+import (
+	"testing"
+
+	"github.com/maxence-charriere/go-app/v10/pkg/app"
+)
+
+func TestResetPasswordRenderRequestForm(t *testing.T) {
+	page := &ResetPassword{}
+
+	ui := page.Render()
+	if _, ok := ui.(app.HTMLSection); !ok {
+		t.Error("ResetPassword.Render() should return app.HTMLSection")
+	}
+}
+
+func TestResetPasswordRenderPasswordForm(t *testing.T) {
+	page := &ResetPassword{
+		token: "reset-token",
+	}
+
+	ui := page.Render()
+	if _, ok := ui.(app.HTMLSection); !ok {
+		t.Error("ResetPassword.Render() should return app.HTMLSection")
+	}
+}
+
+func TestResetPasswordInitialState(t *testing.T) {
+	page := &ResetPassword{}
+
+	if page.token != "" || page.password != "" || page.status != "" {
+		t.Errorf("Expected empty initial state, got %+v", page)
+	}
+}
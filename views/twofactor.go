@@ -0,0 +1,101 @@
+package views
+
+import (
+	"assette/widgets"
+
+	"github.com/maxence-charriere/go-app/v10/pkg/app"
+)
+
+// TwoFactor enrolls the current user in two-factor authentication: it shows
+// a QR code for an authenticator app, confirms a first code and then lists
+// the recovery codes once
+type TwoFactor struct {
+	app.Compo
+	secret        string
+	qrCode        string
+	code          string
+	recoveryCodes []string
+	status        string
+}
+
+func (f *TwoFactor) Render() app.UI {
+	switch {
+	case len(f.recoveryCodes) > 0:
+		return app.Section().Body(
+			&widgets.Header{},
+			app.H1().Text("Two-factor authentication enabled"),
+			app.P().Text("Store these recovery codes somewhere safe. Each can be used once if you lose your authenticator."),
+			app.Ul().Body(
+				app.Range(f.recoveryCodes).Slice(func(i int) app.UI {
+					return app.Li().Body(app.Code().Text(f.recoveryCodes[i]))
+				}),
+			),
+		)
+
+	case f.secret != "":
+		return app.Section().Body(
+			&widgets.Header{},
+			app.H1().Text("Set up two-factor authentication"),
+			app.P().Text("Scan this QR code with your authenticator app, or enter the key manually."),
+			app.Img().Src(f.qrCode).Alt("Two-factor authentication QR code"),
+			app.P().Body(app.Code().Text(f.secret)),
+			app.Form().OnSubmit(f.handleConfirm).Body(
+				app.Input().
+					Type("text").
+					Value(f.code).
+					Placeholder("6-digit code").
+					AutoComplete(false).
+					OnInput(f.ValueTo(&f.code)),
+				app.Button().
+					Type("submit").
+					Text("Confirm"),
+			),
+			app.P().Text(f.status),
+		)
+
+	default:
+		return app.Section().Body(
+			&widgets.Header{},
+			app.H1().Text("Two-factor authentication"),
+			app.P().Text("Protect your account with a code from an authenticator app at every login."),
+			app.Button().
+				Text("Set up").
+				OnClick(f.handleEnroll),
+			app.P().Text(f.status),
+		)
+	}
+}
+
+func (f *TwoFactor) handleEnroll(ctx app.Context, e app.Event) {
+	ctx.Async(func() {
+		enrollment, err := client.EnrollTOTP(ctx)
+
+		ctx.Dispatch(func(ctx app.Context) {
+			if err != nil {
+				f.status = err.Error()
+				return
+			}
+			f.secret = enrollment.Secret
+			f.qrCode = enrollment.QRCode
+			f.status = ""
+		})
+	})
+}
+
+func (f *TwoFactor) handleConfirm(ctx app.Context, e app.Event) {
+	e.PreventDefault()
+
+	code := f.code
+	ctx.Async(func() {
+		recoveryCodes, err := client.ConfirmTOTP(ctx, code)
+
+		ctx.Dispatch(func(ctx app.Context) {
+			f.code = ""
+			if err != nil {
+				f.status = err.Error()
+				return
+			}
+			f.recoveryCodes = recoveryCodes
+		})
+	})
+}
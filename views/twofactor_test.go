@@ -0,0 +1,21 @@
+package views
+
+import (
+	"testing"
+
+	"github.com/maxence-charriere/go-app/v10/pkg/app"
+)
+
+func TestTwoFactorRenderSteps(t *testing.T) {
+	pages := map[string]*TwoFactor{
+		"start":    {},
+		"enroll":   {secret: "JBSWY3DPEHPK3PXP", qrCode: "data:image/png;base64,"},
+		"recovery": {recoveryCodes: []string{"abcde-fghij"}},
+	}
+
+	for name, page := range pages {
+		if _, ok := page.Render().(app.HTMLSection); !ok {
+			t.Errorf("TwoFactor.Render() should return app.HTMLSection on step %s", name)
+		}
+	}
+}
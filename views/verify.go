@@ -0,0 +1,51 @@
+package views
+
+import (
+	"assette/apiclient"
+	"assette/widgets"
+	"errors"
+
+	"github.com/maxence-charriere/go-app/v10/pkg/app"
+)
+
+var _ app.Mounter = (*VerifyEmail)(nil)
+
+// VerifyEmail confirms the token from a verification link on mount
+type VerifyEmail struct {
+	app.Compo
+	status string
+}
+
+func (v *VerifyEmail) Render() app.UI {
+	return app.Section().Body(
+		&widgets.Header{},
+		app.H1().Text("Verify email"),
+		app.P().Text(v.status),
+	)
+}
+
+func (v *VerifyEmail) OnMount(ctx app.Context) {
+	token := ctx.Page().URL().Query().Get("token")
+	if token == "" {
+		v.status = "The verification link is missing its token."
+		return
+	}
+
+	v.status = "Verifying your email address..."
+
+	ctx.Async(func() {
+		status := "Your email address is verified."
+
+		var problem *apiclient.Error
+		if err := client.VerifyEmail(ctx, token); errors.As(err, &problem) {
+			status = "This verification link is invalid or has expired."
+		} else if err != nil {
+			app.Log(err)
+			status = "Verification failed, please try again later."
+		}
+
+		ctx.Dispatch(func(ctx app.Context) {
+			v.status = status
+		})
+	})
+}
@@ -0,0 +1,26 @@
+package views
+
+import (
+	"testing"
+
+	"github.com/maxence-charriere/go-app/v10/pkg/app"
+)
+
+func TestVerifyEmailRender(t *testing.T) {
+	page := &VerifyEmail{
+		status: "Your email address is verified.",
+	}
+
+	ui := page.Render()
+	if ui == nil {
+		t.Error("VerifyEmail.Render() returned nil")
+	}
+
+	if _, ok := ui.(app.HTMLSection); !ok {
+		t.Error("VerifyEmail.Render() should return app.HTMLSection")
+	}
+}
+
+func TestVerifyEmailIsMounter(t *testing.T) {
+	var _ app.Mounter = &VerifyEmail{}
+}
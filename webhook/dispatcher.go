@@ -0,0 +1,375 @@
+//go:build !js
+
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"assette/db"
+)
+
+// Defaults of the Dispatcher settings
+const (
+	DefaultMaxAttempts = 8
+	DefaultBackoff     = 30 * time.Second
+	DefaultMaxBackoff  = 6 * time.Hour
+	DefaultRetention   = 7 * 24 * time.Hour
+	DefaultTimeout     = 10 * time.Second
+)
+
+// pollInterval is how often the queue is read when no delivery is due
+// sooner, to pick up deliveries queued again through the API
+const pollInterval = time.Second
+
+// Source is a namespace whose changes are sent to webhooks
+type Source struct {
+	Namespace string
+
+	// Events maps the kinds of changes to the events they are sent as.
+	// Changes of other kinds are not sent.
+	Events map[db.EventType]string
+
+	// Data returns the data of the payload for a changed record, the last
+	// version of the record for a delete
+	Data func(record db.Record) (interface{}, error)
+}
+
+// Dispatcher delivers the changes to its sources to the subscriptions. Run it
+// on every node: one node of the cluster at a time, elected through etcd,
+// delivers them.
+//
+// Each change is queued once per interested subscription, then POSTed with
+// the HeaderID, HeaderEvent and HeaderSignature headers. Failed deliveries are
+// retried after Backoff, doubled on each attempt up to MaxBackoff, and moved
+// to the dead letters after MaxAttempts. Finished deliveries are logged for
+// Retention.
+//
+// Deliveries are made at least once: if a node stops while sending one, or
+// while queueing the deliveries of a change, the next leader sends them again
+// with the same HeaderID. Retried deliveries can arrive after later ones.
+type Dispatcher struct {
+	Client  *db.Client
+	Sources []Source
+
+	// Sends the deliveries, a client with DefaultTimeout if nil. Redirects
+	// are not followed.
+	HTTPClient *http.Client
+
+	MaxAttempts int           // DefaultMaxAttempts if zero
+	Backoff     time.Duration // DefaultBackoff if zero
+	MaxBackoff  time.Duration // DefaultMaxBackoff if zero
+	Retention   time.Duration // DefaultRetention if zero
+}
+
+// cursor is the revision a source was queued up to
+type cursor struct {
+	Revision int64 `json:"revision"`
+}
+
+// Run delivers changes while this node leads, until ctx is done
+func (d *Dispatcher) Run(ctx context.Context) {
+	if d.HTTPClient == nil {
+		d.HTTPClient = &http.Client{Timeout: DefaultTimeout}
+	}
+	if d.MaxAttempts == 0 {
+		d.MaxAttempts = DefaultMaxAttempts
+	}
+	if d.Backoff == 0 {
+		d.Backoff = DefaultBackoff
+	}
+	if d.MaxBackoff == 0 {
+		d.MaxBackoff = DefaultMaxBackoff
+	}
+	if d.Retention == 0 {
+		d.Retention = DefaultRetention
+	}
+
+	d.Client.Lead(ctx, "webhooks", d.lead)
+}
+
+// lead queues and sends deliveries until leadership is lost
+func (d *Dispatcher) lead(ctx context.Context) {
+	log.Printf("[INFO] Delivering webhooks from this node")
+
+	// Buffered so that queueing never waits for deliveries
+	queued := make(chan struct{}, 1)
+
+	var wg sync.WaitGroup
+	for _, source := range d.Sources {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.watch(ctx, source, queued)
+		}()
+	}
+	d.deliver(ctx, queued)
+	wg.Wait()
+}
+
+// watch queues the changes to a source from where the last leader stopped
+func (d *Dispatcher) watch(ctx context.Context, source Source, queued chan<- struct{}) {
+	for ctx.Err() == nil {
+		if err := d.watchOnce(ctx, source, queued); err != nil {
+			log.Printf("[ERROR] queueing webhooks for %s: %v", source.Namespace, err)
+		}
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// watchOnce queues changes until the watch ends or queueing fails
+func (d *Dispatcher) watchOnce(ctx context.Context, source Source, queued chan<- struct{}) error {
+	var from cursor
+	data, err := d.Client.Get(ctx, stateNamespace, source.Namespace)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &from); err != nil {
+			return err
+		}
+	case err != db.ErrKeyNotFound:
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for event := range d.Client.Watch(ctx, source.Namespace, from.Revision) {
+		if err := d.enqueue(ctx, source, event); err != nil {
+			return err
+		}
+		select {
+		case queued <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// enqueue queues the deliveries of a change, in as many transactions as
+// they need, then moves the cursor of its source past it. If queueing stops
+// in between, the change is queued again from the cursor, and the deliveries
+// queued the first time are kept as they are.
+func (d *Dispatcher) enqueue(ctx context.Context, source Source, event db.Event) error {
+	if name, ok := source.Events[event.Type]; ok {
+		deliveries, err := d.deliveries(ctx, source, name, event.Record)
+		if err != nil {
+			return err
+		}
+
+		ops := make([]db.BatchOp, len(deliveries))
+		for i, delivery := range deliveries {
+			ops[i] = db.BatchOp{Namespace: QueueNamespace, Key: delivery.ID, Value: delivery}
+		}
+		results, err := d.Client.Batch(ctx, ops, false)
+		if err != nil {
+			return err
+		}
+		for _, result := range results {
+			// Queued before queueing stopped
+			if result.Err != nil && result.Err != db.ErrRevisionMismatch {
+				return result.Err
+			}
+		}
+	}
+
+	return d.Client.Put(ctx, stateNamespace, source.Namespace, cursor{Revision: event.Record.ModRevision})
+}
+
+// deliveries returns a delivery of a change for each subscription to event
+func (d *Dispatcher) deliveries(ctx context.Context, source Source, event string, record db.Record) ([]Delivery, error) {
+	subscriptions, err := Subscriptions(ctx, d.Client)
+	if err != nil {
+		return nil, err
+	}
+
+	var data []byte
+	var deliveries []Delivery
+	now := time.Now().UTC()
+	for _, subscription := range subscriptions {
+		if !subscription.Subscribes(event) {
+			continue
+		}
+		if data == nil {
+			value, err := source.Data(record)
+			if err != nil {
+				log.Printf("[WARNING] skipping webhooks for %s/%s: %v", source.Namespace, record.Key, err)
+				return nil, nil
+			}
+			if data, err = json.Marshal(value); err != nil {
+				return nil, err
+			}
+		}
+
+		// Zero-padded so that deliveries sort in the order of the changes
+		id := fmt.Sprintf("%020d-%s", record.ModRevision, subscription.ID)
+		payload, err := json.Marshal(Payload{ID: id, Event: event, CreatedAt: now, Data: data})
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, Delivery{
+			ID:             id,
+			SubscriptionID: subscription.ID,
+			Event:          event,
+			Status:         StatusPending,
+			Payload:        payload,
+			Attempts:       []Attempt{},
+			NextAttemptAt:  now,
+		})
+	}
+	return deliveries, nil
+}
+
+// deliver sends the queued deliveries as they become due
+func (d *Dispatcher) deliver(ctx context.Context, queued <-chan struct{}) {
+	for {
+		next := d.deliverDue(ctx)
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-queued:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// deliverDue attempts the due deliveries in the order of the changes, and
+// returns when to look at the queue again
+func (d *Dispatcher) deliverDue(ctx context.Context) time.Time {
+	next := time.Now().Add(pollInterval)
+
+	records, err := d.Client.List(ctx, QueueNamespace)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("[ERROR] reading the webhook queue: %v", err)
+		}
+		return next
+	}
+
+	for _, record := range records {
+		if ctx.Err() != nil {
+			return next
+		}
+
+		var delivery Delivery
+		if err := json.Unmarshal(record.Value, &delivery); err != nil {
+			continue // Skip malformed deliveries
+		}
+		if delivery.NextAttemptAt.After(time.Now()) {
+			if delivery.NextAttemptAt.Before(next) {
+				next = delivery.NextAttemptAt
+			}
+			continue
+		}
+
+		if err := d.attempt(ctx, delivery); err != nil && ctx.Err() == nil {
+			log.Printf("[ERROR] delivering webhook %s: %v", delivery.ID, err)
+		}
+	}
+	return next
+}
+
+// attempt sends a delivery once, and records the outcome
+func (d *Dispatcher) attempt(ctx context.Context, delivery Delivery) error {
+	data, err := d.Client.Get(ctx, Namespace, delivery.SubscriptionID)
+	if err == db.ErrKeyNotFound {
+		// Deleted since the change was queued
+		_, err = d.Client.Delete(ctx, QueueNamespace, delivery.ID)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	var subscription Subscription
+	if err := json.Unmarshal(data, &subscription); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	status, err := d.post(ctx, subscription, delivery)
+	if ctx.Err() != nil {
+		// Leadership was lost, the next leader sends it again
+		return nil
+	}
+	attempt := Attempt{At: start.UTC(), StatusCode: status, DurationMs: time.Since(start).Milliseconds()}
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+	delivery.Attempts = append(delivery.Attempts, attempt)
+
+	switch {
+	case err == nil:
+		delivery.Status = StatusDelivered
+	case len(delivery.Attempts) >= d.MaxAttempts:
+		delivery.Status = StatusFailed
+	default:
+		delivery.NextAttemptAt = time.Now().Add(d.backoff(len(delivery.Attempts))).UTC()
+		return d.Client.Put(ctx, QueueNamespace, delivery.ID, delivery)
+	}
+	delivery.NextAttemptAt = time.Time{}
+
+	// Recorded before leaving the queue, so that a failure in between sends
+	// the delivery again rather than losing it
+	if err := d.Client.PutWithTTL(ctx, LogNamespace, delivery.ID, delivery, d.Retention); err != nil {
+		return err
+	}
+	if delivery.Status == StatusFailed {
+		log.Printf("[WARNING] webhook %s failed %d times, moved to the dead letters", delivery.ID, len(delivery.Attempts))
+		if err := d.Client.Put(ctx, DeadLetterNamespace, delivery.ID, delivery); err != nil {
+			return err
+		}
+	}
+	_, err = d.Client.Delete(ctx, QueueNamespace, delivery.ID)
+	return err
+}
+
+// post sends a delivery to its subscription and returns the status code of
+// the response, failing unless it is a 2xx
+func (d *Dispatcher) post(ctx context.Context, subscription Subscription, delivery Delivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, subscription.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderID, delivery.ID)
+	req.Header.Set(HeaderEvent, delivery.Event)
+	req.Header.Set(HeaderSignature, Sign(subscription.Secret, time.Now(), delivery.Payload))
+
+	client := *d.HTTPClient
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// Read some of the body so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// backoff returns how long to wait after a number of failed attempts
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	backoff := d.Backoff
+	for i := 1; i < attempts && backoff < d.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, d.MaxBackoff)
+}
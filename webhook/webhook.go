@@ -0,0 +1,243 @@
+//go:build !js
+
+// Package webhook sends changes to records to the URLs external systems
+// registered for them, signed with a secret shared with each receiver.
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"assette/db"
+	"assette/models"
+)
+
+// Namespaces of the webhook records
+const (
+	Namespace           = "webhooks"             // Subscriptions
+	QueueNamespace      = "webhook-queue"        // Deliveries yet to succeed
+	LogNamespace        = "webhook-deliveries"   // Finished deliveries, kept for the retention
+	DeadLetterNamespace = "webhook-dead-letters" // Deliveries that failed every attempt
+	stateNamespace      = "webhook-state"        // Revision each source was queued up to
+)
+
+// Headers sent with each delivery
+const (
+	HeaderID        = "Webhook-Id" // The same for every attempt of a delivery
+	HeaderEvent     = "Webhook-Event"
+	HeaderSignature = "Webhook-Signature"
+)
+
+// Statuses of a delivery
+const (
+	StatusPending   = "pending"
+	StatusDelivered = "delivered"
+	StatusFailed    = "failed"
+)
+
+// ErrInvalidSignature is returned by Verify for a body not signed with the
+// secret, or signed too long ago
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+
+// Subscription is a registered webhook
+type Subscription struct {
+	ID string `json:"id"`
+	models.Webhook
+
+	// Secret signs the deliveries. Only returned by the API when the
+	// subscription is created.
+	Secret string `json:"secret,omitempty"`
+
+	CreatedAt time.Time `json:"createdAt"`
+	CreatedBy string    `json:"createdBy,omitempty"`
+}
+
+// Payload is the JSON body of a delivery
+type Payload struct {
+	ID        string          `json:"id"`
+	Event     string          `json:"event"`
+	CreatedAt time.Time       `json:"createdAt"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// Delivery is an event sent to a subscription, with its attempts so far
+type Delivery struct {
+	ID             string          `json:"id"`
+	SubscriptionID string          `json:"webhookId"`
+	Event          string          `json:"event"`
+	Status         string          `json:"status"`
+	Payload        json.RawMessage `json:"payload"`
+	Attempts       []Attempt       `json:"attempts"`
+	NextAttemptAt  time.Time       `json:"nextAttemptAt,omitzero"`
+}
+
+// Attempt is the outcome of one request of a delivery
+type Attempt struct {
+	At         time.Time `json:"at"`
+	StatusCode int       `json:"statusCode,omitempty"` // Zero if no response was received
+	Error      string    `json:"error,omitempty"`
+	DurationMs int64     `json:"durationMs"`
+}
+
+// NewSecret returns a random signing secret
+func NewSecret() string {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return "whsec_" + hex.EncodeToString(secret)
+}
+
+// Sign returns the Webhook-Signature header of body sent at t: the time in
+// Unix seconds, and the hex HMAC-SHA256 keyed with secret of the time and the
+// body joined with a dot, as in "t=1700000000,v1=5257a869...".
+func Sign(secret string, t time.Time, body []byte) string {
+	timestamp := strconv.FormatInt(t.Unix(), 10)
+	return fmt.Sprintf("t=%s,v1=%s", timestamp, signature(secret, timestamp, body))
+}
+
+// Verify checks the Webhook-Signature header of a received body, and that it
+// was signed less than tolerance ago so that captured deliveries cannot be
+// replayed later
+func Verify(secret string, header string, body []byte, tolerance time.Duration) error {
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		name, value, _ := strings.Cut(part, "=")
+		switch name {
+		case "t":
+			timestamp = value
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if age := time.Since(time.Unix(seconds, 0)); age > tolerance || age < -tolerance {
+		return fmt.Errorf("%w: signed at %s", ErrInvalidSignature, time.Unix(seconds, 0).UTC().Format(time.RFC3339))
+	}
+
+	expected := signature(secret, timestamp, body)
+	for _, s := range signatures {
+		if hmac.Equal([]byte(s), []byte(expected)) {
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
+
+func signature(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Subscriptions returns every subscription, ordered by ID
+func Subscriptions(ctx context.Context, client *db.Client) ([]Subscription, error) {
+	records, err := client.List(ctx, Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	subscriptions := []Subscription{}
+	for _, record := range records {
+		var subscription Subscription
+		if err := json.Unmarshal(record.Value, &subscription); err != nil {
+			continue // Skip malformed subscriptions
+		}
+		subscriptions = append(subscriptions, subscription)
+	}
+	return subscriptions, nil
+}
+
+// Deliveries returns the deliveries to a subscription, queued or logged, most
+// recent first
+func Deliveries(ctx context.Context, client *db.Client, subscriptionID string) ([]Delivery, error) {
+	deliveries := []Delivery{}
+	for _, namespace := range []string{QueueNamespace, LogNamespace} {
+		found, err := list(ctx, client, namespace)
+		if err != nil {
+			return nil, err
+		}
+		for _, delivery := range found {
+			if delivery.SubscriptionID == subscriptionID {
+				deliveries = append(deliveries, delivery)
+			}
+		}
+	}
+
+	// IDs start with the zero-padded revision of the change
+	sort.SliceStable(deliveries, func(i, j int) bool {
+		return deliveries[i].ID > deliveries[j].ID
+	})
+	return deliveries, nil
+}
+
+// DeadLetters returns the deliveries that failed every attempt, most recent
+// first
+func DeadLetters(ctx context.Context, client *db.Client) ([]Delivery, error) {
+	deliveries, err := list(ctx, client, DeadLetterNamespace)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].ID > deliveries[j].ID
+	})
+	return deliveries, nil
+}
+
+// Redeliver queues a dead letter again, with its attempts reset, and removes
+// it from the dead letters. It returns db.ErrKeyNotFound for an unknown dead
+// letter, and db.ErrKeyExists if the delivery is already queued.
+func Redeliver(ctx context.Context, client *db.Client, id string) (Delivery, error) {
+	data, err := client.Get(ctx, DeadLetterNamespace, id)
+	if err != nil {
+		return Delivery{}, err
+	}
+	var delivery Delivery
+	if err := json.Unmarshal(data, &delivery); err != nil {
+		return Delivery{}, err
+	}
+
+	delivery.Status = StatusPending
+	delivery.Attempts = nil
+	delivery.NextAttemptAt = time.Now().UTC()
+	if err := client.Create(ctx, QueueNamespace, id, delivery); err != nil {
+		return Delivery{}, err
+	}
+	if _, err := client.Delete(ctx, DeadLetterNamespace, id); err != nil {
+		return Delivery{}, err
+	}
+	return delivery, nil
+}
+
+// list returns the deliveries of a namespace, ordered by ID
+func list(ctx context.Context, client *db.Client, namespace string) ([]Delivery, error) {
+	records, err := client.List(ctx, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := []Delivery{}
+	for _, record := range records {
+		var delivery Delivery
+		if err := json.Unmarshal(record.Value, &delivery); err != nil {
+			continue // Skip malformed deliveries
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, nil
+}
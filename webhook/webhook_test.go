@@ -0,0 +1,321 @@
+//go:build !js
+
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"assette/db"
+	"assette/models"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+func newTestClient(t *testing.T) *db.Client {
+	// Create unique data directory for each test
+	dataDir := filepath.Join(os.TempDir(), fmt.Sprintf("etcd-test-%d", time.Now().UnixNano()))
+
+	cfg := embed.NewConfig()
+	cfg.Dir = dataDir
+	cfg.LogLevel = "error"
+	cfg.Name = fmt.Sprintf("test-%d", time.Now().UnixNano())
+
+	// Use random ports to avoid conflicts
+	lcurl, _ := url.Parse("http://127.0.0.1:0")
+	cfg.ListenClientUrls = []url.URL{*lcurl}
+	cfg.AdvertiseClientUrls = []url.URL{*lcurl}
+
+	lpurl, _ := url.Parse("http://127.0.0.1:0")
+	cfg.ListenPeerUrls = []url.URL{*lpurl}
+	cfg.AdvertisePeerUrls = []url.URL{*lpurl}
+
+	cfg.InitialCluster = fmt.Sprintf("%s=%s", cfg.Name, lpurl.String())
+	cfg.StrictReconfigCheck = false
+	cfg.InitialClusterToken = "etcd-test-cluster"
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatalf("Failed to start embedded etcd: %v", err)
+	}
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		e.Server.Stop()
+		e.Close()
+		os.RemoveAll(dataDir)
+		t.Fatal("Embedded etcd took too long to start")
+	}
+
+	etcdClient, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{e.Clients[0].Addr().String()},
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		e.Server.Stop()
+		e.Close()
+		os.RemoveAll(dataDir)
+		t.Fatalf("Failed to create etcd client: %v", err)
+	}
+
+	t.Cleanup(func() {
+		etcdClient.Close()
+		e.Server.Stop()
+		e.Close()
+		os.RemoveAll(dataDir)
+	})
+	return db.NewClient(etcdClient)
+}
+
+// eventually retries check until it passes or a few seconds went by
+func eventually(t *testing.T, check func() error) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		err := check()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestSignature(t *testing.T) {
+	body := []byte(`{"id":"1"}`)
+	header := Sign("secret", time.Now(), body)
+
+	if err := Verify("secret", header, body, time.Minute); err != nil {
+		t.Errorf("Expected a valid signature, got %v", err)
+	}
+	if err := Verify("other", header, body, time.Minute); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Expected another secret to fail, got %v", err)
+	}
+	if err := Verify("secret", header, []byte(`{"id":"2"}`), time.Minute); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Expected another body to fail, got %v", err)
+	}
+	if err := Verify("secret", "v1=abc", body, time.Minute); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Expected a header without time to fail, got %v", err)
+	}
+
+	old := Sign("secret", time.Now().Add(-10*time.Minute), body)
+	if err := Verify("secret", old, body, 5*time.Minute); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Expected an old signature to fail, got %v", err)
+	}
+}
+
+type received struct {
+	path   string
+	header http.Header
+	body   []byte
+}
+
+func TestDispatcher(t *testing.T) {
+	client := newTestClient(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	requests := make(chan received, 100)
+	var failing atomic.Bool
+	failing.Store(true)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- received{path: r.URL.Path, header: r.Header, body: body}
+		if r.URL.Path == "/failing" && failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer receiver.Close()
+
+	ok := Subscription{ID: "ok", Webhook: models.Webhook{URL: receiver.URL + "/ok"}, Secret: NewSecret()}
+	failed := Subscription{ID: "failing", Webhook: models.Webhook{URL: receiver.URL + "/failing", Events: []string{"item.created"}}, Secret: NewSecret()}
+	for _, s := range []Subscription{ok, failed} {
+		if err := client.Create(ctx, Namespace, s.ID, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Queued from the start of the history rather than from when the
+	// dispatcher gets elected
+	if err := client.Put(ctx, stateNamespace, "items", cursor{Revision: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	dispatcher := &Dispatcher{
+		Client: client,
+		Sources: []Source{{
+			Namespace: "items",
+			Events:    map[db.EventType]string{db.EventCreate: "item.created", db.EventDelete: "item.deleted"},
+			Data: func(record db.Record) (interface{}, error) {
+				return json.RawMessage(record.Value), nil
+			},
+		}},
+		MaxAttempts: 3,
+		Backoff:     10 * time.Millisecond,
+	}
+	done := make(chan struct{})
+	go func() {
+		dispatcher.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	next := func(path string) received {
+		t.Helper()
+		for {
+			select {
+			case r := <-requests:
+				if r.path == path {
+					return r
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Expected a delivery to %s", path)
+			}
+		}
+	}
+
+	if err := client.Create(ctx, "items", "a", map[string]string{"name": "A"}); err != nil {
+		t.Fatal(err)
+	}
+
+	r := next("/ok")
+	if err := Verify(ok.Secret, r.header.Get(HeaderSignature), r.body, time.Minute); err != nil {
+		t.Errorf("Expected a valid signature: %v", err)
+	}
+	var payload struct {
+		Payload
+		Data struct {
+			Name string `json:"name"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(r.body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.ID != r.header.Get(HeaderID) || payload.Event != "item.created" || r.header.Get(HeaderEvent) != "item.created" || payload.Data.Name != "A" {
+		t.Errorf("Unexpected delivery %s with headers %v", r.body, r.header)
+	}
+
+	// Retried with backoff, then moved to the dead letters
+	var deadLetters []Delivery
+	eventually(t, func() error {
+		var err error
+		if deadLetters, err = DeadLetters(ctx, client); err != nil || len(deadLetters) != 1 {
+			return fmt.Errorf("expected a dead letter, got %+v (%v)", deadLetters, err)
+		}
+		return nil
+	})
+	if dead := deadLetters[0]; dead.SubscriptionID != "failing" || dead.Status != StatusFailed || len(dead.Attempts) != 3 || dead.Attempts[2].StatusCode != http.StatusInternalServerError {
+		t.Errorf("Unexpected dead letter %+v", dead)
+	}
+
+	// Updates are not sent, and deletes only to the subscriptions to them
+	client.Put(ctx, "items", "a", map[string]string{"name": "B"})
+	client.Delete(ctx, "items", "a")
+	if r := next("/ok"); r.header.Get(HeaderEvent) != "item.deleted" || !json.Valid(r.body) {
+		t.Errorf("Expected the delete, got %s with headers %v", r.body, r.header)
+	}
+	eventually(t, func() error {
+		deliveries, err := Deliveries(ctx, client, "ok")
+		if err != nil || len(deliveries) != 2 || deliveries[0].Event != "item.deleted" || deliveries[0].Status != StatusDelivered || len(deliveries[1].Attempts) != 1 {
+			return fmt.Errorf("expected two logged deliveries, got %+v (%v)", deliveries, err)
+		}
+		return nil
+	})
+
+	failing.Store(false)
+	if _, err := Redeliver(ctx, client, deadLetters[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if r := next("/failing"); r.header.Get(HeaderID) != deadLetters[0].ID {
+		t.Errorf("Expected the dead letter to be sent again, got %v", r.header)
+	}
+	eventually(t, func() error {
+		deliveries, err := Deliveries(ctx, client, "failing")
+		if err != nil || len(deliveries) != 1 || deliveries[0].Status != StatusDelivered {
+			return fmt.Errorf("expected the redelivery to be logged, got %+v (%v)", deliveries, err)
+		}
+		return nil
+	})
+	if _, err := Redeliver(ctx, client, deadLetters[0].ID); err != db.ErrKeyNotFound {
+		t.Errorf("Expected the dead letter to be gone, got %v", err)
+	}
+}
+
+// TestEnqueueManySubscriptions checks that changes are queued for more
+// subscriptions than fit in a transaction
+func TestEnqueueManySubscriptions(t *testing.T) {
+	client := newTestClient(t)
+	client.SetMaxTxnOps(5)
+	ctx := context.Background()
+
+	for i := 0; i < 12; i++ {
+		s := Subscription{ID: fmt.Sprintf("s%02d", i), Webhook: models.Webhook{URL: "http://localhost/hook"}, Secret: NewSecret()}
+		if err := client.Create(ctx, Namespace, s.ID, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := client.Create(ctx, "items", "a", map[string]string{"name": "A"}); err != nil {
+		t.Fatal(err)
+	}
+	record, err := client.GetRecord(ctx, "items", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Dispatcher{Client: client}
+	source := Source{
+		Namespace: "items",
+		Events:    map[db.EventType]string{db.EventCreate: "item.created"},
+		Data: func(record db.Record) (interface{}, error) {
+			return json.RawMessage(record.Value), nil
+		},
+	}
+	event := db.Event{Type: db.EventCreate, Record: record}
+	if err := d.enqueue(ctx, source, event); err != nil {
+		t.Fatal(err)
+	}
+
+	queued, err := client.List(ctx, QueueNamespace)
+	if err != nil || len(queued) != 12 {
+		t.Fatalf("Expected 12 queued deliveries, got %d (%v)", len(queued), err)
+	}
+	var moved cursor
+	data, err := client.Get(ctx, stateNamespace, "items")
+	if err != nil || json.Unmarshal(data, &moved) != nil || moved.Revision != record.ModRevision {
+		t.Errorf("Expected the cursor at %d, got %+v (%v)", record.ModRevision, moved, err)
+	}
+
+	// Queued again from the cursor after stopping in between
+	if err := d.enqueue(ctx, source, event); err != nil {
+		t.Errorf("Expected queueing a change again to keep its deliveries, got %v", err)
+	}
+	if queued, err := client.List(ctx, QueueNamespace); err != nil || len(queued) != 12 {
+		t.Errorf("Expected 12 queued deliveries, got %d (%v)", len(queued), err)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	d := &Dispatcher{Backoff: time.Second, MaxBackoff: 5 * time.Second}
+	for attempts, expected := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second, 60: 5 * time.Second} {
+		if backoff := d.backoff(attempts); backoff != expected {
+			t.Errorf("Expected %v after %d attempts, got %v", expected, attempts, backoff)
+		}
+	}
+}
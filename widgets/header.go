@@ -13,5 +13,7 @@ func (h *Header) Render() app.UI {
 		app.A().Href("/").Text("Home"),
 		app.A().Href("/generate").Text("Generate"),
 		app.A().Href("/models").Text("Models"),
+		app.A().Href("/import").Text("Import"),
+		app.A().Href("/login").Text("Login"),
 	)
 }